@@ -0,0 +1,386 @@
+// Package archive exports the game's tables to a versioned NDJSON archive,
+// and imports them back into any dynamostore.Storer, so the game can be
+// backed up, or moved between environments
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+)
+
+const (
+	// Format identifies our archives in their header
+	Format = "wouldyoutatter-archive"
+	// Version is the version of the archive format we write, and the
+	// newest we can read
+	Version = 1
+
+	kindHeader   = "header"
+	kindItem     = "item"
+	kindChecksum = "checksum"
+)
+
+const (
+	// TableContenders holds the contenders and their records
+	TableContenders = "contenders"
+	// TableMatchups holds the head-to-head records
+	TableMatchups = "matchups"
+	// TableUserMatchups holds the matchups each user has seen
+	TableUserMatchups = "user_matchups"
+	// TableMasterMatchups holds every possible matchup
+	TableMasterMatchups = "master_matchups"
+	// TableTokens holds the outstanding vote tokens
+	TableTokens = "tokens"
+	// TablePolls holds the polls, other than an untouched default one
+	TablePolls = "polls"
+)
+
+// Tables are the Storers to export from, or import into, by table name
+type Tables map[string]dynamostore.Storer
+
+// Summary counts the items exported or imported, by table name
+type Summary map[string]int
+
+// table knows how to scan a table for its typed items, and how to decode
+// them again
+type table struct {
+	name    string
+	scan    func(context.Context, dynamostore.Storer) ([]dynamostore.Item, error)
+	newItem func() dynamostore.Item
+}
+
+// tables are in the order they're written to archives
+var tables = []table{
+	{
+		name: TableContenders,
+		scan: func(ctx context.Context, db dynamostore.Storer) ([]dynamostore.Item, error) {
+			cs := contender.Contenders{}
+			if err := db.Scan(ctx, &cs); err != nil {
+				return nil, err
+			}
+			items := make([]dynamostore.Item, len(cs))
+			for i := range cs {
+				items[i] = &cs[i]
+			}
+			return items, nil
+		},
+		newItem: func() dynamostore.Item { return &contender.Contender{} },
+	},
+	{
+		name: TableMatchups,
+		scan: func(ctx context.Context, db dynamostore.Storer) ([]dynamostore.Item, error) {
+			ms := contender.Matchups{}
+			if err := db.Scan(ctx, &ms); err != nil {
+				return nil, err
+			}
+			items := make([]dynamostore.Item, len(ms))
+			for i := range ms {
+				items[i] = &ms[i]
+			}
+			return items, nil
+		},
+		newItem: func() dynamostore.Item { return &contender.Matchup{} },
+	},
+	{
+		name:    TableUserMatchups,
+		scan:    scanMatchupSets,
+		newItem: func() dynamostore.Item { return &contender.MatchupSet{} },
+	},
+	{
+		name:    TableMasterMatchups,
+		scan:    scanMatchupSets,
+		newItem: func() dynamostore.Item { return &contender.MatchupSet{} },
+	},
+	{
+		name: TableTokens,
+		scan: func(ctx context.Context, db dynamostore.Storer) ([]dynamostore.Item, error) {
+			ts := contender.Tokens{}
+			if err := db.Scan(ctx, &ts); err != nil {
+				return nil, err
+			}
+			items := make([]dynamostore.Item, len(ts))
+			for i := range ts {
+				items[i] = &ts[i]
+			}
+			return items, nil
+		},
+		newItem: func() dynamostore.Item { return &contender.Token{} },
+	},
+	{
+		name: TablePolls,
+		scan: func(ctx context.Context, db dynamostore.Storer) ([]dynamostore.Item, error) {
+			ps := contender.Polls{}
+			if err := db.Scan(ctx, &ps); err != nil {
+				return nil, err
+			}
+			items := make([]dynamostore.Item, len(ps))
+			for i := range ps {
+				items[i] = &ps[i]
+			}
+			return items, nil
+		},
+		newItem: func() dynamostore.Item { return &contender.Poll{} },
+	},
+}
+
+func scanMatchupSets(ctx context.Context, db dynamostore.Storer) ([]dynamostore.Item, error) {
+	ss := contender.MatchupSets{}
+	if err := db.Scan(ctx, &ss); err != nil {
+		return nil, err
+	}
+	items := make([]dynamostore.Item, len(ss))
+	for i := range ss {
+		items[i] = &ss[i]
+	}
+	return items, nil
+}
+
+func lookupTable(name string) (table, bool) {
+	for _, t := range tables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return table{}, false
+}
+
+// header is the first line of every archive
+type header struct {
+	Kind      string    `json:"kind"`
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// itemLine holds a single item of a table, as its typed JSON
+type itemLine struct {
+	Kind  string          `json:"kind"`
+	Table string          `json:"table"`
+	Item  json.RawMessage `json:"item"`
+}
+
+// checksumLine follows the items of each table, with the SHA-256 of
+// their JSON, each followed by a newline
+type checksumLine struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// line is any of the above, for reading
+type line struct {
+	Kind    string          `json:"kind"`
+	Format  string          `json:"format"`
+	Version int             `json:"version"`
+	Table   string          `json:"table"`
+	Item    json.RawMessage `json:"item"`
+	Count   int             `json:"count"`
+	SHA256  string          `json:"sha256"`
+}
+
+// Export writes every item of the given tables to w, one table after
+// another, in order of their keys
+func Export(ctx context.Context, w io.Writer, ts Tables) (Summary, error) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&header{Kind: kindHeader, Format: Format, Version: Version, CreatedAt: time.Now().UTC()}); err != nil {
+		return nil, errors.Wrap(err, "failed to write archive header")
+	}
+
+	summary := Summary{}
+	for _, t := range tables {
+		db, ok := ts[t.name]
+		if !ok {
+			continue
+		}
+		items, err := t.scan(ctx, db)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan %s", t.name)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Key() < items[j].Key() })
+
+		hash := sha256.New()
+		for _, item := range items {
+			b, err := json.Marshal(item)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to encode %s item %s", t.name, item.Key())
+			}
+			hash.Write(b)
+			hash.Write([]byte("\n"))
+			if err := enc.Encode(&itemLine{Kind: kindItem, Table: t.name, Item: b}); err != nil {
+				return nil, errors.Wrapf(err, "failed to write %s item %s", t.name, item.Key())
+			}
+		}
+		checksum := &checksumLine{Kind: kindChecksum, Table: t.name, Count: len(items), SHA256: hex.EncodeToString(hash.Sum(nil))}
+		if err := enc.Encode(checksum); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %s checksum", t.name)
+		}
+		summary[t.name] = len(items)
+	}
+	return summary, nil
+}
+
+// Import verifies the whole archive before writing any of it, and then
+// writes every item into the Storer for its table. Items replace any
+// with the same key, and anything else already in the tables is kept
+func Import(ctx context.Context, r io.ReadSeeker, ts Tables) (Summary, error) {
+	if err := Verify(r, ts); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to rewind archive")
+	}
+
+	summary := Summary{}
+	err := readLines(r, func(l *line) error {
+		if l.Kind != kindItem {
+			return nil
+		}
+		t, _ := lookupTable(l.Table)
+		item := t.newItem()
+		if err := json.Unmarshal(l.Item, item); err != nil {
+			return errors.Wrapf(err, "failed to decode %s item", l.Table)
+		}
+		if err := ts[l.Table].Set(ctx, item); err != nil {
+			return errors.Wrapf(err, "failed to import %s item %s", l.Table, item.Key())
+		}
+		summary[l.Table]++
+		return nil
+	})
+	return summary, err
+}
+
+// Copy writes every item of the tables in from into the Storer for the
+// same table in to, e.g. to move the game from the multi-table layout
+// to the single table one. Items replace any with the same key
+func Copy(ctx context.Context, from, to Tables) (Summary, error) {
+	summary := Summary{}
+	for _, t := range tables {
+		src, ok := from[t.name]
+		if !ok {
+			continue
+		}
+		dst, ok := to[t.name]
+		if !ok {
+			return summary, fmt.Errorf("nowhere to copy table %s", t.name)
+		}
+		items, err := t.scan(ctx, src)
+		if err != nil {
+			return summary, errors.Wrapf(err, "failed to scan %s", t.name)
+		}
+		if len(items) == 0 {
+			summary[t.name] = 0
+			continue
+		}
+		if err := dst.BatchSet(ctx, items); err != nil {
+			return summary, errors.Wrapf(err, "failed to copy %s", t.name)
+		}
+		summary[t.name] = len(items)
+	}
+	return summary, nil
+}
+
+// Verify checks the archive is one we can read, that every table's items
+// match its checksum, and that there's a Storer in ts for each of them
+func Verify(r io.Reader, ts Tables) error {
+	var (
+		sawHeader bool
+		current   string
+		count     int
+		hash      = sha256.New()
+		done      = map[string]bool{}
+	)
+	err := readLines(r, func(l *line) error {
+		if !sawHeader {
+			if l.Kind != kindHeader || l.Format != Format {
+				return errors.New("not a wouldyoutatter archive")
+			}
+			if l.Version < 1 || l.Version > Version {
+				return fmt.Errorf("unsupported archive version %d, the newest supported is %d", l.Version, Version)
+			}
+			sawHeader = true
+			return nil
+		}
+
+		if l.Kind != kindItem && l.Kind != kindChecksum {
+			return fmt.Errorf("unknown line kind %q", l.Kind)
+		}
+		// a table starts with its first item, or its checksum if it's empty
+		if current == "" {
+			if _, ok := lookupTable(l.Table); !ok {
+				return fmt.Errorf("unknown table %s", l.Table)
+			}
+			if _, ok := ts[l.Table]; !ok {
+				return fmt.Errorf("nowhere to import table %s", l.Table)
+			}
+			if done[l.Table] {
+				return fmt.Errorf("table %s appears more than once", l.Table)
+			}
+			current = l.Table
+		}
+		if l.Table != current {
+			return fmt.Errorf("table %s has no checksum", current)
+		}
+
+		switch l.Kind {
+		case kindItem:
+			hash.Write(l.Item)
+			hash.Write([]byte("\n"))
+			count++
+		case kindChecksum:
+			if l.Count != count || l.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+				return fmt.Errorf("table %s doesn't match its checksum", l.Table)
+			}
+			done[l.Table] = true
+			current, count = "", 0
+			hash.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !sawHeader {
+		return errors.New("archive is empty")
+	}
+	if current != "" {
+		return fmt.Errorf("table %s has no checksum, the archive may be truncated", current)
+	}
+	return nil
+}
+
+// readLines decodes each line of the archive in turn. Lines can be long,
+// since contenders carry their SVGs, so we don't use a bufio.Scanner
+func readLines(r io.Reader, fn func(*line) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "failed to read archive")
+		}
+		if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 {
+			l := &line{}
+			if jsonErr := json.Unmarshal(trimmed, l); jsonErr != nil {
+				return errors.Wrapf(jsonErr, "failed to decode line %d of archive", n)
+			}
+			if fnErr := fn(l); fnErr != nil {
+				return errors.Wrapf(fnErr, "line %d", n)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/archive"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTables() archive.Tables {
+	return archive.Tables{
+		archive.TableContenders:     dynamostore.NewInMemoryStore(),
+		archive.TableMatchups:       dynamostore.NewInMemoryStore(),
+		archive.TableUserMatchups:   dynamostore.NewInMemoryStore(),
+		archive.TableMasterMatchups: dynamostore.NewInMemoryStore(),
+		archive.TableTokens:         dynamostore.NewInMemoryStore(),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := newTables()
+
+	contenders := contender.NewStore(source[archive.TableContenders])
+	names := []string{"koi", "skull", "anchor"}
+	for _, name := range names {
+		require.NoError(t, contenders.Set(ctx, &contender.Contender{
+			Name:        name,
+			Description: "a " + name,
+			SVG:         []byte("<svg>" + name + "</svg>"),
+			Tags:        []string{"traditional"},
+		}))
+	}
+	all, err := contenders.GetAll(ctx)
+	require.NoError(t, err)
+	require.NoError(t, contender.NewMasterMatchupSetStore(source[archive.TableMasterMatchups]).Add(ctx, "koi", all))
+	require.NoError(t, contender.NewMatchupSetStore(source[archive.TableUserMatchups]).Add(ctx, "some-user", "koi", "skull"))
+	require.NoError(t, contender.NewMatchupStore(source[archive.TableMatchups]).ScoreMatchup(ctx, "koi", "skull"))
+	require.NoError(t, contenders.DeclareWinner(ctx, "koi"))
+	require.NoError(t, contenders.DeclareLoser(ctx, "skull"))
+	token, err := contender.NewTokenStore(source[archive.TableTokens]).CreateToken(ctx, "koi", "anchor")
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	exported, err := archive.Export(ctx, buf, source)
+	require.NoError(t, err)
+	assert.Equal(t, archive.Summary{
+		archive.TableContenders:     3,
+		archive.TableMatchups:       1,
+		archive.TableUserMatchups:   1,
+		archive.TableMasterMatchups: 1,
+		archive.TableTokens:         1,
+	}, exported)
+
+	target := newTables()
+	imported, err := archive.Import(ctx, bytes.NewReader(buf.Bytes()), target)
+	require.NoError(t, err)
+	assert.Equal(t, exported, imported)
+
+	koi, err := contender.NewStore(target[archive.TableContenders]).Get(ctx, "koi")
+	require.NoError(t, err)
+	assert.Equal(t, 1, koi.Wins)
+	assert.Equal(t, 1, koi.Score)
+	assert.Equal(t, []string{"traditional"}, koi.Tags)
+	assert.Equal(t, []byte("<svg>koi</svg>"), koi.SVG)
+
+	matchup, err := contender.NewMatchupStore(target[archive.TableMatchups]).Get(ctx, "koi", "skull")
+	require.NoError(t, err)
+	require.NotNil(t, matchup)
+	assert.Equal(t, 1, matchup.Contender1Wins)
+
+	master, err := contender.NewMasterMatchupSetStore(target[archive.TableMasterMatchups]).Get(ctx)
+	require.NoError(t, err)
+	assert.Len(t, master.Set, 2)
+	seen, err := contender.NewMatchupSetStore(target[archive.TableUserMatchups]).Get(ctx, "some-user")
+	require.NoError(t, err)
+	assert.Len(t, seen.Set, 1)
+
+	ok, err := contender.NewTokenStore(target[archive.TableTokens]).ValidateToken(ctx, token.ID, "anchor", "koi")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// exporting what we imported gives the same items
+	again := &bytes.Buffer{}
+	_, err = archive.Export(ctx, again, target)
+	require.NoError(t, err)
+	assert.Equal(t, withoutHeader(buf.String()), withoutHeader(again.String()))
+}
+
+func TestImportVerifies(t *testing.T) {
+	ctx := context.Background()
+	source := newTables()
+	require.NoError(t, contender.NewStore(source[archive.TableContenders]).Set(ctx, &contender.Contender{Name: "koi", SVG: []byte("<svg/>")}))
+	buf := &bytes.Buffer{}
+	_, err := archive.Export(ctx, buf, source)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	t.Run("tampered items", func(t *testing.T) {
+		target := newTables()
+		tampered := strings.Replace(buf.String(), `"name":"koi"`, `"name":"carp"`, 1)
+		_, err := archive.Import(ctx, strings.NewReader(tampered), target)
+		assert.Error(t, err)
+		// nothing is written if the archive doesn't verify
+		all, err := contender.NewStore(target[archive.TableContenders]).GetAll(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, *all)
+	})
+	t.Run("truncated", func(t *testing.T) {
+		// the header, and the contender without its checksum
+		truncated := strings.Join(lines[:2], "")
+		_, err := archive.Import(ctx, strings.NewReader(truncated), newTables())
+		assert.Error(t, err)
+	})
+	t.Run("newer version", func(t *testing.T) {
+		newer := strings.Replace(buf.String(), `"version":1`, `"version":2`, 1)
+		_, err := archive.Import(ctx, strings.NewReader(newer), newTables())
+		assert.Error(t, err)
+	})
+	t.Run("nowhere to import", func(t *testing.T) {
+		tables := newTables()
+		delete(tables, archive.TableContenders)
+		_, err := archive.Import(ctx, bytes.NewReader(buf.Bytes()), tables)
+		assert.Error(t, err)
+	})
+}
+
+func withoutHeader(s string) string {
+	return s[strings.Index(s, "\n")+1:]
+}
+
+func TestCopyToSingleTable(t *testing.T) {
+	ctx := context.Background()
+	source := newTables()
+	contenders := contender.NewStore(source[archive.TableContenders])
+	for _, name := range []string{"koi", "skull", "anchor"} {
+		require.NoError(t, contenders.Create(ctx, &contender.Contender{Name: name}))
+	}
+	all, err := contenders.GetAll(ctx)
+	require.NoError(t, err)
+	require.NoError(t, contender.NewMasterMatchupSetStore(source[archive.TableMasterMatchups]).Add(ctx, "koi", all))
+	require.NoError(t, contenders.DeclareWinner(ctx, "skull"))
+
+	db := dynamostore.NewInMemoryStore()
+	target := archive.Tables{
+		archive.TableContenders:     dynamostore.WithEntity(db, contender.ContenderEntity),
+		archive.TableMatchups:       dynamostore.WithEntity(db, contender.MatchupEntity),
+		archive.TableUserMatchups:   dynamostore.WithEntity(db, contender.UserMatchupsEntity),
+		archive.TableMasterMatchups: dynamostore.WithEntity(db, contender.MasterMatchupsEntity),
+		archive.TableTokens:         dynamostore.WithEntity(db, contender.TokenEntity),
+	}
+	copied, err := archive.Copy(ctx, source, target)
+	require.NoError(t, err)
+	assert.Equal(t, archive.Summary{
+		archive.TableContenders:     3,
+		archive.TableMatchups:       0,
+		archive.TableUserMatchups:   0,
+		archive.TableMasterMatchups: 1,
+		archive.TableTokens:         0,
+	}, copied)
+
+	leaderboard, err := contender.NewStore(target[archive.TableContenders]).GetLeaderboard(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, *leaderboard, 1)
+	assert.Equal(t, "skull", (*leaderboard)[0].Name)
+	master, err := contender.NewMasterMatchupSetStore(target[archive.TableMasterMatchups]).Get(ctx)
+	require.NoError(t, err)
+	assert.Len(t, master.Set, 2)
+
+	_, err = archive.Copy(ctx, source, archive.Tables{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,271 @@
+// Package client is a typed Go client for the wouldyoutatter API, as
+// described by the service's OpenAPI document
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/contender"
+)
+
+const (
+	masterKeyHeader = "X-Tatter-Master"
+	// apiPrefix pins the API version the client's types match
+	apiPrefix = "/v1"
+)
+
+// Client calls the wouldyoutatter API
+type Client struct {
+	endpoint  string
+	masterKey string
+	http      *http.Client
+	// prefix is where the game's routes are, which is under the API
+	// version for the default poll
+	prefix string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithMasterKey sets the master key sent on the calls that change contenders
+func WithMasterKey(key string) Option {
+	return func(c *Client) {
+		c.masterKey = key
+	}
+}
+
+// WithHTTPClient overrides the underlying HTTP client. Matchups are tracked
+// per session cookie, so the client should have a cookie jar
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.http = h
+	}
+}
+
+// New takes the base URL of the API, e.g. http://localhost:8080,
+// and returns a Client for it
+func New(endpoint string, opts ...Option) *Client {
+	// cookiejar.New never returns an error without options
+	jar, _ := cookiejar.New(nil)
+	c := &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		http:     &http.Client{Jar: jar},
+		prefix:   apiPrefix,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Poll returns a copy of the client which plays the poll with the given
+// ID, instead of the default one. The copy shares the session cookie
+func (c *Client) Poll(id string) *Client {
+	p := *c
+	p.prefix = apiPrefix + "/polls/" + url.PathEscape(id)
+	return &p
+}
+
+// Matchup is a randomly chosen matchup, along with the URL to vote on it
+type Matchup struct {
+	Contender1 contender.Contender `json:"contender_1"`
+	Contender2 contender.Contender `json:"contender_2"`
+	VoteURL    string              `json:"vote_url"`
+}
+
+// CreateContender creates the contender and adds it to the possible matchups
+func (c *Client) CreateContender(ctx context.Context, con *contender.Contender) error {
+	return c.do(ctx, http.MethodPost, c.prefix+"/contenders", con, nil, http.StatusCreated)
+}
+
+// BatchResult is the outcome of creating a single contender of a batch
+type BatchResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Created says whether the contender was created
+func (r BatchResult) Created() bool {
+	return r.Status == http.StatusCreated
+}
+
+// BatchCreateContenders creates the contenders together, and adds them
+// to the possible matchups. It returns a result for each of them, in order,
+// since some can fail while the others are created
+func (c *Client) BatchCreateContenders(ctx context.Context, cons []contender.Contender) ([]BatchResult, error) {
+	in := struct {
+		Contenders []contender.Contender `json:"contenders"`
+	}{Contenders: cons}
+	out := struct {
+		Results []BatchResult `json:"results"`
+	}{}
+	if err := c.do(ctx, http.MethodPost, c.prefix+"/contenders:batch", &in, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
+
+// ListContenders retrieves every contender
+func (c *Client) ListContenders(ctx context.Context) (contender.Contenders, error) {
+	ret := contender.Contenders{}
+	if err := c.do(ctx, http.MethodGet, c.prefix+"/contenders", nil, &ret, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// UpdateContender replaces the details of an existing contender, keeping
+// its record
+func (c *Client) UpdateContender(ctx context.Context, con *contender.Contender) error {
+	return c.do(ctx, http.MethodPut, c.prefix+"/contenders/"+url.PathEscape(con.Name), con, nil, http.StatusNoContent)
+}
+
+// GetContender retrieves a contender by name
+func (c *Client) GetContender(ctx context.Context, name string) (*contender.Contender, error) {
+	ret := &contender.Contender{}
+	if err := c.do(ctx, http.MethodGet, c.prefix+"/contenders/"+url.PathEscape(name), nil, ret, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// DeleteContender deletes a contender by name
+func (c *Client) DeleteContender(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, c.prefix+"/contenders/"+url.PathEscape(name), nil, nil, http.StatusNoContent)
+}
+
+// RandomMatchup returns a matchup this client hasn't seen yet, or nil if
+// there aren't any matchups available
+func (c *Client) RandomMatchup(ctx context.Context) (*Matchup, error) {
+	ret := &Matchup{}
+	if err := c.do(ctx, http.MethodGet, c.prefix+"/matchups/random", nil, ret, http.StatusOK, http.StatusNoContent); err != nil {
+		return nil, err
+	}
+	if ret.VoteURL == "" {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// Vote votes for the winner of the given matchup
+func (c *Client) Vote(ctx context.Context, m *Matchup, winner string) error {
+	payload := struct {
+		Winner string `json:"winner"`
+	}{Winner: winner}
+	return c.do(ctx, http.MethodPost, m.VoteURL, &payload, nil, http.StatusOK)
+}
+
+// MatchupStats retrieves the head-to-head record of two contenders
+func (c *Client) MatchupStats(ctx context.Context, contender1, contender2 string) (*contender.Matchup, error) {
+	ret := &contender.Matchup{}
+	path := fmt.Sprintf("%s/matchups/%s/%s", c.prefix, url.PathEscape(contender1), url.PathEscape(contender2))
+	if err := c.do(ctx, http.MethodGet, path, nil, ret, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Leaderboard retrieves the top contenders by score
+func (c *Client) Leaderboard(ctx context.Context, limit int) (contender.Contenders, error) {
+	ret := contender.Contenders{}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("%s/leaderboard?limit=%d", c.prefix, limit), nil, &ret, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// CreatePoll creates a poll, with no contenders yet
+func (c *Client) CreatePoll(ctx context.Context, p *contender.Poll) error {
+	return c.do(ctx, http.MethodPost, apiPrefix+"/polls", p, nil, http.StatusCreated)
+}
+
+// ListPolls retrieves every poll, including the default one
+func (c *Client) ListPolls(ctx context.Context) (contender.Polls, error) {
+	ret := contender.Polls{}
+	if err := c.do(ctx, http.MethodGet, apiPrefix+"/polls", nil, &ret, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetPoll retrieves a poll by ID
+func (c *Client) GetPoll(ctx context.Context, id string) (*contender.Poll, error) {
+	ret := &contender.Poll{}
+	if err := c.do(ctx, http.MethodGet, apiPrefix+"/polls/"+url.PathEscape(id), nil, ret, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// UpdatePoll replaces the details and settings of a poll
+func (c *Client) UpdatePoll(ctx context.Context, p *contender.Poll) error {
+	return c.do(ctx, http.MethodPut, apiPrefix+"/polls/"+url.PathEscape(p.ID), p, nil, http.StatusNoContent)
+}
+
+// DeletePoll deletes a poll, which must have no contenders left
+func (c *Client) DeletePoll(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, apiPrefix+"/polls/"+url.PathEscape(id), nil, nil, http.StatusNoContent)
+}
+
+// do sends the request, treating any status other than the expected ones
+// as an error, and decodes the response into out if there is a body
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}, expected ...int) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode request")
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.masterKey != "" {
+		req.Header.Set(masterKeyHeader, c.masterKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to send %s %s", method, path)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+	if !statusIn(resp.StatusCode, expected) {
+		return newError(resp.StatusCode, b)
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(b, out), "failed to decode response")
+}
+
+func statusIn(status int, statuses []int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Error is returned for any unexpected response, and carries the
+// problem details the API returned with it
+type Error struct {
+	StatusCode int    `json:"status"`
+	Code       string `json:"code"`
+	Detail     string `json:"detail"`
+	RequestID  string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s (request %s)", e.StatusCode, e.Code, e.Detail, e.RequestID)
+}
+
+func newError(statusCode int, body []byte) *Error {
+	e := &Error{}
+	// not every error comes from our handlers, e.g. a gateway timeout
+	_ = json.Unmarshal(body, e)
+	e.StatusCode = statusCode
+	return e
+}
+
+// StatusCode returns the HTTP status of the response that caused err,
+// or 0 if the error didn't come from a response
+func StatusCode(err error) int {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// NotFoundError is a helper method to determine if an
+// encountered error is due to a 404
+func NotFoundError(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// RetryableError is a helper method to determine if an encountered
+// error is worth retrying, because the request never got a response,
+// or the API was throttling or failing
+func RetryableError(err error) bool {
+	status := StatusCode(err)
+	return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
@@ -1,91 +1,62 @@
 package main
 
 import (
-	"flag"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"strings"
+	"context"
+	"os"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/sbogacz/wouldyoutatter/lambdahttp"
 	"github.com/sbogacz/wouldyoutatter/service"
 	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
-var (
-	config = &service.Config{}
-	s      *service.Service
-)
-
-// Handler takes an APIGW request, converts it to an HTTP Request, and sends it to the
-// http server
-func Handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	httpReq, err := APIGWReqToHTTP(request)
-	if err != nil {
-		return events.APIGatewayProxyResponse{Body: request.Body, StatusCode: http.StatusBadRequest}, err
-	}
-	resp, err := http.DefaultClient.Do(httpReq)
-	if err != nil {
-		return events.APIGatewayProxyResponse{Body: request.Body, StatusCode: http.StatusBadRequest}, err
-	}
-
-	return HTTPRespToAPIGW(resp)
-}
+var config = &service.Config{}
 
 func main() {
-	for _, f := range config.Flags() {
-		f.Apply(flag.CommandLine)
-	}
-
-	var err error
-	s, err = service.New(*config)
-	if err != nil {
+	// the function is configured like the server, by env vars and the
+	// config file, e.g. one deployed alongside it
+	app := cli.NewApp()
+	app.Flags = config.Flags()
+	app.Before = service.LoadConfigFile(app.Flags)
+	app.Action = serve
+	if err := app.Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
-
-	fmt.Printf("Listening on port: %d\n", config.Port)
-	go s.Start()
-
-	lambda.Start(Handler)
 }
 
-// APIGWReqToHTTP converts APIGatewayProxyRequests and translates them to stdlib
-// http.Requests
-func APIGWReqToHTTP(req events.APIGatewayProxyRequest) (*http.Request, error) {
-	addr := fmt.Sprintf("http://127.0.0.1:%d%s", config.Port, req.Path)
-	httpReq, err := http.NewRequest(req.HTTPMethod, addr, strings.NewReader(req.Body))
-	if err != nil {
-		return nil, err
+func serve(c *cli.Context) error {
+	if err := config.Validate(); err != nil {
+		return err
 	}
-	for k, v := range req.Headers {
-		httpReq.Header.Set(k, v)
-	}
-	q := httpReq.URL.Query()
-	for k, v := range req.QueryStringParameters {
-		q.Set(k, v)
-	}
-	httpReq.URL.RawQuery = q.Encode()
+	s, err := service.New(*config)
+	if err != nil {
+		return err
+	}
+
+	// API Gateway and ALB events are served by the service's router in
+	// process, rather than by a server listening on a port
+	adapter := lambdahttp.New(s.Handler())
+	// e.g. the base path of a custom domain mapping
+	adapter.StripPrefix = os.Getenv("STRIP_PREFIX")
+	// set once the REST API's binaryMediaTypes include */*
+	adapter.BinaryResponses = os.Getenv("BINARY_RESPONSES") == "true"
+	lambda.StartHandler(&flushingHandler{Adapter: adapter, s: s})
+	return nil
+}
 
-	return httpReq, nil
+// flushingHandler exports each invocation's spans before it returns,
+// since the process may be frozen until the next one
+type flushingHandler struct {
+	*lambdahttp.Adapter
+	s *service.Service
 }
 
-// HTTPRespToAPIGW converts http.Responses and translates them to APIGatewayProxyResponses
-func HTTPRespToAPIGW(resp *http.Response) (events.APIGatewayProxyResponse, error) {
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return events.APIGatewayProxyResponse{}, err
-	}
-	if err = resp.Body.Close(); err != nil {
-		return events.APIGatewayProxyResponse{}, err
-	}
-	headers := make(map[string]string, len(resp.Header))
-	for k := range resp.Header {
-		headers[k] = resp.Header.Get(k)
-	}
-	return events.APIGatewayProxyResponse{
-		StatusCode: resp.StatusCode,
-		Headers:    headers,
-		Body:       string(body),
-	}, nil
+func (h *flushingHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	defer func() {
+		if err := h.s.FlushTraces(ctx); err != nil {
+			log.WithError(err).Warn("failed to export spans")
+		}
+	}()
+	return h.Adapter.Invoke(ctx, payload)
 }
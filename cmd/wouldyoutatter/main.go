@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 
+	"github.com/sbogacz/wouldyoutatter/archive"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/migrate"
 	"github.com/sbogacz/wouldyoutatter/service"
 	"github.com/urfave/cli"
 )
@@ -29,7 +38,66 @@ func main() {
 	app := cli.NewApp()
 	app.Usage = "this is the CLI app version of wouldyoutatter"
 	app.Flags = flags()
+	app.Before = service.LoadConfigFile(app.Flags)
 	app.Action = serve
+	app.Commands = []cli.Command{
+		{
+			Name:  "config",
+			Usage: "inspect the configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:   "print",
+					Usage:  "print the effective configuration, from the flags, env vars and config file, with secrets redacted",
+					Action: printConfig,
+				},
+			},
+		},
+		{
+			Name:   "export",
+			Usage:  "write every table to an NDJSON archive",
+			Action: exportArchive,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "path to write the archive to, or - for stdout",
+					Value: "-",
+				},
+			},
+		},
+		{
+			Name:   "import",
+			Usage:  "verify an NDJSON archive, and write it into the tables",
+			Action: importArchive,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "path to the archive to import",
+				},
+			},
+		},
+		{
+			Name:   "migrate",
+			Usage:  "reconcile the tables with their schemas, and apply pending migrations",
+			Action: migrateTables,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list the changes and migrations without applying them",
+				},
+			},
+		},
+		{
+			Name:   "convert-layout",
+			Usage:  "copy every item from the tables of the other layout into those of the configured one",
+			Action: convertLayout,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "the layout to copy from, multi or single",
+				},
+			},
+		},
+	}
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -38,6 +106,9 @@ func main() {
 }
 
 func serve(c *cli.Context) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
@@ -46,9 +117,186 @@ func serve(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	go s.Start()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Start()
+	}()
 
-	<-sigs
+	select {
+	case err := <-errs:
+		return err
+	case <-sigs:
+	}
 	s.Stop()
 	return nil
 }
+
+// printConfig prints the configuration as YAML, which can be used as a
+// config file, then any problems with it
+func printConfig(c *cli.Context) error {
+	if err := service.WriteConfig(os.Stdout, c); err != nil {
+		return err
+	}
+	return config.Validate()
+}
+
+func exportArchive(c *cli.Context) error {
+	tables, err := archiveTables(*config)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if path := c.String("output"); path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	summary, err := archive.Export(context.Background(), w, tables)
+	if err != nil {
+		return err
+	}
+	// the archive might be going to stdout
+	printSummary(os.Stderr, "exported", summary)
+	return nil
+}
+
+func importArchive(c *cli.Context) error {
+	if c.String("input") == "" {
+		return errors.New("input is required")
+	}
+	tables, err := archiveTables(*config)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(c.String("input"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	summary, err := archive.Import(context.Background(), f, tables)
+	printSummary(os.Stdout, "imported", summary)
+	return err
+}
+
+func convertLayout(c *cli.Context) error {
+	from := *config
+	from.TableLayout = c.String("from")
+	switch {
+	case from.TableLayout != service.LayoutMulti && from.TableLayout != service.LayoutSingle:
+		return errors.New("from must be multi or single")
+	case from.TableLayout == layout(*config):
+		return fmt.Errorf("the configured layout is already %s", from.TableLayout)
+	}
+
+	source, err := archiveTables(from)
+	if err != nil {
+		return err
+	}
+	destination, err := archiveTables(*config)
+	if err != nil {
+		return err
+	}
+	summary, err := archive.Copy(context.Background(), source, destination)
+	printSummary(os.Stdout, "copied", summary)
+	return err
+}
+
+// layout returns the table layout of the config, which is multi unless
+// it's been set
+func layout(c service.Config) string {
+	if c.TableLayout == "" {
+		return service.LayoutMulti
+	}
+	return c.TableLayout
+}
+
+// archiveTables returns the Storers for the tables of the config
+func archiveTables(c service.Config) (archive.Tables, error) {
+	storers, err := service.NewStorers(c)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Tables{
+		archive.TableContenders:     storers.Contenders,
+		archive.TableMatchups:       storers.Matchups,
+		archive.TableUserMatchups:   storers.UserMatchups,
+		archive.TableMasterMatchups: storers.MasterMatchups,
+		archive.TableTokens:         storers.Tokens,
+		archive.TablePolls:          storers.Polls,
+	}, nil
+}
+
+func migrateTables(c *cli.Context) error {
+	storers, err := service.NewStorers(*config)
+	if err != nil {
+		return err
+	}
+	db, err := service.NewDynamo(*config)
+	if err != nil {
+		return err
+	}
+	tables := migrate.Tables{
+		{Name: archive.TableContenders, Config: config.ContenderTableConfig, Item: &contender.Contender{}, Storer: storers.Contenders},
+		{Name: archive.TableMatchups, Config: config.MatchupTableConfig, Item: &contender.Matchup{}, Storer: storers.Matchups},
+		{Name: archive.TableUserMatchups, Config: config.UserMatchupsTableConfig, Item: &contender.MatchupSet{}, Storer: storers.UserMatchups},
+		{Name: archive.TableMasterMatchups, Config: config.MasterMatchupsTableConfig, Item: &contender.MatchupSet{}, Storer: storers.MasterMatchups},
+		{Name: archive.TableTokens, Config: config.TokenTableConfig, Item: &contender.Token{}, Storer: storers.Tokens},
+		{Name: archive.TablePolls, Config: config.PollTableConfig, Item: &contender.Poll{}, Storer: storers.Polls},
+	}
+	if layout(*config) == service.LayoutSingle {
+		entities := []dynamostore.Entity{
+			contender.ContenderEntity,
+			contender.MatchupEntity,
+			contender.UserMatchupsEntity,
+			contender.MasterMatchupsEntity,
+			contender.TokenEntity,
+			contender.PollEntity,
+		}
+		for i := range tables {
+			tables[i].Config = config.SingleTableConfig
+			tables[i].Item = entities[i].Wrap(tables[i].Item)
+		}
+	}
+	m := &migrate.Migrator{
+		Tables: append(tables,
+			migrate.Table{Name: migrate.TableMigrations, Config: config.MigrationTableConfig, Item: &migrate.Record{}, Storer: storers.Migrations},
+		),
+		Records:  storers.Migrations,
+		Registry: migrate.Default,
+	}
+	if db != nil {
+		m.API = migrate.NewTableAPI(db)
+	}
+
+	dryRun := c.Bool("dry-run")
+	result, err := m.Run(context.Background(), dryRun)
+	if result != nil {
+		changed, applied := "changed", "applied"
+		if dryRun {
+			changed, applied = "would change", "would apply"
+		}
+		for _, change := range result.Changes {
+			fmt.Printf("%s %s: %s\n", changed, change.Table, change.Description)
+		}
+		for _, migration := range result.Migrations {
+			fmt.Printf("%s migration %d %s: %s\n", applied, migration.ID, migration.Name, migration.Description)
+		}
+	}
+	return err
+}
+
+func printSummary(w io.Writer, verb string, summary archive.Summary) {
+	tables := make([]string, 0, len(summary))
+	for table := range summary {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Fprintf(w, "%s %d %s\n", verb, summary[table], table)
+	}
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,11 +11,15 @@ import (
 	"path"
 	"strings"
 
+	"github.com/sbogacz/wouldyoutatter/client"
 	"github.com/sbogacz/wouldyoutatter/contender"
 	"github.com/sbogacz/wouldyoutatter/service"
 	"github.com/urfave/cli"
 )
 
+// uploadBatchSize is the most contenders the API takes in a single batch
+const uploadBatchSize = 100
+
 func main() {
 	app := cli.NewApp()
 	app.Usage = "this is the contender uploader for wouldyoutatter"
@@ -33,11 +36,38 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "endpoint",
-			Usage: "HTTP endpoint to call",
-			Value: "http://localhost:8080/contenders",
+			Usage: "base URL of the API to call",
+			Value: "http://localhost:8080",
 		},
 	}
 	app.Action = upload
+	app.Commands = []cli.Command{
+		{
+			Name:   "sync",
+			Usage:  "create, update and delete contenders to match a manifest",
+			Action: syncManifest,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "manifest",
+					Usage: "Path to the YAML or JSON manifest of contenders",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the plan without changing anything",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "how many changes to make at once",
+					Value: 4,
+				},
+				cli.IntFlag{
+					Name:  "retries",
+					Usage: "how many times to retry a change that fails with a server error",
+					Value: 3,
+				},
+			},
+		},
+	}
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -54,28 +84,77 @@ func upload(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	for _, contender := range *contenders {
-		b, err := json.Marshal(&contender)
-		if err != nil {
-			return err
-		}
-		req, err := http.NewRequest("POST", c.String("endpoint"), bytes.NewBuffer(b))
-		if err != nil {
-			return err
+	tatter := newClient(c.String("endpoint"), c.String("admintoken"))
+	var failed int
+	for start := 0; start < len(*contenders); start += uploadBatchSize {
+		end := start + uploadBatchSize
+		if end > len(*contenders) {
+			end = len(*contenders)
 		}
-		req.Header.Set("X-Tatter-Master", c.String("admintoken"))
-		resp, err := http.DefaultClient.Do(req)
+		results, err := tatter.BatchCreateContenders(context.Background(), (*contenders)[start:end])
 		if err != nil {
 			return err
 		}
-		if resp.StatusCode != http.StatusCreated {
-			log.Printf("Got back status of %d\n", resp.StatusCode)
-			return errors.New("No status created code")
+		for _, result := range results {
+			if result.Status == http.StatusConflict {
+				fmt.Fprintf(os.Stderr, "skipping %s, it already exists\n", result.Name)
+				continue
+			}
+			if !result.Created() {
+				fmt.Fprintf(os.Stderr, "failed to create %s: %s\n", result.Name, result.Detail)
+				failed++
+			}
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d contenders failed", failed)
+	}
+	return nil
+}
+
+func syncManifest(c *cli.Context) error {
+	if c.String("manifest") == "" {
+		return errors.New("manifest is required")
+	}
+	if c.Int("concurrency") < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	wanted, err := loadManifest(c.String("manifest"))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tatter := newClient(c.GlobalString("endpoint"), c.GlobalString("admintoken"))
+	existing, err := tatter.ListContenders(ctx)
+	if err != nil {
+		return err
+	}
+
+	changes, unchanged := plan(wanted, existing)
+	printPlan(os.Stdout, changes, unchanged)
+	if c.Bool("dry-run") || len(changes) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	s := &syncer{
+		tatter:      tatter,
+		concurrency: c.Int("concurrency"),
+		retries:     c.Int("retries"),
+	}
+	if failed := printReport(os.Stdout, s.apply(ctx, changes), unchanged); failed > 0 {
+		return fmt.Errorf("%d changes failed", failed)
+	}
 	return nil
 }
 
+func newClient(endpoint, adminToken string) *client.Client {
+	// older invocations pointed straight at the contenders endpoint
+	endpoint = strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), "/contenders")
+	return client.New(endpoint, client.WithMasterKey(adminToken))
+}
+
 func loadContenders(svgpath string) (*[]contender.Contender, error) {
 	contenders := []contender.Contender{}
 	f, err := os.Open(svgpath)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manifest lists the contenders that should exist, and is the source of
+// truth for sync
+type Manifest struct {
+	Contenders []ManifestEntry `json:"contenders" yaml:"contenders"`
+}
+
+// ManifestEntry describes a single contender
+type ManifestEntry struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description" yaml:"description"`
+	Tags        []string `json:"tags" yaml:"tags"`
+	// SVG is the path to the contender's SVG, relative to the manifest
+	SVG    string `json:"svg" yaml:"svg"`
+	Artist string `json:"artist" yaml:"artist"`
+}
+
+// loadManifest reads a YAML or JSON manifest, depending on its extension,
+// and the SVGs it points to
+func loadManifest(manifestPath string) ([]contender.Contender, error) {
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read manifest")
+	}
+	m := &Manifest{}
+	if strings.EqualFold(filepath.Ext(manifestPath), ".json") {
+		err = json.Unmarshal(b, m)
+	} else {
+		err = yaml.UnmarshalStrict(b, m)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest %s", manifestPath)
+	}
+
+	dir := filepath.Dir(manifestPath)
+	seen := map[string]bool{}
+	contenders := make([]contender.Contender, 0, len(m.Contenders))
+	for i, entry := range m.Contenders {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("contender %d in the manifest has no name", i+1)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("%s is in the manifest more than once", entry.Name)
+		}
+		seen[entry.Name] = true
+		if entry.SVG == "" {
+			return nil, fmt.Errorf("%s has no svg in the manifest", entry.Name)
+		}
+
+		svgPath := entry.SVG
+		if !filepath.IsAbs(svgPath) {
+			svgPath = filepath.Join(dir, svgPath)
+		}
+		svg, err := ioutil.ReadFile(svgPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the svg for %s", entry.Name)
+		}
+
+		// the description defaults to the name, like the uploads from a
+		// directory of SVGs
+		description := entry.Description
+		if description == "" {
+			description = entry.Name
+		}
+		c := contender.Contender{
+			Name:        entry.Name,
+			Description: description,
+			SVG:         svg,
+			Tags:        entry.Tags,
+			Artist:      entry.Artist,
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		contenders = append(contenders, c)
+	}
+	return contenders, nil
+}
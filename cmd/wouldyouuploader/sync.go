@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+)
+
+const (
+	// retryBackoff is how long we wait before the first retry, doubling
+	// for each one after
+	retryBackoff = 250 * time.Millisecond
+)
+
+type action string
+
+const (
+	actionCreate action = "create"
+	actionUpdate action = "update"
+	actionDelete action = "delete"
+)
+
+// actionOrder is the order the plan lists changes in
+var actionOrder = map[action]int{actionCreate: 0, actionUpdate: 1, actionDelete: 2}
+
+// change is a single step of the plan to bring the API in line with the
+// manifest
+type change struct {
+	action    action
+	contender *contender.Contender
+	// fields lists what an update changes
+	fields []string
+}
+
+func (c change) String() string {
+	switch c.action {
+	case actionCreate:
+		return fmt.Sprintf("+ create %s", c.contender.Name)
+	case actionUpdate:
+		return fmt.Sprintf("~ update %s (%s)", c.contender.Name, strings.Join(c.fields, ", "))
+	default:
+		return fmt.Sprintf("- delete %s", c.contender.Name)
+	}
+}
+
+// plan diffs the contenders in the manifest against the ones the API
+// has, and returns the changes to make along with how many are unchanged
+func plan(wanted, existing []contender.Contender) ([]change, int) {
+	existingByName := make(map[string]*contender.Contender, len(existing))
+	for i := range existing {
+		existingByName[existing[i].Name] = &existing[i]
+	}
+
+	changes := []change{}
+	unchanged := 0
+	for i := range wanted {
+		c := &wanted[i]
+		current, ok := existingByName[c.Name]
+		delete(existingByName, c.Name)
+		if !ok {
+			changes = append(changes, change{action: actionCreate, contender: c})
+			continue
+		}
+		if fields := changedFields(current, c); len(fields) > 0 {
+			changes = append(changes, change{action: actionUpdate, contender: c, fields: fields})
+			continue
+		}
+		unchanged++
+	}
+	for _, c := range existingByName {
+		changes = append(changes, change{action: actionDelete, contender: c})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].action != changes[j].action {
+			return actionOrder[changes[i].action] < actionOrder[changes[j].action]
+		}
+		return changes[i].contender.Name < changes[j].contender.Name
+	})
+	return changes, unchanged
+}
+
+func changedFields(current, wanted *contender.Contender) []string {
+	fields := []string{}
+	if current.Description != wanted.Description {
+		fields = append(fields, "description")
+	}
+	if !bytes.Equal(current.SVG, wanted.SVG) {
+		fields = append(fields, "svg")
+	}
+	if strings.Join(current.Tags, "\x00") != strings.Join(wanted.Tags, "\x00") {
+		fields = append(fields, "tags")
+	}
+	if current.Artist != wanted.Artist {
+		fields = append(fields, "artist")
+	}
+	return fields
+}
+
+// syncer applies a plan with bounded concurrency, retrying changes that
+// fail for reasons that might go away
+type syncer struct {
+	tatter      *client.Client
+	concurrency int
+	retries     int
+}
+
+// result is the outcome of applying a single change
+type result struct {
+	change change
+	err    error
+}
+
+// apply makes every change, and returns the results in the order of the
+// plan. A change failing doesn't stop the others
+func (s *syncer) apply(ctx context.Context, changes []change) []result {
+	results := make([]result, len(changes))
+	sem := make(chan struct{}, s.concurrency)
+	wg := sync.WaitGroup{}
+	for i := range changes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = result{change: changes[i], err: s.withRetries(ctx, changes[i])}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func (s *syncer) withRetries(ctx context.Context, c change) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.do(ctx, c)
+		if err == nil || attempt >= s.retries || !client.RetryableError(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (s *syncer) do(ctx context.Context, c change) error {
+	switch c.action {
+	case actionCreate:
+		return s.tatter.CreateContender(ctx, c.contender)
+	case actionUpdate:
+		return s.tatter.UpdateContender(ctx, c.contender)
+	default:
+		err := s.tatter.DeleteContender(ctx, c.contender.Name)
+		// a retried delete may have gone through the first time
+		if client.NotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+}
+
+// printPlan writes the plan in a readable form, one change per line
+func printPlan(w io.Writer, changes []change, unchanged int) {
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "nothing to do, %d unchanged\n", unchanged)
+		return
+	}
+	counts := map[action]int{}
+	for _, c := range changes {
+		fmt.Fprintln(w, c)
+		counts[c.action]++
+	}
+	fmt.Fprintf(w, "\n%d to create, %d to update, %d to delete, %d unchanged\n",
+		counts[actionCreate], counts[actionUpdate], counts[actionDelete], unchanged)
+}
+
+// printReport summarises the results, and returns how many failed
+func printReport(w io.Writer, results []result, unchanged int) int {
+	done := map[action]int{}
+	failed := []result{}
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, r)
+			continue
+		}
+		done[r.change.action]++
+	}
+	fmt.Fprintf(w, "created %d, updated %d, deleted %d, unchanged %d, failed %d\n",
+		done[actionCreate], done[actionUpdate], done[actionDelete], unchanged, len(failed))
+	for _, r := range failed {
+		fmt.Fprintf(w, "  failed to %s %s: %v\n", r.change.action, r.change.contender.Name, r.err)
+	}
+	return len(failed)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func logo(name, description string, tags ...string) contender.Contender {
+	return contender.Contender{
+		Name:        name,
+		Description: description,
+		SVG:         []byte("<svg>" + name + "</svg>"),
+		Tags:        tags,
+	}
+}
+
+func withSVG(c contender.Contender, svg string) contender.Contender {
+	c.SVG = []byte(svg)
+	return c
+}
+
+var syncTests = []struct {
+	name          string
+	existing      []contender.Contender
+	wanted        []contender.Contender
+	wantChanges   []string
+	wantUnchanged int
+}{
+	{
+		name:        "nothing to do",
+		wantChanges: []string{},
+	},
+	{
+		name:        "creates what's missing",
+		wanted:      []contender.Contender{logo("go", "a gopher"), logo("rust", "a crab")},
+		wantChanges: []string{"+ create go", "+ create rust"},
+	},
+	{
+		name:          "leaves what's the same",
+		existing:      []contender.Contender{logo("go", "a gopher", "blue")},
+		wanted:        []contender.Contender{logo("go", "a gopher", "blue")},
+		wantChanges:   []string{},
+		wantUnchanged: 1,
+	},
+	{
+		name:        "updates what's changed, naming the fields",
+		existing:    []contender.Contender{logo("go", "a gopher", "blue"), logo("rust", "a crab")},
+		wanted:      []contender.Contender{logo("go", "a gopher", "cyan"), withSVG(logo("rust", "ferris"), "<svg/>")},
+		wantChanges: []string{"~ update go (tags)", "~ update rust (description, svg)"},
+	},
+	{
+		name:          "deletes what's not in the manifest",
+		existing:      []contender.Contender{logo("go", "a gopher"), logo("perl", "a camel")},
+		wanted:        []contender.Contender{logo("go", "a gopher")},
+		wantChanges:   []string{"- delete perl"},
+		wantUnchanged: 1,
+	},
+	{
+		name:     "creates, then updates, then deletes",
+		existing: []contender.Contender{logo("perl", "a camel"), logo("go", "a gopher"), logo("cobol", "a mainframe")},
+		wanted:   []contender.Contender{logo("zig", "a lizard"), logo("go", "gopher"), logo("elm", "a tree")},
+		wantChanges: []string{
+			"+ create elm",
+			"+ create zig",
+			"~ update go (description)",
+			"- delete cobol",
+			"- delete perl",
+		},
+	},
+}
+
+func TestPlan(t *testing.T) {
+	for _, test := range syncTests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, unchanged := plan(test.wanted, test.existing)
+			got := []string{}
+			for _, c := range changes {
+				got = append(got, c.String())
+			}
+			assert.Equal(t, test.wantChanges, got)
+			assert.Equal(t, test.wantUnchanged, unchanged)
+		})
+	}
+}
+
+// TestSync applies each plan to a service backed by the in-memory store,
+// after which the API should have just the manifest's contenders, and
+// there should be nothing left to do
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range syncTests {
+		t.Run(test.name, func(t *testing.T) {
+			svc, err := service.New(service.Config{LogLevel: "ERROR", MasterKey: service.DefaultMasterKey})
+			require.NoError(t, err)
+			server := httptest.NewServer(svc.Handler())
+			defer server.Close()
+			tatter := client.New(server.URL, client.WithMasterKey(service.DefaultMasterKey))
+			for i := range test.existing {
+				require.NoError(t, tatter.CreateContender(ctx, &test.existing[i]))
+			}
+
+			existing, err := tatter.ListContenders(ctx)
+			require.NoError(t, err)
+			changes, _ := plan(test.wanted, existing)
+			s := &syncer{tatter: tatter, concurrency: 2}
+			for _, r := range s.apply(ctx, changes) {
+				assert.NoError(t, r.err, r.change.String())
+			}
+
+			synced, err := tatter.ListContenders(ctx)
+			require.NoError(t, err)
+			changes, unchanged := plan(test.wanted, synced)
+			assert.Empty(t, changes)
+			assert.Equal(t, len(test.wanted), unchanged)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package contender
 
 import (
 	"context"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sbogacz/wouldyoutatter/dynamostore"
@@ -9,13 +10,24 @@ import (
 
 // Contender is the model for the tattoo options
 type Contender struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	SVG         []byte `json:"svg"`
-	Wins        int    `json:"wins"`
-	Losses      int    `json:"losses"`
-	Score       int    `json:"score"`
-	isLoser     bool
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	SVG         []byte   `json:"svg"`
+	Wins        int      `json:"wins"`
+	Losses      int      `json:"losses"`
+	Score       int      `json:"score"`
+	Tags        []string `json:"tags,omitempty"`
+	Artist      string   `json:"artist,omitempty"`
+	// Version is incremented by every write, so they can be made
+	// conditional on the version last seen
+	Version int64 `json:"version,omitempty"`
+	// Poll is the ID of the poll the contender is in, which the Store
+	// sets from the context
+	Poll    string `json:"poll,omitempty"`
+	isLoser bool
+	// isEdit marks an update of the contender's details, rather than
+	// of its score
+	isEdit bool
 }
 
 // Contenders is a collection that implements Scannable
@@ -37,7 +49,20 @@ func NewLoser(name string) *Contender {
 	}
 }
 
-// Store uses a storer to interact with the underlying Contender db
+// Validate checks that the contender can be stored and addressed by
+// name in the API and in matchup sets
+func (c *Contender) Validate() error {
+	if c.Name == "" {
+		return &ValidationError{Field: "name", Reason: "must not be empty"}
+	}
+	if strings.ContainsAny(c.Name, "/§") {
+		return &ValidationError{Field: "name", Reason: "must not contain '/' or '§'"}
+	}
+	return nil
+}
+
+// Store uses a storer to interact with the underlying Contender db. Its
+// methods read and write the contenders of the poll of their context
 type Store struct {
 	db dynamostore.Storer
 }
@@ -51,12 +76,50 @@ func NewStore(db dynamostore.Storer) *Store {
 
 // Set lets you save a contender
 func (s *Store) Set(ctx context.Context, c *Contender) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	c.Poll = PollFromContext(ctx)
 	return errors.Wrap(s.db.Set(ctx, c), "failed to save contender")
 }
 
+// Create saves a new contender, at its first version, and returns an
+// error matching dynamostore.ConflictError if there's already one with
+// the same name
+func (s *Store) Create(ctx context.Context, c *Contender) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	c.Version = 1
+	c.Poll = PollFromContext(ctx)
+	return errors.Wrap(s.db.Set(ctx, c, dynamostore.CreateOnly()), "failed to create contender")
+}
+
+// Update replaces the details of an existing contender, keeping its
+// record. It returns a not found error if there's no such contender, and
+// a conflict error if a condition of the opts, e.g. dynamostore.IfVersion,
+// doesn't hold. The contender's own version is ignored
+func (s *Store) Update(ctx context.Context, c *Contender, opts ...dynamostore.WriteOption) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	edit := *c
+	edit.isEdit = true
+	edit.Poll = PollFromContext(ctx)
+	// the edit is conditional on the contender existing, and on the opts,
+	// in the one write. Only once it fails do we look for which
+	err := s.db.Update(ctx, &edit, opts...)
+	if dynamostore.ConflictError(err) {
+		if _, getErr := s.Get(ctx, c.Name); getErr != nil && dynamostore.NotFoundError(getErr) {
+			return getErr
+		}
+	}
+	return errors.Wrap(err, "failed to update contender")
+}
+
 // Get lets you retrieve a contender by name
 func (s *Store) Get(ctx context.Context, name string) (*Contender, error) {
-	c := &Contender{Name: name}
+	c := &Contender{Name: name, Poll: PollFromContext(ctx)}
 	item, err := s.db.Get(ctx, c)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to retrieve contender")
@@ -66,16 +129,53 @@ func (s *Store) Get(ctx context.Context, name string) (*Contender, error) {
 	return ret, nil
 }
 
-// Delete lets you delete a container by name
-func (s *Store) Delete(ctx context.Context, name string) error {
-	c := &Contender{Name: name}
+// GetMany retrieves the contenders with the given names together. Names
+// without a contender are left out of the map
+func (s *Store) GetMany(ctx context.Context, names []string) (map[string]*Contender, error) {
+	items := make([]dynamostore.Item, len(names))
+	for i, name := range names {
+		items[i] = &Contender{Name: name, Poll: PollFromContext(ctx)}
+	}
+	found, err := s.db.BatchGet(ctx, items)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve contenders")
+	}
+	ret := make(map[string]*Contender, len(found))
+	for _, item := range found {
+		c := item.(*Contender)
+		ret[c.Name] = c
+	}
+	return ret, nil
+}
+
+// Delete lets you delete a container by name. It returns a conflict
+// error if a condition of the opts, e.g. dynamostore.IfVersion, doesn't hold
+func (s *Store) Delete(ctx context.Context, name string, opts ...dynamostore.WriteOption) error {
+	c := &Contender{Name: name, Poll: PollFromContext(ctx)}
+	return errors.Wrap(s.db.Delete(ctx, c, opts...), "failed to delete contender")
+}
 
-	return errors.Wrap(s.db.Delete(ctx, c), "failed to delete contender")
+// DeletePollItems deletes every contender of the poll of ctx
+func (s *Store) DeletePollItems(ctx context.Context) error {
+	if PollFromContext(ctx) == DefaultPoll {
+		return &ValidationError{Field: "id", Reason: "the default poll's items can't be deleted"}
+	}
+	all, err := s.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range *all {
+		if err := s.Delete(ctx, c.Name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // DeclareWinner lets you declarea a container a winner by name
 func (s *Store) DeclareWinner(ctx context.Context, name string) error {
 	winner := NewWinner(name)
+	winner.Poll = PollFromContext(ctx)
 
 	return errors.Wrapf(s.db.Update(ctx, winner), "failed to declare contender %s the winner", name)
 }
@@ -83,26 +183,58 @@ func (s *Store) DeclareWinner(ctx context.Context, name string) error {
 // DeclareLoser lets you declarea a container a loser by name
 func (s *Store) DeclareLoser(ctx context.Context, name string) error {
 	loser := NewLoser(name)
+	loser.Poll = PollFromContext(ctx)
 
 	return errors.Wrapf(s.db.Update(ctx, loser), "failed to declare contender %s the loser", name)
 }
 
-// GetAll lets you retrieve all of the current contenders
+// GetAll lets you retrieve all of the current contenders of the poll
 func (s *Store) GetAll(ctx context.Context) (*Contenders, error) {
 	cs := []Contender{}
 	otherContenders := Contenders(cs)
-	if err := s.db.Scan(ctx, &otherContenders); err != nil {
+	if err := s.db.Scan(ctx, &pollContenders{Contenders: &otherContenders, poll: PollFromContext(ctx)}); err != nil {
 		return nil, errors.Wrap(err, "failed to get all contenders")
 	}
 	return &otherContenders, nil
 }
 
-// GetLeaderboard lets you retrieve the top N contenders
+// GetLeaderboard lets you retrieve the top N contenders of the poll
 func (s *Store) GetLeaderboard(ctx context.Context, limit int) (*Contenders, error) {
 	cs := []Contender{}
 	leaderboard := Contenders(cs)
-	if err := s.db.Query(ctx, &leaderboard, limit); err != nil {
+	if err := s.db.Query(ctx, &pollContenders{Contenders: &leaderboard, poll: PollFromContext(ctx)}, limit); err != nil {
 		return nil, errors.Wrap(err, "failed to query for leaderboard")
 	}
 	return &leaderboard, nil
 }
+
+// GetScores returns the name, score, wins and losses of every contender of
+// the poll, highest score first. It reads them from the leaderboard index,
+// without the rest of each contender
+func (s *Store) GetScores(ctx context.Context) (*Contenders, error) {
+	cs := []Contender{}
+	scores := Contenders(cs)
+	if err := s.db.Query(ctx, &pollScores{pollContenders{Contenders: &scores, poll: PollFromContext(ctx)}}, 0); err != nil {
+		return nil, errors.Wrap(err, "failed to query for scores")
+	}
+	return &scores, nil
+}
+
+// GetRanks returns the leaderboard position of every contender of the poll,
+// where contenders with the same score share a rank. It ranks the scores in
+// one pass, since they're in order
+func (s *Store) GetRanks(ctx context.Context) (map[string]int, error) {
+	scores, err := s.GetScores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ranks := make(map[string]int, len(*scores))
+	for i, c := range *scores {
+		if i == 0 || c.Score != (*scores)[i-1].Score {
+			ranks[c.Name] = i + 1
+			continue
+		}
+		ranks[c.Name] = ranks[(*scores)[i-1].Name]
+	}
+	return ranks, nil
+}
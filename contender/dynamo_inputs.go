@@ -10,29 +10,55 @@ import (
 	"github.com/sbogacz/wouldyoutatter/dynamostore"
 )
 
-var _ dynamostore.Item = (*Contender)(nil)
+var (
+	_ dynamostore.Item      = (*Contender)(nil)
+	_ dynamostore.Versioned = (*Contender)(nil)
+)
 
 const (
 	leaderboardScoreIndex = "LeaderboardScore"
+	// leaderboardPartition is the partition of the leaderboard index
+	// every contender of a poll is in
+	leaderboardPartition = "topscore"
 )
 
-// Key returns the Contenders name, and implements the dynamostore Item interface
+// Key returns the Contenders name, in its poll's namespace, and implements
+// the dynamostore Item interface
 func (c Contender) Key() string {
-	return c.Name
+	return pollKey(c.Poll, c.Name)
 }
 
 // Marshal encodes the values of a contender into the map format
 // that dynamo expects
 func (c Contender) Marshal() map[string]dynamodb.AttributeValue {
-	return map[string]dynamodb.AttributeValue{
-		"Name":        stringToAttributeValue(c.Name),
+	ret := map[string]dynamodb.AttributeValue{
+		"Name":        stringToAttributeValue(c.Key()),
 		"Description": stringToAttributeValue(c.Description),
 		"SVG":         bytesToAttributeValue(c.SVG),
 		"Wins":        intToAttributeValue(c.Wins),
 		"Losses":      intToAttributeValue(c.Losses),
 		"Score":       intToAttributeValue(c.Score),
-		"Leaderboard": stringToAttributeValue("topscore"), // placeholder
+		"Tags":        stringsToAttributeValue(c.Tags),
+		"Artist":      stringToAttributeValue(c.Artist),
+		"Leaderboard": stringToAttributeValue(pollKey(c.Poll, leaderboardPartition)),
+	}
+	// contenders of the default poll have no poll attribute, like those
+	// saved before there were polls
+	if c.Poll != "" && c.Poll != DefaultPoll {
+		ret["Poll"] = stringToAttributeValue(c.Poll)
+	}
+	// an unversioned contender has no version attribute, which is what
+	// dynamostore.IfVersion(0) expects
+	if c.Version > 0 {
+		ret["Version"] = int64ToAttributeValue(c.Version)
 	}
+	return ret
+}
+
+// VersionAttribute names the attribute holding the contender's version,
+// and implements the dynamostore Versioned interface
+func (c Contender) VersionAttribute() string {
+	return "Version"
 }
 
 // Unmarshal tries to decode a Contender from a dynamo response
@@ -53,13 +79,22 @@ func (c *Contender) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to read Score attribute")
 	}
+	version, err := getInt64(aMap["Version"])
+	if err != nil {
+		return errors.Wrap(err, "failed to read Version attribute")
+	}
+	poll := getString(aMap["Poll"])
 	newContender := &Contender{
-		Name:        getString(aMap["Name"]),
+		Name:        unpollKey(poll, getString(aMap["Name"])),
 		Description: getString(aMap["Description"]),
 		SVG:         getBytes(aMap["SVG"]),
 		Wins:        wins,
 		Losses:      losses,
 		Score:       score,
+		Tags:        getStrings(aMap["Tags"]),
+		Artist:      getString(aMap["Artist"]),
+		Version:     version,
+		Poll:        poll,
 	}
 	*c = *newContender
 	return nil
@@ -67,7 +102,7 @@ func (c *Contender) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 
 // CreateTableInput generates the dynamo input to create the contenders table
 func (c *Contender) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTableInput {
-	return &dynamodb.CreateTableInput{
+	return tc.Configure(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String("Name"),
@@ -88,10 +123,6 @@ func (c *Contender) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.Crea
 				KeyType:       dynamodb.KeyTypeHash,
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(tc.ReadCapacity),
-			WriteCapacityUnits: aws.Int64(tc.WriteCapacity),
-		},
 		GlobalSecondaryIndexes: []dynamodb.GlobalSecondaryIndex{
 			{
 				IndexName: aws.String(leaderboardScoreIndex),
@@ -106,10 +137,6 @@ func (c *Contender) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.Crea
 						KeyType:       dynamodb.KeyTypeRange,
 					},
 				},
-				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-					ReadCapacityUnits:  aws.Int64(tc.ReadCapacity),
-					WriteCapacityUnits: aws.Int64(tc.WriteCapacity),
-				},
 				Projection: &dynamodb.Projection{
 					ProjectionType: dynamodb.ProjectionTypeAll,
 				},
@@ -117,7 +144,7 @@ func (c *Contender) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.Crea
 		},
 
 		TableName: aws.String(tc.TableName),
-	}
+	})
 }
 
 // DescribeTableInput generates the query we need to describe the contender table
@@ -136,7 +163,7 @@ func (c *Contender) TableOptions(tableName string) []dynamostore.TableOption {
 func (c *Contender) GetItemInput(tableName string) *dynamodb.GetItemInput {
 	return &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
-		Key:       map[string]dynamodb.AttributeValue{"Name": {S: aws.String(c.Name)}},
+		Key:       map[string]dynamodb.AttributeValue{"Name": {S: aws.String(c.Key())}},
 	}
 }
 
@@ -152,32 +179,64 @@ func (c *Contender) PutItemInput(tableName string) *dynamodb.PutItemInput {
 func (c *Contender) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
 	return &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
-		Key:       map[string]dynamodb.AttributeValue{"Name": {S: aws.String(c.Name)}},
+		Key:       map[string]dynamodb.AttributeValue{"Name": {S: aws.String(c.Key())}},
 	}
 }
 
 // UpdateItemInput generates the dynamodb.UpdateItemInput for the given contender
 func (c *Contender) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
+	if c.isEdit {
+		return editInput(c, tableName)
+	}
 	if c.isLoser {
-		return lossInput(c.Name, tableName)
+		return lossInput(c.Key(), tableName)
 	}
-	return winInput(c.Name, tableName)
+	return winInput(c.Key(), tableName)
 }
 
+// recordNames are the attribute names of the record updates. They only
+// apply to contenders that exist, so a vote can't bring back a deleted one.
+// Votes leave the version alone, so they don't conflict with edits
+var recordNames = map[string]string{"#n": "Name"}
+
+// editNames are the attribute names of edits, which bump the version
+var editNames = map[string]string{"#n": "Name", "#v": "Version"}
+
 func winInput(name, tableName string) *dynamodb.UpdateItemInput {
 	return &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(tableName),
 		Key:                       map[string]dynamodb.AttributeValue{"Name": {S: aws.String(name)}},
 		UpdateExpression:          aws.String("ADD Wins :w, Score :w"),
+		ConditionExpression:       aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames:  recordNames,
 		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":w": {N: aws.String("1")}},
 	}
 }
 
+func editInput(c *Contender, tableName string) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName:                aws.String(tableName),
+		Key:                      map[string]dynamodb.AttributeValue{"Name": {S: aws.String(c.Key())}},
+		UpdateExpression:         aws.String("SET Description = :d, SVG = :s, Tags = :t, Artist = :a ADD #v :one"),
+		ConditionExpression:      aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames: editNames,
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":d":   stringToAttributeValue(c.Description),
+			":s":   bytesToAttributeValue(c.SVG),
+			":t":   stringsToAttributeValue(c.Tags),
+			":a":   stringToAttributeValue(c.Artist),
+			":one": {N: aws.String("1")},
+		},
+	}
+}
+
 func lossInput(name, tableName string) *dynamodb.UpdateItemInput {
 	return &dynamodb.UpdateItemInput{
-		TableName:        aws.String(tableName),
-		Key:              map[string]dynamodb.AttributeValue{"Name": {S: aws.String(name)}},
-		UpdateExpression: aws.String("ADD Losses :l, Score :ls"),
+		TableName:                aws.String(tableName),
+		Key:                      map[string]dynamodb.AttributeValue{"Name": {S: aws.String(name)}},
+		UpdateExpression:         aws.String("ADD Losses :l, Score :ls"),
+		ConditionExpression:      aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames: recordNames,
 		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
 			":l":  {N: aws.String("1")},
 			":ls": {N: aws.String("-1")},
@@ -193,16 +252,62 @@ func (c *Contenders) ScanInput(tableName string) *dynamodb.ScanInput {
 }
 
 // QueryInput producest a dynamodb QueryInput object looking for the
-// top N contenders
+// top N contenders of the default poll
 func (c *Contenders) QueryInput(tableName string, limit int) *dynamodb.QueryInput {
+	return leaderboardInput(tableName, DefaultPoll, limit)
+}
+
+func leaderboardInput(tableName, poll string, limit int) *dynamodb.QueryInput {
 	return &dynamodb.QueryInput{
 		TableName:                 aws.String(tableName),
 		IndexName:                 aws.String(leaderboardScoreIndex),
 		KeyConditionExpression:    aws.String("Leaderboard = :val"),
-		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":val": {S: aws.String("topscore")}},
-		Limit:            aws.Int64(int64(limit)),
-		ScanIndexForward: aws.Bool(false),
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":val": {S: aws.String(pollKey(poll, leaderboardPartition))}},
+		Limit:                     aws.Int64(int64(limit)),
+		ScanIndexForward:          aws.Bool(false),
+	}
+}
+
+// pollContenders are the contenders of a single poll, which share its
+// leaderboard partition, and are told apart from the others' by their
+// poll attribute when scanned
+type pollContenders struct {
+	*Contenders
+	poll string
+}
+
+// ScanInput only scans the contenders of the poll
+func (c *pollContenders) ScanInput(tableName string) *dynamodb.ScanInput {
+	input := c.Contenders.ScanInput(tableName)
+	input.ExpressionAttributeNames = map[string]string{"#poll": "Poll"}
+	if c.poll == "" || c.poll == DefaultPoll {
+		input.FilterExpression = aws.String("attribute_not_exists(#poll)")
+		return input
 	}
+	input.FilterExpression = aws.String("#poll = :poll")
+	input.ExpressionAttributeValues = map[string]dynamodb.AttributeValue{":poll": stringToAttributeValue(c.poll)}
+	return input
+}
+
+// QueryInput looks for the top N contenders of the poll
+func (c *pollContenders) QueryInput(tableName string, limit int) *dynamodb.QueryInput {
+	return leaderboardInput(tableName, c.poll, limit)
+}
+
+// pollScores are the names, scores and records of every contender of a
+// poll, read from the leaderboard index without the rest of each contender
+type pollScores struct {
+	pollContenders
+}
+
+// QueryInput looks for every contender of the poll, highest score first,
+// projecting only what's needed to rank them
+func (c *pollScores) QueryInput(tableName string, _ int) *dynamodb.QueryInput {
+	input := leaderboardInput(tableName, c.poll, 0)
+	input.Limit = nil
+	input.ProjectionExpression = aws.String("#name, #score, #wins, #losses, #poll")
+	input.ExpressionAttributeNames = map[string]string{"#name": "Name", "#score": "Score", "#wins": "Wins", "#losses": "Losses", "#poll": "Poll"}
+	return input
 }
 
 // Unmarshal allows results to be unmarshalled directly into the struct
@@ -235,6 +340,16 @@ func int64ToAttributeValue(n int64) dynamodb.AttributeValue {
 	return dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", n))}
 }
 
+// stringsToAttributeValue uses a list rather than a string set, since
+// sets can't be empty
+func stringsToAttributeValue(ss []string) dynamodb.AttributeValue {
+	l := make([]dynamodb.AttributeValue, len(ss))
+	for i, s := range ss {
+		l[i] = stringToAttributeValue(s)
+	}
+	return dynamodb.AttributeValue{L: l}
+}
+
 func bytesToAttributeValue(b []byte) dynamodb.AttributeValue {
 	return dynamodb.AttributeValue{B: b}
 }
@@ -246,6 +361,17 @@ func getString(a dynamodb.AttributeValue) string {
 	return *a.S
 }
 
+func getStrings(a dynamodb.AttributeValue) []string {
+	if len(a.L) == 0 {
+		return nil
+	}
+	ss := make([]string, len(a.L))
+	for i := range a.L {
+		ss[i] = getString(a.L[i])
+	}
+	return ss
+}
+
 func getInt(a dynamodb.AttributeValue) (int, error) {
 	if a.N == nil {
 		return 0, nil
@@ -253,6 +379,13 @@ func getInt(a dynamodb.AttributeValue) (int, error) {
 	return strconv.Atoi(*a.N)
 }
 
+func getInt64(a dynamodb.AttributeValue) (int64, error) {
+	if a.N == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(*a.N, 10, 64)
+}
+
 func getBytes(a dynamodb.AttributeValue) []byte {
 	return a.B
 }
@@ -0,0 +1,32 @@
+package contender
+
+import "github.com/sbogacz/wouldyoutatter/dynamostore"
+
+// The entities lay out each kind of item in a single table shared by
+// them all, as an alternative to a table each. The keys of the items of
+// polls other than the default are namespaced by the poll, e.g.
+// CONTENDER#logos/<name>
+var (
+	// ContenderEntity keeps contenders under CONTENDER#<name>, and puts
+	// them on the leaderboard through the shared index
+	ContenderEntity = dynamostore.Entity{
+		Name: "CONTENDER",
+		Index: &dynamostore.EntityIndex{
+			Name:     leaderboardScoreIndex,
+			HashKey:  "Leaderboard",
+			RangeKey: "Score",
+		},
+	}
+	// MatchupEntity keeps head-to-head records under MATCHUP#<a>#<b>
+	MatchupEntity = dynamostore.Entity{Name: "MATCHUP"}
+	// UserMatchupsEntity keeps the matchups each user has seen under
+	// USER#<id>, sorted as SEEN
+	UserMatchupsEntity = dynamostore.Entity{Name: "USER", Sort: "SEEN"}
+	// MasterMatchupsEntity keeps every possible matchup under
+	// POSSIBLE#Master, sorted as MATCHUPS
+	MasterMatchupsEntity = dynamostore.Entity{Name: "POSSIBLE", Sort: "MATCHUPS"}
+	// TokenEntity keeps vote tokens under TOKEN#<id>
+	TokenEntity = dynamostore.Entity{Name: "TOKEN"}
+	// PollEntity keeps polls under POLL#<id>
+	PollEntity = dynamostore.Entity{Name: "POLL"}
+)
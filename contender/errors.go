@@ -0,0 +1,46 @@
+package contender
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidToken is returned when a voting token doesn't exist, has
+	// expired, or doesn't match the matchup it's being used for
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrPollClosed is returned when asking a closed poll for a matchup,
+	// or voting on one
+	ErrPollClosed = errors.New("poll is closed")
+)
+
+// ValidationError describes a model that can't be stored because one
+// of its fields is missing or malformed
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (v *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", v.Field, v.Reason)
+}
+
+// InvalidTokenError is a helper method to determine if an
+// encountered error is due to a bad voting token
+func InvalidTokenError(err error) bool {
+	return errors.Cause(err) == ErrInvalidToken
+}
+
+// PollClosedError is a helper method to determine if an
+// encountered error is due to the poll being closed
+func PollClosedError(err error) bool {
+	return errors.Cause(err) == ErrPollClosed
+}
+
+// IsValidationError is a helper method to determine if an
+// encountered error is due to an invalid model
+func IsValidationError(err error) bool {
+	_, ok := errors.Cause(err).(*ValidationError)
+	return ok
+}
@@ -17,9 +17,15 @@ type Matchup struct {
 	Contender1Wins int
 	Contender2Wins int
 	contender1Won  bool
+	// poll is the ID of the poll of the contenders
+	poll string
 }
 
-// MatchupStore uses a storer to interact with the underlying Matchup db
+// Matchups is a collection that implements Scannable
+type Matchups []Matchup
+
+// MatchupStore uses a storer to interact with the underlying Matchup db.
+// Its methods use the matchups of the poll of their context
 type MatchupStore struct {
 	db dynamostore.Storer
 }
@@ -33,12 +39,13 @@ func NewMatchupStore(db dynamostore.Storer) *MatchupStore {
 
 // Set lets you save a matchup
 func (s *MatchupStore) Set(ctx context.Context, m *Matchup) error {
+	m.poll = PollFromContext(ctx)
 	return errors.Wrap(s.db.Set(ctx, m), "failed to save matchup")
 }
 
 // Get lets you retrieve a matchup by the matchup names
 func (s *MatchupStore) Get(ctx context.Context, contender1, contender2 string) (*Matchup, error) {
-	m := &Matchup{Contender1: contender1, Contender2: contender2}
+	m := &Matchup{Contender1: contender1, Contender2: contender2, poll: PollFromContext(ctx)}
 	item, err := s.db.Get(ctx, m)
 	if err != nil {
 		if dynamostore.NotFoundError(err) {
@@ -53,14 +60,27 @@ func (s *MatchupStore) Get(ctx context.Context, contender1, contender2 string) (
 
 // Delete lets you delete a container by name
 func (s *MatchupStore) Delete(ctx context.Context, contender1, contender2 string) error {
-	m := &Matchup{Contender1: contender1, Contender2: contender2}
+	m := &Matchup{Contender1: contender1, Contender2: contender2, poll: PollFromContext(ctx)}
 
 	return errors.Wrap(s.db.Delete(ctx, m), "failed to delete matchup")
 }
 
+// DeletePollItems deletes the head-to-head records of the poll of ctx
+func (s *MatchupStore) DeletePollItems(ctx context.Context) error {
+	matchups := Matchups{}
+	return deletePollItems(ctx, s.db, &matchups, "Contender1", func() []dynamostore.Item {
+		items := make([]dynamostore.Item, len(matchups))
+		for i := range matchups {
+			items[i] = &matchups[i]
+		}
+		return items
+	})
+}
+
 // ScoreMatchup lets you declare
 func (s *MatchupStore) ScoreMatchup(ctx context.Context, winner, loser string) error {
 	scoredMatchup := newScoredMatchup(winner, loser)
+	scoredMatchup.poll = PollFromContext(ctx)
 	return errors.Wrapf(s.db.Update(ctx, scoredMatchup), "failed to score matchup between winner %s the loser %s", winner, loser)
 }
 
@@ -15,14 +15,23 @@ var _ dynamostore.Item = (*Matchup)(nil)
 
 // Key returns the Contenders name, and implements the dynamostore Item interface
 func (m Matchup) Key() string {
-	return m.Contender1 + m.Contender2
+	return pollKey(m.poll, m.Contender1) + m.Contender2
+}
+
+// key is the matchup's primary key. The hash key is namespaced by the
+// poll, which is enough to keep the polls' matchups apart
+func (m Matchup) key() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"Contender1": {S: aws.String(pollKey(m.poll, m.Contender1))},
+		"Contender2": {S: aws.String(m.Contender2)},
+	}
 }
 
 // Marshal encodes the values of a contender into the map format
 // that dynamo expects
 func (m Matchup) Marshal() map[string]dynamodb.AttributeValue {
 	return map[string]dynamodb.AttributeValue{
-		"Contender1":     stringToAttributeValue(m.Contender1),
+		"Contender1":     stringToAttributeValue(pollKey(m.poll, m.Contender1)),
 		"Contender2":     stringToAttributeValue(m.Contender2),
 		"Contender1Wins": intToAttributeValue(m.Contender1Wins),
 		"Contender2Wins": intToAttributeValue(m.Contender2Wins),
@@ -43,11 +52,13 @@ func (m *Matchup) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to read Contender2Wins attribute")
 	}
+	// the poll is the one the matchup was retrieved with
 	newMatchup := &Matchup{
-		Contender1:     getString(aMap["Contender1"]),
+		Contender1:     unpollKey(m.poll, getString(aMap["Contender1"])),
 		Contender2:     getString(aMap["Contender2"]),
 		Contender1Wins: contender1Wins,
 		Contender2Wins: contender2Wins,
+		poll:           m.poll,
 	}
 	*m = *newMatchup
 	return nil
@@ -55,7 +66,7 @@ func (m *Matchup) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 
 // CreateTableInput generates the dynamo input to create the matchups table
 func (m *Matchup) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTableInput {
-	return &dynamodb.CreateTableInput{
+	return tc.Configure(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String("Contender1"),
@@ -76,12 +87,8 @@ func (m *Matchup) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.Create
 				KeyType:       dynamodb.KeyTypeRange,
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(tc.ReadCapacity),
-			WriteCapacityUnits: aws.Int64(tc.WriteCapacity),
-		},
 		TableName: aws.String(tc.TableName),
-	}
+	})
 }
 
 // DescribeTableInput generates the query we need to describe the matchups table
@@ -100,10 +107,7 @@ func (m *Matchup) TableOptions(tableName string) []dynamostore.TableOption {
 func (m *Matchup) GetItemInput(tableName string) *dynamodb.GetItemInput {
 	return &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
-		Key: map[string]dynamodb.AttributeValue{
-			"Contender1": {S: aws.String(m.Contender1)},
-			"Contender2": {S: aws.String(m.Contender2)},
-		},
+		Key:       m.key(),
 	}
 }
 
@@ -119,10 +123,7 @@ func (m *Matchup) PutItemInput(tableName string) *dynamodb.PutItemInput {
 func (m *Matchup) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
 	return &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
-		Key: map[string]dynamodb.AttributeValue{
-			"Contender1": {S: aws.String(m.Contender1)},
-			"Contender2": {S: aws.String(m.Contender2)},
-		},
+		Key:       m.key(),
 	}
 }
 
@@ -136,11 +137,8 @@ func (m *Matchup) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
 
 func (m *Matchup) contender1WinInput(tableName string) *dynamodb.UpdateItemInput {
 	return &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]dynamodb.AttributeValue{
-			"Contender1": {S: aws.String(m.Contender1)},
-			"Contender2": {S: aws.String(m.Contender2)},
-		},
+		TableName:                 aws.String(tableName),
+		Key:                       m.key(),
 		UpdateExpression:          aws.String("ADD Contender1Wins :w, Contender2Losses :w"),
 		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":w": {N: aws.String("1")}},
 	}
@@ -148,12 +146,28 @@ func (m *Matchup) contender1WinInput(tableName string) *dynamodb.UpdateItemInput
 
 func (m *Matchup) contender2WinInput(tableName string) *dynamodb.UpdateItemInput {
 	return &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]dynamodb.AttributeValue{
-			"Contender1": {S: aws.String(m.Contender1)},
-			"Contender2": {S: aws.String(m.Contender2)},
-		},
+		TableName:                 aws.String(tableName),
+		Key:                       m.key(),
 		UpdateExpression:          aws.String("ADD Contender2Wins :w, Contender1Losses :w"),
 		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":w": {N: aws.String("1")}},
 	}
 }
+
+// ScanInput produces a dynamodb ScanInput object for the whole table
+func (m *Matchups) ScanInput(tableName string) *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// Unmarshal allows results to be unmarshalled directly into the struct
+func (m *Matchups) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	matchups := make([]Matchup, len(maps))
+	for i := range matchups {
+		if err := matchups[i].Unmarshal(maps[i]); err != nil {
+			return errors.Wrap(err, "failed to unmarshal Matchups")
+		}
+	}
+	*m = matchups
+	return nil
+}
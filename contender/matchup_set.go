@@ -17,16 +17,22 @@ const (
 
 // MatchupSet is one of the possible matchup combinations
 type MatchupSet struct {
-	ID    string
-	Set   []MatchupSetEntry
-	entry MatchupSetEntry
+	ID  string
+	Set []MatchupSetEntry
+	// entries are what an Update adds to the set, or removes from it
+	entries []MatchupSetEntry
+	remove  bool
+	// poll is the ID of the poll of the matchups
+	poll string
 }
 
+// MatchupSets is a collection that implements Scannable
+type MatchupSets []MatchupSet
+
 // MatchupSetEntry holds a possible matchup combination
 type MatchupSetEntry struct {
 	Contender1 string
 	Contender2 string
-	remove     bool
 }
 
 func newMatchupSetEntry(c1, c2 string) MatchupSetEntry {
@@ -51,7 +57,7 @@ func (m MatchupSetEntry) String() string {
 }
 
 // MatchupSetStore gives us some helpful methods for interacting
-// with the unerlying Storer
+// with the unerlying Storer. Each poll has its own sets
 type MatchupSetStore struct {
 	db dynamostore.Storer
 }
@@ -66,11 +72,10 @@ func NewMatchupSetStore(db dynamostore.Storer) *MatchupSetStore {
 // Add given a uid corresponding to the session, and two contenders, adds them to the set
 // of matchups that uid has seen
 func (s *MatchupSetStore) Add(ctx context.Context, uid, contender1, contender2 string) error {
-	newEntry := newMatchupSetEntry(contender1, contender2)
-
 	matchupSet := &MatchupSet{
-		ID:    uid,
-		entry: newEntry,
+		ID:      uid,
+		entries: []MatchupSetEntry{newMatchupSetEntry(contender1, contender2)},
+		poll:    PollFromContext(ctx),
 	}
 	if err := s.db.Update(ctx, matchupSet); err != nil {
 		return errors.Wrapf(err, "failed to update the matchup set for ID: %s", uid)
@@ -81,16 +86,11 @@ func (s *MatchupSetStore) Add(ctx context.Context, uid, contender1, contender2 s
 // Remove given a uid corresponding to the session, and two contenders, adds them to the set
 // of matchups that uid has seen
 func (s *MatchupSetStore) Remove(ctx context.Context, uid, contender1, contender2 string) error {
-	contender1, contender2 = OrderMatchup(contender1, contender2)
-	newMatchupEntry := MatchupSetEntry{
-		Contender1: contender1,
-		Contender2: contender2,
-		remove:     true,
-	}
-
 	matchupSet := &MatchupSet{
-		ID:    uid,
-		entry: newMatchupEntry,
+		ID:      uid,
+		entries: []MatchupSetEntry{newMatchupSetEntry(contender1, contender2)},
+		remove:  true,
+		poll:    PollFromContext(ctx),
 	}
 	if err := s.db.Update(ctx, matchupSet); err != nil {
 		return errors.Wrapf(err, "failed to update the matchup set for ID: %s", uid)
@@ -100,7 +100,7 @@ func (s *MatchupSetStore) Remove(ctx context.Context, uid, contender1, contender
 
 // Get lets you retrieve a contender by name
 func (s *MatchupSetStore) Get(ctx context.Context, uid string) (*MatchupSet, error) {
-	m := &MatchupSet{ID: uid}
+	m := &MatchupSet{ID: uid, poll: PollFromContext(ctx)}
 	item, err := s.db.Get(ctx, m)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to retrieve matchup set")
@@ -112,14 +112,19 @@ func (s *MatchupSetStore) Get(ctx context.Context, uid string) (*MatchupSet, err
 
 // Delete is used to restart a matchup set when it is no longer relevant
 func (s *MatchupSetStore) Delete(ctx context.Context, uid string) error {
-	if err := s.db.Delete(ctx, &MatchupSet{ID: uid}); err != nil {
+	if err := s.db.Delete(ctx, &MatchupSet{ID: uid, poll: PollFromContext(ctx)}); err != nil {
 		return errors.Wrap(err, "failed to delete matchup set")
 	}
 	return nil
 }
 
+// DeletePollItems deletes the sets of every user of the poll of ctx
+func (s *MatchupSetStore) DeletePollItems(ctx context.Context) error {
+	return deleteMatchupSets(ctx, s.db)
+}
+
 // MasterMatchupSetStore gives us some helpful methods for interacting
-// with the unerlying Storer
+// with the unerlying Storer. Each poll has its own master set
 type MasterMatchupSetStore struct {
 	db dynamostore.Storer
 }
@@ -131,63 +136,61 @@ func NewMasterMatchupSetStore(db dynamostore.Storer) *MasterMatchupSetStore {
 	}
 }
 
-// Add given a uid corresponding to the session, and two contenders, adds them to the set
-// of matchups that uid has seen
+// Add adds every matchup between the given contender and the others to
+// the master set
 func (s *MasterMatchupSetStore) Add(ctx context.Context, contender1 string, otherContenders *Contenders) error {
-	for _, contender2 := range *otherContenders {
-		// don't create dupes
-		if contender1 == contender2.Name {
-			continue
-		}
-		c1, c2 := OrderMatchup(contender1, contender2.Name)
-		newMatchupEntry := MatchupSetEntry{
-			Contender1: c1,
-			Contender2: c2,
-		}
-
-		matchupSet := &MatchupSet{
-			ID:    masterKey,
-			entry: newMatchupEntry,
-		}
-		if err := s.db.Update(ctx, matchupSet); err != nil {
-			return errors.Wrapf(err, "failed to update the matchup set for ID: %s", masterKey)
-		}
+	return s.AddAll(ctx, []string{contender1}, otherContenders)
+}
 
-	}
-	return nil
+// AddAll adds every matchup between each of the given contenders and the
+// others to the master set, with a single update
+func (s *MasterMatchupSetStore) AddAll(ctx context.Context, contenders []string, otherContenders *Contenders) error {
+	return s.update(ctx, contenders, otherContenders, false)
 }
 
-// Remove given a uid corresponding to the session, and two contenders, adds them to the set
-// of matchups that uid has seen
+// Remove removes every matchup between the given contender and the
+// others from the master set
 func (s *MasterMatchupSetStore) Remove(ctx context.Context, contender1 string, otherContenders *Contenders) error {
-
-	for _, contender2 := range *otherContenders {
-		// didn't create dupes
-		if contender1 == contender2.Name {
-			continue
-		}
-		c1, c2 := OrderMatchup(contender1, contender2.Name)
-		newMatchupEntry := MatchupSetEntry{
-			Contender1: c1,
-			Contender2: c2,
-			remove:     true,
-		}
-
-		matchupSet := &MatchupSet{
-			ID:    masterKey,
-			entry: newMatchupEntry,
-		}
-		if err := s.db.Update(ctx, matchupSet); err != nil {
-			return errors.Wrapf(err, "failed to update the matchup set for ID: %s", masterKey)
+	return s.update(ctx, []string{contender1}, otherContenders, true)
+}
+
+func (s *MasterMatchupSetStore) update(ctx context.Context, contenders []string, otherContenders *Contenders, remove bool) error {
+	seen := map[string]bool{}
+	entries := []MatchupSetEntry{}
+	for _, contender1 := range contenders {
+		for _, contender2 := range *otherContenders {
+			// don't create dupes
+			if contender1 == contender2.Name {
+				continue
+			}
+			entry := newMatchupSetEntry(contender1, contender2.Name)
+			if seen[entry.String()] {
+				continue
+			}
+			seen[entry.String()] = true
+			entries = append(entries, entry)
 		}
+	}
+	// Dynamo doesn't allow empty sets
+	if len(entries) == 0 {
+		return nil
+	}
 
+	matchupSet := &MatchupSet{
+		ID:      masterKey,
+		entries: entries,
+		remove:  remove,
+		poll:    PollFromContext(ctx),
+	}
+	if err := s.db.Update(ctx, matchupSet); err != nil {
+		return errors.Wrapf(err, "failed to update the matchup set for ID: %s", masterKey)
 	}
 	return nil
 }
 
 // Get lets you retrieve a contender by name
 func (s *MasterMatchupSetStore) Get(ctx context.Context) (*MatchupSet, error) {
-	m := &MatchupSet{ID: masterKey}
+	m := &MatchupSet{ID: masterKey, poll: PollFromContext(ctx)}
 	item, err := s.db.Get(ctx, m)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to retrieve matchup set")
@@ -196,3 +199,20 @@ func (s *MasterMatchupSetStore) Get(ctx context.Context) (*MatchupSet, error) {
 	ret := item.(*MatchupSet)
 	return ret, nil
 }
+
+// DeletePollItems deletes the master set of the poll of ctx
+func (s *MasterMatchupSetStore) DeletePollItems(ctx context.Context) error {
+	return deleteMatchupSets(ctx, s.db)
+}
+
+// deleteMatchupSets deletes the matchup sets of the poll of ctx from db
+func deleteMatchupSets(ctx context.Context, db dynamostore.Storer) error {
+	sets := MatchupSets{}
+	return deletePollItems(ctx, db, &sets, "ID", func() []dynamostore.Item {
+		items := make([]dynamostore.Item, len(sets))
+		for i := range sets {
+			items[i] = &sets[i]
+		}
+		return items
+	})
+}
@@ -11,7 +11,7 @@ var _ dynamostore.Item = (*MatchupSet)(nil)
 
 // Key returns the Contenders name, and implements the dynamostore Item interface
 func (m MatchupSet) Key() string {
-	return m.ID
+	return pollKey(m.poll, m.ID)
 }
 
 // Marshal encodes the values of a contender into the map format
@@ -22,7 +22,7 @@ func (m MatchupSet) Marshal() map[string]dynamodb.AttributeValue {
 		set = append(set, entry.String())
 	}
 	return map[string]dynamodb.AttributeValue{
-		"ID": stringToAttributeValue(m.ID),
+		"ID": stringToAttributeValue(m.Key()),
 		"MatchupSet": {
 			SS: set,
 		},
@@ -40,9 +40,11 @@ func (m *MatchupSet) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 		set = append(set, matchupEntryfromString(entry))
 	}
 
+	// the poll is the one the set was retrieved with
 	newMatchupSet := &MatchupSet{
-		ID:  getString(aMap["ID"]),
-		Set: set,
+		ID:   unpollKey(m.poll, getString(aMap["ID"])),
+		Set:  set,
+		poll: m.poll,
 	}
 	*m = *newMatchupSet
 	return nil
@@ -50,7 +52,7 @@ func (m *MatchupSet) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 
 // CreateTableInput generates the dynamo input to create the matchupSet table
 func (m *MatchupSet) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTableInput {
-	return &dynamodb.CreateTableInput{
+	return tc.Configure(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String("ID"),
@@ -63,12 +65,8 @@ func (m *MatchupSet) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.Cre
 				KeyType:       dynamodb.KeyTypeHash,
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(tc.ReadCapacity),
-			WriteCapacityUnits: aws.Int64(tc.WriteCapacity),
-		},
 		TableName: aws.String(tc.TableName),
-	}
+	})
 }
 
 // DescribeTableInput generates the query we need to describe the matchup set tables
@@ -88,7 +86,7 @@ func (m *MatchupSet) GetItemInput(tableName string) *dynamodb.GetItemInput {
 	return &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]dynamodb.AttributeValue{
-			"ID": {S: aws.String(m.ID)},
+			"ID": {S: aws.String(m.Key())},
 		},
 		ConsistentRead: aws.Bool(true),
 	}
@@ -107,28 +105,52 @@ func (m *MatchupSet) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput
 	return &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]dynamodb.AttributeValue{
-			"ID": {S: aws.String(m.ID)},
+			"ID": {S: aws.String(m.Key())},
 		},
 	}
 }
 
-// UpdateItemInput is a no-op, since we don't update the matchupSet
+// UpdateItemInput adds the pending entries to the matchupSet, or removes
+// them from it, in a single update
 func (m *MatchupSet) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
-	updateExpression := "ADD MatchupSet :c" //ADD MatchupSet :c"
-	if m.entry.remove {
+	updateExpression := "ADD MatchupSet :c"
+	if m.remove {
 		updateExpression = "DELETE MatchupSet :c"
 	}
+	entries := make([]string, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry.String())
+	}
 	return &dynamodb.UpdateItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]dynamodb.AttributeValue{
 
-			"ID": {S: aws.String(m.ID)},
+			"ID": {S: aws.String(m.Key())},
 		},
 		UpdateExpression: aws.String(updateExpression),
 		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
 			":c": {
-				SS: []string{m.entry.String()},
+				SS: entries,
 			},
 		},
 	}
 }
+
+// ScanInput produces a dynamodb ScanInput object for the whole table
+func (m *MatchupSets) ScanInput(tableName string) *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// Unmarshal allows results to be unmarshalled directly into the struct
+func (m *MatchupSets) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	sets := make([]MatchupSet, len(maps))
+	for i := range sets {
+		if err := sets[i].Unmarshal(maps[i]); err != nil {
+			return errors.Wrap(err, "failed to unmarshal MatchupSets")
+		}
+	}
+	*m = sets
+	return nil
+}
@@ -0,0 +1,211 @@
+package contender
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+)
+
+const (
+	// DefaultPoll is the ID of the poll the unscoped routes serve. Its
+	// items keep the keys they had before there were polls
+	DefaultPoll = "default"
+	// pollSeparator joins a poll's ID to the keys of its items. Neither
+	// poll IDs nor contender names can contain it
+	pollSeparator = "/"
+	// maxPollIDLength keeps poll IDs short enough to prefix keys with
+	maxPollIDLength = 64
+)
+
+var pollIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Poll is a would-you-rather game of its own, e.g. of tattoos or of
+// logos, with its own contenders, matchups and leaderboard
+type Poll struct {
+	ID          string       `json:"id"`
+	Title       string       `json:"title,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Settings    PollSettings `json:"settings"`
+}
+
+// PollSettings change how a poll is played
+type PollSettings struct {
+	// LeaderboardSize is how many contenders the leaderboard has, unless
+	// a request asks for a different number. Zero leaves it to the service
+	LeaderboardSize int `json:"leaderboard_size,omitempty"`
+	// Closed polls can still be read, but hand out no more matchups, and
+	// take no more votes
+	Closed bool `json:"closed,omitempty"`
+}
+
+// Polls is a collection that implements Scannable
+type Polls []Poll
+
+// Validate checks that the poll can be stored, and its ID used in routes
+// and to namespace the keys of its items
+func (p *Poll) Validate() error {
+	switch {
+	case p.ID == "":
+		return &ValidationError{Field: "id", Reason: "must not be empty"}
+	case len(p.ID) > maxPollIDLength:
+		return &ValidationError{Field: "id", Reason: "must be at most 64 characters"}
+	case !pollIDPattern.MatchString(p.ID):
+		return &ValidationError{Field: "id", Reason: "must be lowercase letters, digits and dashes"}
+	case p.Settings.LeaderboardSize < 0:
+		return &ValidationError{Field: "settings.leaderboard_size", Reason: "must not be negative"}
+	}
+	return nil
+}
+
+type pollContextKey struct{}
+
+// WithPoll returns a copy of ctx in which the stores read and write the
+// items of the poll with the given ID
+func WithPoll(ctx context.Context, pollID string) context.Context {
+	return context.WithValue(ctx, pollContextKey{}, pollID)
+}
+
+// PollFromContext returns the ID of the poll the stores use with ctx,
+// which is the DefaultPoll unless it was set with WithPoll
+func PollFromContext(ctx context.Context) string {
+	if pollID, ok := ctx.Value(pollContextKey{}).(string); ok && pollID != "" {
+		return pollID
+	}
+	return DefaultPoll
+}
+
+// pollKey namespaces the key of an item by its poll. Those of the
+// default poll are left as they are
+func pollKey(poll, key string) string {
+	if poll == "" || poll == DefaultPoll {
+		return key
+	}
+	return poll + pollSeparator + key
+}
+
+// unpollKey returns the key of an item without its poll's namespace
+func unpollKey(poll, key string) string {
+	if poll == "" || poll == DefaultPoll {
+		return key
+	}
+	return strings.TrimPrefix(key, poll+pollSeparator)
+}
+
+// PollItemStore is a store of items namespaced by their poll, which are
+// deleted along with it
+type PollItemStore interface {
+	// DeletePollItems deletes every item of the poll of the context
+	DeletePollItems(ctx context.Context) error
+}
+
+// PollStore uses a storer to interact with the underlying Poll db
+type PollStore struct {
+	db    dynamostore.Storer
+	items []PollItemStore
+}
+
+// NewPollStore takes a dynamodb Storer and uses it for the poll store.
+// Deleting a poll deletes its items from each of the given stores
+func NewPollStore(db dynamostore.Storer, items ...PollItemStore) *PollStore {
+	return &PollStore{
+		db:    db,
+		items: items,
+	}
+}
+
+// Create saves a new poll, and returns an error matching
+// dynamostore.ConflictError if there's already one with the same ID. The
+// default poll always exists
+func (s *PollStore) Create(ctx context.Context, p *Poll) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.ID == DefaultPoll {
+		return errors.Wrap(dynamostore.ErrConditionFailed, "the default poll already exists")
+	}
+	return errors.Wrap(s.db.Set(ctx, p, dynamostore.CreateOnly()), "failed to create poll")
+}
+
+// Get retrieves a poll by ID. The default poll has no title or settings
+// until it's updated
+func (s *PollStore) Get(ctx context.Context, id string) (*Poll, error) {
+	item, err := s.db.Get(ctx, &Poll{ID: id})
+	if err != nil {
+		if id == DefaultPoll && dynamostore.NotFoundError(err) {
+			return &Poll{ID: DefaultPoll}, nil
+		}
+		return nil, errors.Wrap(err, "failed to retrieve poll")
+	}
+	return item.(*Poll), nil
+}
+
+// Update replaces the details and settings of an existing poll. It
+// returns a not found error if there's no such poll
+func (s *PollStore) Update(ctx context.Context, p *Poll) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if _, err := s.Get(ctx, p.ID); err != nil {
+		return err
+	}
+	return errors.Wrap(s.db.Set(ctx, p), "failed to update poll")
+}
+
+// Delete deletes a poll by ID, after deleting its items from the stores
+// the PollStore was made with, so none are left where no route can reach
+// them. If that fails, the poll is kept so the delete can be retried. The
+// default poll can't be deleted
+func (s *PollStore) Delete(ctx context.Context, id string) error {
+	if id == DefaultPoll {
+		return &ValidationError{Field: "id", Reason: "the default poll can't be deleted"}
+	}
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	pollCtx := WithPoll(ctx, id)
+	for _, items := range s.items {
+		if err := items.DeletePollItems(pollCtx); err != nil {
+			return errors.Wrap(err, "failed to delete poll")
+		}
+	}
+	return errors.Wrap(s.db.Delete(ctx, &Poll{ID: id}), "failed to delete poll")
+}
+
+// GetAll retrieves every poll, including the default one, ordered by ID
+func (s *PollStore) GetAll(ctx context.Context) (*Polls, error) {
+	polls := Polls{}
+	if err := s.db.Scan(ctx, &polls); err != nil {
+		return nil, errors.Wrap(err, "failed to get all polls")
+	}
+	hasDefault := false
+	for _, p := range polls {
+		hasDefault = hasDefault || p.ID == DefaultPoll
+	}
+	if !hasDefault {
+		polls = append(polls, Poll{ID: DefaultPoll})
+	}
+	sort.Slice(polls, func(i, j int) bool { return polls[i].ID < polls[j].ID })
+	return &polls, nil
+}
+
+// deletePollItems deletes every item of the poll of ctx that scannable
+// finds in db, where keyAttribute is the attribute namespaced by the poll
+func deletePollItems(ctx context.Context, db dynamostore.Storer, scannable dynamostore.Scannable, keyAttribute string, items func() []dynamostore.Item) error {
+	poll := PollFromContext(ctx)
+	if poll == DefaultPoll {
+		return &ValidationError{Field: "id", Reason: "the default poll's items can't be deleted"}
+	}
+	if err := db.Scan(ctx, &pollItems{Scannable: scannable, poll: poll, keyAttribute: keyAttribute}); err != nil {
+		return errors.Wrapf(err, "failed to find the items of poll %s", poll)
+	}
+	for _, item := range items() {
+		if err := db.Delete(ctx, item); err != nil {
+			return errors.Wrapf(err, "failed to delete the items of poll %s", poll)
+		}
+	}
+	return nil
+}
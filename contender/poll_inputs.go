@@ -0,0 +1,152 @@
+package contender
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+)
+
+var _ dynamostore.Item = (*Poll)(nil)
+
+// Key returns the poll's ID, and implements the dynamostore Item interface
+func (p Poll) Key() string {
+	return p.ID
+}
+
+// Marshal encodes the values of a poll into the map format that dynamo
+// expects
+func (p Poll) Marshal() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"ID":              stringToAttributeValue(p.ID),
+		"Title":           stringToAttributeValue(p.Title),
+		"Description":     stringToAttributeValue(p.Description),
+		"LeaderboardSize": intToAttributeValue(p.Settings.LeaderboardSize),
+		"Closed":          boolToAttributeValue(p.Settings.Closed),
+	}
+}
+
+// Unmarshal tries to decode a Poll from a dynamo response
+func (p *Poll) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
+	if len(aMap) == 0 {
+		return errors.New(dynamodb.ErrCodeResourceNotFoundException)
+	}
+	leaderboardSize, err := getInt(aMap["LeaderboardSize"])
+	if err != nil {
+		return errors.Wrap(err, "failed to read LeaderboardSize attribute")
+	}
+	*p = Poll{
+		ID:          getString(aMap["ID"]),
+		Title:       getString(aMap["Title"]),
+		Description: getString(aMap["Description"]),
+		Settings: PollSettings{
+			LeaderboardSize: leaderboardSize,
+			Closed:          getBool(aMap["Closed"]),
+		},
+	}
+	return nil
+}
+
+// CreateTableInput generates the dynamo input to create the polls table
+func (p *Poll) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTableInput {
+	return tc.Configure(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("ID"),
+				AttributeType: dynamodb.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("ID"),
+				KeyType:       dynamodb.KeyTypeHash,
+			},
+		},
+		TableName: aws.String(tc.TableName),
+	})
+}
+
+// DescribeTableInput generates the query we need to describe the polls table
+func (p *Poll) DescribeTableInput(tableName string) *dynamodb.DescribeTableInput {
+	return &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// TableOptions is a no-op for the polls table
+func (p *Poll) TableOptions(tableName string) []dynamostore.TableOption {
+	return nil
+}
+
+// GetItemInput generates the dynamodb.GetItemInput for the given poll
+func (p *Poll) GetItemInput(tableName string) *dynamodb.GetItemInput {
+	return &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]dynamodb.AttributeValue{"ID": {S: aws.String(p.ID)}},
+	}
+}
+
+// PutItemInput generates the dynamodb.PutItemInput for the given poll
+func (p *Poll) PutItemInput(tableName string) *dynamodb.PutItemInput {
+	return &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      p.Marshal(),
+	}
+}
+
+// DeleteItemInput generates the dynamodb.DeleteItemInput for the given poll
+func (p *Poll) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
+	return &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]dynamodb.AttributeValue{"ID": {S: aws.String(p.ID)}},
+	}
+}
+
+// UpdateItemInput is unsupported, polls are replaced with Set
+func (p *Poll) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
+	return nil
+}
+
+// ScanInput produces a dynamodb ScanInput object for the whole table
+func (p *Polls) ScanInput(tableName string) *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// Unmarshal allows results to be unmarshalled directly into the struct
+func (p *Polls) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	polls := make([]Poll, len(maps))
+	for i := range polls {
+		if err := polls[i].Unmarshal(maps[i]); err != nil {
+			return errors.Wrap(err, "failed to unmarshal Polls")
+		}
+	}
+	*p = polls
+	return nil
+}
+
+func boolToAttributeValue(b bool) dynamodb.AttributeValue {
+	return dynamodb.AttributeValue{BOOL: aws.Bool(b)}
+}
+
+func getBool(a dynamodb.AttributeValue) bool {
+	return aws.BoolValue(a.BOOL)
+}
+
+// pollItems scans for the items of a poll other than the default one,
+// whose keys all start with the poll's namespace. The items keep their
+// namespaced keys, which is all that deleting them needs
+type pollItems struct {
+	dynamostore.Scannable
+	poll         string
+	keyAttribute string
+}
+
+func (p *pollItems) ScanInput(tableName string) *dynamodb.ScanInput {
+	input := p.Scannable.ScanInput(tableName)
+	input.FilterExpression = aws.String("begins_with(#key, :poll)")
+	input.ExpressionAttributeNames = map[string]string{"#key": p.keyAttribute}
+	input.ExpressionAttributeValues = map[string]dynamodb.AttributeValue{":poll": stringToAttributeValue(p.poll + pollSeparator)}
+	return input
+}
@@ -16,9 +16,15 @@ type Token struct {
 	Contender1 string
 	Contender2 string
 	ExpireAt   int64
+	// poll is the ID of the poll of the matchup
+	poll string
 }
 
-// TokenStore gives us some nicer typed access to the DB
+// Tokens is a collection that implements Scannable
+type Tokens []Token
+
+// TokenStore gives us some nicer typed access to the DB. Tokens are only
+// valid in the poll they were created in
 type TokenStore struct {
 	db dynamostore.Storer
 }
@@ -43,6 +49,7 @@ func (s *TokenStore) CreateToken(ctx context.Context, contender1, contender2 str
 		Contender1: contender1,
 		Contender2: contender2,
 		ExpireAt:   time.Now().Add(time.Hour * 24).Unix(),
+		poll:       PollFromContext(ctx),
 	}
 	if err := s.db.Set(ctx, t); err != nil {
 		return nil, errors.Wrap(err, "failed to create token")
@@ -53,8 +60,11 @@ func (s *TokenStore) CreateToken(ctx context.Context, contender1, contender2 str
 // ValidateToken checks to see whether a given token is still valid for the given matchup
 func (s *TokenStore) ValidateToken(ctx context.Context, uid, contender1, contender2 string) (bool, error) {
 
-	item, err := s.db.Get(ctx, &Token{ID: uid})
+	item, err := s.db.Get(ctx, &Token{ID: uid, poll: PollFromContext(ctx)})
 	if err != nil {
+		if dynamostore.NotFoundError(err) {
+			return false, ErrInvalidToken
+		}
 		return false, errors.Wrap(err, "failed to validate token against the db")
 	}
 
@@ -74,12 +84,24 @@ func (s *TokenStore) ValidateToken(ctx context.Context, uid, contender1, contend
 
 // InvalidateToken is used for explicit token invalidation (like when the token is used)
 func (s *TokenStore) InvalidateToken(ctx context.Context, uid string) error {
-	if err := s.db.Delete(ctx, &Token{ID: uid}); err != nil {
+	if err := s.db.Delete(ctx, &Token{ID: uid, poll: PollFromContext(ctx)}); err != nil {
 		return errors.Wrap(err, "failed to invalidate token")
 	}
 	return nil
 }
 
+// DeletePollItems deletes the unused tokens of the poll of ctx
+func (s *TokenStore) DeletePollItems(ctx context.Context) error {
+	tokens := Tokens{}
+	return deletePollItems(ctx, s.db, &tokens, "ID", func() []dynamostore.Item {
+		items := make([]dynamostore.Item, len(tokens))
+		for i := range tokens {
+			items[i] = &tokens[i]
+		}
+		return items
+	})
+}
+
 // TokenTableConfig allows us to set configuration details
 // for the dynamo table from the app
 type TokenTableConfig struct {
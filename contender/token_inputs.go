@@ -11,14 +11,14 @@ var _ dynamostore.Item = (*Token)(nil)
 
 // Key returns the Contenders name, and implements the dynamostore Item interface
 func (t Token) Key() string {
-	return t.ID
+	return pollKey(t.poll, t.ID)
 }
 
 // Marshal encodes the values of a contender into the map format
 // that dynamo expects
 func (t Token) Marshal() map[string]dynamodb.AttributeValue {
 	return map[string]dynamodb.AttributeValue{
-		"ID":         stringToAttributeValue(t.ID),
+		"ID":         stringToAttributeValue(t.Key()),
 		"Contender1": stringToAttributeValue(t.Contender1),
 		"Contender2": stringToAttributeValue(t.Contender2),
 		"ExpireAt":   int64ToAttributeValue(t.ExpireAt),
@@ -30,10 +30,17 @@ func (t *Token) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 	if len(aMap) == 0 {
 		return errors.New(dynamodb.ErrCodeResourceNotFoundException)
 	}
+	expireAt, err := getInt64(aMap["ExpireAt"])
+	if err != nil {
+		return errors.Wrap(err, "failed to read ExpireAt attribute")
+	}
+	// the poll is the one the token was retrieved with
 	newToken := &Token{
-		ID:         getString(aMap["ID"]),
+		ID:         unpollKey(t.poll, getString(aMap["ID"])),
 		Contender1: getString(aMap["Contender1"]),
 		Contender2: getString(aMap["Contender2"]),
+		ExpireAt:   expireAt,
+		poll:       t.poll,
 	}
 	*t = *newToken
 	return nil
@@ -41,7 +48,7 @@ func (t *Token) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
 
 // CreateTableInput generates the dynamo input to create the token table
 func (t *Token) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTableInput {
-	return &dynamodb.CreateTableInput{
+	return tc.Configure(&dynamodb.CreateTableInput{
 		AttributeDefinitions: []dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String("ID"),
@@ -54,12 +61,8 @@ func (t *Token) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTa
 				KeyType:       dynamodb.KeyTypeHash,
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(tc.ReadCapacity),
-			WriteCapacityUnits: aws.Int64(tc.WriteCapacity),
-		},
 		TableName: aws.String(tc.TableName),
-	}
+	})
 }
 
 // DescribeTableInput generates the query we need to describe the token table
@@ -74,7 +77,7 @@ func (t *Token) GetItemInput(tableName string) *dynamodb.GetItemInput {
 	return &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]dynamodb.AttributeValue{
-			"ID": {S: aws.String(t.ID)},
+			"ID": {S: aws.String(t.Key())},
 		},
 	}
 }
@@ -92,7 +95,7 @@ func (t *Token) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
 	return &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]dynamodb.AttributeValue{
-			"ID": {S: aws.String(t.ID)},
+			"ID": {S: aws.String(t.Key())},
 		},
 	}
 }
@@ -118,3 +121,22 @@ func (t *Token) updateTimeToLiveInput(tableName string) *dynamodb.UpdateTimeToLi
 		},
 	}
 }
+
+// ScanInput produces a dynamodb ScanInput object for the whole table
+func (t *Tokens) ScanInput(tableName string) *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// Unmarshal allows results to be unmarshalled directly into the struct
+func (t *Tokens) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	tokens := make([]Token, len(maps))
+	for i := range tokens {
+		if err := tokens[i].Unmarshal(maps[i]); err != nil {
+			return errors.Wrap(err, "failed to unmarshal Tokens")
+		}
+	}
+	*t = tokens
+	return nil
+}
@@ -0,0 +1,356 @@
+package dynamostore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+const (
+	// DefaultCacheTTL is how long items are cached, if the CacheConfig
+	// doesn't say
+	DefaultCacheTTL = time.Minute
+	// DefaultCacheQueryTTL is how long query results are cached, if the
+	// CacheConfig doesn't say
+	DefaultCacheQueryTTL = 5 * time.Second
+)
+
+// Cache keeps values by key, for up to a TTL. A TTL of 0 keeps the value
+// until it's deleted or evicted
+type Cache interface {
+	// Get returns the value of the key, and whether there was one
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// CacheMetrics is told about the hits and misses of a cached table's
+// reads, so they can be counted
+type CacheMetrics interface {
+	Hit(table, operation string)
+	Miss(table, operation string)
+}
+
+// CacheConfig controls how a Storer's reads are cached
+type CacheConfig struct {
+	// Prefix namespaces the table's keys in the cache, so tables, or
+	// services, can share one
+	Prefix string
+	// TTL is how long items read with Get and BatchGet are cached
+	TTL time.Duration
+	// QueryTTL is how long query results are cached. Every write to the
+	// table invalidates them too, but it bounds how stale they get when
+	// the writes come from elsewhere
+	QueryTTL time.Duration
+	// Metrics is told about hits and misses. If it's nil, they're counted
+	// in expvar
+	Metrics CacheMetrics
+}
+
+func (c CacheConfig) withDefaults() CacheConfig {
+	if c.TTL <= 0 {
+		c.TTL = DefaultCacheTTL
+	}
+	if c.QueryTTL <= 0 {
+		c.QueryTTL = DefaultCacheQueryTTL
+	}
+	if c.Metrics == nil {
+		c.Metrics = defaultCacheMetrics
+	}
+	return c
+}
+
+// WithCache returns a Storer which reads items and query results through
+// the cache, and only goes to db for those it doesn't have. Writes go
+// straight to db, and then invalidate the item and every cached query
+// result of the table. Scans aren't cached. If the cache fails, reads
+// fall back to db
+func WithCache(db Storer, cache Cache, c CacheConfig) Storer {
+	return &cachedStore{
+		Storer: db,
+		cache:  cache,
+		c:      c.withDefaults(),
+	}
+}
+
+type cachedStore struct {
+	Storer
+	cache Cache
+	c     CacheConfig
+}
+
+func (s *cachedStore) itemKey(item Item) string {
+	return s.c.Prefix + ":item:" + item.Key()
+}
+
+// versionKey holds the version of the item's cached value. Writes replace
+// it, so a read that started before one can tell, and not cache what it
+// read
+func (s *cachedStore) versionKey(item Item) string {
+	return s.c.Prefix + ":version:" + item.Key()
+}
+
+// generationKey holds the generation of the table's query results. Writes
+// replace it, which orphans the results cached under the old one
+func (s *cachedStore) generationKey() string {
+	return s.c.Prefix + ":generation"
+}
+
+// Get returns the cached item, or gets it from db and caches it
+func (s *cachedStore) Get(ctx context.Context, item Item) (Item, error) {
+	if item.Key() == "" {
+		return s.Storer.Get(ctx, item)
+	}
+	key := s.itemKey(item)
+	if aMap, ok := s.read(ctx, key); ok {
+		if err := item.Unmarshal(aMap); err == nil {
+			s.c.Metrics.Hit(s.c.Prefix, "Get")
+			return item, nil
+		}
+	}
+	s.c.Metrics.Miss(s.c.Prefix, "Get")
+
+	version := s.version(ctx, item)
+	found, err := s.Storer.Get(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+	s.fill(ctx, found, version)
+	return found, nil
+}
+
+// BatchGet returns the cached items, and gets the rest from db together
+func (s *cachedStore) BatchGet(ctx context.Context, items []Item) ([]Item, error) {
+	found := map[string]Item{}
+	var misses []Item
+	versions := map[string][]byte{}
+	for _, item := range items {
+		if _, ok := found[item.Key()]; ok || item.Key() == "" {
+			continue
+		}
+		if aMap, ok := s.read(ctx, s.itemKey(item)); ok && item.Unmarshal(aMap) == nil {
+			s.c.Metrics.Hit(s.c.Prefix, "BatchGet")
+			found[item.Key()] = item
+			continue
+		}
+		s.c.Metrics.Miss(s.c.Prefix, "BatchGet")
+		versions[item.Key()] = s.version(ctx, item)
+		misses = append(misses, item)
+	}
+	if len(misses) > 0 {
+		got, err := s.Storer.BatchGet(ctx, misses)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range got {
+			found[item.Key()] = item
+			s.fill(ctx, item, versions[item.Key()])
+		}
+	}
+
+	ret := make([]Item, 0, len(found))
+	returned := map[string]bool{}
+	for _, item := range items {
+		if f, ok := found[item.Key()]; ok && !returned[item.Key()] {
+			returned[item.Key()] = true
+			ret = append(ret, f)
+		}
+	}
+	return ret, nil
+}
+
+// Query returns the cached results of the same query, or runs it on db
+// and caches its results
+func (s *cachedStore) Query(ctx context.Context, items Queryable, limit int) error {
+	key, ok := s.queryKey(ctx, items, limit)
+	if ok {
+		if cached, hit, err := s.cache.Get(ctx, key); err != nil {
+			s.logError(ctx, err, "read query results")
+		} else if hit {
+			var maps []map[string]dynamodb.AttributeValue
+			if err := json.Unmarshal(cached, &maps); err == nil {
+				s.c.Metrics.Hit(s.c.Prefix, "Query")
+				return items.Unmarshal(maps)
+			}
+		}
+	}
+	s.c.Metrics.Miss(s.c.Prefix, "Query")
+
+	recorder := &queryRecorder{Queryable: items}
+	if err := s.Storer.Query(ctx, recorder, limit); err != nil {
+		return err
+	}
+	if ok {
+		if b, err := json.Marshal(recorder.maps); err == nil {
+			if err := s.cache.Set(ctx, key, b, s.c.QueryTTL); err != nil {
+				s.logError(ctx, err, "cache query results")
+			}
+		}
+	}
+	return nil
+}
+
+// queryKey returns the key of the query's results in the current
+// generation, or false if it can't be found
+func (s *cachedStore) queryKey(ctx context.Context, items Queryable, limit int) (string, bool) {
+	generation, ok, err := s.cache.Get(ctx, s.generationKey())
+	if err != nil {
+		s.logError(ctx, err, "read generation")
+		return "", false
+	}
+	if !ok {
+		generation = newGeneration()
+		if err := s.cache.Set(ctx, s.generationKey(), generation, 0); err != nil {
+			s.logError(ctx, err, "start generation")
+			return "", false
+		}
+	}
+	input, err := json.Marshal(items.QueryInput(s.c.Prefix, limit))
+	if err != nil {
+		return "", false
+	}
+	sum := sha1.Sum(input)
+	return fmt.Sprintf("%s:query:%s:%s", s.c.Prefix, generation, hex.EncodeToString(sum[:])), true
+}
+
+// Set saves the item, and invalidates it
+func (s *cachedStore) Set(ctx context.Context, item Item, opts ...WriteOption) error {
+	defer s.invalidate(ctx, item)
+	return s.Storer.Set(ctx, item, opts...)
+}
+
+// BatchSet saves the items, and invalidates them
+func (s *cachedStore) BatchSet(ctx context.Context, items []Item) error {
+	defer s.invalidate(ctx, items...)
+	return s.Storer.BatchSet(ctx, items)
+}
+
+// Update updates the item, and invalidates it
+func (s *cachedStore) Update(ctx context.Context, item Item, opts ...WriteOption) error {
+	defer s.invalidate(ctx, item)
+	return s.Storer.Update(ctx, item, opts...)
+}
+
+// Delete deletes the item, and invalidates it
+func (s *cachedStore) Delete(ctx context.Context, item Item, opts ...WriteOption) error {
+	defer s.invalidate(ctx, item)
+	return s.Storer.Delete(ctx, item, opts...)
+}
+
+// invalidate replaces the versions of the items, drops them, and starts a
+// new generation of query results. It's done whether or not the write
+// succeeded, since a failed write can mean the cached item was stale. The
+// versions are replaced before the items are dropped, so a read racing
+// with the write can only cache what it read if it does so between
+// checking the version and filling
+func (s *cachedStore) invalidate(ctx context.Context, items ...Item) {
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		if err := s.cache.Set(ctx, s.versionKey(item), newGeneration(), s.c.TTL); err != nil {
+			s.logError(ctx, err, "replace item version")
+		}
+		keys = append(keys, s.itemKey(item))
+	}
+	if err := s.cache.Delete(ctx, keys...); err != nil {
+		s.logError(ctx, err, "invalidate items")
+	}
+	if err := s.cache.Set(ctx, s.generationKey(), newGeneration(), 0); err != nil {
+		s.logError(ctx, err, "invalidate query results")
+	}
+}
+
+// read returns the attributes cached under the key, if there are any
+func (s *cachedStore) read(ctx context.Context, key string) (map[string]dynamodb.AttributeValue, bool) {
+	b, ok, err := s.cache.Get(ctx, key)
+	if err != nil {
+		s.logError(ctx, err, "read item")
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	aMap := map[string]dynamodb.AttributeValue{}
+	if err := json.Unmarshal(b, &aMap); err != nil {
+		return nil, false
+	}
+	return aMap, true
+}
+
+// version returns the version of the item's cached value, which is nil if
+// it hasn't been written lately
+func (s *cachedStore) version(ctx context.Context, item Item) []byte {
+	version, _, err := s.cache.Get(ctx, s.versionKey(item))
+	if err != nil {
+		s.logError(ctx, err, "read item version")
+	}
+	return version
+}
+
+// fill caches the item read from db, unless it's been written since its
+// version was read, since what was read may be older than the write
+func (s *cachedStore) fill(ctx context.Context, item Item, version []byte) {
+	current, _, err := s.cache.Get(ctx, s.versionKey(item))
+	if err != nil {
+		s.logError(ctx, err, "read item version")
+		return
+	}
+	if !bytes.Equal(version, current) {
+		return
+	}
+	b, err := json.Marshal(item.Marshal())
+	if err != nil {
+		return
+	}
+	if err := s.cache.Set(ctx, s.itemKey(item), b, s.c.TTL); err != nil {
+		s.logError(ctx, err, "cache item")
+	}
+}
+
+func (s *cachedStore) logError(ctx context.Context, err error, action string) {
+	logging.FromContext(ctx).WithError(err).WithField("table", s.c.Prefix).Warnf("failed to %s", action)
+}
+
+func newGeneration() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// queryRecorder keeps the attributes of a query's results, as they're
+// unmarshalled
+type queryRecorder struct {
+	Queryable
+	maps []map[string]dynamodb.AttributeValue
+}
+
+func (r *queryRecorder) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	r.maps = maps
+	return r.Queryable.Unmarshal(maps)
+}
+
+// expvarCacheMetrics counts hits and misses in expvar maps, keyed by
+// table and operation, e.g. "Contenders.Get"
+type expvarCacheMetrics struct {
+	hits   *expvar.Map
+	misses *expvar.Map
+}
+
+var defaultCacheMetrics = &expvarCacheMetrics{
+	hits:   expvar.NewMap("dynamostore_cache_hits"),
+	misses: expvar.NewMap("dynamostore_cache_misses"),
+}
+
+func (m *expvarCacheMetrics) Hit(table, operation string) {
+	m.hits.Add(table+"."+operation, 1)
+}
+
+func (m *expvarCacheMetrics) Miss(table, operation string) {
+	m.misses.Add(table+"."+operation, 1)
+}
@@ -0,0 +1,284 @@
+package dynamostore_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the reads that reach the store
+type countingStore struct {
+	dynamostore.Storer
+	gets, batchGets, queries int
+}
+
+func (s *countingStore) Get(ctx context.Context, item dynamostore.Item) (dynamostore.Item, error) {
+	s.gets++
+	return s.Storer.Get(ctx, item)
+}
+
+func (s *countingStore) BatchGet(ctx context.Context, items []dynamostore.Item) ([]dynamostore.Item, error) {
+	s.batchGets++
+	return s.Storer.BatchGet(ctx, items)
+}
+
+func (s *countingStore) Query(ctx context.Context, items dynamostore.Queryable, limit int) error {
+	s.queries++
+	return s.Storer.Query(ctx, items, limit)
+}
+
+type countingCacheMetrics struct {
+	hits, misses int
+}
+
+func (m *countingCacheMetrics) Hit(table, operation string)  { m.hits++ }
+func (m *countingCacheMetrics) Miss(table, operation string) { m.misses++ }
+
+func TestCachedStore(t *testing.T) {
+	caches := map[string]func(t *testing.T) dynamostore.Cache{
+		"lru": func(t *testing.T) dynamostore.Cache {
+			return dynamostore.NewLRUCache(100)
+		},
+		"redis": func(t *testing.T) dynamostore.Cache {
+			r := dynamostore.NewRedisCache(dynamostore.RedisConfig{Addr: redisAddr(t)})
+			t.Cleanup(func() { r.Close() })
+			return r
+		},
+	}
+	for name, newCache := range caches {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			db := &countingStore{Storer: dynamostore.NewInMemoryStore()}
+			metrics := &countingCacheMetrics{}
+			prefix := fmt.Sprintf("Contenders-%d", time.Now().UnixNano())
+			contenders := contender.NewStore(dynamostore.WithCache(db, newCache(t), dynamostore.CacheConfig{
+				Prefix:  prefix,
+				Metrics: metrics,
+			}))
+			for _, name := range []string{"bear", "cat", "dog"} {
+				require.NoError(t, contenders.Create(ctx, &contender.Contender{Name: name, SVG: []byte("<svg/>")}))
+			}
+
+			t.Run("gets are read through", func(t *testing.T) {
+				for i := 0; i < 2; i++ {
+					cat, err := contenders.Get(ctx, "cat")
+					require.NoError(t, err)
+					assert.Equal(t, []byte("<svg/>"), cat.SVG)
+				}
+				assert.Equal(t, 1, db.gets)
+				assert.Equal(t, 1, metrics.hits)
+
+				many, err := contenders.GetMany(ctx, []string{"cat", "dog", "fox"})
+				require.NoError(t, err)
+				assert.Len(t, many, 2)
+				many, err = contenders.GetMany(ctx, []string{"cat", "dog"})
+				require.NoError(t, err)
+				assert.Len(t, many, 2)
+				assert.Equal(t, 1, db.batchGets, "only the first should have missed")
+			})
+			t.Run("writes invalidate items", func(t *testing.T) {
+				require.NoError(t, contenders.DeclareWinner(ctx, "cat"))
+				cat, err := contenders.Get(ctx, "cat")
+				require.NoError(t, err)
+				assert.Equal(t, 1, cat.Wins)
+				assert.Equal(t, 2, db.gets)
+			})
+			t.Run("writes invalidate queries", func(t *testing.T) {
+				leaders := func() []string {
+					leaderboard, err := contenders.GetLeaderboard(ctx, 3)
+					require.NoError(t, err)
+					names := []string{}
+					for _, c := range *leaderboard {
+						names = append(names, c.Name)
+					}
+					return names
+				}
+				assert.Equal(t, "cat", leaders()[0])
+				assert.Equal(t, "cat", leaders()[0])
+				assert.Equal(t, 1, db.queries)
+
+				require.NoError(t, contenders.DeclareWinner(ctx, "dog"))
+				require.NoError(t, contenders.DeclareWinner(ctx, "dog"))
+				assert.Equal(t, "dog", leaders()[0])
+				assert.Equal(t, 2, db.queries)
+			})
+			t.Run("deletes invalidate items", func(t *testing.T) {
+				require.NoError(t, contenders.Delete(ctx, "bear"))
+				_, err := contenders.Get(ctx, "bear")
+				assert.True(t, dynamostore.NotFoundError(err))
+			})
+		})
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	cache := dynamostore.NewLRUCache(2)
+
+	require.NoError(t, cache.Set(ctx, "a", []byte("1"), 0))
+	require.NoError(t, cache.Set(ctx, "b", []byte("2"), 0))
+	_, ok, _ := cache.Get(ctx, "a")
+	assert.True(t, ok)
+	require.NoError(t, cache.Set(ctx, "c", []byte("3"), 0))
+	_, ok, _ = cache.Get(ctx, "b")
+	assert.False(t, ok, "b was least recently used")
+	assert.Equal(t, 2, cache.Len())
+
+	require.NoError(t, cache.Set(ctx, "a", []byte("1"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, ok, _ = cache.Get(ctx, "a")
+	assert.False(t, ok, "a should have expired")
+
+	require.NoError(t, cache.Delete(ctx, "c", "missing"))
+	assert.Equal(t, 0, cache.Len())
+}
+
+// redisAddr returns REDIS_ADDR if it's set, and otherwise the address of
+// a fake server, which only knows GET, SET and DEL
+func redisAddr(t *testing.T) string {
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	var lock sync.Mutex
+	values := map[string]string{}
+	expiry := map[string]time.Time{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					lock.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "GET":
+						v, ok := values[args[1]]
+						if e, expires := expiry[args[1]]; expires && time.Now().After(e) {
+							ok = false
+						}
+						if ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+						} else {
+							fmt.Fprint(conn, "$-1\r\n")
+						}
+					case "SET":
+						values[args[1]] = args[2]
+						delete(expiry, args[1])
+						if len(args) == 5 {
+							ms, _ := strconv.Atoi(args[4])
+							expiry[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+						}
+						fmt.Fprint(conn, "+OK\r\n")
+					case "DEL":
+						for _, key := range args[1:] {
+							delete(values, key)
+						}
+						fmt.Fprintf(conn, ":%d\r\n", len(args)-1)
+					default:
+						fmt.Fprintf(conn, "-ERR unknown command %s\r\n", args[0])
+					}
+					lock.Unlock()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// racingStore writes through the cached store in the middle of a read, as
+// if another request's write landed while the read was on its way back
+type racingStore struct {
+	dynamostore.Storer
+	during func()
+}
+
+func (s *racingStore) Get(ctx context.Context, item dynamostore.Item) (dynamostore.Item, error) {
+	found, err := s.Storer.Get(ctx, item)
+	if s.during != nil {
+		during := s.during
+		s.during = nil
+		during()
+	}
+	return found, err
+}
+
+func (s *racingStore) BatchGet(ctx context.Context, items []dynamostore.Item) ([]dynamostore.Item, error) {
+	found, err := s.Storer.BatchGet(ctx, items)
+	if s.during != nil {
+		during := s.during
+		s.during = nil
+		during()
+	}
+	return found, err
+}
+
+func TestCachedStoreSkipsFillsRacingWrites(t *testing.T) {
+	ctx := context.Background()
+	db := &racingStore{Storer: dynamostore.NewInMemoryStore()}
+	contenders := contender.NewStore(dynamostore.WithCache(db, dynamostore.NewLRUCache(100), dynamostore.CacheConfig{
+		Prefix:  "racing",
+		Metrics: &countingCacheMetrics{},
+	}))
+	for _, name := range []string{"cat", "dog"} {
+		require.NoError(t, contenders.Create(ctx, &contender.Contender{Name: name, SVG: []byte("<svg/>")}))
+	}
+
+	db.during = func() { require.NoError(t, contenders.DeclareWinner(ctx, "cat")) }
+	cat, err := contenders.Get(ctx, "cat")
+	require.NoError(t, err)
+	assert.Equal(t, 0, cat.Wins, "the read started before the win")
+	cat, err = contenders.Get(ctx, "cat")
+	require.NoError(t, err)
+	assert.Equal(t, 1, cat.Wins, "the stale read shouldn't have been cached")
+
+	db.during = func() { require.NoError(t, contenders.DeclareWinner(ctx, "dog")) }
+	_, err = contenders.GetMany(ctx, []string{"cat", "dog"})
+	require.NoError(t, err)
+	many, err := contenders.GetMany(ctx, []string{"cat", "dog"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, many["dog"].Wins, "the stale read shouldn't have been cached")
+}
@@ -0,0 +1,186 @@
+package dynamostore
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+// WriteOption adds a condition to a Set, Update or Delete
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	createOnly bool
+	exists     bool
+	version    *int64
+}
+
+// CreateOnly makes a write fail with ErrConditionFailed if the item
+// already exists
+func CreateOnly() WriteOption {
+	return func(o *writeOptions) {
+		o.createOnly = true
+	}
+}
+
+// IfExists makes a write fail with ErrConditionFailed unless the item
+// already exists
+func IfExists() WriteOption {
+	return func(o *writeOptions) {
+		o.exists = true
+	}
+}
+
+// IfVersion makes a write fail with ErrConditionFailed unless the stored
+// item is at the given version. The item must be Versioned
+func IfVersion(version int64) WriteOption {
+	return func(o *writeOptions) {
+		o.version = &version
+	}
+}
+
+// condition is a condition expression, along with the names and values
+// it refers to
+type condition struct {
+	expression *string
+	names      map[string]string
+	values     map[string]dynamodb.AttributeValue
+}
+
+// buildCondition combines the condition of the item's own input with
+// those of the options, e.g. "attribute_exists(#n) AND #v = :v". The
+// names and values are those of the input, with any the options need
+// added, since an update expression shares them
+func buildCondition(item Item, own condition, opts []WriteOption) (condition, error) {
+	o := &writeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	terms := []string{}
+	if own.expression != nil && *own.expression != "" {
+		terms = append(terms, *own.expression)
+	}
+	c := condition{
+		names:  copyNames(own.names),
+		values: copyAttributes(own.values),
+	}
+	if o.createOnly {
+		for name := range item.GetItemInput("").Key {
+			c.names["#createOnlyKey"] = name
+			terms = append(terms, "attribute_not_exists(#createOnlyKey)")
+			break
+		}
+	}
+	if o.exists {
+		for name := range item.GetItemInput("").Key {
+			c.names["#existsKey"] = name
+			terms = append(terms, "attribute_exists(#existsKey)")
+			break
+		}
+	}
+	if o.version != nil {
+		versioned, ok := item.(Versioned)
+		if !ok || versioned.VersionAttribute() == "" {
+			return condition{}, errors.Errorf("item %s doesn't have a version", item.Key())
+		}
+		c.names["#expectedVersion"] = versioned.VersionAttribute()
+		if *o.version == 0 {
+			// items saved before they had versions don't have the attribute
+			terms = append(terms, "attribute_not_exists(#expectedVersion)")
+		} else {
+			c.values[":expectedVersion"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(*o.version, 10))}
+			terms = append(terms, "#expectedVersion = :expectedVersion")
+		}
+	}
+
+	if len(terms) > 0 {
+		c.expression = aws.String(strings.Join(terms, " AND "))
+	}
+	if len(c.names) == 0 {
+		c.names = nil
+	}
+	if len(c.values) == 0 {
+		c.values = nil
+	}
+	return c, nil
+}
+
+// evaluateCondition supports the conditions we use, joined by AND:
+// attribute_exists(a), attribute_not_exists(a), begins_with(a, :v) and
+// a = :v. The item is nil if it doesn't exist
+func evaluateCondition(item map[string]dynamodb.AttributeValue, c condition) (bool, error) {
+	if c.expression == nil {
+		return true, nil
+	}
+	resolve := func(name string) string {
+		if resolved, ok := c.names[name]; ok {
+			return resolved
+		}
+		return name
+	}
+	for _, term := range strings.Split(*c.expression, " AND ") {
+		term = strings.TrimSpace(term)
+		switch {
+		case strings.HasPrefix(term, "attribute_exists(") && strings.HasSuffix(term, ")"):
+			name := resolve(strings.TrimSuffix(strings.TrimPrefix(term, "attribute_exists("), ")"))
+			if _, ok := item[name]; !ok {
+				return false, nil
+			}
+		case strings.HasPrefix(term, "attribute_not_exists(") && strings.HasSuffix(term, ")"):
+			name := resolve(strings.TrimSuffix(strings.TrimPrefix(term, "attribute_not_exists("), ")"))
+			if _, ok := item[name]; ok {
+				return false, nil
+			}
+		case strings.HasPrefix(term, "begins_with(") && strings.HasSuffix(term, ")"):
+			args := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(term, "begins_with("), ")"), ",", 2)
+			if len(args) != 2 {
+				return false, errors.Errorf("unsupported condition: %s", term)
+			}
+			val, ok := c.values[strings.TrimSpace(args[1])]
+			if !ok || val.S == nil {
+				return false, errors.Errorf("missing string value for condition: %s", term)
+			}
+			attr := item[resolve(strings.TrimSpace(args[0]))]
+			if attr.S == nil || !strings.HasPrefix(*attr.S, *val.S) {
+				return false, nil
+			}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			val, ok := c.values[strings.TrimSpace(parts[1])]
+			if !ok {
+				return false, errors.Errorf("missing value for condition: %s", term)
+			}
+			if !attributesEqual(item[resolve(strings.TrimSpace(parts[0]))], val) {
+				return false, nil
+			}
+		default:
+			return false, errors.Errorf("unsupported condition: %s", term)
+		}
+	}
+	return true, nil
+}
+
+// checkBatchable rejects items we can't save with BatchSet: those without
+// a key, and those whose puts have a condition, since BatchWriteItem has
+// nowhere to send it
+func checkBatchable(item Item) error {
+	if item.Key() == "" {
+		return errors.New("must provide a non-empty name")
+	}
+	if input := item.PutItemInput(""); input != nil && input.ConditionExpression != nil && *input.ConditionExpression != "" {
+		return errors.Errorf("item %s has a condition, which can't be checked in a batch", item.Key())
+	}
+	return nil
+}
+
+func copyNames(m map[string]string) map[string]string {
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
@@ -2,18 +2,29 @@ package dynamostore
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
+	"github.com/sbogacz/wouldyoutatter/logging"
 )
 
 type retryKey string
 
 const (
+	// rKey counts how many times an operation has been restarted after
+	// creating its table, which happens at most maxRetries times
 	rKey       retryKey = "retries"
 	maxRetries          = 2
+
+	// batchWriteSize is the most items a BatchWriteItem request can take
+	batchWriteSize = 25
+	// batchGetSize is the most keys a BatchGetItem request can take
+	batchGetSize = 100
 )
 
 type dynamoStore struct {
@@ -35,7 +46,7 @@ func New(d *dynamodb.DynamoDB, c *TableConfig) Storer {
 }
 
 // Set takes a Item and tries to save it to Dynamo
-func (s *dynamoStore) Set(ctx context.Context, item Item) error {
+func (s *dynamoStore) Set(ctx context.Context, item Item, opts ...WriteOption) error {
 	var (
 		numRetries int
 		ok         bool
@@ -49,36 +60,275 @@ func (s *dynamoStore) Set(ctx context.Context, item Item) error {
 		return errors.New("must provide a non-empty name")
 	}
 
-	s.lock.RLock()
 	input := item.PutItemInput(s.c.TableName)
-	req := s.dynamo.PutItemRequest(input)
-
-	if _, err := req.Send(); err != nil {
-		s.lock.RUnlock()
+	cond, err := buildCondition(item, condition{input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}, opts)
+	if err != nil {
+		return err
+	}
+	input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues = cond.expression, cond.names, cond.values
+
+	err = s.retry(ctx, "Set", func(ctx context.Context) error {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		req := s.dynamo.PutItemRequest(input)
+		req.SetContext(ctx)
+		_, err := req.Send()
+		return err
+	})
+	if err != nil {
+		if ConflictError(err) {
+			return errors.Wrapf(ErrConditionFailed, "failed to write Item %s to the database", item.Key())
+		}
+		if numRetries >= maxRetries || !TableNotFoundError(err) {
+			logging.FromContext(ctx).WithField("num_retries", numRetries).WithError(err).Error("failed to set item")
+			return errors.Wrapf(err, "failed to write Item %s to the database", item.Key())
+		}
 		if createTableErr := s.createTableOnError(ctx, item, err); createTableErr != nil {
-			log.WithField("num_retries", numRetries).WithError(err).Error("failed to set item")
 			return errors.Wrapf(createTableErr, "failed to write Item %s to the database", item.Key())
 		}
 		// retry after creating table
-		return s.Set(ctx, item)
+		return s.Set(ctx, item, opts...)
+	}
+	logging.FromContext(ctx).WithField("key", item.Key()).Debugf("successfully set item")
+
+	return nil
+}
+
+// BatchSet saves the items with as few BatchWriteItem requests as it can,
+// resending any that Dynamo leaves unprocessed
+func (s *dynamoStore) BatchSet(ctx context.Context, items []Item) error {
+	for _, item := range items {
+		if err := checkBatchable(item); err != nil {
+			return err
+		}
 	}
-	s.lock.RUnlock()
-	log.WithField("key", item.Key()).Debugf("successfully set item")
 
+	failed := map[string]error{}
+	for start := 0; start < len(items); start += batchWriteSize {
+		end := start + batchWriteSize
+		if end > len(items) {
+			end = len(items)
+		}
+		chunk := items[start:end]
+		err := s.batchWrite(ctx, chunk)
+		if err == nil {
+			continue
+		}
+		if chunkFailed, ok := FailedKeys(err); ok {
+			for key, keyErr := range chunkFailed {
+				failed[key] = keyErr
+			}
+			continue
+		}
+		for _, item := range chunk {
+			failed[item.Key()] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
 	return nil
 }
 
+// batchWrite sends a single BatchWriteItem request, of at most
+// batchWriteSize items
+func (s *dynamoStore) batchWrite(ctx context.Context, items []Item) error {
+	var (
+		numRetries int
+		ok         bool
+	)
+	if numRetries, ok = ctx.Value(rKey).(int); !ok {
+		numRetries = 0
+	}
+	ctx = context.WithValue(ctx, rKey, numRetries+1)
+
+	// unprocessed items come back as attributes, so we find them again
+	// by their primary key
+	keyNames := primaryKeyNames(items[0], s.c.TableName)
+	byKey := make(map[string]Item, len(items))
+	requests := make([]dynamodb.WriteRequest, 0, len(items))
+	for _, item := range items {
+		attributes := item.Marshal()
+		byKey[primaryKey(attributes, keyNames)] = item
+		requests = append(requests, dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: attributes}})
+	}
+
+	// unprocessed items are retried under the same policy as errors
+	pending := map[string][]dynamodb.WriteRequest{s.c.TableName: requests}
+	for attempt := 1; len(pending[s.c.TableName]) > 0; attempt++ {
+		var output *dynamodb.BatchWriteItemOutput
+		err := s.retry(ctx, "BatchWriteItem", func(ctx context.Context) error {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			var err error
+			req := s.dynamo.BatchWriteItemRequest(&dynamodb.BatchWriteItemInput{RequestItems: pending})
+			req.SetContext(ctx)
+			output, err = req.Send()
+			return err
+		})
+		if err != nil {
+			if numRetries >= maxRetries || !TableNotFoundError(err) {
+				return errors.Wrap(err, "failed to send BatchWriteItem request")
+			}
+			if createTableErr := s.createTableOnError(ctx, items[0], err); createTableErr != nil {
+				return errors.Wrap(createTableErr, "failed to send BatchWriteItem request")
+			}
+			// retry after creating table
+			return s.batchWrite(ctx, items)
+		}
+		pending = output.UnprocessedItems
+		if len(pending[s.c.TableName]) == 0 {
+			return nil
+		}
+		unprocessed := fmt.Errorf("%d items unprocessed", len(pending[s.c.TableName]))
+		if !s.backoff(ctx, "BatchWriteItem", attempt, unprocessed) {
+			break
+		}
+	}
+
+	failed := map[string]error{}
+	for _, req := range pending[s.c.TableName] {
+		if item, ok := byKey[primaryKey(req.PutRequest.Item, keyNames)]; ok {
+			failed[item.Key()] = errors.New("still unprocessed after retrying")
+		}
+	}
+	return &BatchError{Failed: failed}
+}
+
+// BatchGet retrieves the items with as few BatchGetItem requests as it
+// can, resending any keys Dynamo leaves unprocessed. It returns the items
+// it found, in the order they were given
+func (s *dynamoStore) BatchGet(ctx context.Context, items []Item) ([]Item, error) {
+	if len(items) == 0 {
+		return []Item{}, nil
+	}
+	for _, item := range items {
+		if item.Key() == "" {
+			return nil, errors.New("must provide a non-empty name")
+		}
+	}
+
+	// BatchGetItem doesn't allow the same key twice in a request
+	keyNames := primaryKeyNames(items[0], s.c.TableName)
+	unique := []Item{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		key := primaryKey(item.GetItemInput(s.c.TableName).Key, keyNames)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, item)
+		}
+	}
+
+	found := map[string]map[string]dynamodb.AttributeValue{}
+	for start := 0; start < len(unique); start += batchGetSize {
+		end := start + batchGetSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		if err := s.batchGet(ctx, unique[start:end], keyNames, found); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]Item, 0, len(found))
+	for _, item := range items {
+		attributes, ok := found[primaryKey(item.GetItemInput(s.c.TableName).Key, keyNames)]
+		if !ok {
+			continue
+		}
+		if err := item.Unmarshal(attributes); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal item %s", item.Key())
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+// batchGet sends a single BatchGetItem request, of at most batchGetSize
+// keys, and adds what it finds to found, by primary key
+func (s *dynamoStore) batchGet(ctx context.Context, items []Item, keyNames []string, found map[string]map[string]dynamodb.AttributeValue) error {
+	keys := make([]map[string]dynamodb.AttributeValue, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.GetItemInput(s.c.TableName).Key)
+	}
+
+	pending := map[string]dynamodb.KeysAndAttributes{
+		s.c.TableName: {Keys: keys, ConsistentRead: items[0].GetItemInput(s.c.TableName).ConsistentRead},
+	}
+	for attempt := 1; ; attempt++ {
+		var output *dynamodb.BatchGetItemOutput
+		err := s.retry(ctx, "BatchGetItem", func(ctx context.Context) error {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			var err error
+			req := s.dynamo.BatchGetItemRequest(&dynamodb.BatchGetItemInput{RequestItems: pending})
+			req.SetContext(ctx)
+			output, err = req.Send()
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to send BatchGetItem request")
+		}
+		for _, attributes := range output.Responses[s.c.TableName] {
+			found[primaryKey(attributes, keyNames)] = attributes
+		}
+		pending = output.UnprocessedKeys
+		n := len(pending[s.c.TableName].Keys)
+		if n == 0 {
+			return nil
+		}
+		unprocessed := fmt.Errorf("%d keys unprocessed", n)
+		if !s.backoff(ctx, "BatchGetItem", attempt, unprocessed) {
+			return errors.Wrap(unprocessed, "failed to retrieve every item")
+		}
+	}
+}
+
+// primaryKeyNames returns the names of the attributes making up the
+// item's primary key
+func primaryKeyNames(item Item, tableName string) []string {
+	names := []string{}
+	for name := range item.GetItemInput(tableName).Key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// primaryKey flattens the primary key attributes of an item to a string
+func primaryKey(attributes map[string]dynamodb.AttributeValue, names []string) string {
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		a := attributes[name]
+		switch {
+		case a.S != nil:
+			values = append(values, *a.S)
+		case a.N != nil:
+			values = append(values, *a.N)
+		default:
+			values = append(values, string(a.B))
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
 // Get takes a name and tries to retrieve it from DynamoDB
 func (s *dynamoStore) Get(ctx context.Context, item Item) (Item, error) {
 	if item.Key() == "" {
 		return nil, errors.New("must provide a non-empty name")
 	}
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
 	input := item.GetItemInput(s.c.TableName)
-	req := s.dynamo.GetItemRequest(input)
-	output, err := req.Send()
+	var output *dynamodb.GetItemOutput
+	err := s.retry(ctx, "Get", func(ctx context.Context) error {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		var err error
+		req := s.dynamo.GetItemRequest(input)
+		req.SetContext(ctx)
+		output, err = req.Send()
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to send Get request")
 	}
@@ -87,7 +337,7 @@ func (s *dynamoStore) Get(ctx context.Context, item Item) (Item, error) {
 }
 
 // Update takes a Item and tries to update it in Dynamo
-func (s *dynamoStore) Update(ctx context.Context, item Item) error {
+func (s *dynamoStore) Update(ctx context.Context, item Item, opts ...WriteOption) error {
 	var (
 		numRetries int
 		ok         bool
@@ -100,34 +350,65 @@ func (s *dynamoStore) Update(ctx context.Context, item Item) error {
 		return errors.New("must provide a non-empty name")
 	}
 
-	s.lock.RLock()
 	input := item.UpdateItemInput(s.c.TableName)
-	req := s.dynamo.UpdateItemRequest(input)
+	cond, err := buildCondition(item, condition{input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}, opts)
+	if err != nil {
+		return err
+	}
+	input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues = cond.expression, cond.names, cond.values
 
-	if _, err := req.Send(); err != nil {
-		s.lock.RUnlock()
+	retry := s.retry
+	if !idempotentUpdate(input, opts) {
+		retry = s.retryThrottled
+	}
+	err = retry(ctx, "Update", func(ctx context.Context) error {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		req := s.dynamo.UpdateItemRequest(input)
+		req.SetContext(ctx)
+		_, err := req.Send()
+		return err
+	})
+	if err != nil {
+		if ConflictError(err) {
+			return errors.Wrapf(ErrConditionFailed, "failed to update Item %s", item.Key())
+		}
+		if numRetries >= maxRetries || !TableNotFoundError(err) {
+			return errors.Wrap(err, "failed to send Update request")
+		}
 		if createTableErr := s.createTableOnError(ctx, item, err); createTableErr != nil {
 			return errors.Wrap(createTableErr, "failed to send Update request")
 		}
 		// retry after creating table
-		return s.Update(ctx, item)
+		return s.Update(ctx, item, opts...)
 	}
-	s.lock.RUnlock()
 	return nil
 }
 
 // Delete takes a Item and tries to delete it from Dynamo
-func (s *dynamoStore) Delete(ctx context.Context, item Item) error {
+func (s *dynamoStore) Delete(ctx context.Context, item Item, opts ...WriteOption) error {
 	if item.Key() == "" {
 		return errors.New("must provide a non-empty name")
 	}
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
 	input := item.DeleteItemInput(s.c.TableName)
-	req := s.dynamo.DeleteItemRequest(input)
-
-	if _, err := req.Send(); err != nil {
+	cond, err := buildCondition(item, condition{input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}, opts)
+	if err != nil {
+		return err
+	}
+	input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues = cond.expression, cond.names, cond.values
+
+	err = s.retry(ctx, "Delete", func(ctx context.Context) error {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		req := s.dynamo.DeleteItemRequest(input)
+		req.SetContext(ctx)
+		_, err := req.Send()
+		return err
+	})
+	if err != nil {
+		if ConflictError(err) {
+			return errors.Wrapf(ErrConditionFailed, "failed to delete Item %s", item.Key())
+		}
 		return errors.Wrap(err, "failed to send Delete request")
 	}
 	return nil
@@ -135,37 +416,101 @@ func (s *dynamoStore) Delete(ctx context.Context, item Item) error {
 
 // Scan takes a scannable and tries to scan against DynamoDB
 func (s *dynamoStore) Scan(ctx context.Context, items Scannable) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
+	// a single Scan returns at most 1MB, so follow the pages to the end
 	input := items.ScanInput(s.c.TableName)
-	req := s.dynamo.ScanRequest(input)
-	output, err := req.Send()
-	if err != nil {
-		return errors.Wrap(err, "failed to send Scan request")
+	all := []map[string]dynamodb.AttributeValue{}
+	for {
+		var output *dynamodb.ScanOutput
+		err := s.retry(ctx, "Scan", func(ctx context.Context) error {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			var err error
+			req := s.dynamo.ScanRequest(input)
+			req.SetContext(ctx)
+			output, err = req.Send()
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to send Scan request")
+		}
+		all = append(all, output.Items...)
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
 	}
 
-	return items.Unmarshal(output.Items)
+	return items.Unmarshal(all)
 }
 
-// Query takes a scannable and tries to query against DynamoDB
+// Query takes a scannable and tries to query against DynamoDB. A single
+// Query returns at most 1MB, so it follows the pages until it has the
+// limit, or to the end without one
 func (s *dynamoStore) Query(ctx context.Context, items Queryable, limit int) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-
 	input := items.QueryInput(s.c.TableName, limit)
-	req := s.dynamo.QueryRequest(input)
-	output, err := req.Send()
-	if err != nil {
-		return errors.Wrap(err, "failed to send Query request")
+	all := []map[string]dynamodb.AttributeValue{}
+	for {
+		var output *dynamodb.QueryOutput
+		err := s.retry(ctx, "Query", func(ctx context.Context) error {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			var err error
+			req := s.dynamo.QueryRequest(input)
+			req.SetContext(ctx)
+			output, err = req.Send()
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to send Query request")
+		}
+		all = append(all, output.Items...)
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		if input.Limit != nil && *input.Limit > 0 {
+			remaining := *input.Limit - int64(len(output.Items))
+			if remaining <= 0 {
+				break
+			}
+			input.Limit = aws.Int64(remaining)
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
 	}
 
-	return items.Unmarshal(output.Items)
+	return items.Unmarshal(all)
+}
+
+// EnsureTable checks that the item's table exists, and is active. If it
+// doesn't, it's created when create is set, and is an error otherwise
+func (s *dynamoStore) EnsureTable(ctx context.Context, item Item, create bool) error {
+	describeInput := item.DescribeTableInput(s.c.TableName)
+	var output *dynamodb.DescribeTableOutput
+	err := s.retry(ctx, "DescribeTable", func(ctx context.Context) error {
+		req := s.dynamo.DescribeTableRequest(describeInput)
+		req.SetContext(ctx)
+		var err error
+		output, err = req.Send()
+		return err
+	})
+	switch {
+	case err == nil:
+		if output.Table != nil && output.Table.TableStatus == dynamodb.TableStatusActive {
+			return nil
+		}
+		if err := s.dynamo.WaitUntilTableExistsWithContext(ctx, describeInput); err != nil {
+			return errors.Wrapf(err, "table %s didn't become active in time", s.c.TableName)
+		}
+		return nil
+	case !TableNotFoundError(err):
+		return errors.Wrapf(err, "failed to describe table %s", s.c.TableName)
+	case !create:
+		return errors.Wrapf(err, "table %s doesn't exist", s.c.TableName)
+	}
+	return s.createTableOnError(ctx, item, err)
 }
 
 func (s *dynamoStore) createTableOnError(ctx context.Context, item Item, err error) error {
 	if !TableNotFoundError(err) {
-		log.WithError(err).Errorf("argh")
 		return err
 	}
 	s.lock.Lock()
@@ -173,36 +518,38 @@ func (s *dynamoStore) createTableOnError(ctx context.Context, item Item, err err
 
 	input := item.CreateTableInput(s.c)
 	req := s.dynamo.CreateTableRequest(input)
+	req.SetContext(ctx)
 	if _, err := req.Send(); err != nil {
-		log.WithError(err).Errorf("failed to create table for %s", item.Key())
+		logging.FromContext(ctx).WithError(err).Errorf("failed to create table for %s", item.Key())
 	}
 
-	log.Debug("going to wait")
+	logging.FromContext(ctx).Debug("going to wait")
 	describeInput := item.DescribeTableInput(s.c.TableName)
 	if err := s.dynamo.WaitUntilTableExistsWithContext(ctx, describeInput); err != nil {
-		log.WithError(err).Errorf("table for %s was not created in time", item.Key())
+		logging.FromContext(ctx).WithError(err).Errorf("table for %s was not created in time", item.Key())
 		return errors.Wrap(err, "table was not created in time")
 	}
-	log.Debug("done waiting")
+	logging.FromContext(ctx).Debug("done waiting")
 
 	var hadOpts bool
 	// loop through table options we have
-	for _, tableOption := range item.TableOptions(s.c.TableName) {
-		if optionErr := tableOption.Send(s.dynamo); optionErr != nil {
-			log.WithError(optionErr).Errorf("failed to apply table option %s to table %s", tableOption.Name(), s.c.TableName)
+	tableOptions := append(item.TableOptions(s.c.TableName), s.c.TableOptions()...)
+	for _, tableOption := range tableOptions {
+		if optionErr := tableOption.Send(ctx, s.dynamo); optionErr != nil {
+			logging.FromContext(ctx).WithError(optionErr).Errorf("failed to apply table option %s to table %s", tableOption.Name(), s.c.TableName)
 			return errors.Wrapf(optionErr, "failed to apply table option %s to table %s", tableOption.Name(), s.c.TableName)
 		}
 		hadOpts = true
 	}
 	// if we made any table updates, wait again just in case the change takes time to propagate
 	if hadOpts {
-		log.Debug("going to wait")
+		logging.FromContext(ctx).Debug("going to wait")
 		describeInput := item.DescribeTableInput(s.c.TableName)
 		if err := s.dynamo.WaitUntilTableExistsWithContext(ctx, describeInput); err != nil {
-			log.WithError(err).Errorf("table for %s was not created in time", item.Key())
+			logging.FromContext(ctx).WithError(err).Errorf("table for %s was not created in time", item.Key())
 			return errors.Wrap(err, "table was not created in time")
 		}
-		log.Debug("done waiting")
+		logging.FromContext(ctx).Debug("done waiting")
 	}
 
 	return nil
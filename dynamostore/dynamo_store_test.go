@@ -0,0 +1,105 @@
+package dynamostore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pagedQueries answers Query requests a page of pageSize items at a time,
+// out of the given names, and records the requests
+type pagedQueries struct {
+	lock     sync.Mutex
+	names    []string
+	pageSize int
+	requests []dynamodb.QueryInput
+}
+
+func (p *pagedQueries) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	input := dynamodb.QueryInput{}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.lock.Lock()
+	p.requests = append(p.requests, input)
+	p.lock.Unlock()
+
+	start := 0
+	if key, ok := input.ExclusiveStartKey["Name"]; ok {
+		for i, name := range p.names {
+			if name == aws.StringValue(key.S) {
+				start = i + 1
+			}
+		}
+	}
+	end := start + p.pageSize
+	if input.Limit != nil && start+int(*input.Limit) < end {
+		end = start + int(*input.Limit)
+	}
+	if end > len(p.names) {
+		end = len(p.names)
+	}
+	output := map[string]interface{}{}
+	items := []map[string]dynamodb.AttributeValue{}
+	for _, name := range p.names[start:end] {
+		items = append(items, map[string]dynamodb.AttributeValue{"Name": {S: aws.String(name)}})
+	}
+	output["Items"] = items
+	if end < len(p.names) {
+		output["LastEvaluatedKey"] = items[len(items)-1]
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(output)
+}
+
+func newTestDynamo(t *testing.T, h http.Handler) *dynamodb.DynamoDB {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	cfg := defaults.Config()
+	cfg.Region = "local"
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(server.URL)
+	cfg.Credentials = aws.NewStaticCredentialsProvider("key", "secret", "")
+	return dynamodb.New(cfg)
+}
+
+func TestQueryFollowsPages(t *testing.T) {
+	names := []string{}
+	for i := 0; i < 7; i++ {
+		names = append(names, fmt.Sprintf("contender-%d", i))
+	}
+
+	tests := []struct {
+		name         string
+		limit        int
+		want         []string
+		wantRequests int
+	}{
+		{name: "to the end without a limit", limit: 0, want: names, wantRequests: 3},
+		{name: "until it has the limit", limit: 4, want: names[:4], wantRequests: 2},
+		{name: "not past the first page if it has the limit", limit: 2, want: names[:2], wantRequests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pages := &pagedQueries{names: names, pageSize: 3}
+			db := New(newTestDynamo(t, pages), &TableConfig{TableName: "Test"})
+			items := &scoredItems{group: "pets"}
+			require.NoError(t, db.Query(context.Background(), items, test.limit))
+			assert.Equal(t, test.want, items.names)
+			assert.Len(t, pages.requests, test.wantRequests)
+			if test.limit > 0 && len(pages.requests) > 1 {
+				assert.Equal(t, int64(test.limit-3), aws.Int64Value(pages.requests[1].Limit), "later pages only ask for what's left")
+			}
+		})
+	}
+}
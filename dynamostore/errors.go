@@ -1,12 +1,28 @@
 package dynamostore
 
 import (
+	"context"
+	"fmt"
 	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/pkg/errors"
 )
 
+const (
+	// errCodeThrottling is returned by the control plane when requests
+	// are coming in too fast, and isn't defined in the dynamodb package
+	errCodeThrottling = "ThrottlingException"
+)
+
+var (
+	// ErrConditionFailed is returned when a write's condition, e.g. that
+	// the item doesn't exist yet or is at a given version, doesn't hold
+	ErrConditionFailed = errors.New(dynamodb.ErrCodeConditionalCheckFailedException)
+)
+
 // NotFoundError is a helper method to determine if an
 // encountered error is due to a 404
 func NotFoundError(err error) bool {
@@ -20,3 +36,68 @@ func TableNotFoundError(err error) bool {
 	return errors.Cause(err).Error() == dynamodb.ErrCodeTableNotFoundException ||
 		errRoot == dynamodb.ErrCodeResourceNotFoundException
 }
+
+// ConflictError is a helper method to determine if an encountered
+// error is due to a write whose condition wasn't met, i.e. ErrConditionFailed
+func ConflictError(err error) bool {
+	return errorCode(err) == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// ThrottledError is a helper method to determine if an encountered
+// error is due to exceeding the table's throughput or request limits
+func ThrottledError(err error) bool {
+	switch errorCode(err) {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException,
+		dynamodb.ErrCodeRequestLimitExceeded,
+		errCodeThrottling:
+		return true
+	}
+	return false
+}
+
+// CanceledError is a helper method to determine if an encountered error
+// is due to the context being cancelled, or its deadline, or the
+// operation's timeout, passing before the request finished
+func CanceledError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errors.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded:
+		return true
+	}
+	return errorCode(err) == aws.ErrCodeRequestCanceled
+}
+
+// errorCode returns the AWS error code of the root cause, falling back
+// to the prefix of the error message for errors we construct ourselves
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	cause := errors.Cause(err)
+	if awsErr, ok := cause.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return strings.Split(cause.Error(), ":")[0]
+}
+
+// BatchError is returned by BatchSet when some of the items couldn't be
+// saved, and holds why for each of them, by key
+type BatchError struct {
+	Failed map[string]error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("failed to save %d items of the batch", len(e.Failed))
+}
+
+// FailedKeys returns the keys of the items in a BatchError that couldn't
+// be saved, and the reasons. Any other error means none of them were saved
+func FailedKeys(err error) (map[string]error, bool) {
+	batchErr, ok := errors.Cause(err).(*BatchError)
+	if !ok {
+		return nil, false
+	}
+	return batchErr.Failed, true
+}
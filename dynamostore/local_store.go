@@ -2,38 +2,81 @@ package dynamostore
 
 import (
 	"context"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/pkg/errors"
 )
 
+// localStore keeps items in their marshalled form, so that Update can
+// apply the same expressions that Dynamo would, and so that every Get
+// hands back a fresh copy instead of a shared pointer. Like Dynamo, it
+// fails operations whose context is already done
 type localStore struct {
-	l     sync.RWMutex
-	items map[string]Item
+	l      sync.RWMutex
+	items  map[string]map[string]dynamodb.AttributeValue
+	schema *dynamodb.CreateTableInput
 }
 
-var _ Storer = (*dynamoStore)(nil)
+var _ Storer = (*localStore)(nil)
 
 // NewInMemoryStore returns a local map backed instance of a Storer
 func NewInMemoryStore() Storer {
 	return &localStore{
 		l:     sync.RWMutex{},
-		items: make(map[string]Item, 10),
+		items: make(map[string]map[string]dynamodb.AttributeValue, 10),
 	}
 }
 
-func (s *localStore) Set(ctx context.Context, item Item) error {
+func (s *localStore) Set(ctx context.Context, item Item, opts ...WriteOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if item.Key() == "" {
 		return errors.New("must provide a non-empty name")
 	}
+	input := item.PutItemInput("")
+	cond, err := buildCondition(item, condition{input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}, opts)
+	if err != nil {
+		return err
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if err := s.checkCondition(item, cond); err != nil {
+		return err
+	}
+	s.learnSchema(item)
+	s.items[item.Key()] = copyAttributes(item.Marshal())
+	return nil
+}
+
+// BatchSet saves every item, which can't partly fail in memory
+func (s *localStore) BatchSet(ctx context.Context, items []Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := checkBatchable(item); err != nil {
+			return err
+		}
+	}
 	s.l.Lock()
-	s.items[item.Key()] = item
-	s.l.Unlock()
+	defer s.l.Unlock()
+	for _, item := range items {
+		s.learnSchema(item)
+		s.items[item.Key()] = copyAttributes(item.Marshal())
+	}
 	return nil
 }
 
 func (s *localStore) Get(ctx context.Context, item Item) (Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if item.Key() == "" {
 		return nil, errors.New("must provide a non-empty name")
 	}
@@ -44,51 +87,343 @@ func (s *localStore) Get(ctx context.Context, item Item) (Item, error) {
 	if !ok {
 		return nil, errors.New(dynamodb.ErrCodeResourceNotFoundException)
 	}
-	return it, nil
+	return item, item.Unmarshal(copyAttributes(it))
 }
 
-func (s *localStore) Update(ctx context.Context, item Item) error {
+// BatchGet retrieves the items that exist, in the order they were given
+func (s *localStore) BatchGet(ctx context.Context, items []Item) ([]Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Key() == "" {
+			return nil, errors.New("must provide a non-empty name")
+		}
+	}
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	ret := make([]Item, 0, len(items))
+	for _, item := range items {
+		it, ok := s.items[item.Key()]
+		if !ok {
+			continue
+		}
+		if err := item.Unmarshal(copyAttributes(it)); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal item %s", item.Key())
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+func (s *localStore) Update(ctx context.Context, item Item, opts ...WriteOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if item.Key() == "" {
 		return errors.New("must provide a non-empty name")
 	}
+	input := item.UpdateItemInput("")
+	if input == nil || input.UpdateExpression == nil {
+		return errors.Errorf("item %s doesn't support updates", item.Key())
+	}
+	cond, err := buildCondition(item, condition{input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}, opts)
+	if err != nil {
+		return err
+	}
+
 	s.l.Lock()
-	s.items[item.Key()] = item
-	s.l.Unlock()
+	defer s.l.Unlock()
+	if err := s.checkCondition(item, cond); err != nil {
+		return err
+	}
+	s.learnSchema(item)
+
+	// updates are upserts, so start from the key if the item doesn't exist
+	current, ok := s.items[item.Key()]
+	if !ok {
+		current = copyAttributes(input.Key)
+	}
+	updated, err := applyUpdateExpression(copyAttributes(current), *input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update item %s", item.Key())
+	}
+	s.items[item.Key()] = updated
 	return nil
 }
 
-func (s *localStore) Delete(ctx context.Context, item Item) error {
+func (s *localStore) Delete(ctx context.Context, item Item, opts ...WriteOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if item.Key() == "" {
 		return errors.New("must provide a non-empty name")
 	}
+	input := item.DeleteItemInput("")
+	cond, err := buildCondition(item, condition{input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}, opts)
+	if err != nil {
+		return err
+	}
+
 	s.l.Lock()
+	defer s.l.Unlock()
+	if err := s.checkCondition(item, cond); err != nil {
+		return err
+	}
 	delete(s.items, item.Key())
-	s.l.Unlock()
 	return nil
 }
 
+// checkCondition returns ErrConditionFailed if the stored item doesn't
+// meet the condition. It expects the write lock
+func (s *localStore) checkCondition(item Item, cond condition) error {
+	ok, err := evaluateCondition(s.items[item.Key()], cond)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check condition for item %s", item.Key())
+	}
+	if !ok {
+		return errors.Wrapf(ErrConditionFailed, "failed to write item %s", item.Key())
+	}
+	return nil
+}
+
+// Scan supports filters in the form of the conditions we use
 func (s *localStore) Scan(ctx context.Context, items Scannable) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s.l.RLock()
 	defer s.l.RUnlock()
 
+	input := items.ScanInput("")
+	filter := condition{input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues}
 	allItems := make([]map[string]dynamodb.AttributeValue, 0, len(s.items))
 	for _, v := range s.items {
-		allItems = append(allItems, v.Marshal())
+		ok, err := evaluateCondition(v, filter)
+		if err != nil {
+			return errors.Wrap(err, "failed to filter scan")
+		}
+		if ok {
+			allItems = append(allItems, copyAttributes(v))
+		}
 	}
 	return items.Unmarshal(allItems)
 }
 
+// Query supports the subset of queries we use: an equality condition on
+// the hash key of the table or one of its indexes, ordered by the range key
 func (s *localStore) Query(ctx context.Context, items Queryable, limit int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s.l.RLock()
 	defer s.l.RUnlock()
 
-	allItems := make([]map[string]dynamodb.AttributeValue, 0, limit)
-	var i int
-	for _, v := range s.items {
-		if i == limit {
-			break
+	input := items.QueryInput("", limit)
+	hashKey, rangeKey := s.keySchema(input.IndexName)
+	attr, val, err := parseKeyCondition(input.KeyConditionExpression, input.ExpressionAttributeValues)
+	if err != nil {
+		return err
+	}
+	if hashKey != "" && attr != hashKey {
+		return errors.Errorf("key condition must be on the hash key %s", hashKey)
+	}
+
+	// ties on the range key come back in the order of their keys, as
+	// they do from Dynamo, rather than in the map's random order
+	keys := make([]string, 0, len(s.items))
+	for k := range s.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	matched := make([]map[string]dynamodb.AttributeValue, 0, len(s.items))
+	for _, k := range keys {
+		if v := s.items[k]; attributesEqual(v[attr], val) {
+			matched = append(matched, copyAttributes(v))
 		}
-		allItems = append(allItems, v.Marshal())
 	}
-	return items.Unmarshal(allItems)
+
+	forward := input.ScanIndexForward == nil || *input.ScanIndexForward
+	if rangeKey != "" {
+		sort.SliceStable(matched, func(i, j int) bool {
+			if forward {
+				return attributeLess(matched[i][rangeKey], matched[j][rangeKey])
+			}
+			return attributeLess(matched[j][rangeKey], matched[i][rangeKey])
+		})
+	}
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return items.Unmarshal(matched)
+}
+
+// learnSchema records the table definition of the first item we see, which
+// stands in for the lazily created Dynamo table. It expects the write lock
+func (s *localStore) learnSchema(item Item) {
+	if s.schema != nil {
+		return
+	}
+	s.schema = item.CreateTableInput(&TableConfig{})
+}
+
+// keySchema returns the hash and range key names for the table, or for
+// the index with the given name
+func (s *localStore) keySchema(indexName *string) (hashKey, rangeKey string) {
+	if s.schema == nil {
+		return "", ""
+	}
+	keys := s.schema.KeySchema
+	if indexName != nil {
+		for _, gsi := range s.schema.GlobalSecondaryIndexes {
+			if gsi.IndexName != nil && *gsi.IndexName == *indexName {
+				keys = gsi.KeySchema
+			}
+		}
+	}
+	for _, k := range keys {
+		switch k.KeyType {
+		case dynamodb.KeyTypeHash:
+			hashKey = *k.AttributeName
+		case dynamodb.KeyTypeRange:
+			rangeKey = *k.AttributeName
+		}
+	}
+	return hashKey, rangeKey
+}
+
+func parseKeyCondition(expr *string, values map[string]dynamodb.AttributeValue) (string, dynamodb.AttributeValue, error) {
+	if expr == nil {
+		return "", dynamodb.AttributeValue{}, errors.New("query must have a key condition")
+	}
+	parts := strings.Split(*expr, "=")
+	if len(parts) != 2 {
+		return "", dynamodb.AttributeValue{}, errors.Errorf("unsupported key condition: %s", *expr)
+	}
+	val, ok := values[strings.TrimSpace(parts[1])]
+	if !ok {
+		return "", dynamodb.AttributeValue{}, errors.Errorf("missing value for key condition: %s", *expr)
+	}
+	return strings.TrimSpace(parts[0]), val, nil
+}
+
+// applyUpdateExpression supports the ADD, DELETE and SET actions as we use
+// them, e.g. "ADD Wins :w, Score :w" or "SET Description = :d, #v = :v"
+func applyUpdateExpression(item map[string]dynamodb.AttributeValue, expr string, names map[string]string, values map[string]dynamodb.AttributeValue) (map[string]dynamodb.AttributeValue, error) {
+	fields := strings.Fields(strings.Replace(expr, ",", " , ", -1))
+	var action string
+	for i := 0; i < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "ADD", "DELETE", "SET":
+			action = strings.ToUpper(fields[i])
+			continue
+		case ",":
+			continue
+		}
+		name := fields[i]
+		if resolved, ok := names[name]; ok {
+			name = resolved
+		}
+		if action == "SET" && i+1 < len(fields) && fields[i+1] == "=" {
+			i++
+		}
+		if i+1 >= len(fields) {
+			return nil, errors.Errorf("unsupported update expression: %s", expr)
+		}
+		i++
+		val, ok := values[fields[i]]
+		if !ok {
+			return nil, errors.Errorf("missing value %s in update expression", fields[i])
+		}
+		switch action {
+		case "ADD":
+			added, err := addAttribute(item[name], val)
+			if err != nil {
+				return nil, err
+			}
+			item[name] = added
+		case "DELETE":
+			item[name] = deleteFromSet(item[name], val)
+		case "SET":
+			item[name] = val
+		default:
+			return nil, errors.Errorf("unsupported update expression: %s", expr)
+		}
+	}
+	return item, nil
+}
+
+func addAttribute(current, val dynamodb.AttributeValue) (dynamodb.AttributeValue, error) {
+	if val.N != nil {
+		n := 0
+		if current.N != nil {
+			var err error
+			if n, err = strconv.Atoi(*current.N); err != nil {
+				return current, errors.Wrap(err, "failed to parse number attribute")
+			}
+		}
+		delta, err := strconv.Atoi(*val.N)
+		if err != nil {
+			return current, errors.Wrap(err, "failed to parse number value")
+		}
+		sum := strconv.Itoa(n + delta)
+		return dynamodb.AttributeValue{N: &sum}, nil
+	}
+	set := append([]string{}, current.SS...)
+	for _, s := range val.SS {
+		if !stringInSlice(s, set) {
+			set = append(set, s)
+		}
+	}
+	return dynamodb.AttributeValue{SS: set}, nil
+}
+
+func deleteFromSet(current, val dynamodb.AttributeValue) dynamodb.AttributeValue {
+	set := make([]string, 0, len(current.SS))
+	for _, s := range current.SS {
+		if !stringInSlice(s, val.SS) {
+			set = append(set, s)
+		}
+	}
+	return dynamodb.AttributeValue{SS: set}
+}
+
+func attributesEqual(a, b dynamodb.AttributeValue) bool {
+	switch {
+	case a.S != nil && b.S != nil:
+		return *a.S == *b.S
+	case a.N != nil && b.N != nil:
+		return *a.N == *b.N
+	}
+	return false
+}
+
+func attributeLess(a, b dynamodb.AttributeValue) bool {
+	if a.N != nil && b.N != nil {
+		x, _ := strconv.ParseFloat(*a.N, 64)
+		y, _ := strconv.ParseFloat(*b.N, 64)
+		return x < y
+	}
+	if a.S != nil && b.S != nil {
+		return *a.S < *b.S
+	}
+	return false
+}
+
+func copyAttributes(m map[string]dynamodb.AttributeValue) map[string]dynamodb.AttributeValue {
+	ret := make(map[string]dynamodb.AttributeValue, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+func stringInSlice(s string, arr []string) bool {
+	for _, str := range arr {
+		if s == str {
+			return true
+		}
+	}
+	return false
 }
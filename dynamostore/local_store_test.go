@@ -0,0 +1,279 @@
+package dynamostore
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scoredItem is keyed by its name, and queried by its group, in order of
+// its score
+type scoredItem struct {
+	Name      string
+	Group     string
+	Score     int
+	condition string
+}
+
+func (i *scoredItem) Key() string { return i.Name }
+
+func (i *scoredItem) PutItemInput(tableName string) *dynamodb.PutItemInput {
+	input := &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: i.Marshal()}
+	if i.condition != "" {
+		input.ConditionExpression = aws.String(i.condition)
+	}
+	return input
+}
+
+func (i *scoredItem) GetItemInput(tableName string) *dynamodb.GetItemInput {
+	return &dynamodb.GetItemInput{TableName: aws.String(tableName), Key: i.key()}
+}
+
+func (i *scoredItem) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
+	return nil
+}
+
+func (i *scoredItem) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
+	return &dynamodb.DeleteItemInput{TableName: aws.String(tableName), Key: i.key()}
+}
+
+func (i *scoredItem) CreateTableInput(c *TableConfig) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		KeySchema: []dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Group"), KeyType: dynamodb.KeyTypeHash},
+			{AttributeName: aws.String("Score"), KeyType: dynamodb.KeyTypeRange},
+		},
+	}
+}
+
+func (i *scoredItem) DescribeTableInput(tableName string) *dynamodb.DescribeTableInput {
+	return &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}
+}
+
+func (i *scoredItem) TableOptions(string) []TableOption { return nil }
+
+func (i *scoredItem) key() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{"Name": {S: aws.String(i.Name)}}
+}
+
+func (i *scoredItem) Marshal() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"Name":  {S: aws.String(i.Name)},
+		"Group": {S: aws.String(i.Group)},
+		"Score": {N: aws.String(strconv.Itoa(i.Score))},
+	}
+}
+
+func (i *scoredItem) Unmarshal(m map[string]dynamodb.AttributeValue) error {
+	i.Name, i.Group = aws.StringValue(m["Name"].S), aws.StringValue(m["Group"].S)
+	return nil
+}
+
+// scoredItems queries a group of scoredItems
+type scoredItems struct {
+	group   string
+	reverse bool
+	names   []string
+}
+
+func (s *scoredItems) QueryInput(tableName string, limit int) *dynamodb.QueryInput {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(tableName),
+		KeyConditionExpression:    aws.String("Group = :g"),
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":g": {S: aws.String(s.group)}},
+		ScanIndexForward:          aws.Bool(!s.reverse),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int64(int64(limit))
+	}
+	return input
+}
+
+func (s *scoredItems) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	s.names = []string{}
+	for _, m := range maps {
+		s.names = append(s.names, aws.StringValue(m["Name"].S))
+	}
+	return nil
+}
+
+func TestApplyUpdateExpression(t *testing.T) {
+	n := func(v string) dynamodb.AttributeValue { return dynamodb.AttributeValue{N: aws.String(v)} }
+	ss := func(v ...string) dynamodb.AttributeValue { return dynamodb.AttributeValue{SS: v} }
+	values := map[string]dynamodb.AttributeValue{
+		":one":   n("1"),
+		":minus": n("-1"),
+		":tags":  ss("b", "c"),
+		":drop":  ss("a"),
+		":desc":  {S: aws.String("a cat")},
+	}
+	names := map[string]string{"#v": "Version", "#d": "Description"}
+
+	tests := []struct {
+		name       string
+		item       map[string]dynamodb.AttributeValue
+		expression string
+		want       map[string]dynamodb.AttributeValue
+	}{
+		{
+			name:       "ADD to missing numbers",
+			item:       map[string]dynamodb.AttributeValue{},
+			expression: "ADD Wins :one, Score :minus",
+			want:       map[string]dynamodb.AttributeValue{"Wins": n("1"), "Score": n("-1")},
+		},
+		{
+			name:       "ADD to existing numbers, through names",
+			item:       map[string]dynamodb.AttributeValue{"Wins": n("2"), "Version": n("4")},
+			expression: "ADD Wins :one, #v :one",
+			want:       map[string]dynamodb.AttributeValue{"Wins": n("3"), "Version": n("5")},
+		},
+		{
+			name:       "ADD to a set skips what's already in it",
+			item:       map[string]dynamodb.AttributeValue{"Tags": ss("a", "b")},
+			expression: "ADD Tags :tags",
+			want:       map[string]dynamodb.AttributeValue{"Tags": ss("a", "b", "c")},
+		},
+		{
+			name:       "DELETE from a set",
+			item:       map[string]dynamodb.AttributeValue{"Tags": ss("a", "b")},
+			expression: "DELETE Tags :drop",
+			want:       map[string]dynamodb.AttributeValue{"Tags": ss("b")},
+		},
+		{
+			name:       "SET then ADD",
+			item:       map[string]dynamodb.AttributeValue{"Description": {S: aws.String("a dog")}, "Version": n("1")},
+			expression: "SET #d = :desc ADD #v :one",
+			want:       map[string]dynamodb.AttributeValue{"Description": {S: aws.String("a cat")}, "Version": n("2")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := applyUpdateExpression(test.item, test.expression, names, values)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+
+	t.Run("missing values are errors", func(t *testing.T) {
+		_, err := applyUpdateExpression(map[string]dynamodb.AttributeValue{}, "ADD Wins :two", names, values)
+		assert.Error(t, err)
+	})
+	t.Run("unsupported actions are errors", func(t *testing.T) {
+		_, err := applyUpdateExpression(map[string]dynamodb.AttributeValue{}, "REMOVE Wins :one", names, values)
+		assert.Error(t, err)
+	})
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	item := map[string]dynamodb.AttributeValue{
+		"Name":    {S: aws.String("logos/cat")},
+		"Version": {N: aws.String("2")},
+	}
+	names := map[string]string{"#n": "Name", "#v": "Version"}
+	values := map[string]dynamodb.AttributeValue{
+		":v":      {N: aws.String("2")},
+		":stale":  {N: aws.String("1")},
+		":poll":   {S: aws.String("logos/")},
+		":other":  {S: aws.String("flags/")},
+		":number": {N: aws.String("2")},
+	}
+
+	tests := []struct {
+		name       string
+		item       map[string]dynamodb.AttributeValue
+		expression string
+		want       bool
+		wantErr    bool
+	}{
+		{name: "no condition", item: nil, expression: "", want: true},
+		{name: "exists", item: item, expression: "attribute_exists(#n)", want: true},
+		{name: "doesn't exist", item: nil, expression: "attribute_exists(#n)", want: false},
+		{name: "not exists", item: nil, expression: "attribute_not_exists(#n)", want: true},
+		{name: "not exists, but does", item: item, expression: "attribute_not_exists(#n)", want: false},
+		{name: "equal", item: item, expression: "#v = :v", want: true},
+		{name: "not equal", item: item, expression: "#v = :stale", want: false},
+		{name: "begins with", item: item, expression: "begins_with(#n, :poll)", want: true},
+		{name: "doesn't begin with", item: item, expression: "begins_with(#n, :other)", want: false},
+		{name: "all terms hold", item: item, expression: "attribute_exists(#n) AND #v = :v", want: true},
+		{name: "one term doesn't hold", item: item, expression: "attribute_exists(#n) AND #v = :stale", want: false},
+		{name: "begins with a number", item: item, expression: "begins_with(#n, :number)", wantErr: true},
+		{name: "missing value", item: item, expression: "#v = :missing", wantErr: true},
+		{name: "unsupported", item: item, expression: "size(#n) > :v", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := condition{names: names, values: values}
+			if test.expression != "" {
+				c.expression = aws.String(test.expression)
+			}
+			got, err := evaluateCondition(test.item, c)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestLocalStoreQuery(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryStore()
+	for _, item := range []*scoredItem{
+		{Name: "cat", Group: "pets", Score: 3},
+		{Name: "dog", Group: "pets", Score: 10},
+		{Name: "bee", Group: "pets", Score: 3},
+		{Name: "fox", Group: "wild", Score: 7},
+		{Name: "ant", Group: "pets", Score: -2},
+	} {
+		require.NoError(t, db.Set(ctx, item))
+	}
+
+	tests := []struct {
+		name  string
+		query *scoredItems
+		limit int
+		want  []string
+	}{
+		{name: "in order of the range key", query: &scoredItems{group: "pets"}, want: []string{"ant", "bee", "cat", "dog"}},
+		{name: "in reverse", query: &scoredItems{group: "pets", reverse: true}, want: []string{"dog", "bee", "cat", "ant"}},
+		{name: "limited", query: &scoredItems{group: "pets", reverse: true}, limit: 2, want: []string{"dog", "bee"}},
+		{name: "limit beyond the matches", query: &scoredItems{group: "wild"}, limit: 5, want: []string{"fox"}},
+		{name: "no matches", query: &scoredItems{group: "none"}, want: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.NoError(t, db.Query(ctx, test.query, test.limit))
+			assert.Equal(t, test.want, test.query.names)
+		})
+	}
+}
+
+func TestLocalStoreBatchSet(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryStore()
+
+	require.NoError(t, db.BatchSet(ctx, []Item{
+		&scoredItem{Name: "cat", Group: "pets"},
+		&scoredItem{Name: "dog", Group: "pets"},
+	}))
+	_, err := db.Get(ctx, &scoredItem{Name: "dog"})
+	require.NoError(t, err)
+
+	// conditions can't be checked in a batch, so none of it is saved
+	err = db.BatchSet(ctx, []Item{
+		&scoredItem{Name: "fox", Group: "wild"},
+		&scoredItem{Name: "owl", Group: "wild", condition: "attribute_not_exists(Name)"},
+	})
+	assert.Error(t, err)
+	_, err = db.Get(ctx, &scoredItem{Name: "fox"})
+	assert.True(t, NotFoundError(err))
+
+	assert.Error(t, db.BatchSet(ctx, []Item{&scoredItem{}}), "items need a key")
+}
@@ -0,0 +1,109 @@
+package dynamostore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultLRUCacheSize is how many values an LRUCache holds, if it isn't
+// given a size
+const DefaultLRUCacheSize = 1000
+
+// LRUCache is an in-process Cache, which evicts the least recently used
+// value when it's full
+type LRUCache struct {
+	size    int
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+var _ Cache = (*LRUCache)(nil)
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewLRUCache returns an LRUCache which holds up to size values
+func NewLRUCache(size int) *LRUCache {
+	if size < 1 {
+		size = DefaultLRUCacheSize
+	}
+	return &LRUCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the value of the key, unless it's expired
+func (c *LRUCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := e.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && !c.now().Before(entry.expiresAt) {
+		c.remove(e)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true, nil
+}
+
+// Set saves the value, evicting the least recently used if the cache is
+// full
+func (c *LRUCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &lruEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expiresAt = c.now().Add(ttl)
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+// Delete drops the keys
+func (c *LRUCache) Delete(ctx context.Context, keys ...string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.remove(e)
+		}
+	}
+	return nil
+}
+
+// Len returns how many values the cache holds, including any that have
+// expired but haven't been dropped yet
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*lruEntry).key)
+}
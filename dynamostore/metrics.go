@@ -0,0 +1,99 @@
+package dynamostore
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+// StoreMetrics is told how long each of a Storer's operations took, and
+// whether it failed, so they can be measured
+type StoreMetrics interface {
+	Observe(table, operation string, took time.Duration, err error)
+}
+
+// WithMetrics returns a Storer which tells the metrics about every
+// operation on db, labelled with the table name. If metrics is nil,
+// operations and their errors are counted in the dynamostore_operations
+// and dynamostore_operation_errors expvars
+func WithMetrics(db Storer, table string, metrics StoreMetrics) Storer {
+	if metrics == nil {
+		metrics = defaultStoreMetrics
+	}
+	return &measuredStore{db: db, table: table, metrics: metrics}
+}
+
+type measuredStore struct {
+	db      Storer
+	table   string
+	metrics StoreMetrics
+}
+
+func (s *measuredStore) observe(operation string, start time.Time, err error) {
+	s.metrics.Observe(s.table, operation, time.Since(start), err)
+}
+
+func (s *measuredStore) Set(ctx context.Context, item Item, opts ...WriteOption) (err error) {
+	defer func(start time.Time) { s.observe("Set", start, err) }(time.Now())
+	return s.db.Set(ctx, item, opts...)
+}
+
+func (s *measuredStore) BatchSet(ctx context.Context, items []Item) (err error) {
+	defer func(start time.Time) { s.observe("BatchSet", start, err) }(time.Now())
+	return s.db.BatchSet(ctx, items)
+}
+
+func (s *measuredStore) Get(ctx context.Context, item Item) (_ Item, err error) {
+	defer func(start time.Time) { s.observe("Get", start, err) }(time.Now())
+	return s.db.Get(ctx, item)
+}
+
+func (s *measuredStore) BatchGet(ctx context.Context, items []Item) (_ []Item, err error) {
+	defer func(start time.Time) { s.observe("BatchGet", start, err) }(time.Now())
+	return s.db.BatchGet(ctx, items)
+}
+
+func (s *measuredStore) Update(ctx context.Context, item Item, opts ...WriteOption) (err error) {
+	defer func(start time.Time) { s.observe("Update", start, err) }(time.Now())
+	return s.db.Update(ctx, item, opts...)
+}
+
+func (s *measuredStore) Delete(ctx context.Context, item Item, opts ...WriteOption) (err error) {
+	defer func(start time.Time) { s.observe("Delete", start, err) }(time.Now())
+	return s.db.Delete(ctx, item, opts...)
+}
+
+func (s *measuredStore) Scan(ctx context.Context, items Scannable) (err error) {
+	defer func(start time.Time) { s.observe("Scan", start, err) }(time.Now())
+	return s.db.Scan(ctx, items)
+}
+
+func (s *measuredStore) Query(ctx context.Context, items Queryable, limit int) (err error) {
+	defer func(start time.Time) { s.observe("Query", start, err) }(time.Now())
+	return s.db.Query(ctx, items, limit)
+}
+
+// EnsureTable ensures the table of the measured Storer, if it can
+func (s *measuredStore) EnsureTable(ctx context.Context, item Item, create bool) error {
+	return EnsureTable(ctx, s.db, item, create)
+}
+
+// expvarStoreMetrics counts operations, and those that failed, in expvar
+// maps keyed by table and operation, e.g. "Contenders.Get". Items that
+// weren't found aren't counted as failures
+type expvarStoreMetrics struct {
+	operations *expvar.Map
+	errors     *expvar.Map
+}
+
+var defaultStoreMetrics = &expvarStoreMetrics{
+	operations: expvar.NewMap("dynamostore_operations"),
+	errors:     expvar.NewMap("dynamostore_operation_errors"),
+}
+
+func (m *expvarStoreMetrics) Observe(table, operation string, took time.Duration, err error) {
+	m.operations.Add(table+"."+operation, 1)
+	if err != nil && !NotFoundError(err) {
+		m.errors.Add(table+"."+operation, 1)
+	}
+}
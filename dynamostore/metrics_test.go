@@ -0,0 +1,47 @@
+package dynamostore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type observation struct {
+	table, operation string
+	err              error
+}
+
+type recordingStoreMetrics struct {
+	observed []observation
+}
+
+func (m *recordingStoreMetrics) Observe(table, operation string, took time.Duration, err error) {
+	m.observed = append(m.observed, observation{table, operation, err})
+}
+
+func TestMeasuredStore(t *testing.T) {
+	ctx := context.Background()
+	metrics := &recordingStoreMetrics{}
+	db := dynamostore.WithMetrics(dynamostore.NewInMemoryStore(), "Contenders", metrics)
+
+	require.NoError(t, db.Set(ctx, &contender.Contender{Name: "koi"}))
+	_, err := db.Get(ctx, &contender.Contender{Name: "koi"})
+	require.NoError(t, err)
+	_, err = db.Get(ctx, &contender.Contender{Name: "nobody"})
+	require.True(t, dynamostore.NotFoundError(err))
+	require.NoError(t, db.Delete(ctx, &contender.Contender{Name: "koi"}))
+	assert.NoError(t, dynamostore.EnsureTable(ctx, db, &contender.Contender{}, false))
+
+	require.Len(t, metrics.observed, 4)
+	for i, operation := range []string{"Set", "Get", "Get", "Delete"} {
+		assert.Equal(t, "Contenders", metrics.observed[i].table)
+		assert.Equal(t, operation, metrics.observed[i].operation)
+	}
+	assert.NoError(t, metrics.observed[1].err)
+	assert.True(t, dynamostore.NotFoundError(metrics.observed[2].err), "the operation's error is observed")
+}
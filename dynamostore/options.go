@@ -1,6 +1,8 @@
 package dynamostore
 
 import (
+	"context"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
@@ -21,8 +23,9 @@ func (u *updateTTLReq) Name() string {
 }
 
 // Send allows the TTL option to be applied against dynamo
-func (u *updateTTLReq) Send(db *dynamodb.DynamoDB) error {
+func (u *updateTTLReq) Send(ctx context.Context, db *dynamodb.DynamoDB) error {
 	req := db.UpdateTimeToLiveRequest(u.input)
+	req.SetContext(ctx)
 	_, err := req.Send()
 	return err
 }
@@ -47,12 +50,104 @@ func (c *createGSIReq) Name() string {
 }
 
 // Send allows the GSI option to be applied against dynamo
-func (c *createGSIReq) Send(db *dynamodb.DynamoDB) error {
+func (c *createGSIReq) Send(ctx context.Context, db *dynamodb.DynamoDB) error {
 	input := &dynamodb.UpdateTableInput{
 		TableName:                   aws.String(c.tableName),
 		GlobalSecondaryIndexUpdates: c.gsiUpdates,
 	}
 	req := db.UpdateTableRequest(input)
+	req.SetContext(ctx)
+	_, err := req.Send()
+	return err
+}
+
+type pitrReq struct {
+	tableName string
+}
+
+// NewPITROption creates a TableOption that turns on point in time
+// recovery for the table
+func NewPITROption(tableName string) TableOption {
+	return &pitrReq{tableName: tableName}
+}
+
+// Name describes the point in time recovery option
+func (p *pitrReq) Name() string {
+	return "PITR"
+}
+
+// Send allows the point in time recovery option to be applied against dynamo
+func (p *pitrReq) Send(ctx context.Context, db *dynamodb.DynamoDB) error {
+	input := &dynamodb.UpdateContinuousBackupsInput{
+		TableName: aws.String(p.tableName),
+		PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	}
+	req := db.UpdateContinuousBackupsRequest(input)
+	req.SetContext(ctx)
 	_, err := req.Send()
 	return err
 }
+
+type tagsReq struct {
+	tableName string
+	tags      Tags
+}
+
+// NewTagsOption creates a TableOption that adds the tags to the table
+func NewTagsOption(tableName string, tags Tags) TableOption {
+	return &tagsReq{tableName: tableName, tags: tags}
+}
+
+// Name describes the tags option
+func (t *tagsReq) Name() string {
+	return "Tags"
+}
+
+// Send allows the tags option to be applied against dynamo. Tags are
+// added by the table's ARN, so it describes the table first
+func (t *tagsReq) Send(ctx context.Context, db *dynamodb.DynamoDB) error {
+	describeReq := db.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(t.tableName)})
+	describeReq.SetContext(ctx)
+	output, err := describeReq.Send()
+	if err != nil {
+		return err
+	}
+	req := db.TagResourceRequest(&dynamodb.TagResourceInput{
+		ResourceArn: output.Table.TableArn,
+		Tags:        t.tags.Dynamo(),
+	})
+	req.SetContext(ctx)
+	_, err = req.Send()
+	return err
+}
+
+// TimeToLive returns the TTL specification set by any of the options, so
+// it can be compared with a table's current settings, or nil if none do
+func TimeToLive(opts []TableOption) *dynamodb.TimeToLiveSpecification {
+	for _, opt := range opts {
+		if u, ok := opt.(*updateTTLReq); ok && u.input != nil {
+			return u.input.TimeToLiveSpecification
+		}
+	}
+	return nil
+}
+
+// IndexCreates returns the GSIs created by any of the options, so they
+// can be compared with a table's current indexes
+func IndexCreates(opts []TableOption) []dynamodb.CreateGlobalSecondaryIndexAction {
+	var ret []dynamodb.CreateGlobalSecondaryIndexAction
+	for _, opt := range opts {
+		c, ok := opt.(*createGSIReq)
+		if !ok {
+			continue
+		}
+		for _, update := range c.gsiUpdates {
+			if update.Create != nil {
+				ret = append(ret, *update.Create)
+			}
+		}
+	}
+	return ret
+}
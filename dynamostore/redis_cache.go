@@ -0,0 +1,245 @@
+package dynamostore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultRedisPoolSize is how many idle connections a RedisCache
+	// keeps, if the RedisConfig doesn't say
+	DefaultRedisPoolSize = 8
+	// DefaultRedisTimeout is how long a RedisCache waits for each
+	// command, if the RedisConfig and the context don't say
+	DefaultRedisTimeout = 500 * time.Millisecond
+)
+
+// RedisConfig says how to connect to a Redis compatible server
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	PoolSize int
+	Timeout  time.Duration
+}
+
+// RedisCache is a Cache kept in a Redis compatible server, so it can be
+// shared by every instance of the service. It speaks just enough of the
+// protocol for GET, SET and DEL
+type RedisCache struct {
+	c    RedisConfig
+	idle chan *redisConn
+}
+
+var _ Cache = (*RedisCache)(nil)
+
+// NewRedisCache returns a RedisCache for the server. It doesn't connect
+// until it's first used
+func NewRedisCache(c RedisConfig) *RedisCache {
+	if c.PoolSize < 1 {
+		c.PoolSize = DefaultRedisPoolSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultRedisTimeout
+	}
+	return &RedisCache{
+		c:    c,
+		idle: make(chan *redisConn, c.PoolSize),
+	}
+}
+
+// Get returns the value of the key, if it has one
+func (r *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := r.do(ctx, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, false, errors.Errorf("unexpected reply to GET: %v", reply)
+	}
+	return b, true, nil
+}
+
+// Set saves the value, expiring it after the TTL if there is one
+func (r *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		ms := ttl.Nanoseconds() / int64(time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	_, err := r.do(ctx, args...)
+	return err
+}
+
+// Delete drops the keys
+func (r *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := r.do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Close closes the idle connections
+func (r *RedisCache) Close() error {
+	for {
+		select {
+		case conn := <-r.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the command on an idle connection, or a new one, and returns
+// its reply. Connections that fail aren't reused
+func (r *RedisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(r.c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	if _, isReplyError := err.(redisError); err != nil && !isReplyError {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to send %s to redis", args[0])
+	}
+	r.release(conn)
+	return reply, err
+}
+
+func (r *RedisCache) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, nil
+	default:
+	}
+	d := net.Dialer{Timeout: r.c.Timeout}
+	netConn, err := d.DialContext(ctx, "tcp", r.c.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to redis")
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	if err := conn.SetDeadline(time.Now().Add(r.c.Timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if r.c.Password != "" {
+		if _, err := conn.do("AUTH", r.c.Password); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed to authenticate with redis")
+		}
+	}
+	if r.c.DB != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(r.c.DB)); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed to select redis db")
+		}
+	}
+	return conn, nil
+}
+
+func (r *RedisCache) release(conn *redisConn) {
+	select {
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do writes the command as an array of bulk strings, and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	w := bufio.NewWriter(c.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads a reply of any type. Nil bulk strings are nil, and
+// bulk strings are []byte
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.Errorf("malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, errors.Errorf("unknown reply type %q", kind)
+}
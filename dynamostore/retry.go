@@ -0,0 +1,232 @@
+package dynamostore
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/logging"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultRetryMaxAttempts is how many times a request is sent, in all,
+	// if the RetryPolicy doesn't say
+	DefaultRetryMaxAttempts = 3
+	// DefaultRetryBaseDelay is the most we wait before the first retry, if
+	// the RetryPolicy doesn't say
+	DefaultRetryBaseDelay = 50 * time.Millisecond
+	// DefaultRetryMaxDelay is the most we wait before any retry, if the
+	// RetryPolicy doesn't say
+	DefaultRetryMaxDelay = time.Second
+	// DefaultOperationTimeout is the longest an operation, retries
+	// included, can take, if the table's Timeouts don't say
+	DefaultOperationTimeout = 5 * time.Second
+
+	errCodeInternalServerError = "InternalServerError"
+	errCodeServiceUnavailable  = "ServiceUnavailable"
+)
+
+// RetryPolicy controls how requests that fail with a RetryableError are
+// retried. The wait before each retry is random, up to a limit which
+// doubles from BaseDelay with each attempt, but never exceeds MaxDelay.
+// Zero values take the defaults
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// RetryMetrics is told about the retries of a table's requests, so they
+// can be counted
+type RetryMetrics interface {
+	// Retried is called before each retry of the operation
+	Retried(table, operation string, err error)
+	// Exhausted is called when the operation fails after its last attempt,
+	// or when there isn't time for another before the context's deadline
+	Exhausted(table, operation string, err error)
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryMaxDelay
+	}
+	return p
+}
+
+// delay returns how long to wait before retrying after the given attempt,
+// using "full jitter", so clients throttled together don't retry together
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	limit := p.MaxDelay
+	if attempt < 32 {
+		if backoff := p.BaseDelay << uint(attempt-1); backoff > 0 && backoff < limit {
+			limit = backoff
+		}
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// RetryableError is a helper method to determine if an encountered error
+// is worth retrying: throttling, server errors, and transient network
+// errors. It's false for errors the request itself caused
+func RetryableError(err error) bool {
+	if err == nil || CanceledError(err) {
+		return false
+	}
+	if ThrottledError(err) {
+		return true
+	}
+	cause := errors.Cause(err)
+	if aws.IsErrorRetryable(cause) {
+		return true
+	}
+	if reqErr, ok := cause.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	switch errorCode(err) {
+	case errCodeInternalServerError, errCodeServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// retry calls send until it succeeds, fails with an error that isn't
+// retryable, or the policy's attempts, the operation's timeout or the
+// context's deadline run out. The attempts share a span, with an event
+// for each retry, and send is passed a context bounded by the timeout.
+// send must be idempotent, since a request that failed with a server or
+// network error may still have been applied
+func (s *dynamoStore) retry(ctx context.Context, operation string, send func(context.Context) error) error {
+	return s.retryWhen(ctx, operation, RetryableError, send)
+}
+
+// retryThrottled is retry for requests that aren't idempotent, e.g. those
+// adding to a number. They're only retried when throttled, since Dynamo
+// rejects those without applying them
+func (s *dynamoStore) retryThrottled(ctx context.Context, operation string, send func(context.Context) error) error {
+	return s.retryWhen(ctx, operation, ThrottledError, send)
+}
+
+func (s *dynamoStore) retryWhen(ctx context.Context, operation string, retryable func(error) bool, send func(context.Context) error) (err error) {
+	if timeout := s.c.Timeouts.For(operation); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, span := s.startSpan(ctx, operation)
+	defer func() { endSpan(span, err) }()
+	for attempt := 1; ; attempt++ {
+		err = send(ctx)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if !s.backoff(ctx, operation, attempt, err) {
+			return err
+		}
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt+1),
+			attribute.String("error", err.Error()),
+		))
+	}
+}
+
+// idempotentUpdate reports whether sending the update twice leaves the
+// item as sending it once does. Adding to a number doesn't, unless the
+// update is conditioned on the version it bumps, which a second attempt
+// would fail
+func idempotentUpdate(input *dynamodb.UpdateItemInput, opts []WriteOption) bool {
+	o := &writeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.version != nil || input.UpdateExpression == nil {
+		return true
+	}
+	adding := false
+	for _, field := range strings.Fields(strings.Replace(*input.UpdateExpression, ",", " ", -1)) {
+		switch strings.ToUpper(field) {
+		case "ADD":
+			adding = true
+		case "DELETE", "SET", "REMOVE":
+			adding = false
+		default:
+			if adding && input.ExpressionAttributeValues[field].N != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// backoff waits before the next attempt of the operation, and reports
+// whether there should be one
+func (s *dynamoStore) backoff(ctx context.Context, operation string, attempt int, err error) bool {
+	policy := s.c.Retry.withDefaults()
+	metrics := s.metrics()
+	if attempt >= policy.MaxAttempts {
+		metrics.Exhausted(s.c.TableName, operation, err)
+		return false
+	}
+	wait := policy.delay(attempt)
+	// don't start an attempt we know the caller won't wait for
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		metrics.Exhausted(s.c.TableName, operation, err)
+		return false
+	}
+
+	metrics.Retried(s.c.TableName, operation, err)
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"table":     s.c.TableName,
+		"operation": operation,
+		"attempt":   attempt,
+		"wait":      wait,
+	}).WithError(err).Debug("retrying request")
+	select {
+	case <-ctx.Done():
+		metrics.Exhausted(s.c.TableName, operation, err)
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+func (s *dynamoStore) metrics() RetryMetrics {
+	if s.c.Metrics != nil {
+		return s.c.Metrics
+	}
+	return defaultRetryMetrics
+}
+
+// expvarRetryMetrics counts retries in expvar maps, keyed by table and
+// operation, e.g. "Contenders.Set"
+type expvarRetryMetrics struct {
+	retried   *expvar.Map
+	exhausted *expvar.Map
+}
+
+var defaultRetryMetrics = &expvarRetryMetrics{
+	retried:   expvar.NewMap("dynamostore_retries"),
+	exhausted: expvar.NewMap("dynamostore_retries_exhausted"),
+}
+
+func (m *expvarRetryMetrics) Retried(table, operation string, err error) {
+	m.retried.Add(table+"."+operation, 1)
+}
+
+func (m *expvarRetryMetrics) Exhausted(table, operation string, err error) {
+	m.exhausted.Add(table+"."+operation, 1)
+}
@@ -0,0 +1,207 @@
+package dynamostore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type countingMetrics struct {
+	retried, exhausted int
+}
+
+func (m *countingMetrics) Retried(table, operation string, err error)   { m.retried++ }
+func (m *countingMetrics) Exhausted(table, operation string, err error) { m.exhausted++ }
+
+func TestRetryableError(t *testing.T) {
+	assert.True(t, RetryableError(awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)))
+	assert.True(t, RetryableError(awserr.NewRequestFailure(awserr.New(errCodeInternalServerError, "oops", nil), 500, "id")))
+	assert.True(t, RetryableError(awserr.NewRequestFailure(awserr.New("Whatever", "bad gateway", nil), 502, "id")))
+	assert.False(t, RetryableError(awserr.NewRequestFailure(awserr.New("ValidationException", "bad request", nil), 400, "id")))
+	assert.False(t, RetryableError(ErrConditionFailed))
+	assert.False(t, RetryableError(nil))
+	assert.False(t, RetryableError(awserr.New(aws.ErrCodeRequestCanceled, "request context canceled", context.DeadlineExceeded)))
+	assert.False(t, RetryableError(context.Canceled))
+}
+
+func TestRetry(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	newStore := func(metrics RetryMetrics) *dynamoStore {
+		return &dynamoStore{c: &TableConfig{
+			TableName: "Test",
+			Retry:     RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond},
+			Metrics:   metrics,
+		}}
+	}
+
+	t.Run("retries until it succeeds", func(t *testing.T) {
+		metrics := &countingMetrics{}
+		calls := 0
+		err := newStore(metrics).retry(context.Background(), "Set", func(context.Context) error {
+			calls++
+			if calls < 3 {
+				return throttled
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, 2, metrics.retried)
+		assert.Equal(t, 0, metrics.exhausted)
+	})
+	t.Run("gives up after its attempts", func(t *testing.T) {
+		metrics := &countingMetrics{}
+		calls := 0
+		err := newStore(metrics).retry(context.Background(), "Set", func(context.Context) error {
+			calls++
+			return throttled
+		})
+		assert.Equal(t, throttled, err)
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, 1, metrics.exhausted)
+	})
+	t.Run("doesn't retry other errors", func(t *testing.T) {
+		calls := 0
+		bad := errors.New("bad request")
+		err := newStore(&countingMetrics{}).retry(context.Background(), "Set", func(context.Context) error {
+			calls++
+			return bad
+		})
+		assert.Equal(t, bad, err)
+		assert.Equal(t, 1, calls)
+	})
+	t.Run("only retries throttled requests that aren't idempotent", func(t *testing.T) {
+		metrics := &countingMetrics{}
+		calls := 0
+		failed := awserr.NewRequestFailure(awserr.New(errCodeInternalServerError, "oops", nil), 500, "id")
+		err := newStore(metrics).retryThrottled(context.Background(), "Update", func(context.Context) error {
+			calls++
+			return failed
+		})
+		assert.Equal(t, failed, err)
+		assert.Equal(t, 1, calls, "it may have been applied")
+		assert.Equal(t, 0, metrics.retried)
+
+		calls = 0
+		err = newStore(metrics).retryThrottled(context.Background(), "Update", func(context.Context) error {
+			calls++
+			if calls < 2 {
+				return throttled
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+	t.Run("doesn't wait past the deadline", func(t *testing.T) {
+		metrics := &countingMetrics{}
+		s := newStore(metrics)
+		s.c.Retry = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		calls := 0
+		start := time.Now()
+		err := s.retry(ctx, "Set", func(context.Context) error {
+			calls++
+			return throttled
+		})
+		assert.Equal(t, throttled, err)
+		assert.True(t, calls < 5)
+		assert.True(t, time.Since(start) < time.Second)
+		assert.Equal(t, 1, metrics.exhausted)
+	})
+	t.Run("bounds the operation by its timeout", func(t *testing.T) {
+		s := newStore(&countingMetrics{})
+		s.c.Timeouts = Timeouts{Default: time.Hour, ByOperation: OperationTimeouts{"Get": 10 * time.Millisecond}}
+
+		calls := 0
+		start := time.Now()
+		err := s.retry(context.Background(), "Get", func(ctx context.Context) error {
+			calls++
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.True(t, CanceledError(err))
+		assert.Equal(t, 1, calls, "timeouts aren't retried")
+		assert.True(t, time.Since(start) < time.Second)
+
+		err = s.retry(context.Background(), "Set", func(ctx context.Context) error {
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Second, "other operations get the default")
+			return nil
+		})
+		assert.NoError(t, err)
+	})
+	t.Run("traces the call", func(t *testing.T) {
+		recorder := tracetest.NewSpanRecorder()
+		s := newStore(&countingMetrics{})
+		s.c.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		calls := 0
+		err := s.retry(context.Background(), "Set", func(context.Context) error {
+			calls++
+			if calls < 2 {
+				return throttled
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		require.Len(t, recorder.Ended(), 1)
+		span := recorder.Ended()[0]
+		assert.Equal(t, "DynamoDB.Set", span.Name())
+		assert.Equal(t, codes.Unset, span.Status().Code)
+		require.Len(t, span.Events(), 1)
+		assert.Equal(t, "retry", span.Events()[0].Name)
+
+		err = s.retry(context.Background(), "Get", func(context.Context) error { return throttled })
+		assert.Error(t, err)
+		require.Len(t, recorder.Ended(), 2)
+		assert.Equal(t, codes.Error, recorder.Ended()[1].Status().Code)
+	})
+}
+
+func TestIdempotentUpdate(t *testing.T) {
+	one := dynamodb.AttributeValue{N: aws.String("1")}
+	update := func(expression string, values map[string]dynamodb.AttributeValue) *dynamodb.UpdateItemInput {
+		return &dynamodb.UpdateItemInput{UpdateExpression: aws.String(expression), ExpressionAttributeValues: values}
+	}
+	for _, tc := range []struct {
+		name       string
+		input      *dynamodb.UpdateItemInput
+		opts       []WriteOption
+		idempotent bool
+	}{
+		{"adding to numbers", update("ADD Wins :w, Score :w", map[string]dynamodb.AttributeValue{":w": one}), nil, false},
+		{"adding to a number after setting", update("SET Description = :d ADD #v :one", map[string]dynamodb.AttributeValue{":d": {S: aws.String("a cat")}, ":one": one}), nil, false},
+		{"adding to a number, conditioned on its version", update("SET Description = :d ADD #v :one", map[string]dynamodb.AttributeValue{":d": {S: aws.String("a cat")}, ":one": one}), []WriteOption{IfVersion(2)}, true},
+		{"adding to a number, conditioned on existing", update("ADD Wins :w", map[string]dynamodb.AttributeValue{":w": one}), []WriteOption{IfExists()}, false},
+		{"adding to a set", update("ADD MatchupSet :c", map[string]dynamodb.AttributeValue{":c": {SS: []string{"a§b"}}}), nil, true},
+		{"deleting from a set", update("DELETE MatchupSet :c", map[string]dynamodb.AttributeValue{":c": {SS: []string{"a§b"}}}), nil, true},
+		{"setting a number", update("SET GSI1SK = :s", map[string]dynamodb.AttributeValue{":s": one}), nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.idempotent, idempotentUpdate(tc.input, tc.opts))
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond}.withDefaults()
+	for i := 0; i < 100; i++ {
+		assert.True(t, p.delay(1) <= 10*time.Millisecond)
+		assert.True(t, p.delay(2) <= 20*time.Millisecond)
+		assert.True(t, p.delay(10) <= 40*time.Millisecond)
+		assert.True(t, p.delay(100) <= 40*time.Millisecond)
+	}
+}
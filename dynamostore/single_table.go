@@ -0,0 +1,436 @@
+package dynamostore
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SingleTableIndex is the GSI of the single table, which entities
+	// overload with their own index
+	SingleTableIndex = "GSI1"
+
+	partitionKey  = "PK"
+	sortKey       = "SK"
+	entityType    = "Type"
+	indexHashKey  = "GSI1PK"
+	indexRangeKey = "GSI1SK"
+)
+
+// Entity lays out one kind of item in a table shared with other kinds.
+// Its items are keyed by a partition key of its name and the item's own
+// key values, e.g. "CONTENDER#bear" or "MATCHUP#a#b", and a sort key
+type Entity struct {
+	// Name identifies the kind of item, e.g. "CONTENDER", and prefixes
+	// its partition keys
+	Name string
+	// Sort is the sort key of its items, e.g. "SEEN" for the matchups a
+	// user has seen. It defaults to Name
+	Sort string
+	// Index maps one of the item's own GSIs onto the shared SingleTableIndex
+	Index *EntityIndex
+}
+
+// EntityIndex maps an item's GSI onto the shared SingleTableIndex. Its
+// hash key must be a string, and its range key a number
+type EntityIndex struct {
+	// Name is the name of the item's GSI, which its queries use
+	Name     string
+	HashKey  string
+	RangeKey string
+}
+
+// WithEntity returns a Storer of the entity's items, kept in the table of
+// db alongside those of other entities
+func WithEntity(db Storer, e Entity) Storer {
+	return &entityStore{db: db, entity: e}
+}
+
+// Wrap returns the item as it's kept in a table shared with other kinds
+func (e Entity) Wrap(item Item) Item {
+	return &entityItem{Item: item, entity: e}
+}
+
+func (e Entity) sort() string {
+	if e.Sort != "" {
+		return e.Sort
+	}
+	return e.Name
+}
+
+// SingleTableInput returns the input to create a table that any entity's
+// items can be kept in
+func SingleTableInput(tc *TableConfig) *dynamodb.CreateTableInput {
+	return tc.Configure(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(partitionKey), AttributeType: dynamodb.ScalarAttributeTypeS},
+			{AttributeName: aws.String(sortKey), AttributeType: dynamodb.ScalarAttributeTypeS},
+			{AttributeName: aws.String(indexHashKey), AttributeType: dynamodb.ScalarAttributeTypeS},
+			{AttributeName: aws.String(indexRangeKey), AttributeType: dynamodb.ScalarAttributeTypeN},
+		},
+		KeySchema: []dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(partitionKey), KeyType: dynamodb.KeyTypeHash},
+			{AttributeName: aws.String(sortKey), KeyType: dynamodb.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(SingleTableIndex),
+				KeySchema: []dynamodb.KeySchemaElement{
+					{AttributeName: aws.String(indexHashKey), KeyType: dynamodb.KeyTypeHash},
+					{AttributeName: aws.String(indexRangeKey), KeyType: dynamodb.KeyTypeRange},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: dynamodb.ProjectionTypeAll,
+				},
+			},
+		},
+		TableName: aws.String(tc.TableName),
+	})
+}
+
+// entityItem is an item as it's kept in the single table. It has the
+// same attributes, along with its keys, its entity's name, and the
+// attributes of the shared index
+type entityItem struct {
+	Item
+	entity Entity
+}
+
+var (
+	_ Item      = (*entityItem)(nil)
+	_ Versioned = (*entityItem)(nil)
+)
+
+// Key is unique across entities, unlike the item's own
+func (e *entityItem) Key() string {
+	return e.partitionKey() + "/" + e.entity.sort()
+}
+
+// partitionKey joins the entity's name and the item's key values, in
+// the order of their attribute names
+func (e *entityItem) partitionKey() string {
+	key := e.Item.GetItemInput("").Key
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{e.entity.Name}
+	for _, name := range names {
+		parts = append(parts, primaryKey(key, []string{name}))
+	}
+	return strings.Join(parts, "#")
+}
+
+func (e *entityItem) key() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		partitionKey: {S: aws.String(e.partitionKey())},
+		sortKey:      {S: aws.String(e.entity.sort())},
+	}
+}
+
+func (e *entityItem) Marshal() map[string]dynamodb.AttributeValue {
+	attributes := e.Item.Marshal()
+	for name, val := range e.key() {
+		attributes[name] = val
+	}
+	attributes[entityType] = dynamodb.AttributeValue{S: aws.String(e.entity.Name)}
+	if index := e.entity.Index; index != nil {
+		hash, hasHash := attributes[index.HashKey]
+		rng, hasRange := attributes[index.RangeKey]
+		if hasHash && hasRange && hash.S != nil {
+			attributes[indexHashKey] = e.indexHashValue(hash)
+			attributes[indexRangeKey] = rng
+		}
+	}
+	return attributes
+}
+
+// indexHashValue prefixes the hash key of the item's index with the
+// entity's name, so entities don't share each other's index partitions
+func (e *entityItem) indexHashValue(val dynamodb.AttributeValue) dynamodb.AttributeValue {
+	return dynamodb.AttributeValue{S: aws.String(e.entity.Name + "#" + aws.StringValue(val.S))}
+}
+
+func (e *entityItem) PutItemInput(tableName string) *dynamodb.PutItemInput {
+	input := e.Item.PutItemInput(tableName)
+	input.Item = e.Marshal()
+	return input
+}
+
+func (e *entityItem) GetItemInput(tableName string) *dynamodb.GetItemInput {
+	input := e.Item.GetItemInput(tableName)
+	input.Key = e.key()
+	return input
+}
+
+func (e *entityItem) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
+	input := e.Item.DeleteItemInput(tableName)
+	input.Key = e.key()
+	return input
+}
+
+// UpdateItemInput also sets the item's own key attributes and its
+// entity's name, since an update can create the item, and keeps the
+// range key of the shared index in step with the item's
+func (e *entityItem) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
+	input := e.Item.UpdateItemInput(tableName)
+	if input == nil || input.UpdateExpression == nil {
+		return input
+	}
+	names := copyNames(input.ExpressionAttributeNames)
+	values := copyAttributes(input.ExpressionAttributeValues)
+	sets := []string{}
+	i := 0
+	for name, val := range e.Item.GetItemInput("").Key {
+		names[placeholder("#entityKey", i)] = name
+		values[placeholder(":entityKey", i)] = val
+		sets = append(sets, placeholder("#entityKey", i)+" = "+placeholder(":entityKey", i))
+		i++
+	}
+	names["#entityType"] = entityType
+	values[":entityType"] = dynamodb.AttributeValue{S: aws.String(e.entity.Name)}
+	sets = append(sets, "#entityType = :entityType")
+
+	expression := *input.UpdateExpression
+	if index := e.entity.Index; index != nil {
+		expression = mirrorUpdates(expression, names, index.RangeKey, indexRangeKey)
+	}
+	expression = addSets(expression, sets)
+
+	input.Key = e.key()
+	input.UpdateExpression = aws.String(expression)
+	input.ExpressionAttributeNames = names
+	input.ExpressionAttributeValues = values
+	return input
+}
+
+func (e *entityItem) CreateTableInput(tc *TableConfig) *dynamodb.CreateTableInput {
+	return SingleTableInput(tc)
+}
+
+// VersionAttribute is that of the item, if it's Versioned
+func (e *entityItem) VersionAttribute() string {
+	if versioned, ok := e.Item.(Versioned); ok {
+		return versioned.VersionAttribute()
+	}
+	return ""
+}
+
+func placeholder(prefix string, i int) string {
+	return prefix + string(rune('A'+i))
+}
+
+// addSets adds the assignments to the SET clause of an update
+// expression, or adds a SET clause if it doesn't have one
+func addSets(expression string, sets []string) string {
+	assignments := strings.Join(sets, ", ")
+	fields := strings.Fields(expression)
+	for i, field := range fields {
+		if strings.ToUpper(field) == "SET" {
+			fields[i] = field + " " + assignments + ","
+			return strings.Join(fields, " ")
+		}
+	}
+	return "SET " + assignments + " " + expression
+}
+
+// mirrorUpdates makes the ADD and SET actions of an update expression on
+// the attribute do the same to the mirror, e.g. "ADD Score :w" becomes
+// "ADD Score :w, GSI1SK :w"
+func mirrorUpdates(expression string, names map[string]string, attribute, mirror string) string {
+	clauses := splitClauses(expression)
+	for i, clause := range clauses {
+		action := strings.ToUpper(strings.Fields(clause)[0])
+		if action != "ADD" && action != "SET" {
+			continue
+		}
+		body := strings.TrimSpace(clause[len(action):])
+		actions := strings.Split(body, ",")
+		for _, a := range actions {
+			fields := strings.Fields(strings.Replace(a, "=", " = ", 1))
+			if len(fields) < 2 {
+				continue
+			}
+			name := fields[0]
+			if resolved, ok := names[name]; ok {
+				name = resolved
+			}
+			if name != attribute {
+				continue
+			}
+			names["#entityMirror"] = mirror
+			mirrored := append([]string{"#entityMirror"}, fields[1:]...)
+			body += ", " + strings.Join(mirrored, " ")
+		}
+		clauses[i] = action + " " + body
+	}
+	return strings.Join(clauses, " ")
+}
+
+// splitClauses splits an update expression into its clauses, each
+// starting with its action, e.g. "SET a = :a, b = :b" and "ADD c :c"
+func splitClauses(expression string) []string {
+	clauses := []string{}
+	current := []string{}
+	for _, field := range strings.Fields(expression) {
+		switch strings.ToUpper(field) {
+		case "SET", "ADD", "REMOVE", "DELETE":
+			if len(current) > 0 {
+				clauses = append(clauses, strings.Join(current, " "))
+			}
+			current = []string{field}
+			continue
+		}
+		current = append(current, field)
+	}
+	if len(current) > 0 {
+		clauses = append(clauses, strings.Join(current, " "))
+	}
+	return clauses
+}
+
+// entityScan only scans the items of its entity
+type entityScan struct {
+	Scannable
+	entity Entity
+}
+
+func (s *entityScan) ScanInput(tableName string) *dynamodb.ScanInput {
+	input := s.Scannable.ScanInput(tableName)
+	names := copyNames(input.ExpressionAttributeNames)
+	values := copyAttributes(input.ExpressionAttributeValues)
+	names["#entityType"] = entityType
+	values[":entityType"] = dynamodb.AttributeValue{S: aws.String(s.entity.Name)}
+	filter := "#entityType = :entityType"
+	if input.FilterExpression != nil && *input.FilterExpression != "" {
+		filter = *input.FilterExpression + " AND " + filter
+	}
+	input.FilterExpression = aws.String(filter)
+	input.ExpressionAttributeNames = names
+	input.ExpressionAttributeValues = values
+	return input
+}
+
+// entityQuery sends queries of the entity's index to the shared index
+type entityQuery struct {
+	Queryable
+	entity Entity
+}
+
+func (q *entityQuery) QueryInput(tableName string, limit int) *dynamodb.QueryInput {
+	input := q.Queryable.QueryInput(tableName, limit)
+	index := q.entity.Index
+	if index == nil || input.IndexName == nil || *input.IndexName != index.Name || input.KeyConditionExpression == nil {
+		return input
+	}
+	parts := strings.Split(*input.KeyConditionExpression, "=")
+	if len(parts) != 2 {
+		return input
+	}
+	name, valueName := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if resolved, ok := input.ExpressionAttributeNames[name]; ok {
+		name = resolved
+	}
+	val, ok := input.ExpressionAttributeValues[valueName]
+	if name != index.HashKey || !ok {
+		return input
+	}
+	values := copyAttributes(input.ExpressionAttributeValues)
+	values[valueName] = (&entityItem{entity: q.entity}).indexHashValue(val)
+
+	input.IndexName = aws.String(SingleTableIndex)
+	input.KeyConditionExpression = aws.String(indexHashKey + " = " + valueName)
+	input.ExpressionAttributeValues = values
+	return input
+}
+
+// entityStore keeps one entity's items in a Storer shared with others
+type entityStore struct {
+	db     Storer
+	entity Entity
+}
+
+var _ Storer = (*entityStore)(nil)
+
+func (s *entityStore) wrap(item Item) *entityItem {
+	return &entityItem{Item: item, entity: s.entity}
+}
+
+func (s *entityStore) Set(ctx context.Context, item Item, opts ...WriteOption) error {
+	return s.db.Set(ctx, s.wrap(item), opts...)
+}
+
+// BatchSet reports the items it couldn't save by their own keys
+func (s *entityStore) BatchSet(ctx context.Context, items []Item) error {
+	wrapped := make([]Item, len(items))
+	keys := make(map[string]string, len(items))
+	for i, item := range items {
+		w := s.wrap(item)
+		wrapped[i] = w
+		keys[w.Key()] = item.Key()
+	}
+	err := s.db.BatchSet(ctx, wrapped)
+	failed, ok := FailedKeys(err)
+	if !ok {
+		return err
+	}
+	unwrapped := make(map[string]error, len(failed))
+	for key, keyErr := range failed {
+		unwrapped[keys[key]] = keyErr
+	}
+	return &BatchError{Failed: unwrapped}
+}
+
+// EnsureTable ensures the shared table, as the entity's items describe it
+func (s *entityStore) EnsureTable(ctx context.Context, item Item, create bool) error {
+	return EnsureTable(ctx, s.db, s.wrap(item), create)
+}
+
+func (s *entityStore) Get(ctx context.Context, item Item) (Item, error) {
+	got, err := s.db.Get(ctx, s.wrap(item))
+	if err != nil {
+		return nil, err
+	}
+	return got.(*entityItem).Item, nil
+}
+
+func (s *entityStore) BatchGet(ctx context.Context, items []Item) ([]Item, error) {
+	wrapped := make([]Item, len(items))
+	for i, item := range items {
+		wrapped[i] = s.wrap(item)
+	}
+	found, err := s.db.BatchGet(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Item, len(found))
+	for i, item := range found {
+		ret[i] = item.(*entityItem).Item
+	}
+	return ret, nil
+}
+
+func (s *entityStore) Update(ctx context.Context, item Item, opts ...WriteOption) error {
+	return s.db.Update(ctx, s.wrap(item), opts...)
+}
+
+func (s *entityStore) Delete(ctx context.Context, item Item, opts ...WriteOption) error {
+	return s.db.Delete(ctx, s.wrap(item), opts...)
+}
+
+func (s *entityStore) Scan(ctx context.Context, items Scannable) error {
+	return s.db.Scan(ctx, &entityScan{Scannable: items, entity: s.entity})
+}
+
+func (s *entityStore) Query(ctx context.Context, items Queryable, limit int) error {
+	if s.entity.Index == nil {
+		return errors.Errorf("entity %s has no index to query", s.entity.Name)
+	}
+	return s.db.Query(ctx, &entityQuery{Queryable: items, entity: s.entity}, limit)
+}
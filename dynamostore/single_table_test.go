@@ -0,0 +1,193 @@
+package dynamostore_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawItems scans every item of a table, whatever its kind
+type rawItems []map[string]dynamodb.AttributeValue
+
+func (r *rawItems) ScanInput(tableName string) *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{TableName: aws.String(tableName)}
+}
+
+func (r *rawItems) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	*r = maps
+	return nil
+}
+
+func TestSingleTable(t *testing.T) {
+	ctx := context.Background()
+	db := dynamostore.NewInMemoryStore()
+	contenders := contender.NewStore(dynamostore.WithEntity(db, contender.ContenderEntity))
+	matchups := contender.NewMatchupStore(dynamostore.WithEntity(db, contender.MatchupEntity))
+	userMatchups := contender.NewMatchupSetStore(dynamostore.WithEntity(db, contender.UserMatchupsEntity))
+	masterMatchups := contender.NewMasterMatchupSetStore(dynamostore.WithEntity(db, contender.MasterMatchupsEntity))
+	tokens := contender.NewTokenStore(dynamostore.WithEntity(db, contender.TokenEntity))
+
+	for _, name := range []string{"bear", "cat", "dog"} {
+		require.NoError(t, contenders.Create(ctx, &contender.Contender{Name: name, Description: "a " + name}))
+	}
+	all, err := contenders.GetAll(ctx)
+	require.NoError(t, err)
+	require.NoError(t, masterMatchups.AddAll(ctx, []string{"bear", "cat", "dog"}, all))
+	require.NoError(t, userMatchups.Add(ctx, "user", "bear", "cat"))
+	require.NoError(t, matchups.ScoreMatchup(ctx, "cat", "bear"))
+	require.NoError(t, contenders.DeclareWinner(ctx, "cat"))
+	require.NoError(t, contenders.DeclareLoser(ctx, "bear"))
+	token, err := tokens.CreateToken(ctx, "bear", "cat")
+	require.NoError(t, err)
+
+	t.Run("keys", func(t *testing.T) {
+		raw := rawItems{}
+		require.NoError(t, db.Scan(ctx, &raw))
+		keys := []string{}
+		for _, item := range raw {
+			keys = append(keys, aws.StringValue(item["PK"].S)+"/"+aws.StringValue(item["SK"].S))
+		}
+		sort.Strings(keys)
+		assert.Equal(t, []string{
+			"CONTENDER#bear/CONTENDER",
+			"CONTENDER#cat/CONTENDER",
+			"CONTENDER#dog/CONTENDER",
+			"MATCHUP#bear#cat/MATCHUP",
+			"POSSIBLE#Master/MATCHUPS",
+			"TOKEN#" + token.ID + "/TOKEN",
+			"USER#user/SEEN",
+		}, keys)
+	})
+	t.Run("each store only sees its own", func(t *testing.T) {
+		all, err := contenders.GetAll(ctx)
+		require.NoError(t, err)
+		assert.Len(t, *all, 3)
+
+		possible, err := masterMatchups.Get(ctx)
+		require.NoError(t, err)
+		assert.Len(t, possible.Set, 3)
+		seen, err := userMatchups.Get(ctx, "user")
+		require.NoError(t, err)
+		assert.Len(t, seen.Set, 1)
+		m, err := matchups.Get(ctx, "bear", "cat")
+		require.NoError(t, err)
+		assert.Equal(t, "bear", m.Contender1)
+		valid, err := tokens.ValidateToken(ctx, token.ID, "bear", "cat")
+		require.NoError(t, err)
+		assert.True(t, valid)
+	})
+	t.Run("leaderboard", func(t *testing.T) {
+		leaderboard, err := contenders.GetLeaderboard(ctx, 3)
+		require.NoError(t, err)
+		names := []string{}
+		for _, c := range *leaderboard {
+			names = append(names, c.Name)
+		}
+		assert.Equal(t, []string{"cat", "dog", "bear"}, names)
+	})
+	t.Run("ranks", func(t *testing.T) {
+		ranks, err := contenders.GetRanks(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"cat": 1, "dog": 2, "bear": 3}, ranks)
+
+		// contenders on the same score share a rank, and the next is
+		// ranked after all of them
+		pollCtx := contender.WithPoll(ctx, "ranks")
+		for _, name := range []string{"ant", "bee", "fly", "gnat"} {
+			require.NoError(t, contenders.Set(pollCtx, &contender.Contender{Name: name}))
+		}
+		require.NoError(t, contenders.DeclareWinner(pollCtx, "fly"))
+		require.NoError(t, contenders.DeclareLoser(pollCtx, "gnat"))
+		ranks, err = contenders.GetRanks(pollCtx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"fly": 1, "ant": 2, "bee": 2, "gnat": 4}, ranks)
+	})
+	t.Run("records and versions", func(t *testing.T) {
+		cat, err := contenders.Get(ctx, "cat")
+		require.NoError(t, err)
+		assert.Equal(t, 1, cat.Wins)
+		assert.Equal(t, int64(1), cat.Version, "votes don't change the version")
+
+		cat.Description = "a big cat"
+		require.NoError(t, contenders.Update(ctx, cat, dynamostore.IfVersion(cat.Version)))
+		cat.Description = "a stale cat"
+		assert.True(t, dynamostore.ConflictError(contenders.Update(ctx, cat, dynamostore.IfVersion(cat.Version))))
+		assert.True(t, dynamostore.NotFoundError(contenders.Update(ctx, &contender.Contender{Name: "fox"}, dynamostore.IfVersion(1))))
+
+		// contenders saved before versioning are at version 0
+		require.NoError(t, dynamostore.WithEntity(db, contender.ContenderEntity).Set(ctx, &contender.Contender{Name: "owl"}))
+		owl := &contender.Contender{Name: "owl", Description: "a wise owl"}
+		require.NoError(t, contenders.Update(ctx, owl, dynamostore.IfVersion(0)))
+		assert.True(t, dynamostore.ConflictError(contenders.Update(ctx, owl, dynamostore.IfVersion(0))))
+		require.NoError(t, contenders.Delete(ctx, "owl", dynamostore.IfVersion(1)))
+		assert.True(t, dynamostore.ConflictError(contenders.Delete(ctx, "owl", dynamostore.IfExists())))
+
+		many, err := contenders.GetMany(ctx, []string{"cat", "dog", "fox"})
+		require.NoError(t, err)
+		assert.Len(t, many, 2)
+		assert.Equal(t, "a big cat", many["cat"].Description)
+	})
+	t.Run("votes can't bring back deleted contenders", func(t *testing.T) {
+		require.NoError(t, contenders.Delete(ctx, "dog"))
+		assert.True(t, dynamostore.ConflictError(contenders.DeclareWinner(ctx, "dog")))
+		_, err := contenders.Get(ctx, "dog")
+		assert.True(t, dynamostore.NotFoundError(err))
+	})
+	t.Run("deleting a poll deletes its items", func(t *testing.T) {
+		polls := contender.NewPollStore(dynamostore.WithEntity(db, contender.PollEntity), contenders, matchups, userMatchups, masterMatchups, tokens)
+		keys := func() []string {
+			raw := rawItems{}
+			require.NoError(t, db.Scan(ctx, &raw))
+			keys := []string{}
+			for _, item := range raw {
+				keys = append(keys, aws.StringValue(item["PK"].S))
+			}
+			sort.Strings(keys)
+			return keys
+		}
+		before := keys()
+
+		require.NoError(t, polls.Create(ctx, &contender.Poll{ID: "gone"}))
+		pollCtx := contender.WithPoll(ctx, "gone")
+		for _, name := range []string{"bear", "cat"} {
+			require.NoError(t, contenders.Create(pollCtx, &contender.Contender{Name: name}))
+		}
+		all, err := contenders.GetAll(pollCtx)
+		require.NoError(t, err)
+		require.NoError(t, masterMatchups.AddAll(pollCtx, []string{"bear", "cat"}, all))
+		require.NoError(t, userMatchups.Add(pollCtx, "user", "bear", "cat"))
+		require.NoError(t, matchups.ScoreMatchup(pollCtx, "cat", "bear"))
+		_, err = tokens.CreateToken(pollCtx, "bear", "cat")
+		require.NoError(t, err)
+
+		require.NoError(t, polls.Delete(ctx, "gone"))
+		assert.Equal(t, before, keys(), "only the poll's items are deleted")
+		_, err = polls.Get(ctx, "gone")
+		assert.True(t, dynamostore.NotFoundError(err))
+		assert.Error(t, tokens.DeletePollItems(ctx), "the default poll's items can't be deleted")
+	})
+}
+
+func TestEntityUpdateItemInput(t *testing.T) {
+	input := contender.ContenderEntity.Wrap(contender.NewWinner("cat")).UpdateItemInput("Table")
+
+	assert.Equal(t, "CONTENDER#cat", aws.StringValue(input.Key["PK"].S))
+	assert.Equal(t, "CONTENDER", aws.StringValue(input.Key["SK"].S))
+	expression := aws.StringValue(input.UpdateExpression)
+	assert.True(t, strings.HasPrefix(expression, "SET #entityKeyA = :entityKeyA, #entityType = :entityType ADD Wins :w, Score :w"), expression)
+	assert.True(t, strings.HasSuffix(expression, ", #entityMirror :w"), expression)
+	assert.Equal(t, "GSI1SK", input.ExpressionAttributeNames["#entityMirror"])
+	assert.Equal(t, "Name", input.ExpressionAttributeNames["#entityKeyA"])
+
+	// the item's own input is left alone
+	own := contender.NewWinner("cat").UpdateItemInput("Table")
+	assert.NotContains(t, own.ExpressionAttributeNames, "#entityMirror")
+}
@@ -21,10 +21,17 @@ type Item interface {
 	Unmarshal(map[string]dynamodb.AttributeValue) error
 }
 
+// Versioned is implemented by items with a version attribute, so writes
+// can require the stored item to be at the version the caller last saw,
+// with IfVersion. Items are responsible for incrementing it
+type Versioned interface {
+	VersionAttribute() string
+}
+
 // TableOption is an interface to specify requests that occur post-table
 // creation, e.g. TTL enabling, or GSI creation
 type TableOption interface {
-	Send(db *dynamodb.DynamoDB) error
+	Send(ctx context.Context, db *dynamodb.DynamoDB) error
 	Name() string
 }
 
@@ -40,12 +47,38 @@ type Scannable interface {
 	Unmarshal([]map[string]dynamodb.AttributeValue) error
 }
 
-// Storer is the interface to the K/V retrieval of Contenders
+// Storer is the interface to the K/V retrieval of Contenders. Writes
+// are made only if the condition of the item's own input, and of any
+// WriteOptions, holds, and otherwise fail with ErrConditionFailed
 type Storer interface {
-	Set(context.Context, Item) error
+	Set(context.Context, Item, ...WriteOption) error
+	// BatchSet saves many items at once, and returns a *BatchError
+	// naming any it couldn't save. Like BatchWriteItem, it can't check
+	// conditions, so it rejects items whose puts have one
+	BatchSet(context.Context, []Item) error
 	Get(context.Context, Item) (Item, error)
-	Update(context.Context, Item) error
-	Delete(context.Context, Item) error
+	// BatchGet retrieves many items at once, and returns those it found,
+	// in the order they were given
+	BatchGet(context.Context, []Item) ([]Item, error)
+	Update(context.Context, Item, ...WriteOption) error
+	Delete(context.Context, Item, ...WriteOption) error
 	Scan(context.Context, Scannable) error
 	Query(context.Context, Queryable, int) error
 }
+
+// TableEnsurer is implemented by Storers whose tables might not exist
+// yet, so they can be checked, or created, before they're first used
+// rather than by the first write
+type TableEnsurer interface {
+	EnsureTable(ctx context.Context, item Item, create bool) error
+}
+
+// EnsureTable checks that the table of the Storer exists, creating it
+// from the item if create is set. Storers that aren't TableEnsurers, like
+// the in-memory one, always have their table
+func EnsureTable(ctx context.Context, db Storer, item Item, create bool) error {
+	if ensurer, ok := db.(TableEnsurer); ok {
+		return ensurer.EnsureTable(ctx, item, create)
+	}
+	return nil
+}
@@ -2,17 +2,52 @@ package dynamostore
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TableConfig allows us to set configuration details
 // for the dynamo table from the app
 type TableConfig struct {
-	TableName     string
+	TableName string
+	// BillingMode is PROVISIONED, when the table has the read and write
+	// capacity below, or PAY_PER_REQUEST
+	BillingMode   string
 	ReadCapacity  int64
 	WriteCapacity int64
+	// IndexCapacity is the provisioned capacity of GSIs, by index name.
+	// GSIs that aren't in it have the table's capacity
+	IndexCapacity Capacities
+
+	// SSE encrypts the table with a KMS key, the one with SSEKMSKeyID,
+	// or the AWS managed key if that's empty
+	SSE         bool
+	SSEKMSKeyID string
+	// PointInTimeRecovery turns on continuous backups once the table is
+	// created
+	PointInTimeRecovery bool
+	// Tags are added to the table once it's created
+	Tags Tags
+
+	// Retry controls how throttled and failed requests are retried
+	Retry RetryPolicy
+	// Timeouts bound how long each operation on the table, retries
+	// included, can take
+	Timeouts Timeouts
+	// Metrics is told about retries. If it's nil, they're counted in
+	// the dynamostore_retries and dynamostore_retries_exhausted expvars
+	Metrics RetryMetrics
+	// TracerProvider traces each Dynamo call. If it's nil, the global
+	// one is used
+	TracerProvider trace.TracerProvider
 }
 
 // Flags returns a slice of the configuration options for the contender table
@@ -25,6 +60,13 @@ func (c *TableConfig) Flags(prefix, defaultTableName string) []cli.Flag {
 			Value:       defaultTableName,
 			Destination: &c.TableName,
 		},
+		cli.StringFlag{
+			Name:        cliFlagName(prefix, "table-billing-mode"),
+			EnvVar:      envVarName(prefix, "TABLE_BILLING_MODE"),
+			Usage:       "PROVISIONED, to use the read and write capacity, or PAY_PER_REQUEST",
+			Value:       string(dynamodb.BillingModeProvisioned),
+			Destination: &c.BillingMode,
+		},
 		cli.Int64Flag{
 			Name:        cliFlagName(prefix, "table-read-capacity"),
 			EnvVar:      envVarName(prefix, "TABLE_READ_CAPACITY"),
@@ -37,11 +79,282 @@ func (c *TableConfig) Flags(prefix, defaultTableName string) []cli.Flag {
 			Value:       5,
 			Destination: &c.WriteCapacity,
 		},
+		cli.GenericFlag{
+			Name:   cliFlagName(prefix, "table-index-capacity"),
+			EnvVar: envVarName(prefix, "TABLE_INDEX_CAPACITY"),
+			Usage:  "the capacity of a GSI, as name=read:write, if it shouldn't have the table's",
+			Value:  &c.IndexCapacity,
+		},
+		cli.BoolFlag{
+			Name:        cliFlagName(prefix, "table-sse"),
+			EnvVar:      envVarName(prefix, "TABLE_SSE"),
+			Usage:       "encrypt the table with a KMS key",
+			Destination: &c.SSE,
+		},
+		cli.StringFlag{
+			Name:        cliFlagName(prefix, "table-sse-kms-key-id"),
+			EnvVar:      envVarName(prefix, "TABLE_SSE_KMS_KEY_ID"),
+			Usage:       "the KMS key to encrypt the table with, if not the AWS managed one",
+			Destination: &c.SSEKMSKeyID,
+		},
+		cli.BoolFlag{
+			Name:        cliFlagName(prefix, "table-point-in-time-recovery"),
+			EnvVar:      envVarName(prefix, "TABLE_POINT_IN_TIME_RECOVERY"),
+			Usage:       "turn on continuous backups for the table",
+			Destination: &c.PointInTimeRecovery,
+		},
+		cli.GenericFlag{
+			Name:   cliFlagName(prefix, "table-tags"),
+			EnvVar: envVarName(prefix, "TABLE_TAGS"),
+			Usage:  "a tag for the table, as key=value",
+			Value:  &c.Tags,
+		},
+		cli.IntFlag{
+			Name:        cliFlagName(prefix, "retry-max-attempts"),
+			EnvVar:      envVarName(prefix, "RETRY_MAX_ATTEMPTS"),
+			Usage:       "how many times a request is sent before giving up, in all",
+			Value:       DefaultRetryMaxAttempts,
+			Destination: &c.Retry.MaxAttempts,
+		},
+		cli.DurationFlag{
+			Name:        cliFlagName(prefix, "retry-base-delay"),
+			EnvVar:      envVarName(prefix, "RETRY_BASE_DELAY"),
+			Usage:       "the most to wait before the first retry, which doubles with each attempt",
+			Value:       DefaultRetryBaseDelay,
+			Destination: &c.Retry.BaseDelay,
+		},
+		cli.DurationFlag{
+			Name:        cliFlagName(prefix, "retry-max-delay"),
+			EnvVar:      envVarName(prefix, "RETRY_MAX_DELAY"),
+			Usage:       "the most to wait before any retry",
+			Value:       DefaultRetryMaxDelay,
+			Destination: &c.Retry.MaxDelay,
+		},
+		cli.DurationFlag{
+			Name:        cliFlagName(prefix, "operation-timeout"),
+			EnvVar:      envVarName(prefix, "OPERATION_TIMEOUT"),
+			Usage:       "the longest an operation on the table, retries included, can take, or 0 for no limit",
+			Value:       DefaultOperationTimeout,
+			Destination: &c.Timeouts.Default,
+		},
+		cli.GenericFlag{
+			Name:   cliFlagName(prefix, "operation-timeouts"),
+			EnvVar: envVarName(prefix, "OPERATION_TIMEOUTS"),
+			Usage:  "the timeout of an operation, e.g. Scan=10s, if it shouldn't have the default",
+			Value:  &c.Timeouts.ByOperation,
+		},
+	}
+}
+
+// Configure sets the billing mode, capacity and encryption of a table's
+// CreateTableInput, and of its GSIs, from the config. Items call it from
+// their CreateTableInput, so every table is created the same way
+func (c *TableConfig) Configure(input *dynamodb.CreateTableInput) *dynamodb.CreateTableInput {
+	input.BillingMode = c.billingMode()
+	input.ProvisionedThroughput = c.throughput(Capacity{Read: c.ReadCapacity, Write: c.WriteCapacity})
+	for i := range input.GlobalSecondaryIndexes {
+		index := &input.GlobalSecondaryIndexes[i]
+		capacity, ok := c.IndexCapacity[aws.StringValue(index.IndexName)]
+		if !ok {
+			capacity = Capacity{Read: c.ReadCapacity, Write: c.WriteCapacity}
+		}
+		index.ProvisionedThroughput = c.throughput(capacity)
+	}
+	if c.SSE {
+		input.SSESpecification = &dynamodb.SSESpecification{
+			Enabled: aws.Bool(true),
+			SSEType: dynamodb.SSETypeKms,
+		}
+		if c.SSEKMSKeyID != "" {
+			input.SSESpecification.KMSMasterKeyId = aws.String(c.SSEKMSKeyID)
+		}
+	}
+	return input
+}
+
+// TableOptions returns the options the config needs applied once the
+// table is created, for point in time recovery and tags
+func (c *TableConfig) TableOptions() []TableOption {
+	var ret []TableOption
+	if c.PointInTimeRecovery {
+		ret = append(ret, NewPITROption(c.TableName))
+	}
+	if len(c.Tags) > 0 {
+		ret = append(ret, NewTagsOption(c.TableName, c.Tags))
+	}
+	return ret
+}
+
+// PayPerRequest reports whether the table is billed per request, rather
+// than having provisioned capacity
+func (c *TableConfig) PayPerRequest() bool {
+	return c.billingMode() == dynamodb.BillingModePayPerRequest
+}
+
+func (c *TableConfig) billingMode() dynamodb.BillingMode {
+	if c.BillingMode == "" {
+		return dynamodb.BillingModeProvisioned
+	}
+	return dynamodb.BillingMode(strings.ToUpper(c.BillingMode))
+}
+
+// throughput returns the provisioned throughput for the capacity, which
+// tables billed per request mustn't have
+func (c *TableConfig) throughput(capacity Capacity) *dynamodb.ProvisionedThroughput {
+	if c.PayPerRequest() {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(capacity.Read),
+		WriteCapacityUnits: aws.Int64(capacity.Write),
+	}
+}
+
+// Capacity is a provisioned read and write capacity
+type Capacity struct {
+	Read  int64
+	Write int64
+}
+
+// Capacities are capacities by index name. They're a cli.Generic, set
+// from comma separated name=read:write pairs
+type Capacities map[string]Capacity
+
+// Set adds the capacities in the value
+func (cs *Capacities) Set(value string) error {
+	if *cs == nil {
+		*cs = Capacities{}
+	}
+	return eachPair(value, func(name, capacity string) error {
+		parts := strings.Split(capacity, ":")
+		if len(parts) != 2 {
+			return errors.Errorf("capacity of %s must be read:write", name)
+		}
+		read, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid read capacity of %s", name)
+		}
+		write, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid write capacity of %s", name)
+		}
+		(*cs)[name] = Capacity{Read: read, Write: write}
+		return nil
+	})
+}
+
+func (cs *Capacities) String() string {
+	pairs := []string{}
+	for name, capacity := range *cs {
+		pairs = append(pairs, fmt.Sprintf("%s=%d:%d", name, capacity.Read, capacity.Write))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Timeouts bound operations on a table, so that a slow or unreachable
+// Dynamo can't hold callers up for longer than they'd wait. Zero values
+// don't bound operations, beyond their context's deadline
+type Timeouts struct {
+	// Default bounds the operations that aren't in ByOperation
+	Default     time.Duration
+	ByOperation OperationTimeouts
+}
+
+// For returns the timeout of the operation, e.g. Get, Scan or
+// BatchWriteItem
+func (t Timeouts) For(operation string) time.Duration {
+	if timeout, ok := t.ByOperation[operation]; ok {
+		return timeout
+	}
+	return t.Default
+}
+
+// OperationTimeouts are timeouts by operation name. They're a
+// cli.Generic, set from comma separated operation=duration pairs
+type OperationTimeouts map[string]time.Duration
+
+// Set adds the timeouts in the value
+func (ts *OperationTimeouts) Set(value string) error {
+	if *ts == nil {
+		*ts = OperationTimeouts{}
+	}
+	return eachPair(value, func(operation, timeout string) error {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timeout of %s", operation)
+		}
+		(*ts)[operation] = d
+		return nil
+	})
+}
+
+func (ts *OperationTimeouts) String() string {
+	pairs := []string{}
+	for operation, timeout := range *ts {
+		pairs = append(pairs, operation+"="+timeout.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Tags are table tags. They're a cli.Generic, set from comma separated
+// key=value pairs
+type Tags map[string]string
+
+// Set adds the tags in the value
+func (t *Tags) Set(value string) error {
+	if *t == nil {
+		*t = Tags{}
+	}
+	return eachPair(value, func(key, val string) error {
+		(*t)[key] = val
+		return nil
+	})
+}
+
+// Dynamo returns the tags as Dynamo expects them, in key order
+func (t Tags) Dynamo() []dynamodb.Tag {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := make([]dynamodb.Tag, len(keys))
+	for i, key := range keys {
+		ret[i] = dynamodb.Tag{Key: aws.String(key), Value: aws.String(t[key])}
+	}
+	return ret
+}
+
+func (t *Tags) String() string {
+	pairs := []string{}
+	for key, val := range *t {
+		pairs = append(pairs, key+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// eachPair calls fn with each of the comma separated key=value pairs
+func eachPair(value string, fn func(key, val string) error) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.Errorf("%q must be key=value", pair)
+		}
+		if err := fn(parts[0], parts[1]); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func envVarName(prefix, name string) string {
-	return strings.Replace("-", "_", strings.ToUpper(cliFlagName(prefix, name)), -1)
+	return strings.Replace(strings.ToUpper(cliFlagName(prefix, name)), "-", "_", -1)
 }
 
 func cliFlagName(prefix, name string) string {
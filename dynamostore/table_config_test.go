@@ -0,0 +1,98 @@
+package dynamostore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+func testTableInput() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String("Test"),
+		GlobalSecondaryIndexes: []dynamodb.GlobalSecondaryIndex{
+			{IndexName: aws.String("ByScore")},
+			{IndexName: aws.String("ByName")},
+		},
+	}
+}
+
+func TestTableConfigConfigure(t *testing.T) {
+	t.Run("provisioned", func(t *testing.T) {
+		c := &TableConfig{TableName: "Test", ReadCapacity: 5, WriteCapacity: 3}
+		require.NoError(t, c.IndexCapacity.Set("ByScore=10:1"))
+
+		input := c.Configure(testTableInput())
+		assert.Equal(t, dynamodb.BillingModeProvisioned, input.BillingMode)
+		assert.Equal(t, int64(5), aws.Int64Value(input.ProvisionedThroughput.ReadCapacityUnits))
+		assert.Equal(t, int64(3), aws.Int64Value(input.ProvisionedThroughput.WriteCapacityUnits))
+		assert.Equal(t, int64(10), aws.Int64Value(input.GlobalSecondaryIndexes[0].ProvisionedThroughput.ReadCapacityUnits))
+		assert.Equal(t, int64(1), aws.Int64Value(input.GlobalSecondaryIndexes[0].ProvisionedThroughput.WriteCapacityUnits))
+		assert.Equal(t, int64(5), aws.Int64Value(input.GlobalSecondaryIndexes[1].ProvisionedThroughput.ReadCapacityUnits))
+		assert.Nil(t, input.SSESpecification)
+		assert.Empty(t, c.TableOptions())
+	})
+	t.Run("pay per request", func(t *testing.T) {
+		c := &TableConfig{TableName: "Test", BillingMode: "pay_per_request", ReadCapacity: 5, WriteCapacity: 5}
+
+		input := c.Configure(testTableInput())
+		assert.Equal(t, dynamodb.BillingModePayPerRequest, input.BillingMode)
+		assert.Nil(t, input.ProvisionedThroughput)
+		for _, index := range input.GlobalSecondaryIndexes {
+			assert.Nil(t, index.ProvisionedThroughput)
+		}
+	})
+	t.Run("encryption, backups and tags", func(t *testing.T) {
+		c := &TableConfig{TableName: "Test", SSE: true, SSEKMSKeyID: "alias/tattoos", PointInTimeRecovery: true}
+		require.NoError(t, c.Tags.Set("team=tattoos"))
+
+		input := c.Configure(testTableInput())
+		require.NotNil(t, input.SSESpecification)
+		assert.True(t, aws.BoolValue(input.SSESpecification.Enabled))
+		assert.Equal(t, dynamodb.SSETypeKms, input.SSESpecification.SSEType)
+		assert.Equal(t, "alias/tattoos", aws.StringValue(input.SSESpecification.KMSMasterKeyId))
+
+		names := []string{}
+		for _, opt := range c.TableOptions() {
+			names = append(names, opt.Name())
+		}
+		assert.Equal(t, []string{"PITR", "Tags"}, names)
+	})
+}
+
+func TestTableConfigFlags(t *testing.T) {
+	c := &TableConfig{}
+	envVars := map[string]string{}
+	for _, f := range c.Flags("user-matchups", "User-Past-Matchups") {
+		if sf, ok := f.(cli.StringFlag); ok {
+			envVars[sf.Name] = sf.EnvVar
+		}
+	}
+	assert.Equal(t, "USER_MATCHUPS_TABLE_NAME", envVars["user-matchups-table-name"])
+}
+
+func TestTableConfigFlagValues(t *testing.T) {
+	var cs Capacities
+	require.NoError(t, cs.Set("ByScore=10:1, ByName=2:2"))
+	require.NoError(t, cs.Set("Other=1:1"))
+	assert.Equal(t, "ByName=2:2,ByScore=10:1,Other=1:1", cs.String())
+	assert.Error(t, cs.Set("ByScore=10"))
+	assert.Error(t, cs.Set("ByScore=a:1"))
+	assert.Error(t, cs.Set("=1:1"))
+
+	var tags Tags
+	require.NoError(t, tags.Set("team=tattoos,env=prod=blue"))
+	assert.Equal(t, Tags{"team": "tattoos", "env": "prod=blue"}, tags)
+	assert.Error(t, tags.Set("team"))
+
+	var timeouts OperationTimeouts
+	require.NoError(t, timeouts.Set("Scan=10s,Get=250ms"))
+	assert.Equal(t, "Get=250ms,Scan=10s", timeouts.String())
+	assert.Equal(t, 250*time.Millisecond, Timeouts{Default: time.Second, ByOperation: timeouts}.For("Get"))
+	assert.Equal(t, time.Second, Timeouts{Default: time.Second, ByOperation: timeouts}.For("Set"))
+	assert.Error(t, timeouts.Set("Scan=soon"))
+}
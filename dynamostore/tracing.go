@@ -0,0 +1,42 @@
+package dynamostore
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the instrumentation the dynamostore spans come from
+const tracerName = "github.com/sbogacz/wouldyoutatter/dynamostore"
+
+// startSpan starts the span of a Dynamo call, which lasts through any
+// retries of it
+func (s *dynamoStore) startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	provider := s.c.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName).Start(ctx, "DynamoDB."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "dynamodb"),
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", "DynamoDB"),
+			attribute.String("rpc.method", operation),
+			attribute.StringSlice("aws.dynamodb.table_names", []string{s.c.TableName}),
+		),
+	)
+}
+
+// endSpan ends the span of a Dynamo call, recording its error, if it
+// failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorCode(err))
+	}
+	span.End()
+}
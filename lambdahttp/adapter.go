@@ -0,0 +1,337 @@
+// Package lambdahttp serves Lambda events from API Gateway (REST APIs,
+// and HTTP APIs in either payload format) and Application Load Balancers
+// with an http.Handler, in process, so the service runs the same on
+// Lambda as it does behind its own server
+package lambdahttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+// requestIDHeader is set from API Gateway's request ID, if the caller
+// didn't send one
+const requestIDHeader = "X-Request-Id"
+
+// Adapter turns Lambda events into http.Requests for its handler, and
+// the handler's responses back into the event's responses. It can be
+// given to lambda.StartHandler, and works out which kind of event it's
+// been sent
+type Adapter struct {
+	handler http.Handler
+	// StripPrefix is removed from the start of request paths, e.g. the
+	// base path of a custom domain's mapping to a REST API
+	StripPrefix string
+	// BinaryResponses says the REST API's binaryMediaTypes include */*,
+	// so it passes on the base64 bodies of compressed responses. Without
+	// it, the Accept-Encoding of REST API events (and of HTTP API events
+	// in payload format 1.0, which can't be told apart) is removed, so the
+	// handler answers them uncompressed
+	BinaryResponses bool
+}
+
+// New returns an Adapter for the handler
+func New(h http.Handler) *Adapter {
+	return &Adapter{handler: h}
+}
+
+// Invoke serves the event in the payload, which may be a REST API, HTTP
+// API or ALB event
+func (a *Adapter) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	var probe struct {
+		Version        string `json:"version"`
+		RequestContext struct {
+			ELB *json.RawMessage `json:"elb"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, errors.Wrap(err, "failed to decode event")
+	}
+
+	var resp interface{}
+	var err error
+	switch {
+	case probe.Version == "2.0":
+		var req HTTPAPIRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, errors.Wrap(err, "failed to decode HTTP API event")
+		}
+		resp, err = a.HTTPAPI(ctx, req)
+	case probe.RequestContext.ELB != nil:
+		var req ALBRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, errors.Wrap(err, "failed to decode ALB event")
+		}
+		resp, err = a.ALB(ctx, req)
+	default:
+		var req events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, errors.Wrap(err, "failed to decode API Gateway event")
+		}
+		resp, err = a.Proxy(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// Proxy serves a REST API event, or an HTTP API event in payload format
+// 1.0
+func (a *Adapter) Proxy(ctx context.Context, event events.APIGatewayProxyRequest) (ProxyResponse, error) {
+	path := event.Path
+	if path == "" {
+		path = fillPath(event.Resource, event.PathParameters)
+	}
+	query := url.Values{}
+	for k, vs := range event.MultiValueQueryStringParameters {
+		query[k] = append([]string(nil), vs...)
+	}
+	for k, v := range event.QueryStringParameters {
+		if _, ok := query[k]; !ok {
+			query.Set(k, v)
+		}
+	}
+	req, err := a.newRequest(ctx, event.HTTPMethod, path, query.Encode(), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return ProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+	}
+	for k, vs := range event.MultiValueHeaders {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	for k, v := range event.Headers {
+		if _, ok := req.Header[http.CanonicalHeaderKey(k)]; !ok {
+			req.Header.Set(k, v)
+		}
+	}
+	setRequestDetails(req, event.RequestContext.Identity.SourceIP, event.RequestContext.RequestID)
+	if !a.BinaryResponses {
+		req.Header.Del("Accept-Encoding")
+	}
+
+	rec := a.serve(req)
+	body, isBase64 := encodeBody(rec)
+	return ProxyResponse{
+		StatusCode:        rec.Code,
+		MultiValueHeaders: rec.Result().Header,
+		Body:              body,
+		IsBase64Encoded:   isBase64,
+	}, nil
+}
+
+// HTTPAPI serves an HTTP API event in payload format 2.0. Its raw path
+// includes the stage, unless it's the $default stage, so that's removed
+func (a *Adapter) HTTPAPI(ctx context.Context, event HTTPAPIRequest) (HTTPAPIResponse, error) {
+	path, err := url.PathUnescape(event.RawPath)
+	if err != nil {
+		return HTTPAPIResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+	}
+	if stage := event.RequestContext.Stage; stage != "" && stage != "$default" {
+		path = trimPathPrefix(path, "/"+stage)
+	}
+	method := event.RequestContext.HTTP.Method
+	req, err := a.newRequest(ctx, method, path, event.RawQueryString, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return HTTPAPIResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+	}
+	// repeated headers arrive joined with commas, which is how they'd
+	// arrive over HTTP too
+	for k, v := range event.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(event.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	if req.Host == "" {
+		req.Host = event.RequestContext.DomainName
+	}
+	setRequestDetails(req, event.RequestContext.HTTP.SourceIP, event.RequestContext.RequestID)
+
+	rec := a.serve(req)
+	resp := HTTPAPIResponse{StatusCode: rec.Code, Headers: map[string]string{}}
+	for k, vs := range rec.Result().Header {
+		if k == "Set-Cookie" {
+			resp.Cookies = append(resp.Cookies, vs...)
+			continue
+		}
+		resp.Headers[k] = strings.Join(vs, ", ")
+	}
+	resp.Body, resp.IsBase64Encoded = encodeBody(rec)
+	return resp, nil
+}
+
+// ALB serves an Application Load Balancer event, answering with the
+// same kind of headers as it was sent
+func (a *Adapter) ALB(ctx context.Context, event ALBRequest) (ALBResponse, error) {
+	// the ALB passes the query string on as it received it, so it's
+	// still encoded
+	var pairs []string
+	if len(event.MultiValueQueryStringParameters) > 0 {
+		for k, vs := range event.MultiValueQueryStringParameters {
+			for _, v := range vs {
+				pairs = append(pairs, k+"="+v)
+			}
+		}
+	} else {
+		for k, v := range event.QueryStringParameters {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	multiValue := len(event.MultiValueHeaders) > 0
+
+	req, err := a.newRequest(ctx, event.HTTPMethod, event.Path, strings.Join(pairs, "&"), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return ALBResponse{StatusCode: http.StatusBadRequest, StatusDescription: statusDescription(http.StatusBadRequest), Body: err.Error()}, nil
+	}
+	if multiValue {
+		for k, vs := range event.MultiValueHeaders {
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+	} else {
+		for k, v := range event.Headers {
+			req.Header.Set(k, v)
+		}
+	}
+	setRequestDetails(req, req.Header.Get("X-Forwarded-For"), "")
+
+	rec := a.serve(req)
+	resp := ALBResponse{StatusCode: rec.Code, StatusDescription: statusDescription(rec.Code)}
+	if multiValue {
+		resp.MultiValueHeaders = rec.Result().Header
+	} else {
+		resp.Headers = map[string]string{}
+		for k, vs := range rec.Result().Header {
+			if k == "Set-Cookie" {
+				// only one Set-Cookie can survive without multi-value
+				// headers
+				resp.Headers[k] = vs[len(vs)-1]
+				continue
+			}
+			resp.Headers[k] = strings.Join(vs, ", ")
+		}
+	}
+	resp.Body, resp.IsBase64Encoded = encodeBody(rec)
+	return resp, nil
+}
+
+// newRequest builds the request from an event's parts. The path is
+// unescaped, and the query string escaped
+func (a *Adapter) newRequest(ctx context.Context, method, path, rawQuery, body string, isBase64 bool) (*http.Request, error) {
+	b := []byte(body)
+	if isBase64 {
+		var err error
+		if b, err = base64.StdEncoding.DecodeString(body); err != nil {
+			return nil, errors.Wrap(err, "failed to decode base64 body")
+		}
+	}
+	if a.StripPrefix != "" {
+		path = trimPathPrefix(path, a.StripPrefix)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u := &url.URL{Path: path, RawQuery: rawQuery}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = u.RequestURI()
+	return req.WithContext(ctx), nil
+}
+
+func (a *Adapter) serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// setRequestDetails sets the caller's address and the Host, and the
+// request ID from the event, unless the caller sent one
+func setRequestDetails(req *http.Request, sourceIP, requestID string) {
+	if sourceIP != "" {
+		req.RemoteAddr = strings.TrimSpace(strings.Split(sourceIP, ",")[0])
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if requestID != "" && req.Header.Get(requestIDHeader) == "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+}
+
+// fillPath fills a resource's path parameters in, e.g. /contenders/{id}
+// or /{proxy+}
+func fillPath(resource string, params map[string]string) string {
+	segments := strings.Split(resource, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.Trim(segment, "{}"), "+")
+		segments[i] = params[name]
+	}
+	return strings.Join(segments, "/")
+}
+
+// trimPathPrefix removes the prefix from the path, if it's a whole
+// number of segments of it
+func trimPathPrefix(path, prefix string) string {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if path == prefix {
+		return "/"
+	}
+	if strings.HasPrefix(path, prefix+"/") {
+		return strings.TrimPrefix(path, prefix)
+	}
+	return path
+}
+
+// encodeBody returns the response body, base64 encoded unless it's text
+// which hasn't been compressed
+func encodeBody(rec *httptest.ResponseRecorder) (string, bool) {
+	b := rec.Body.Bytes()
+	header := rec.Result().Header
+	if header.Get("Content-Encoding") == "" && isText(header.Get("Content-Type")) {
+		return string(b), false
+	}
+	if len(b) == 0 {
+		return "", false
+	}
+	return base64.StdEncoding.EncodeToString(b), true
+}
+
+func isText(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == "application/javascript" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+func statusDescription(code int) string {
+	return fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
@@ -0,0 +1,304 @@
+package lambdahttp_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/go-chi/chi"
+	"github.com/sbogacz/wouldyoutatter/lambdahttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo is what the test handler saw of a request
+type echo struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	ID         string              `json:"id"`
+	Query      map[string][]string `json:"query"`
+	Accept     []string            `json:"accept"`
+	Cookie     string              `json:"cookie"`
+	RequestID  string              `json:"request_id"`
+	RemoteAddr string              `json:"remote_addr"`
+	Host       string              `json:"host"`
+	Body       []byte              `json:"body,omitempty"`
+}
+
+var binary = []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+
+func newHandler() http.Handler {
+	r := chi.NewRouter()
+	r.HandleFunc("/contenders/{id}", func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(echo{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			ID:         chi.URLParam(req, "id"),
+			Query:      req.URL.Query(),
+			Accept:     req.Header["Accept"],
+			Cookie:     req.Header.Get("Cookie"),
+			RequestID:  req.Header.Get("X-Request-Id"),
+			RemoteAddr: req.RemoteAddr,
+			Host:       req.Host,
+			Body:       body,
+		})
+	})
+	r.Get("/compressed", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte("hello"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("hello"))
+		gz.Close()
+	})
+	r.Get("/image", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(binary)
+	})
+	return r
+}
+
+func decodeEcho(t *testing.T, body string, isBase64 bool) echo {
+	require.False(t, isBase64)
+	var e echo
+	require.NoError(t, json.Unmarshal([]byte(body), &e))
+	return e
+}
+
+func TestProxy(t *testing.T) {
+	cases := []struct {
+		name  string
+		strip string
+		event events.APIGatewayProxyRequest
+		want  echo
+	}{
+		{
+			name: "multi-value headers and query",
+			event: events.APIGatewayProxyRequest{
+				HTTPMethod:                      "POST",
+				Path:                            "/contenders/koi",
+				MultiValueHeaders:               map[string][]string{"Accept": {"text/html", "application/json"}},
+				MultiValueQueryStringParameters: map[string][]string{"tag": {"fish", "water"}, "q": {"a b&c"}},
+				QueryStringParameters:           map[string]string{"tag": "water", "q": "a b&c"},
+				Body:                            "hello",
+				RequestContext: events.APIGatewayProxyRequestContext{
+					RequestID: "gateway-id",
+					Identity:  events.APIGatewayRequestIdentity{SourceIP: "1.2.3.4"},
+				},
+			},
+			want: echo{
+				Method: "POST", Path: "/contenders/koi", ID: "koi",
+				Query:     map[string][]string{"tag": {"fish", "water"}, "q": {"a b&c"}},
+				Accept:    []string{"text/html", "application/json"},
+				RequestID: "gateway-id", RemoteAddr: "1.2.3.4", Body: []byte("hello"),
+			},
+		},
+		{
+			name: "single-value headers and a binary body",
+			event: events.APIGatewayProxyRequest{
+				HTTPMethod:      "PUT",
+				Path:            "/contenders/koi",
+				Headers:         map[string]string{"Accept": "application/json", "X-Request-Id": "caller-id", "Host": "tatter.example"},
+				Body:            base64.StdEncoding.EncodeToString(binary),
+				IsBase64Encoded: true,
+				RequestContext:  events.APIGatewayProxyRequestContext{RequestID: "gateway-id"},
+			},
+			want: echo{
+				Method: "PUT", Path: "/contenders/koi", ID: "koi", Query: map[string][]string{},
+				Accept: []string{"application/json"}, RequestID: "caller-id", Host: "tatter.example", Body: binary,
+			},
+		},
+		{
+			name: "path parameters, without a path",
+			event: events.APIGatewayProxyRequest{
+				HTTPMethod:     "GET",
+				Resource:       "/{proxy+}",
+				PathParameters: map[string]string{"proxy": "contenders/skull"},
+			},
+			want: echo{Method: "GET", Path: "/contenders/skull", ID: "skull", Query: map[string][]string{}},
+		},
+		{
+			name:  "base path",
+			strip: "/api",
+			event: events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/api/contenders/rose"},
+			want:  echo{Method: "GET", Path: "/contenders/rose", ID: "rose", Query: map[string][]string{}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			adapter := lambdahttp.New(newHandler())
+			adapter.StripPrefix = c.strip
+			resp, err := adapter.Proxy(context.Background(), c.event)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Equal(t, []string{"a=1", "b=2"}, resp.MultiValueHeaders["Set-Cookie"])
+			assert.Equal(t, c.want, decodeEcho(t, resp.Body, resp.IsBase64Encoded))
+		})
+	}
+	t.Run("binary responses", func(t *testing.T) {
+		resp, err := lambdahttp.New(newHandler()).Proxy(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/image"})
+		require.NoError(t, err)
+		assert.True(t, resp.IsBase64Encoded)
+		assert.Equal(t, base64.StdEncoding.EncodeToString(binary), resp.Body)
+	})
+	t.Run("compression needs binary responses", func(t *testing.T) {
+		event := events.APIGatewayProxyRequest{
+			HTTPMethod:        "GET",
+			Path:              "/compressed",
+			MultiValueHeaders: map[string][]string{"Accept-Encoding": {"gzip"}},
+		}
+		resp, err := lambdahttp.New(newHandler()).Proxy(context.Background(), event)
+		require.NoError(t, err)
+		assert.False(t, resp.IsBase64Encoded)
+		assert.Empty(t, resp.MultiValueHeaders["Content-Encoding"])
+		assert.Equal(t, "hello", resp.Body)
+
+		adapter := lambdahttp.New(newHandler())
+		adapter.BinaryResponses = true
+		resp, err = adapter.Proxy(context.Background(), event)
+		require.NoError(t, err)
+		assert.True(t, resp.IsBase64Encoded)
+		assert.Equal(t, []string{"gzip"}, resp.MultiValueHeaders["Content-Encoding"])
+	})
+	t.Run("bad bodies", func(t *testing.T) {
+		resp, err := lambdahttp.New(newHandler()).Proxy(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: "POST", Path: "/contenders/koi", Body: "not base64!", IsBase64Encoded: true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestHTTPAPI(t *testing.T) {
+	cases := []struct {
+		name  string
+		event lambdahttp.HTTPAPIRequest
+		want  echo
+	}{
+		{
+			name: "default stage",
+			event: lambdahttp.HTTPAPIRequest{
+				Version:        "2.0",
+				RawPath:        "/contenders/koi%20fish",
+				RawQueryString: "tag=fish&tag=water",
+				Cookies:        []string{"user=1", "theme=dark"},
+				Headers:        map[string]string{"accept": "text/html,application/json"},
+				Body:           "hello",
+				RequestContext: lambdahttp.HTTPAPIRequestContext{
+					DomainName: "tatter.example",
+					RequestID:  "gateway-id",
+					Stage:      "$default",
+					HTTP:       lambdahttp.HTTPAPIRequestContextHTTP{Method: "POST", SourceIP: "1.2.3.4"},
+				},
+			},
+			want: echo{
+				Method: "POST", Path: "/contenders/koi fish", ID: "koi fish",
+				Query:  map[string][]string{"tag": {"fish", "water"}},
+				Accept: []string{"text/html,application/json"}, Cookie: "user=1; theme=dark",
+				RequestID: "gateway-id", RemoteAddr: "1.2.3.4", Host: "tatter.example", Body: []byte("hello"),
+			},
+		},
+		{
+			name: "named stage",
+			event: lambdahttp.HTTPAPIRequest{
+				Version: "2.0",
+				RawPath: "/v1/contenders/koi",
+				RequestContext: lambdahttp.HTTPAPIRequestContext{
+					Stage: "v1",
+					HTTP:  lambdahttp.HTTPAPIRequestContextHTTP{Method: "GET"},
+				},
+			},
+			want: echo{Method: "GET", Path: "/contenders/koi", ID: "koi", Query: map[string][]string{}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := lambdahttp.New(newHandler()).HTTPAPI(context.Background(), c.event)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Equal(t, []string{"a=1", "b=2"}, resp.Cookies)
+			assert.NotContains(t, resp.Headers, "Set-Cookie")
+			assert.Equal(t, c.want, decodeEcho(t, resp.Body, resp.IsBase64Encoded))
+		})
+	}
+}
+
+func TestALB(t *testing.T) {
+	t.Run("multi-value", func(t *testing.T) {
+		resp, err := lambdahttp.New(newHandler()).ALB(context.Background(), lambdahttp.ALBRequest{
+			HTTPMethod:                      "GET",
+			Path:                            "/contenders/koi",
+			MultiValueQueryStringParameters: map[string][]string{"q": {"a%20b", "c"}},
+			MultiValueHeaders:               map[string][]string{"accept": {"text/html", "application/json"}, "x-forwarded-for": {"1.2.3.4, 10.0.0.1"}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "201 Created", resp.StatusDescription)
+		assert.Nil(t, resp.Headers)
+		assert.Equal(t, []string{"a=1", "b=2"}, resp.MultiValueHeaders["Set-Cookie"])
+		assert.Equal(t, echo{
+			Method: "GET", Path: "/contenders/koi", ID: "koi",
+			Query:  map[string][]string{"q": {"a b", "c"}},
+			Accept: []string{"text/html", "application/json"}, RemoteAddr: "1.2.3.4",
+		}, decodeEcho(t, resp.Body, resp.IsBase64Encoded))
+	})
+	t.Run("single-value", func(t *testing.T) {
+		resp, err := lambdahttp.New(newHandler()).ALB(context.Background(), lambdahttp.ALBRequest{
+			HTTPMethod:            "GET",
+			Path:                  "/image",
+			QueryStringParameters: map[string]string{"q": "a%20b"},
+			Headers:               map[string]string{"accept": "image/png"},
+		})
+		require.NoError(t, err)
+		assert.Nil(t, resp.MultiValueHeaders)
+		assert.Equal(t, "image/png", resp.Headers["Content-Type"])
+		assert.True(t, resp.IsBase64Encoded)
+	})
+}
+
+func TestInvoke(t *testing.T) {
+	adapter := lambdahttp.New(newHandler())
+	cases := map[string]string{
+		"rest":     `{"httpMethod": "GET", "path": "/contenders/koi", "requestContext": {"stage": "prod"}}`,
+		"http api": `{"version": "2.0", "rawPath": "/contenders/koi", "requestContext": {"http": {"method": "GET"}}}`,
+		"alb":      `{"httpMethod": "GET", "path": "/contenders/koi", "requestContext": {"elb": {"targetGroupArn": "arn"}}}`,
+	}
+	for name, payload := range cases {
+		t.Run(name, func(t *testing.T) {
+			b, err := adapter.Invoke(context.Background(), []byte(payload))
+			require.NoError(t, err)
+			var resp struct {
+				StatusCode        int                 `json:"statusCode"`
+				StatusDescription string              `json:"statusDescription"`
+				Cookies           []string            `json:"cookies"`
+				MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+				Body              string              `json:"body"`
+			}
+			require.NoError(t, json.Unmarshal(b, &resp))
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Equal(t, "koi", decodeEcho(t, resp.Body, false).ID)
+			switch name {
+			case "http api":
+				assert.Len(t, resp.Cookies, 2)
+			case "alb":
+				assert.Equal(t, "201 Created", resp.StatusDescription)
+			default:
+				assert.Len(t, resp.MultiValueHeaders["Set-Cookie"], 2)
+			}
+		})
+	}
+	_, err := adapter.Invoke(context.Background(), []byte("not json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package lambdahttp
+
+// The events package of the aws-lambda-go version we're on only has the
+// REST API's request, and its response can't hold repeated headers, so
+// the rest of the events are defined here
+
+// ProxyResponse is the response to a REST API, or HTTP API payload
+// format 1.0, event. Every header goes in MultiValueHeaders, so that
+// repeated ones, like Set-Cookie, survive
+type ProxyResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// HTTPAPIRequest is an HTTP API event, in payload format 2.0
+type HTTPAPIRequest struct {
+	Version               string                `json:"version"`
+	RouteKey              string                `json:"routeKey"`
+	RawPath               string                `json:"rawPath"`
+	RawQueryString        string                `json:"rawQueryString"`
+	Cookies               []string              `json:"cookies,omitempty"`
+	Headers               map[string]string     `json:"headers"`
+	QueryStringParameters map[string]string     `json:"queryStringParameters,omitempty"`
+	PathParameters        map[string]string     `json:"pathParameters,omitempty"`
+	StageVariables        map[string]string     `json:"stageVariables,omitempty"`
+	RequestContext        HTTPAPIRequestContext `json:"requestContext"`
+	Body                  string                `json:"body,omitempty"`
+	IsBase64Encoded       bool                  `json:"isBase64Encoded"`
+}
+
+// HTTPAPIRequestContext describes where an HTTP API event came from
+type HTTPAPIRequestContext struct {
+	AccountID    string                    `json:"accountId"`
+	APIID        string                    `json:"apiId"`
+	DomainName   string                    `json:"domainName"`
+	DomainPrefix string                    `json:"domainPrefix"`
+	HTTP         HTTPAPIRequestContextHTTP `json:"http"`
+	RequestID    string                    `json:"requestId"`
+	RouteKey     string                    `json:"routeKey"`
+	Stage        string                    `json:"stage"`
+	Time         string                    `json:"time"`
+	TimeEpoch    int64                     `json:"timeEpoch"`
+	Authorizer   map[string]interface{}    `json:"authorizer,omitempty"`
+}
+
+// HTTPAPIRequestContextHTTP is the HTTP part of an HTTP API event's
+// request context
+type HTTPAPIRequestContextHTTP struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Protocol  string `json:"protocol"`
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+}
+
+// HTTPAPIResponse is the response to an HTTP API event, in payload
+// format 2.0. Repeated headers are joined with commas, except for
+// Set-Cookie, which goes in Cookies
+type HTTPAPIResponse struct {
+	StatusCode      int               `json:"statusCode"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Cookies         []string          `json:"cookies,omitempty"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+}
+
+// ALBRequest is an Application Load Balancer event. Only one of Headers
+// and MultiValueHeaders is set, depending on whether the target group
+// has multi-value headers enabled, and likewise for the query string.
+// Unlike API Gateway, the ALB leaves query string values URL encoded
+type ALBRequest struct {
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	QueryStringParameters           map[string]string   `json:"queryStringParameters,omitempty"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters,omitempty"`
+	Headers                         map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders,omitempty"`
+	RequestContext                  ALBRequestContext   `json:"requestContext"`
+	Body                            string              `json:"body"`
+	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
+}
+
+// ALBRequestContext names the target group an ALB event came from
+type ALBRequestContext struct {
+	ELB ALBContext `json:"elb"`
+}
+
+// ALBContext names the target group
+type ALBContext struct {
+	TargetGroupArn string `json:"targetGroupArn"`
+}
+
+// ALBResponse is the response to an ALB event. It uses the same kind of
+// headers as the request did
+type ALBResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
@@ -0,0 +1,153 @@
+// Package logging carries a logger in a request's context, so that
+// everything done for the request, down to the stores, logs with its
+// request ID, and keeps secrets out of the logs
+package logging
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatText logs in logrus' text format
+	FormatText = "text"
+	// FormatJSON logs a JSON object per line
+	FormatJSON = "json"
+
+	// Redacted replaces secrets in the logs
+	Redacted = "[REDACTED]"
+)
+
+type contextKey struct{}
+
+// secretHeaders are the headers whose values are never logged
+var secretHeaders = map[string]bool{
+	"X-Tatter-Master": true,
+	"X-Tatter-Admin":  true,
+	"X-Tatter-Token":  true,
+	"Authorization":   true,
+	"Cookie":          true,
+	"Set-Cookie":      true,
+}
+
+// secretParams are the query parameters whose values are never logged
+var secretParams = map[string]bool{
+	"token": true,
+}
+
+// secretFields are the log fields whose values are never logged
+var secretFields = map[string]bool{
+	"master_key": true,
+	"admin_key":  true,
+	"token":      true,
+	"cookie":     true,
+	"password":   true,
+}
+
+// New returns a logger at the level, in FormatText or FormatJSON, which
+// redacts secret fields, and secret headers of any http.Header field
+func New(level logrus.Level, format string, w io.Writer) (*logrus.Logger, error) {
+	var formatter logrus.Formatter
+	switch format {
+	case "", FormatText:
+		formatter = &logrus.TextFormatter{}
+	case FormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+	logger := logrus.New()
+	logger.SetLevel(level)
+	logger.SetOutput(w)
+	logger.Formatter = &redactingFormatter{Formatter: formatter}
+	return logger, nil
+}
+
+// WithLogger returns ctx carrying the logger
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger ctx carries, or the standard logger if
+// it doesn't carry one
+func FromContext(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// RedactHeaders returns a copy of the headers, with the values of secret
+// ones redacted
+func RedactHeaders(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for k, vs := range h {
+		if secretHeaders[http.CanonicalHeaderKey(k)] {
+			redacted[k] = []string{Redacted}
+			continue
+		}
+		redacted[k] = vs
+	}
+	return redacted
+}
+
+// RedactURL returns the request URI of u, with the values of secret query
+// parameters redacted
+func RedactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	query := u.Query()
+	for k := range query {
+		if secretParams[strings.ToLower(k)] {
+			query[k] = []string{Redacted}
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// redactingFormatter redacts secrets from an entry's fields before it's
+// formatted
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if !needsRedacting(entry.Data) {
+		return f.Formatter.Format(entry)
+	}
+	// the entry's data may be shared with other entries, so redact a copy
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case http.Header:
+			data[k] = RedactHeaders(value)
+		default:
+			if secretFields[strings.ToLower(k)] {
+				data[k] = Redacted
+				continue
+			}
+			data[k] = v
+		}
+	}
+	copied := *entry
+	copied.Data = data
+	return f.Formatter.Format(&copied)
+}
+
+func needsRedacting(data logrus.Fields) bool {
+	for k, v := range data {
+		if _, ok := v.(http.Header); ok || secretFields[strings.ToLower(k)] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/logging"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := logging.New(logrus.InfoLevel, logging.FormatJSON, &out)
+	require.NoError(t, err)
+
+	headers := http.Header{}
+	headers.Set("X-Tatter-Master", "sekrit")
+	headers.Set("Cookie", "wouldyoutatterID=abc")
+	headers.Set("Accept", "application/json")
+	logger.WithFields(logrus.Fields{
+		"headers": headers,
+		"token":   "sekrit",
+		"table":   "Contenders",
+	}).Debug("not logged")
+	logger.WithFields(logrus.Fields{
+		"headers": headers,
+		"token":   "sekrit",
+		"table":   "Contenders",
+	}).Info("logged")
+
+	assert.NotContains(t, out.String(), "sekrit")
+	assert.NotContains(t, out.String(), "not logged")
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "logged", line["msg"])
+	assert.Equal(t, logging.Redacted, line["token"])
+	assert.Equal(t, "Contenders", line["table"])
+	logged := line["headers"].(map[string]interface{})
+	assert.Equal(t, []interface{}{logging.Redacted}, logged["X-Tatter-Master"])
+	assert.Equal(t, []interface{}{logging.Redacted}, logged["Cookie"])
+	assert.Equal(t, []interface{}{"application/json"}, logged["Accept"])
+	assert.Equal(t, "sekrit", headers.Get("X-Tatter-Master"), "the logged headers aren't changed")
+
+	_, err = logging.New(logrus.InfoLevel, "xml", &out)
+	assert.Error(t, err)
+}
+
+func TestFromContext(t *testing.T) {
+	assert.NotNil(t, logging.FromContext(context.Background()), "falls back to the standard logger")
+
+	var out bytes.Buffer
+	logger, err := logging.New(logrus.InfoLevel, logging.FormatText, &out)
+	require.NoError(t, err)
+	ctx := logging.WithLogger(context.Background(), logger.WithField("request_id", "abc"))
+	logging.FromContext(ctx).Info("hi")
+	assert.Contains(t, out.String(), "request_id=abc")
+}
+
+func TestRedactURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{url: "/v1/contenders", want: "/v1/contenders"},
+		{url: "/v1/leaderboard?limit=5", want: "/v1/leaderboard?limit=5"},
+		{url: "/ws?token=sekrit&limit=5", want: "/ws?limit=5&token=%5BREDACTED%5D"},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		require.NoError(t, err)
+		assert.Equal(t, c.want, logging.RedactURL(u))
+	}
+}
@@ -0,0 +1,219 @@
+// Package migrate brings the game's tables in line with the schema their
+// items describe, creating missing tables, and adding indexes, TTL and
+// billing settings to existing ones, and then runs the versioned
+// migrations, such as backfills, that haven't been applied yet
+package migrate
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+const (
+	// TableMigrations holds the record of applied migrations
+	TableMigrations = "migrations"
+
+	// DefaultPollInterval is how often we check whether a table has
+	// finished changing, if the Migrator doesn't say
+	DefaultPollInterval = 5 * time.Second
+)
+
+// Table is one of the game's tables
+type Table struct {
+	// Name is the name the table goes by in the game, e.g. "contenders",
+	// rather than its name in Dynamo
+	Name   string
+	Config *dynamostore.TableConfig
+	// Item describes the table's schema, with its CreateTableInput and
+	// TableOptions
+	Item   dynamostore.Item
+	Storer dynamostore.Storer
+}
+
+// Tables are the tables migrations run against
+type Tables []Table
+
+// Storer returns the Storer of the named table, or nil if there's no
+// such table
+func (ts Tables) Storer(name string) dynamostore.Storer {
+	for _, t := range ts {
+		if t.Name == name {
+			return t.Storer
+		}
+	}
+	return nil
+}
+
+// Migration is a numbered change to the tables, which is applied once.
+// Migrations should be safe to run again, in case one fails after its
+// change is made but before it's recorded
+type Migration struct {
+	ID          int
+	Name        string
+	Description string
+	Up          func(ctx context.Context, tables Tables) error
+}
+
+// Registry holds the migrations, in the order they're applied
+type Registry struct {
+	migrations []Migration
+}
+
+// NewRegistry returns a Registry of the given migrations
+func NewRegistry(ms ...Migration) *Registry {
+	r := &Registry{}
+	for _, m := range ms {
+		r.Register(m)
+	}
+	return r
+}
+
+// Register adds a migration to the registry. It panics if the ID isn't
+// positive or is already taken, since IDs are how migrations are recorded
+func (r *Registry) Register(m Migration) {
+	if m.ID < 1 {
+		panic(errors.Errorf("migration %q must have a positive ID", m.Name))
+	}
+	for _, other := range r.migrations {
+		if other.ID == m.ID {
+			panic(errors.Errorf("migrations %q and %q have the same ID %d", other.Name, m.Name, m.ID))
+		}
+	}
+	r.migrations = append(r.migrations, m)
+	sort.Slice(r.migrations, func(i, j int) bool {
+		return r.migrations[i].ID < r.migrations[j].ID
+	})
+}
+
+// Migrations returns the registered migrations, in ID order
+func (r *Registry) Migrations() []Migration {
+	return append([]Migration(nil), r.migrations...)
+}
+
+// Migrator reconciles the tables with their schemas, and applies the
+// migrations in its registry
+type Migrator struct {
+	// API changes the tables' schemas. If it's nil, e.g. when the tables
+	// are in memory, only the migrations are run
+	API    TableAPI
+	Tables Tables
+	// Records is where applied migrations are recorded
+	Records  dynamostore.Storer
+	Registry *Registry
+	// PollInterval is how often we check whether a table has finished
+	// changing. Zero means DefaultPollInterval
+	PollInterval time.Duration
+}
+
+// Result lists what a run changed, or would change if it were a dry run
+type Result struct {
+	Changes    []Change
+	Migrations []Migration
+}
+
+// Run reconciles the tables with their schemas, then applies the pending
+// migrations in order, recording each. On a dry run it only lists them
+func (m *Migrator) Run(ctx context.Context, dryRun bool) (*Result, error) {
+	result := &Result{}
+	if m.API != nil {
+		changes, err := m.Plan(ctx)
+		if err != nil {
+			return result, err
+		}
+		for _, change := range changes {
+			if !dryRun {
+				logging.FromContext(ctx).WithField("table", change.Table).Infof("applying change: %s", change.Description)
+				if err := change.apply(ctx); err != nil {
+					return result, errors.Wrapf(err, "failed to %s on table %s", change.Description, change.Table)
+				}
+			}
+			result.Changes = append(result.Changes, change)
+		}
+	}
+
+	applied := map[int]bool{}
+	// reading the records would create their table, which a dry run
+	// shouldn't do, but if it doesn't exist, nothing's been applied
+	if !dryRun || !creates(result.Changes, m.recordsTableName()) {
+		var err error
+		if applied, err = m.applied(ctx); err != nil {
+			return result, err
+		}
+	}
+	for _, migration := range m.Registry.Migrations() {
+		if applied[migration.ID] {
+			continue
+		}
+		if !dryRun {
+			logging.FromContext(ctx).WithField("migration", migration.ID).Infof("applying migration %s", migration.Name)
+			if err := migration.Up(ctx, m.Tables); err != nil {
+				return result, errors.Wrapf(err, "failed to apply migration %d %s", migration.ID, migration.Name)
+			}
+			record := &Record{
+				ID:        migration.ID,
+				Name:      migration.Name,
+				AppliedAt: time.Now().UTC(),
+			}
+			if err := m.Records.Set(ctx, record); err != nil {
+				return result, errors.Wrapf(err, "failed to record migration %d %s", migration.ID, migration.Name)
+			}
+		}
+		result.Migrations = append(result.Migrations, migration)
+	}
+	return result, nil
+}
+
+// applied returns the IDs of the migrations that have been recorded
+func (m *Migrator) applied(ctx context.Context) (map[int]bool, error) {
+	records := Records{}
+	if err := m.Records.Scan(ctx, &records); err != nil {
+		return nil, errors.Wrap(err, "failed to read applied migrations")
+	}
+	ret := make(map[int]bool, len(records))
+	for _, r := range records {
+		ret[r.ID] = true
+	}
+	return ret, nil
+}
+
+func (m *Migrator) recordsTableName() string {
+	for _, t := range m.Tables {
+		if t.Storer == m.Records {
+			return t.Config.TableName
+		}
+	}
+	return ""
+}
+
+func (m *Migrator) pollInterval() time.Duration {
+	if m.PollInterval > 0 {
+		return m.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+// Backfill saves each of the items that fill changes, with the given
+// WriteOptions. Items whose condition fails, because they were written
+// since they were read, are skipped, so the options should make sure
+// they didn't already get the change. It returns how many it saved
+func Backfill(ctx context.Context, db dynamostore.Storer, items []dynamostore.Item, fill func(dynamostore.Item) bool, opts ...dynamostore.WriteOption) (int, error) {
+	filled := 0
+	for _, item := range items {
+		if !fill(item) {
+			continue
+		}
+		if err := db.Set(ctx, item, opts...); err != nil {
+			if dynamostore.ConflictError(err) {
+				continue
+			}
+			return filled, errors.Wrapf(err, "failed to backfill %s", item.Key())
+		}
+		filled++
+	}
+	return filled, nil
+}
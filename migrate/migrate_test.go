@@ -0,0 +1,391 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/sbogacz/wouldyoutatter/archive"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPI keeps table descriptions in memory, and applies creates and
+// updates immediately
+type fakeAPI struct {
+	tables  map[string]*dynamodb.TableDescription
+	ttls    map[string]*dynamodb.TimeToLiveDescription
+	pitr    map[string]bool
+	tags    map[string]map[string]string
+	updates int
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		tables: map[string]*dynamodb.TableDescription{},
+		ttls:   map[string]*dynamodb.TimeToLiveDescription{},
+		pitr:   map[string]bool{},
+		tags:   map[string]map[string]string{},
+	}
+}
+
+func (f *fakeAPI) DescribeTable(ctx context.Context, tableName string) (*dynamodb.TableDescription, error) {
+	t, ok := f.tables[tableName]
+	if !ok {
+		return nil, errors.New(dynamodb.ErrCodeResourceNotFoundException)
+	}
+	return t, nil
+}
+
+func (f *fakeAPI) CreateTable(ctx context.Context, input *dynamodb.CreateTableInput) error {
+	t := &dynamodb.TableDescription{
+		TableName:             input.TableName,
+		TableArn:              aws.String("arn:aws:dynamodb:local:table/" + aws.StringValue(input.TableName)),
+		TableStatus:           dynamodb.TableStatusActive,
+		BillingModeSummary:    &dynamodb.BillingModeSummary{BillingMode: input.BillingMode},
+		ProvisionedThroughput: throughputDescription(input.ProvisionedThroughput),
+	}
+	for _, index := range input.GlobalSecondaryIndexes {
+		t.GlobalSecondaryIndexes = append(t.GlobalSecondaryIndexes, dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:             index.IndexName,
+			IndexStatus:           dynamodb.IndexStatusActive,
+			ProvisionedThroughput: throughputDescription(index.ProvisionedThroughput),
+		})
+	}
+	if input.SSESpecification != nil && aws.BoolValue(input.SSESpecification.Enabled) {
+		t.SSEDescription = &dynamodb.SSEDescription{Status: dynamodb.SSEStatusEnabled}
+	}
+	f.tables[aws.StringValue(input.TableName)] = t
+	return nil
+}
+
+func (f *fakeAPI) UpdateTable(ctx context.Context, input *dynamodb.UpdateTableInput) error {
+	f.updates++
+	t := f.tables[aws.StringValue(input.TableName)]
+	if input.BillingMode != "" {
+		t.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: input.BillingMode}
+	}
+	if input.ProvisionedThroughput != nil {
+		t.ProvisionedThroughput = throughputDescription(input.ProvisionedThroughput)
+	}
+	if input.SSESpecification != nil {
+		t.SSEDescription = &dynamodb.SSEDescription{Status: dynamodb.SSEStatusDisabled}
+		if aws.BoolValue(input.SSESpecification.Enabled) {
+			t.SSEDescription.Status = dynamodb.SSEStatusEnabled
+		}
+	}
+	for _, update := range input.GlobalSecondaryIndexUpdates {
+		if update.Create != nil {
+			t.GlobalSecondaryIndexes = append(t.GlobalSecondaryIndexes, dynamodb.GlobalSecondaryIndexDescription{
+				IndexName:             update.Create.IndexName,
+				IndexStatus:           dynamodb.IndexStatusActive,
+				ProvisionedThroughput: throughputDescription(update.Create.ProvisionedThroughput),
+			})
+		}
+		if update.Update != nil {
+			for i := range t.GlobalSecondaryIndexes {
+				if aws.StringValue(t.GlobalSecondaryIndexes[i].IndexName) == aws.StringValue(update.Update.IndexName) {
+					t.GlobalSecondaryIndexes[i].ProvisionedThroughput = throughputDescription(update.Update.ProvisionedThroughput)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeAPI) DescribeTimeToLive(ctx context.Context, tableName string) (*dynamodb.TimeToLiveDescription, error) {
+	if ttl, ok := f.ttls[tableName]; ok {
+		return ttl, nil
+	}
+	return &dynamodb.TimeToLiveDescription{TimeToLiveStatus: dynamodb.TimeToLiveStatusDisabled}, nil
+}
+
+func (f *fakeAPI) UpdateTimeToLive(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput) error {
+	f.ttls[aws.StringValue(input.TableName)] = &dynamodb.TimeToLiveDescription{
+		AttributeName:    input.TimeToLiveSpecification.AttributeName,
+		TimeToLiveStatus: dynamodb.TimeToLiveStatusEnabled,
+	}
+	return nil
+}
+
+func (f *fakeAPI) DescribeContinuousBackups(ctx context.Context, tableName string) (*dynamodb.ContinuousBackupsDescription, error) {
+	status := dynamodb.PointInTimeRecoveryStatusDisabled
+	if f.pitr[tableName] {
+		status = dynamodb.PointInTimeRecoveryStatusEnabled
+	}
+	return &dynamodb.ContinuousBackupsDescription{
+		PointInTimeRecoveryDescription: &dynamodb.PointInTimeRecoveryDescription{PointInTimeRecoveryStatus: status},
+	}, nil
+}
+
+func (f *fakeAPI) UpdateContinuousBackups(ctx context.Context, input *dynamodb.UpdateContinuousBackupsInput) error {
+	f.pitr[aws.StringValue(input.TableName)] = aws.BoolValue(input.PointInTimeRecoverySpecification.PointInTimeRecoveryEnabled)
+	return nil
+}
+
+func (f *fakeAPI) ListTags(ctx context.Context, arn string) ([]dynamodb.Tag, error) {
+	var tags []dynamodb.Tag
+	for key, val := range f.tags[arn] {
+		tags = append(tags, dynamodb.Tag{Key: aws.String(key), Value: aws.String(val)})
+	}
+	return tags, nil
+}
+
+func (f *fakeAPI) TagResource(ctx context.Context, input *dynamodb.TagResourceInput) error {
+	arn := aws.StringValue(input.ResourceArn)
+	if f.tags[arn] == nil {
+		f.tags[arn] = map[string]string{}
+	}
+	for _, tag := range input.Tags {
+		f.tags[arn][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return nil
+}
+
+func throughputDescription(p *dynamodb.ProvisionedThroughput) *dynamodb.ProvisionedThroughputDescription {
+	if p == nil {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughputDescription{
+		ReadCapacityUnits:  p.ReadCapacityUnits,
+		WriteCapacityUnits: p.WriteCapacityUnits,
+	}
+}
+
+func tableConfig(name string) *dynamostore.TableConfig {
+	return &dynamostore.TableConfig{TableName: name, ReadCapacity: 5, WriteCapacity: 5}
+}
+
+func newMigrator(api migrate.TableAPI, registry *migrate.Registry) *migrate.Migrator {
+	records := dynamostore.NewInMemoryStore()
+	return &migrate.Migrator{
+		API: api,
+		Tables: migrate.Tables{
+			{Name: archive.TableContenders, Config: tableConfig("Contenders"), Item: &contender.Contender{}, Storer: dynamostore.NewInMemoryStore()},
+			{Name: archive.TableTokens, Config: tableConfig("Tokens"), Item: &contender.Token{}, Storer: dynamostore.NewInMemoryStore()},
+			{Name: migrate.TableMigrations, Config: tableConfig("Schema-Migrations"), Item: &migrate.Record{}, Storer: records},
+		},
+		Records:      records,
+		Registry:     registry,
+		PollInterval: time.Millisecond,
+	}
+}
+
+func descriptions(changes []migrate.Change) []string {
+	ret := make([]string, len(changes))
+	for i, c := range changes {
+		ret[i] = c.Table + ": " + c.Description
+	}
+	return ret
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates missing tables", func(t *testing.T) {
+		api := newFakeAPI()
+		m := newMigrator(api, migrate.NewRegistry())
+
+		result, err := m.Run(ctx, true)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"Contenders: create table",
+			"Tokens: create table",
+			"Tokens: enable TTL on ExpireAt",
+			"Schema-Migrations: create table",
+		}, descriptions(result.Changes))
+		assert.Empty(t, api.tables, "a dry run shouldn't change anything")
+
+		_, err = m.Run(ctx, false)
+		require.NoError(t, err)
+		require.Contains(t, api.tables, "Contenders")
+		assert.Len(t, api.tables["Contenders"].GlobalSecondaryIndexes, 1)
+		assert.Equal(t, "ExpireAt", aws.StringValue(api.ttls["Tokens"].AttributeName))
+
+		result, err = m.Run(ctx, false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Changes)
+	})
+	t.Run("updates existing tables", func(t *testing.T) {
+		api := newFakeAPI()
+		m := newMigrator(api, migrate.NewRegistry())
+		_, err := m.Run(ctx, false)
+		require.NoError(t, err)
+
+		// as if the index had been added after the table was created,
+		// and the throughput was changed by hand
+		contenders := api.tables["Contenders"]
+		contenders.GlobalSecondaryIndexes = nil
+		contenders.ProvisionedThroughput.ReadCapacityUnits = aws.Int64(1)
+		api.tables["Tokens"].BillingModeSummary.BillingMode = dynamodb.BillingModePayPerRequest
+		delete(api.ttls, "Tokens")
+
+		result, err := m.Run(ctx, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"Contenders: change provisioned throughput to 5 read, 5 write",
+			"Contenders: add index LeaderboardScore",
+			"Tokens: switch billing mode from PAY_PER_REQUEST to PROVISIONED",
+			"Tokens: enable TTL on ExpireAt",
+		}, descriptions(result.Changes))
+		assert.Equal(t, int64(5), aws.Int64Value(contenders.ProvisionedThroughput.ReadCapacityUnits))
+		assert.Len(t, contenders.GlobalSecondaryIndexes, 1)
+		assert.Equal(t, dynamodb.BillingModeProvisioned, api.tables["Tokens"].BillingModeSummary.BillingMode)
+
+		updates := api.updates
+		result, err = m.Run(ctx, false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Changes)
+		assert.Equal(t, updates, api.updates)
+	})
+	t.Run("creates a shared table once", func(t *testing.T) {
+		api := newFakeAPI()
+		m := newMigrator(api, migrate.NewRegistry())
+		single := tableConfig("WouldYouTatter")
+		m.Tables[0].Config, m.Tables[0].Item = single, contender.ContenderEntity.Wrap(&contender.Contender{})
+		m.Tables[1].Config, m.Tables[1].Item = single, contender.TokenEntity.Wrap(&contender.Token{})
+
+		result, err := m.Run(ctx, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"WouldYouTatter: create table",
+			"WouldYouTatter: enable TTL on ExpireAt",
+			"Schema-Migrations: create table",
+		}, descriptions(result.Changes))
+		require.Contains(t, api.tables, "WouldYouTatter")
+		assert.Equal(t, dynamostore.SingleTableIndex, aws.StringValue(api.tables["WouldYouTatter"].GlobalSecondaryIndexes[0].IndexName))
+
+		result, err = m.Run(ctx, false)
+		require.NoError(t, err)
+		assert.Empty(t, result.Changes)
+	})
+}
+
+func TestReconcileTableConfig(t *testing.T) {
+	ctx := context.Background()
+	api := newFakeAPI()
+	m := newMigrator(api, migrate.NewRegistry())
+	_, err := m.Run(ctx, false)
+	require.NoError(t, err)
+
+	config := m.Tables[0].Config
+	config.BillingMode = "PAY_PER_REQUEST"
+	config.SSE = true
+	config.PointInTimeRecovery = true
+	require.NoError(t, config.Tags.Set("team=tattoos,env=test"))
+
+	result, err := m.Run(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Contenders: switch billing mode from PROVISIONED to PAY_PER_REQUEST",
+		"Contenders: enable server-side encryption",
+		"Contenders: enable point in time recovery",
+		"Contenders: tag env=test,team=tattoos",
+	}, descriptions(result.Changes))
+	contenders := api.tables["Contenders"]
+	assert.Equal(t, dynamodb.BillingModePayPerRequest, contenders.BillingModeSummary.BillingMode)
+	assert.Equal(t, dynamodb.SSEStatusEnabled, contenders.SSEDescription.Status)
+	assert.True(t, api.pitr["Contenders"])
+	assert.Equal(t, map[string]string{"team": "tattoos", "env": "test"}, api.tags[aws.StringValue(contenders.TableArn)])
+
+	result, err = m.Run(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Changes)
+
+	t.Run("new tables are created with it", func(t *testing.T) {
+		api := newFakeAPI()
+		m := newMigrator(api, migrate.NewRegistry())
+		m.Tables[0].Config.BillingMode = "PAY_PER_REQUEST"
+		m.Tables[0].Config.PointInTimeRecovery = true
+
+		result, err := m.Run(ctx, false)
+		require.NoError(t, err)
+		assert.Contains(t, descriptions(result.Changes), "Contenders: enable point in time recovery")
+		contenders := api.tables["Contenders"]
+		assert.Equal(t, dynamodb.BillingModePayPerRequest, contenders.BillingModeSummary.BillingMode)
+		assert.Nil(t, contenders.ProvisionedThroughput)
+		assert.Nil(t, contenders.GlobalSecondaryIndexes[0].ProvisionedThroughput)
+		assert.True(t, api.pitr["Contenders"])
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	var ran []int
+	migration := func(id int) migrate.Migration {
+		return migrate.Migration{
+			ID:   id,
+			Name: "test",
+			Up: func(ctx context.Context, tables migrate.Tables) error {
+				ran = append(ran, id)
+				return nil
+			},
+		}
+	}
+	registry := migrate.NewRegistry(migration(2), migration(1))
+	m := newMigrator(nil, registry)
+
+	result, err := m.Run(ctx, true)
+	require.NoError(t, err)
+	assert.Len(t, result.Migrations, 2)
+	assert.Empty(t, ran, "a dry run shouldn't apply migrations")
+
+	_, err = m.Run(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, ran)
+
+	// only the new migration is applied
+	registry.Register(migration(3))
+	result, err = m.Run(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, result.Migrations, 1)
+	assert.Equal(t, 3, result.Migrations[0].ID)
+	assert.Equal(t, []int{1, 2, 3}, ran)
+
+	t.Run("failures aren't recorded", func(t *testing.T) {
+		registry.Register(migrate.Migration{
+			ID:   4,
+			Name: "broken",
+			Up: func(ctx context.Context, tables migrate.Tables) error {
+				return errors.New("oops")
+			},
+		})
+		_, err := m.Run(ctx, false)
+		assert.Error(t, err)
+		result, err := m.Run(ctx, true)
+		require.NoError(t, err)
+		require.Len(t, result.Migrations, 1)
+		assert.Equal(t, 4, result.Migrations[0].ID)
+	})
+	t.Run("IDs are unique", func(t *testing.T) {
+		assert.Panics(t, func() { registry.Register(migration(1)) })
+		assert.Panics(t, func() { registry.Register(migration(0)) })
+	})
+}
+
+func TestBackfillContenderVersions(t *testing.T) {
+	ctx := context.Background()
+	m := newMigrator(nil, migrate.Default)
+	db := m.Tables.Storer(archive.TableContenders)
+
+	// saved before contenders had versions
+	require.NoError(t, db.Set(ctx, &contender.Contender{Name: "old"}))
+	require.NoError(t, db.Set(ctx, &contender.Contender{Name: "new", Version: 3}))
+
+	_, err := m.Run(ctx, false)
+	require.NoError(t, err)
+
+	store := contender.NewStore(db)
+	old, err := store.Get(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), old.Version)
+	newer, err := store.Get(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), newer.Version)
+}
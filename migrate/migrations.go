@@ -0,0 +1,49 @@
+package migrate
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/archive"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+// Default is the registry of the game's migrations. New migrations take
+// the next ID, and are never renumbered once released
+var Default = NewRegistry(
+	Migration{
+		ID:          1,
+		Name:        "contender-versions",
+		Description: "give contenders saved before versioning a version, so they can be updated conditionally",
+		Up:          backfillContenderVersions,
+	},
+)
+
+func backfillContenderVersions(ctx context.Context, tables Tables) error {
+	db := tables.Storer(archive.TableContenders)
+	if db == nil {
+		return errors.New("there's no contenders table")
+	}
+	cs := contender.Contenders{}
+	if err := db.Scan(ctx, &cs); err != nil {
+		return errors.Wrap(err, "failed to scan contenders")
+	}
+	items := make([]dynamostore.Item, len(cs))
+	for i := range cs {
+		items[i] = &cs[i]
+	}
+	// only fill contenders that still don't have a version when they're
+	// saved, so we don't undo votes cast since the scan
+	filled, err := Backfill(ctx, db, items, func(item dynamostore.Item) bool {
+		c := item.(*contender.Contender)
+		if c.Version > 0 {
+			return false
+		}
+		c.Version = 1
+		return true
+	}, dynamostore.IfVersion(0))
+	logging.FromContext(ctx).Infof("backfilled the versions of %d contenders", filled)
+	return err
+}
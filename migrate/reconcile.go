@@ -0,0 +1,509 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+)
+
+// TableAPI is the part of the Dynamo API that manages tables
+type TableAPI interface {
+	DescribeTable(ctx context.Context, tableName string) (*dynamodb.TableDescription, error)
+	CreateTable(ctx context.Context, input *dynamodb.CreateTableInput) error
+	UpdateTable(ctx context.Context, input *dynamodb.UpdateTableInput) error
+	DescribeTimeToLive(ctx context.Context, tableName string) (*dynamodb.TimeToLiveDescription, error)
+	UpdateTimeToLive(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput) error
+	DescribeContinuousBackups(ctx context.Context, tableName string) (*dynamodb.ContinuousBackupsDescription, error)
+	UpdateContinuousBackups(ctx context.Context, input *dynamodb.UpdateContinuousBackupsInput) error
+	ListTags(ctx context.Context, arn string) ([]dynamodb.Tag, error)
+	TagResource(ctx context.Context, input *dynamodb.TagResourceInput) error
+}
+
+type dynamoAPI struct {
+	db *dynamodb.DynamoDB
+}
+
+// NewTableAPI returns the TableAPI of a Dynamo client
+func NewTableAPI(db *dynamodb.DynamoDB) TableAPI {
+	return &dynamoAPI{db: db}
+}
+
+func (a *dynamoAPI) DescribeTable(ctx context.Context, tableName string) (*dynamodb.TableDescription, error) {
+	req := a.db.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	req.SetContext(ctx)
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	return output.Table, nil
+}
+
+func (a *dynamoAPI) CreateTable(ctx context.Context, input *dynamodb.CreateTableInput) error {
+	req := a.db.CreateTableRequest(input)
+	req.SetContext(ctx)
+	_, err := req.Send()
+	return err
+}
+
+func (a *dynamoAPI) UpdateTable(ctx context.Context, input *dynamodb.UpdateTableInput) error {
+	req := a.db.UpdateTableRequest(input)
+	req.SetContext(ctx)
+	_, err := req.Send()
+	return err
+}
+
+func (a *dynamoAPI) DescribeTimeToLive(ctx context.Context, tableName string) (*dynamodb.TimeToLiveDescription, error) {
+	req := a.db.DescribeTimeToLiveRequest(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	req.SetContext(ctx)
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	return output.TimeToLiveDescription, nil
+}
+
+func (a *dynamoAPI) UpdateTimeToLive(ctx context.Context, input *dynamodb.UpdateTimeToLiveInput) error {
+	req := a.db.UpdateTimeToLiveRequest(input)
+	req.SetContext(ctx)
+	_, err := req.Send()
+	return err
+}
+
+func (a *dynamoAPI) DescribeContinuousBackups(ctx context.Context, tableName string) (*dynamodb.ContinuousBackupsDescription, error) {
+	req := a.db.DescribeContinuousBackupsRequest(&dynamodb.DescribeContinuousBackupsInput{TableName: aws.String(tableName)})
+	req.SetContext(ctx)
+	output, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	return output.ContinuousBackupsDescription, nil
+}
+
+func (a *dynamoAPI) UpdateContinuousBackups(ctx context.Context, input *dynamodb.UpdateContinuousBackupsInput) error {
+	req := a.db.UpdateContinuousBackupsRequest(input)
+	req.SetContext(ctx)
+	_, err := req.Send()
+	return err
+}
+
+func (a *dynamoAPI) ListTags(ctx context.Context, arn string) ([]dynamodb.Tag, error) {
+	var (
+		tags      []dynamodb.Tag
+		nextToken *string
+	)
+	for {
+		req := a.db.ListTagsOfResourceRequest(&dynamodb.ListTagsOfResourceInput{
+			ResourceArn: aws.String(arn),
+			NextToken:   nextToken,
+		})
+		req.SetContext(ctx)
+		output, err := req.Send()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, output.Tags...)
+		if nextToken = output.NextToken; nextToken == nil {
+			return tags, nil
+		}
+	}
+}
+
+func (a *dynamoAPI) TagResource(ctx context.Context, input *dynamodb.TagResourceInput) error {
+	req := a.db.TagResourceRequest(input)
+	req.SetContext(ctx)
+	_, err := req.Send()
+	return err
+}
+
+// Change is a difference between a table and its schema, and how to
+// make it go away
+type Change struct {
+	// Table is the name of the table in Dynamo
+	Table       string
+	Description string
+
+	create bool
+	apply  func(context.Context) error
+}
+
+// creates reports whether the changes include creating the table
+func creates(changes []Change, tableName string) bool {
+	for _, c := range changes {
+		if c.create && c.Table == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan compares the tables with their schemas, and returns the changes
+// needed to reconcile them, in the order they should be applied
+func (m *Migrator) Plan(ctx context.Context) ([]Change, error) {
+	var changes []Change
+	planned := map[string]bool{}
+	for _, t := range m.Tables {
+		name := t.Config.TableName
+		tableChanges, err := m.plan(ctx, t, planned[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to plan changes to table %s", name)
+		}
+		planned[name] = true
+		changes = append(changes, tableChanges...)
+	}
+	return changes, nil
+}
+
+// plan returns the changes a table needs. When several tables share
+// one Dynamo table, as they do in the single table layout, only the
+// first plans the table itself, and the rest only add their TTL
+func (m *Migrator) plan(ctx context.Context, t Table, shared bool) ([]Change, error) {
+	name := t.Config.TableName
+	desired := t.Item.CreateTableInput(t.Config)
+	opts := t.Item.TableOptions(name)
+
+	current, err := m.API.DescribeTable(ctx, name)
+	if err != nil && !dynamostore.TableNotFoundError(err) {
+		return nil, err
+	}
+	if shared {
+		return m.planTTL(ctx, name, current != nil, dynamostore.TimeToLive(opts))
+	}
+	var changes []Change
+	indexes := map[string]dynamodb.GlobalSecondaryIndexDescription{}
+	if current == nil {
+		changes = append(changes, Change{
+			Table:       name,
+			Description: "create table",
+			create:      true,
+			apply: func(ctx context.Context) error {
+				if err := m.API.CreateTable(ctx, desired); err != nil {
+					return err
+				}
+				return m.waitUntilActive(ctx, name)
+			},
+		})
+		// the indexes in the input are created with the table
+		for _, index := range desired.GlobalSecondaryIndexes {
+			indexes[aws.StringValue(index.IndexName)] = dynamodb.GlobalSecondaryIndexDescription{IndexName: index.IndexName}
+		}
+	} else {
+		for _, index := range current.GlobalSecondaryIndexes {
+			indexes[aws.StringValue(index.IndexName)] = index
+		}
+		changes = append(changes, m.planCapacity(name, desired, current, indexes)...)
+		changes = append(changes, m.planSSE(name, desired, current)...)
+	}
+
+	for _, index := range desiredIndexes(desired, opts) {
+		if _, ok := indexes[aws.StringValue(index.IndexName)]; ok {
+			continue
+		}
+		input := &dynamodb.UpdateTableInput{
+			TableName:            aws.String(name),
+			AttributeDefinitions: desired.AttributeDefinitions,
+			GlobalSecondaryIndexUpdates: []dynamodb.GlobalSecondaryIndexUpdate{
+				{Create: &index},
+			},
+		}
+		changes = append(changes, Change{
+			Table:       name,
+			Description: fmt.Sprintf("add index %s", aws.StringValue(index.IndexName)),
+			apply:       m.updateTable(name, input),
+		})
+	}
+
+	ttl, err := m.planTTL(ctx, name, current != nil, dynamostore.TimeToLive(opts))
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, ttl...)
+	if t.Config.PointInTimeRecovery {
+		pitr, err := m.planPITR(ctx, name, current != nil)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, pitr...)
+	}
+	if len(t.Config.Tags) > 0 {
+		tags, err := m.planTags(ctx, name, current, t.Config.Tags)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, tags...)
+	}
+	return changes, nil
+}
+
+// planCapacity returns the change to the billing mode or throughput of
+// an existing table, if it needs one
+func (m *Migrator) planCapacity(name string, desired *dynamodb.CreateTableInput, current *dynamodb.TableDescription, indexes map[string]dynamodb.GlobalSecondaryIndexDescription) []Change {
+	desiredMode := billingMode(desired.BillingMode)
+	currentMode := dynamodb.BillingModeProvisioned
+	if current.BillingModeSummary != nil {
+		currentMode = billingMode(current.BillingModeSummary.BillingMode)
+	}
+
+	input := &dynamodb.UpdateTableInput{TableName: aws.String(name)}
+	var description string
+	if desiredMode != currentMode {
+		description = fmt.Sprintf("switch billing mode from %s to %s", currentMode, desiredMode)
+		input.BillingMode = desiredMode
+		if desiredMode == dynamodb.BillingModeProvisioned {
+			input.ProvisionedThroughput = desired.ProvisionedThroughput
+			input.GlobalSecondaryIndexUpdates = indexThroughputUpdates(desired, indexes, true)
+		}
+	} else if desiredMode == dynamodb.BillingModeProvisioned {
+		if differs(current.ProvisionedThroughput, desired.ProvisionedThroughput) {
+			input.ProvisionedThroughput = desired.ProvisionedThroughput
+		}
+		input.GlobalSecondaryIndexUpdates = indexThroughputUpdates(desired, indexes, false)
+		if input.ProvisionedThroughput == nil && len(input.GlobalSecondaryIndexUpdates) == 0 {
+			return nil
+		}
+		description = "change provisioned throughput"
+		if p := desired.ProvisionedThroughput; p != nil {
+			description = fmt.Sprintf("change provisioned throughput to %d read, %d write",
+				aws.Int64Value(p.ReadCapacityUnits), aws.Int64Value(p.WriteCapacityUnits))
+		}
+	} else {
+		return nil
+	}
+	return []Change{{
+		Table:       name,
+		Description: description,
+		apply:       m.updateTable(name, input),
+	}}
+}
+
+// planSSE returns the change turning server-side encryption of an
+// existing table on or off, if it needs one. It doesn't change the key
+// of a table that's already encrypted
+func (m *Migrator) planSSE(name string, desired *dynamodb.CreateTableInput, current *dynamodb.TableDescription) []Change {
+	want := desired.SSESpecification != nil && aws.BoolValue(desired.SSESpecification.Enabled)
+	have := false
+	if current.SSEDescription != nil {
+		switch current.SSEDescription.Status {
+		case dynamodb.SSEStatusEnabled, dynamodb.SSEStatusEnabling, dynamodb.SSEStatusUpdating:
+			have = true
+		}
+	}
+	if want == have {
+		return nil
+	}
+	input := &dynamodb.UpdateTableInput{
+		TableName:        aws.String(name),
+		SSESpecification: desired.SSESpecification,
+	}
+	description := "enable server-side encryption"
+	if !want {
+		input.SSESpecification = &dynamodb.SSESpecification{Enabled: aws.Bool(false)}
+		description = "disable server-side encryption"
+	}
+	return []Change{{
+		Table:       name,
+		Description: description,
+		apply:       m.updateTable(name, input),
+	}}
+}
+
+// planPITR returns the change turning on point in time recovery, if it
+// isn't on yet. It's never turned off, since that loses the backups
+func (m *Migrator) planPITR(ctx context.Context, name string, exists bool) ([]Change, error) {
+	if exists {
+		current, err := m.API.DescribeContinuousBackups(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && current.PointInTimeRecoveryDescription != nil &&
+			current.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus == dynamodb.PointInTimeRecoveryStatusEnabled {
+			return nil, nil
+		}
+	}
+	input := &dynamodb.UpdateContinuousBackupsInput{
+		TableName: aws.String(name),
+		PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	}
+	return []Change{{
+		Table:       name,
+		Description: "enable point in time recovery",
+		apply: func(ctx context.Context) error {
+			return m.API.UpdateContinuousBackups(ctx, input)
+		},
+	}}, nil
+}
+
+// planTags returns the change adding the tags the table is missing, or
+// has other values for. Other tags are left alone
+func (m *Migrator) planTags(ctx context.Context, name string, current *dynamodb.TableDescription, tags dynamostore.Tags) ([]Change, error) {
+	missing := dynamostore.Tags{}
+	for key, val := range tags {
+		missing[key] = val
+	}
+	if current != nil {
+		existing, err := m.API.ListTags(ctx, aws.StringValue(current.TableArn))
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range existing {
+			if val, ok := missing[aws.StringValue(tag.Key)]; ok && val == aws.StringValue(tag.Value) {
+				delete(missing, aws.StringValue(tag.Key))
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return []Change{{
+		Table:       name,
+		Description: fmt.Sprintf("tag %s", missing.String()),
+		apply: func(ctx context.Context) error {
+			// a table created by this run didn't have an ARN to plan with
+			table, err := m.API.DescribeTable(ctx, name)
+			if err != nil {
+				return err
+			}
+			return m.API.TagResource(ctx, &dynamodb.TagResourceInput{
+				ResourceArn: table.TableArn,
+				Tags:        missing.Dynamo(),
+			})
+		},
+	}}, nil
+}
+
+// planTTL returns the change enabling TTL on the table, if it should be
+// and isn't yet
+func (m *Migrator) planTTL(ctx context.Context, name string, exists bool, spec *dynamodb.TimeToLiveSpecification) ([]Change, error) {
+	if spec == nil || !aws.BoolValue(spec.Enabled) {
+		return nil, nil
+	}
+	if exists {
+		current, err := m.API.DescribeTimeToLive(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && aws.StringValue(current.AttributeName) == aws.StringValue(spec.AttributeName) {
+			switch current.TimeToLiveStatus {
+			case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+				return nil, nil
+			}
+		}
+	}
+	input := &dynamodb.UpdateTimeToLiveInput{
+		TableName:               aws.String(name),
+		TimeToLiveSpecification: spec,
+	}
+	return []Change{{
+		Table:       name,
+		Description: fmt.Sprintf("enable TTL on %s", aws.StringValue(spec.AttributeName)),
+		apply: func(ctx context.Context) error {
+			return m.API.UpdateTimeToLive(ctx, input)
+		},
+	}}, nil
+}
+
+// updateTable returns a change's apply func for a table update, which
+// waits for the table to finish updating, since Dynamo only allows one
+// update at a time
+func (m *Migrator) updateTable(name string, input *dynamodb.UpdateTableInput) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := m.API.UpdateTable(ctx, input); err != nil {
+			return err
+		}
+		return m.waitUntilActive(ctx, name)
+	}
+}
+
+// waitUntilActive waits until the table, and all of its indexes, are
+// active, which includes the backfill of new indexes
+func (m *Migrator) waitUntilActive(ctx context.Context, name string) error {
+	for {
+		current, err := m.API.DescribeTable(ctx, name)
+		if err != nil && !dynamostore.TableNotFoundError(err) {
+			return err
+		}
+		if current != nil && active(current) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "table %s did not become active in time", name)
+		case <-time.After(m.pollInterval()):
+		}
+	}
+}
+
+func active(t *dynamodb.TableDescription) bool {
+	if t.TableStatus != dynamodb.TableStatusActive {
+		return false
+	}
+	for _, index := range t.GlobalSecondaryIndexes {
+		if index.IndexStatus != dynamodb.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+// desiredIndexes returns the indexes the table should have, whether
+// they're in its CreateTableInput, or added by a TableOption
+func desiredIndexes(input *dynamodb.CreateTableInput, opts []dynamostore.TableOption) []dynamodb.CreateGlobalSecondaryIndexAction {
+	ret := make([]dynamodb.CreateGlobalSecondaryIndexAction, 0, len(input.GlobalSecondaryIndexes))
+	for _, index := range input.GlobalSecondaryIndexes {
+		ret = append(ret, dynamodb.CreateGlobalSecondaryIndexAction{
+			IndexName:             index.IndexName,
+			KeySchema:             index.KeySchema,
+			Projection:            index.Projection,
+			ProvisionedThroughput: index.ProvisionedThroughput,
+		})
+	}
+	return append(ret, dynamostore.IndexCreates(opts)...)
+}
+
+// indexThroughputUpdates returns updates for the existing indexes whose
+// provisioned throughput isn't what the input asks for, or for all of
+// them if all is set
+func indexThroughputUpdates(input *dynamodb.CreateTableInput, indexes map[string]dynamodb.GlobalSecondaryIndexDescription, all bool) []dynamodb.GlobalSecondaryIndexUpdate {
+	var ret []dynamodb.GlobalSecondaryIndexUpdate
+	for _, index := range input.GlobalSecondaryIndexes {
+		current, ok := indexes[aws.StringValue(index.IndexName)]
+		if !ok || index.ProvisionedThroughput == nil {
+			continue
+		}
+		if !all && !differs(current.ProvisionedThroughput, index.ProvisionedThroughput) {
+			continue
+		}
+		ret = append(ret, dynamodb.GlobalSecondaryIndexUpdate{
+			Update: &dynamodb.UpdateGlobalSecondaryIndexAction{
+				IndexName:             index.IndexName,
+				ProvisionedThroughput: index.ProvisionedThroughput,
+			},
+		})
+	}
+	return ret
+}
+
+func differs(current *dynamodb.ProvisionedThroughputDescription, desired *dynamodb.ProvisionedThroughput) bool {
+	if desired == nil {
+		return false
+	}
+	if current == nil {
+		return true
+	}
+	return aws.Int64Value(current.ReadCapacityUnits) != aws.Int64Value(desired.ReadCapacityUnits) ||
+		aws.Int64Value(current.WriteCapacityUnits) != aws.Int64Value(desired.WriteCapacityUnits)
+}
+
+// billingMode defaults an unset billing mode to Dynamo's default
+func billingMode(mode dynamodb.BillingMode) dynamodb.BillingMode {
+	if mode == "" {
+		return dynamodb.BillingModeProvisioned
+	}
+	return mode
+}
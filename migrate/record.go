@@ -0,0 +1,143 @@
+package migrate
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+)
+
+// Record is the record of an applied migration
+type Record struct {
+	ID        int
+	Name      string
+	AppliedAt time.Time
+}
+
+// Records is a collection that implements Scannable
+type Records []Record
+
+var _ dynamostore.Item = (*Record)(nil)
+
+// Key returns the migration's ID, and implements the dynamostore Item interface
+func (r Record) Key() string {
+	return strconv.Itoa(r.ID)
+}
+
+// Marshal encodes the record into the map format that dynamo expects
+func (r Record) Marshal() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"ID":        {N: aws.String(strconv.Itoa(r.ID))},
+		"Name":      {S: aws.String(r.Name)},
+		"AppliedAt": {S: aws.String(r.AppliedAt.Format(time.RFC3339))},
+	}
+}
+
+// Unmarshal tries to decode a Record from a dynamo response
+func (r *Record) Unmarshal(aMap map[string]dynamodb.AttributeValue) error {
+	if len(aMap) == 0 {
+		return errors.New(dynamodb.ErrCodeResourceNotFoundException)
+	}
+	id, err := strconv.Atoi(aws.StringValue(aMap["ID"].N))
+	if err != nil {
+		return errors.Wrap(err, "failed to read ID attribute")
+	}
+	appliedAt, err := time.Parse(time.RFC3339, aws.StringValue(aMap["AppliedAt"].S))
+	if err != nil {
+		return errors.Wrap(err, "failed to read AppliedAt attribute")
+	}
+	*r = Record{
+		ID:        id,
+		Name:      aws.StringValue(aMap["Name"].S),
+		AppliedAt: appliedAt,
+	}
+	return nil
+}
+
+// CreateTableInput generates the dynamo input to create the migrations table
+func (r *Record) CreateTableInput(tc *dynamostore.TableConfig) *dynamodb.CreateTableInput {
+	return tc.Configure(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("ID"),
+				AttributeType: dynamodb.ScalarAttributeTypeN,
+			},
+		},
+		KeySchema: []dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("ID"),
+				KeyType:       dynamodb.KeyTypeHash,
+			},
+		},
+		TableName: aws.String(tc.TableName),
+	})
+}
+
+// DescribeTableInput generates the query we need to describe the migrations table
+func (r *Record) DescribeTableInput(tableName string) *dynamodb.DescribeTableInput {
+	return &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// TableOptions is a no-op for the migrations table
+func (r *Record) TableOptions(tableName string) []dynamostore.TableOption {
+	return nil
+}
+
+// GetItemInput generates the dynamodb.GetItemInput for the given record
+func (r *Record) GetItemInput(tableName string) *dynamodb.GetItemInput {
+	return &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       r.key(),
+	}
+}
+
+// PutItemInput generates the dynamodb.PutItemInput for the given record
+func (r *Record) PutItemInput(tableName string) *dynamodb.PutItemInput {
+	return &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      r.Marshal(),
+	}
+}
+
+// DeleteItemInput generates the dynamodb.DeleteItemInput for the given record
+func (r *Record) DeleteItemInput(tableName string) *dynamodb.DeleteItemInput {
+	return &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       r.key(),
+	}
+}
+
+// UpdateItemInput is a no-op, since records aren't updated
+func (r *Record) UpdateItemInput(tableName string) *dynamodb.UpdateItemInput {
+	return nil
+}
+
+func (r *Record) key() map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"ID": {N: aws.String(strconv.Itoa(r.ID))},
+	}
+}
+
+// ScanInput produces a dynamodb ScanInput object for the whole table
+func (rs *Records) ScanInput(tableName string) *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+}
+
+// Unmarshal allows results to be unmarshalled directly into the struct
+func (rs *Records) Unmarshal(maps []map[string]dynamodb.AttributeValue) error {
+	records := make([]Record, len(maps))
+	for i := range records {
+		if err := records[i].Unmarshal(maps[i]); err != nil {
+			return errors.Wrap(err, "failed to unmarshal Records")
+		}
+	}
+	*rs = records
+	return nil
+}
@@ -0,0 +1,144 @@
+package service_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPCaching(t *testing.T) {
+	ctx := context.Background()
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	name := "caching-dragon"
+	require.NoError(t, tatter.CreateContender(ctx, &contender.Contender{
+		Name: name,
+		SVG:  []byte("<svg>pretend this is a dragon</svg>"),
+	}))
+	defer tatter.DeleteContender(ctx, name)
+
+	// the transport mustn't ask for gzip itself, or it decodes responses
+	// for us
+	httpClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path string, headers map[string]string) *http.Response {
+		req, err := http.NewRequest("GET", baseAddress+path, nil)
+		require.NoError(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("policies", func(t *testing.T) {
+		for path, policy := range map[string]string{
+			"/contenders/" + name:          service.CacheControlContender,
+			"/contenders/" + name + "/svg": service.CacheControlAsset,
+			"/leaderboard":                 service.CacheControlLeaderboard,
+		} {
+			resp := get(path, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+			assert.Equal(t, policy, resp.Header.Get("Cache-Control"), path)
+		}
+		resp := get("/contenders/caching-nobody", nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Cache-Control"), "errors shouldn't be cached")
+	})
+	t.Run("contenders keep their version ETag", func(t *testing.T) {
+		c, err := tatter.GetContender(ctx, name)
+		require.NoError(t, err)
+		resp := get("/contenders/"+name, nil)
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		assert.Equal(t, `"1-0-0"`, etag)
+
+		resp = get("/contenders/"+name, map[string]string{"If-None-Match": "W/" + etag})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+		c.Description = "a changed dragon"
+		require.NoError(t, tatter.UpdateContender(ctx, c))
+		resp = get("/contenders/"+name, map[string]string{"If-None-Match": etag})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+	})
+	t.Run("compression", func(t *testing.T) {
+		identity := get("/contenders/"+name+"/svg", nil)
+		plain, err := ioutil.ReadAll(identity.Body)
+		identity.Body.Close()
+		require.NoError(t, err)
+		assert.Empty(t, identity.Header.Get("Content-Encoding"))
+		assert.Contains(t, identity.Header.Values("Vary"), "Accept-Encoding")
+
+		resp := get("/contenders/"+name+"/svg", map[string]string{"Accept-Encoding": "gzip"})
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(gz)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, plain, b)
+
+		resp = get("/contenders/"+name+"/svg", map[string]string{"Accept-Encoding": "gzip;q=0.5, br"})
+		assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+		b, err = ioutil.ReadAll(brotli.NewReader(resp.Body))
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, plain, b)
+
+		resp = get("/contenders/"+name+"/svg", map[string]string{"Accept-Encoding": "br;q=0, identity"})
+		resp.Body.Close()
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	})
+	t.Run("each representation has its own ETag", func(t *testing.T) {
+		etags := map[string]string{}
+		for representation, headers := range map[string]map[string]string{
+			"identity": nil,
+			"gzip":     {"Accept-Encoding": "gzip"},
+			"br":       {"Accept-Encoding": "br"},
+			"v2":       {"Accept": service.V2.MediaType()},
+			"v2-gzip":  {"Accept": service.V2.MediaType(), "Accept-Encoding": "gzip"},
+		} {
+			resp := get("/contenders/"+name, headers)
+			resp.Body.Close()
+			etags[representation] = resp.Header.Get("ETag")
+		}
+		assert.Equal(t, map[string]string{
+			"identity": `"2-0-0"`,
+			"gzip":     `"2-0-0-gzip"`,
+			"br":       `"2-0-0-br"`,
+			"v2":       `"2-0-0-v2"`,
+			"v2-gzip":  `"2-0-0-v2-gzip"`,
+		}, etags)
+
+		resp := get("/contenders/"+name+"/svg", nil)
+		resp.Body.Close()
+		svgETag := resp.Header.Get("ETag")
+		resp = get("/contenders/"+name+"/svg", map[string]string{"Accept-Encoding": "gzip"})
+		resp.Body.Close()
+		gzipETag := resp.Header.Get("ETag")
+		assert.NotEqual(t, svgETag, gzipETag)
+
+		// the encoded ETag only matches requests for the same encoding
+		for encoding, status := range map[string]int{"gzip": http.StatusNotModified, "br": http.StatusOK, "identity": http.StatusOK} {
+			resp = get("/contenders/"+name+"/svg", map[string]string{"Accept-Encoding": encoding, "If-None-Match": gzipETag})
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode, encoding)
+			if status == http.StatusNotModified {
+				assert.Equal(t, gzipETag, resp.Header.Get("ETag"))
+			}
+		}
+	})
+}
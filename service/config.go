@@ -1,12 +1,18 @@
 package service
 
 import (
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+	"github.com/sbogacz/wouldyoutatter/tracing"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -27,6 +33,50 @@ const (
 	DefaultMasterMatchupsTableName = "Possible-Matchups"
 	// DefaultTokenTableName is what it sounds like
 	DefaultTokenTableName = "Tokens"
+	// DefaultPollTableName is what it sounds like
+	DefaultPollTableName = "Polls"
+	// DefaultMigrationTableName is what it sounds like
+	DefaultMigrationTableName = "Schema-Migrations"
+	// DefaultSingleTableName is the table every entity is kept in, with
+	// the single table layout
+	DefaultSingleTableName = "WouldYouTatter"
+
+	// EnvironmentDevelopment is for running locally, or in tests
+	EnvironmentDevelopment = "development"
+	// EnvironmentProduction is checked more strictly by Validate, e.g. it
+	// can't use the default master key
+	EnvironmentProduction = "production"
+
+	// LayoutMulti keeps each kind of item in a table of its own
+	LayoutMulti = "multi"
+	// LayoutSingle keeps every kind of item in a single table
+	LayoutSingle = "single"
+
+	// CacheOff reads contenders straight from their table
+	CacheOff = "off"
+	// CacheLRU caches contenders and the leaderboard in process
+	CacheLRU = "lru"
+	// CacheRedis caches contenders and the leaderboard in Redis, so every
+	// instance shares, and invalidates, the same cache
+	CacheRedis = "redis"
+
+	// EnsureTablesOff leaves each table to be created by the first write
+	// to it
+	EnsureTablesOff = "off"
+	// EnsureTablesVerify checks that every table exists at startup
+	EnsureTablesVerify = "verify"
+	// EnsureTablesCreate creates any table that doesn't exist at startup
+	EnsureTablesCreate = "create"
+	// DefaultEnsureTablesTimeout is how long startup waits for the tables
+	DefaultEnsureTablesTimeout = time.Minute
+	// DefaultDrainDelay is how long Stop fails readiness for before it
+	// shuts the server down, so load balancers stop sending it traffic
+	DefaultDrainDelay = 5 * time.Second
+	// DefaultShutdownTimeout is how long in-flight requests get to finish
+	DefaultShutdownTimeout = 30 * time.Second
+	// DefaultRequestTimeout is how long a request's storage calls get,
+	// which leaves time to answer within the default write timeout
+	DefaultRequestTimeout = 20 * time.Second
 )
 
 var (
@@ -36,6 +86,12 @@ var (
 // Config holds the service variables we want to
 // to configure from the cli/env
 type Config struct {
+	// ConfigFile is the YAML or TOML file settings are read from, when
+	// they aren't set by env vars or flags
+	ConfigFile string
+	// Environment is EnvironmentDevelopment or EnvironmentProduction
+	Environment string
+
 	Port            int
 	AWSAccessKeyID  string
 	AWSSecretKey    string
@@ -44,6 +100,33 @@ type Config struct {
 	LogLevel        string
 	APIReadTimeout  time.Duration
 	APIWriteTimeout time.Duration
+	// RequestTimeout is the deadline of each request's context, except
+	// for streams
+	RequestTimeout time.Duration
+	// LogFormat is logging.FormatText or logging.FormatJSON
+	LogFormat string
+	// LogOutput is where the service logs to, stdout if it's nil
+	LogOutput io.Writer
+	// TableLayout is LayoutMulti or LayoutSingle
+	TableLayout string
+
+	// Cache is CacheOff, CacheLRU or CacheRedis
+	Cache         string
+	CacheSize     int
+	CacheTTL      time.Duration
+	CacheQueryTTL time.Duration
+	RedisAddr     string
+	RedisPassword string
+
+	// EnsureTables is EnsureTablesOff, EnsureTablesVerify or
+	// EnsureTablesCreate
+	EnsureTables        string
+	EnsureTablesTimeout time.Duration
+
+	// AdminKey protects /debug/info, which isn't served without one
+	AdminKey        string
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
 
 	// Table Configs
 	ContenderTableConfig      *dynamostore.TableConfig
@@ -51,14 +134,44 @@ type Config struct {
 	UserMatchupsTableConfig   *dynamostore.TableConfig
 	MasterMatchupsTableConfig *dynamostore.TableConfig
 	TokenTableConfig          *dynamostore.TableConfig
+	PollTableConfig           *dynamostore.TableConfig
+	MigrationTableConfig      *dynamostore.TableConfig
+	// SingleTableConfig is used in place of the others, except for the
+	// migrations table, with the single table layout
+	SingleTableConfig *dynamostore.TableConfig
+
+	// Tracing controls how requests, and their Dynamo calls, are traced
+	Tracing tracing.Config
+	// TracerProvider, if it's set, is used instead of the one Tracing
+	// configures, e.g. to record spans in memory
+	TracerProvider trace.TracerProvider
+
+	// Broker distributes votes and leaderboard changes to streaming
+	// clients. If it's nil, the service uses an InMemoryBroker, which
+	// only reaches clients of the same instance
+	Broker Broker
 }
 
 // Flags r	eturns the slice of cli.Flags that we have
 // available
 func (c *Config) Flags() []cli.Flag {
 	ret := []cli.Flag{
+		cli.StringFlag{
+			Name:        ConfigFileFlag,
+			EnvVar:      "CONFIG_FILE",
+			Usage:       "a YAML or TOML file of settings, by flag name, for those that aren't set by env vars or flags",
+			Destination: &c.ConfigFile,
+		},
+		cli.StringFlag{
+			Name:        "environment",
+			EnvVar:      "ENVIRONMENT",
+			Usage:       "development, or production to check the configuration more strictly",
+			Destination: &c.Environment,
+			Value:       EnvironmentDevelopment,
+		},
 		cli.IntFlag{
 			Name:        "port, p",
+			EnvVar:      "PORT",
 			Usage:       "the port you'd like to run the service on",
 			Destination: &c.Port,
 			Value:       DefaultPort,
@@ -95,6 +208,13 @@ func (c *Config) Flags() []cli.Flag {
 			Destination: &c.LogLevel,
 			Value:       DefaultLogLevel,
 		},
+		cli.StringFlag{
+			Name:        "log-format",
+			EnvVar:      "LOG_FORMAT",
+			Usage:       "text, or json to log a JSON object per line",
+			Destination: &c.LogFormat,
+			Value:       logging.FormatText,
+		},
 		cli.DurationFlag{
 			Name:        "api-read-timeout",
 			EnvVar:      "API_READ_TIMEOUT",
@@ -109,6 +229,94 @@ func (c *Config) Flags() []cli.Flag {
 			Destination: &c.APIWriteTimeout,
 			Value:       time.Second * 30,
 		},
+		cli.DurationFlag{
+			Name:        "request-timeout",
+			EnvVar:      "REQUEST_TIMEOUT",
+			Usage:       "how long a request's storage calls get before it fails with a 504, which should be less than the write timeout",
+			Destination: &c.RequestTimeout,
+			Value:       DefaultRequestTimeout,
+		},
+		cli.StringFlag{
+			Name:        "table-layout",
+			EnvVar:      "TABLE_LAYOUT",
+			Usage:       "multi, for a table per kind of item, or single, to keep them all in the single table",
+			Destination: &c.TableLayout,
+			Value:       LayoutMulti,
+		},
+		cli.StringFlag{
+			Name:        "cache",
+			EnvVar:      "CACHE",
+			Usage:       "off, lru to cache contenders and the leaderboard in process, or redis to cache them in --redis-addr",
+			Destination: &c.Cache,
+			Value:       CacheOff,
+		},
+		cli.IntFlag{
+			Name:        "cache-size",
+			EnvVar:      "CACHE_SIZE",
+			Usage:       "the most values the lru cache holds",
+			Destination: &c.CacheSize,
+			Value:       dynamostore.DefaultLRUCacheSize,
+		},
+		cli.DurationFlag{
+			Name:        "cache-ttl",
+			EnvVar:      "CACHE_TTL",
+			Usage:       "how long contenders are cached",
+			Destination: &c.CacheTTL,
+			Value:       dynamostore.DefaultCacheTTL,
+		},
+		cli.DurationFlag{
+			Name:        "cache-query-ttl",
+			EnvVar:      "CACHE_QUERY_TTL",
+			Usage:       "how long the leaderboard is cached",
+			Destination: &c.CacheQueryTTL,
+			Value:       dynamostore.DefaultCacheQueryTTL,
+		},
+		cli.StringFlag{
+			Name:        "redis-addr",
+			EnvVar:      "REDIS_ADDR",
+			Usage:       "the host:port of the redis cache",
+			Destination: &c.RedisAddr,
+		},
+		cli.StringFlag{
+			Name:        "redis-password",
+			EnvVar:      "REDIS_PASSWORD",
+			Usage:       "the password of the redis cache, if it has one",
+			Destination: &c.RedisPassword,
+		},
+		cli.StringFlag{
+			Name:        "ensure-tables",
+			EnvVar:      "ENSURE_TABLES",
+			Usage:       "off, verify to check the tables exist at startup, or create to create any that don't",
+			Destination: &c.EnsureTables,
+			Value:       EnsureTablesOff,
+		},
+		cli.DurationFlag{
+			Name:        "ensure-tables-timeout",
+			EnvVar:      "ENSURE_TABLES_TIMEOUT",
+			Usage:       "how long startup waits for the tables to be verified or created",
+			Destination: &c.EnsureTablesTimeout,
+			Value:       DefaultEnsureTablesTimeout,
+		},
+		cli.StringFlag{
+			Name:        "admin-key",
+			EnvVar:      "ADMIN_KEY",
+			Usage:       "the key required in the X-Tatter-Admin header for /debug/info, which isn't served without one",
+			Destination: &c.AdminKey,
+		},
+		cli.DurationFlag{
+			Name:        "drain-delay",
+			EnvVar:      "DRAIN_DELAY",
+			Usage:       "how long the service fails readiness for, when stopping, before it stops accepting requests",
+			Destination: &c.DrainDelay,
+			Value:       DefaultDrainDelay,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-timeout",
+			EnvVar:      "SHUTDOWN_TIMEOUT",
+			Usage:       "how long in-flight requests get to finish when the service stops",
+			Destination: &c.ShutdownTimeout,
+			Value:       DefaultShutdownTimeout,
+		},
 	}
 	// initialize configs
 	c.ContenderTableConfig = &dynamostore.TableConfig{}
@@ -116,12 +324,19 @@ func (c *Config) Flags() []cli.Flag {
 	c.UserMatchupsTableConfig = &dynamostore.TableConfig{}
 	c.MasterMatchupsTableConfig = &dynamostore.TableConfig{}
 	c.TokenTableConfig = &dynamostore.TableConfig{}
+	c.PollTableConfig = &dynamostore.TableConfig{}
+	c.MigrationTableConfig = &dynamostore.TableConfig{}
+	c.SingleTableConfig = &dynamostore.TableConfig{}
 
 	ret = append(ret, c.ContenderTableConfig.Flags("contender", DefaultContenderTableName)...)
 	ret = append(ret, c.MatchupTableConfig.Flags("matchup", DefaultMatchupTableName)...)
 	ret = append(ret, c.UserMatchupsTableConfig.Flags("user-matchups", DefaultUserMatchupsTableName)...)
 	ret = append(ret, c.MasterMatchupsTableConfig.Flags("master-matchups", DefaultMasterMatchupsTableName)...)
 	ret = append(ret, c.TokenTableConfig.Flags("token", DefaultTokenTableName)...)
+	ret = append(ret, c.PollTableConfig.Flags("poll", DefaultPollTableName)...)
+	ret = append(ret, c.MigrationTableConfig.Flags("migration", DefaultMigrationTableName)...)
+	ret = append(ret, c.SingleTableConfig.Flags("single", DefaultSingleTableName)...)
+	ret = append(ret, c.Tracing.Flags()...)
 	return ret
 }
 
@@ -146,3 +361,92 @@ func (c *Config) logLevelToLogrus() log.Level {
 	}
 	return log.InfoLevel
 }
+
+// ConfigError is a problem with one of a Config's settings, which it
+// names by flag
+type ConfigError struct {
+	Setting string
+	Reason  string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Setting, e.Reason)
+}
+
+// ConfigErrors are every problem Validate found with a Config
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the config, and returns ConfigErrors with every problem
+// it finds, rather than the first, so they can all be fixed at once.
+// Empty settings take their defaults, as they do in New
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	invalid := func(setting, reason string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Setting: setting, Reason: fmt.Sprintf(reason, args...)})
+	}
+	oneOf := func(setting, value string, allowed ...string) {
+		if value == "" {
+			return
+		}
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		invalid(setting, "%q isn't one of %s", value, strings.Join(allowed, ", "))
+	}
+
+	oneOf("environment", c.Environment, EnvironmentDevelopment, EnvironmentProduction)
+	if c.Port <= 0 || c.Port > 65535 {
+		invalid("port", "%d isn't between 1 and 65535", c.Port)
+	}
+	oneOf("log-level", c.LogLevel, "DEBUG", "INFO", "WARN", "ERROR")
+	oneOf("log-format", c.LogFormat, logging.FormatText, logging.FormatJSON)
+	switch {
+	case c.MasterKey == "":
+		invalid("master-key", "must be set")
+	case c.MasterKey == DefaultMasterKey && c.Environment == EnvironmentProduction:
+		invalid("master-key", "mustn't be the default in production")
+	}
+	oneOf("table-layout", c.TableLayout, LayoutMulti, LayoutSingle)
+	oneOf("cache", c.Cache, CacheOff, CacheLRU, CacheRedis)
+	if c.Cache == CacheRedis && c.RedisAddr == "" {
+		invalid("redis-addr", "must be set for the redis cache")
+	}
+	oneOf("ensure-tables", c.EnsureTables, EnsureTablesOff, EnsureTablesVerify, EnsureTablesCreate)
+	oneOf("tracing", c.Tracing.Exporter, tracing.ExporterOff, tracing.ExporterOTLP, tracing.ExporterXRay)
+
+	type table struct {
+		prefix string
+		config *dynamostore.TableConfig
+	}
+	tables := []table{
+		{"contender", c.ContenderTableConfig},
+		{"matchup", c.MatchupTableConfig},
+		{"user-matchups", c.UserMatchupsTableConfig},
+		{"master-matchups", c.MasterMatchupsTableConfig},
+		{"token", c.TokenTableConfig},
+		{"poll", c.PollTableConfig},
+	}
+	if c.TableLayout == LayoutSingle {
+		tables = []table{{"single", c.SingleTableConfig}}
+	}
+	for _, t := range append(tables, table{"migration", c.MigrationTableConfig}) {
+		if t.config == nil || t.config.TableName == "" {
+			invalid(t.prefix+"-table-name", "must be set")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
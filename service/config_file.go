@@ -0,0 +1,226 @@
+package service
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/logging"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFileFlag names the flag of the config file
+const ConfigFileFlag = "config"
+
+// secretSettings are the settings whose values aren't printed
+var secretSettings = map[string]bool{
+	"aws-access-key-id": true,
+	"aws-secret-key":    true,
+	"master-key":        true,
+	"admin-key":         true,
+	"redis-password":    true,
+}
+
+// LoadConfigFile returns a cli.BeforeFunc that sets the flags that
+// weren't set on the command line or by env vars from the config file,
+// if there is one, so settings come from flags, then env vars, then the
+// file, then the defaults. The file's keys are flag names, e.g.
+//
+//	log-level: DEBUG
+//	contender:
+//	  table-name: Contenders
+//	  table-tags: [team=tattoos]
+//
+// where nested keys are joined with dashes
+func LoadConfigFile(flags []cli.Flag) cli.BeforeFunc {
+	return func(ctx *cli.Context) error {
+		path := ctx.GlobalString(ConfigFileFlag)
+		if path == "" {
+			return nil
+		}
+		known := flagNames(flags)
+		delete(known, ConfigFileFlag)
+		settings, err := readConfigFile(path, known)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read config file %s", path)
+		}
+
+		set := map[string]bool{}
+		for name := range settings {
+			set[name] = ctx.GlobalIsSet(name)
+		}
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if set[name] {
+				continue
+			}
+			if err := ctx.GlobalSet(name, settings[name]); err != nil {
+				return errors.Wrapf(err, "invalid %s in config file %s", name, path)
+			}
+		}
+		return nil
+	}
+}
+
+// readConfigFile reads the settings in the YAML or TOML file, by flag
+// name, as they'd be given on the command line
+func readConfigFile(path string, known map[string]bool) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".json":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	default:
+		return nil, errors.Errorf("unknown config file type %q, which should be .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	var unknown []string
+	flattenSettings("", raw, known, settings, &unknown)
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.Errorf("unknown settings %s", strings.Join(unknown, ", "))
+	}
+	return settings, nil
+}
+
+// flattenSettings adds the settings in values to settings, joining the
+// keys of nested maps with dashes, until they name a flag
+func flattenSettings(prefix string, values map[string]interface{}, known map[string]bool, settings map[string]string, unknown *[]string) {
+	for key, value := range values {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+		if known[name] {
+			settings[name] = settingValue(value)
+			continue
+		}
+		if nested, ok := stringMap(value); ok {
+			flattenSettings(name, nested, known, settings, unknown)
+			continue
+		}
+		*unknown = append(*unknown, name)
+	}
+}
+
+// settingValue returns the value as it'd be given on the command line.
+// Lists and maps are for flags like the tags, which take comma separated
+// values
+func settingValue(value interface{}) string {
+	if m, ok := stringMap(value); ok {
+		pairs := make([]string, 0, len(m))
+		for k, v := range m {
+			pairs = append(pairs, k+"="+settingValue(v))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, len(list))
+		for i, v := range list {
+			values[i] = settingValue(v)
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// stringMap returns the value as a map with string keys, if it's a map,
+// whichever decoder it came from
+func stringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			ret[fmt.Sprint(k)] = v
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// flagNames returns the names of the flags, without their aliases
+func flagNames(flags []cli.Flag) map[string]bool {
+	names := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		names[flagName(f)] = true
+	}
+	return names
+}
+
+func flagName(f cli.Flag) string {
+	return strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+}
+
+// WriteConfig writes the effective settings of the app's flags as YAML,
+// which can be read back as a config file, with secrets redacted
+func WriteConfig(w io.Writer, ctx *cli.Context) error {
+	// subcommands have apps of their own, with only their flags
+	root := ctx
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+	skip := map[string]bool{
+		ConfigFileFlag:            true,
+		flagName(cli.HelpFlag):    true,
+		flagName(cli.VersionFlag): true,
+	}
+	settings := yaml.MapSlice{}
+	for _, f := range root.App.Flags {
+		name := flagName(f)
+		if skip[name] {
+			continue
+		}
+		settings = append(settings, yaml.MapItem{Key: name, Value: settingOf(ctx, name)})
+	}
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// settingOf returns the flag's value, typed for YAML where it can be
+func settingOf(ctx *cli.Context, name string) interface{} {
+	value, ok := ctx.GlobalGeneric(name).(flag.Value)
+	if !ok {
+		return nil
+	}
+	if secretSettings[name] && value.String() != "" {
+		return logging.Redacted
+	}
+	getter, ok := value.(flag.Getter)
+	if !ok {
+		return value.String()
+	}
+	switch v := getter.Get().(type) {
+	case time.Duration:
+		return v.String()
+	default:
+		return v
+	}
+}
@@ -0,0 +1,146 @@
+package service_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/logging"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultConfig returns the config the flags' defaults make
+func defaultConfig() *service.Config {
+	c := &service.Config{}
+	set := flag.NewFlagSet("defaults", flag.ContinueOnError)
+	for _, f := range c.Flags() {
+		f.Apply(set)
+	}
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, defaultConfig().Validate())
+
+	c := defaultConfig()
+	c.Environment = service.EnvironmentProduction
+	c.Port = 0
+	c.LogLevel = "LOUD"
+	c.Cache = service.CacheRedis
+	c.MatchupTableConfig.TableName = ""
+	err := c.Validate()
+	require.Error(t, err)
+	errs, ok := err.(service.ConfigErrors)
+	require.True(t, ok)
+	settings := []string{}
+	for _, e := range errs {
+		settings = append(settings, e.Setting)
+	}
+	assert.Equal(t, []string{"port", "log-level", "master-key", "redis-addr", "matchup-table-name"}, settings, "every problem is reported")
+
+	c = defaultConfig()
+	c.TableLayout = service.LayoutSingle
+	c.MatchupTableConfig.TableName = ""
+	assert.NoError(t, c.Validate(), "the single table layout doesn't use the others")
+}
+
+// runWithConfigFile runs an app with the service's flags and the args,
+// and returns the config it ran with
+func runWithConfigFile(t *testing.T, args ...string) (*service.Config, error) {
+	c := &service.Config{}
+	app := cli.NewApp()
+	app.Flags = c.Flags()
+	app.Before = service.LoadConfigFile(app.Flags)
+	app.Action = func(*cli.Context) error { return nil }
+	return c, app.Run(append([]string{"wouldyoutatter"}, args...))
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	t.Run("yaml", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+port: 9090
+log-level: DEBUG
+log-format: json
+contender:
+  table-name: FileContenders
+  table-tags:
+    team: tattoos
+  operation-timeouts: [Scan=10s, Get=1s]
+`)
+		t.Setenv("LOG_LEVEL", "WARN")
+		c, err := runWithConfigFile(t, "--config", path, "--log-format", "text")
+		require.NoError(t, err)
+		assert.Equal(t, 9090, c.Port, "the file overrides the defaults")
+		assert.Equal(t, "WARN", c.LogLevel, "env vars override the file")
+		assert.Equal(t, logging.FormatText, c.LogFormat, "flags override the file")
+		assert.Equal(t, "FileContenders", c.ContenderTableConfig.TableName)
+		assert.Equal(t, "tattoos", c.ContenderTableConfig.Tags["team"])
+		assert.Equal(t, 10*time.Second, c.ContenderTableConfig.Timeouts.For("Scan"))
+		assert.Equal(t, service.DefaultMatchupTableName, c.MatchupTableConfig.TableName)
+	})
+	t.Run("toml", func(t *testing.T) {
+		path := writeFile(t, "config.toml", `
+table-layout = "single"
+
+[single]
+table-name = "FileTatters"
+`)
+		c, err := runWithConfigFile(t, "--config", path)
+		require.NoError(t, err)
+		assert.Equal(t, service.LayoutSingle, c.TableLayout)
+		assert.Equal(t, "FileTatters", c.SingleTableConfig.TableName)
+	})
+	t.Run("unknown settings", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", "prot: 9090\ncontender:\n  name: typo\n")
+		_, err := runWithConfigFile(t, "--config", path)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "contender-name, prot")
+	})
+	t.Run("invalid values", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", "port: lots\n")
+		_, err := runWithConfigFile(t, "--config", path)
+		assert.Error(t, err)
+	})
+}
+
+func TestWriteConfig(t *testing.T) {
+	var out bytes.Buffer
+	c := &service.Config{}
+	app := cli.NewApp()
+	app.Flags = c.Flags()
+	app.Commands = []cli.Command{{
+		Name:   "print",
+		Action: func(ctx *cli.Context) error { return service.WriteConfig(&out, ctx) },
+	}}
+	require.NoError(t, app.Run([]string{"wouldyoutatter", "--port", "9090", "--contender-table-tags", "team=tattoos", "print"}))
+
+	printed := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal(out.Bytes(), &printed))
+	assert.Equal(t, 9090, printed["port"])
+	assert.Equal(t, logging.Redacted, printed["master-key"])
+	assert.Equal(t, "", printed["admin-key"], "unset secrets aren't redacted")
+	assert.Equal(t, "team=tattoos", printed["contender-table-tags"])
+	assert.Equal(t, "20s", printed["request-timeout"])
+	assert.NotContains(t, printed, "help")
+	assert.NotContains(t, printed, service.ConfigFileFlag)
+
+	// and it can be read back
+	path := writeFile(t, "printed.yaml", out.String())
+	read, err := runWithConfigFile(t, "--config", path)
+	require.NoError(t, err)
+	assert.Equal(t, 9090, read.Port)
+	assert.Equal(t, "tattoos", read.ContenderTableConfig.Tags["team"])
+}
@@ -2,11 +2,16 @@ package service_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/sbogacz/wouldyoutatter/client"
 	"github.com/sbogacz/wouldyoutatter/contender"
 	"github.com/sbogacz/wouldyoutatter/service"
 	"github.com/stretchr/testify/assert"
@@ -27,9 +32,11 @@ func TestSimpleContenderCRUD(t *testing.T) {
 		req, err := http.NewRequest("POST", contenderAddress, bytes.NewBuffer(b))
 		require.NoError(t, err)
 
+		req.Header.Set(service.RequestIDHeader, "create-contender-test")
 		resp, err := http.DefaultClient.Do(req)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assertProblem(t, resp, service.CodeUnauthorized)
 
 		// if we add the master key header it should succeed
 		req, err = http.NewRequest("POST", contenderAddress, bytes.NewBuffer(b))
@@ -78,6 +85,175 @@ func TestSimpleContenderCRUD(t *testing.T) {
 	})
 }
 
+func TestContenderErrors(t *testing.T) {
+	t.Run("missing name fails validation", func(t *testing.T) {
+		b, err := json.Marshal(&contender.Contender{Description: "nameless"})
+		require.NoError(t, err)
+
+		req, err := http.NewRequest("POST", contenderAddress, bytes.NewBuffer(b))
+		require.NoError(t, err)
+		req.Header.Set("X-Tatter-Master", service.DefaultMasterKey)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assertProblem(t, resp, service.CodeValidation)
+	})
+	t.Run("unknown contender is not found", func(t *testing.T) {
+		resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/%s", contenderAddress, "nobody"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assertProblem(t, resp, service.CodeNotFound)
+	})
+	t.Run("requests past their deadline time out", func(t *testing.T) {
+		impatient, err := service.New(service.Config{LogLevel: "ERROR", RequestTimeout: time.Nanosecond})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		impatient.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/v1/contenders/nobody", nil))
+		resp := rec.Result()
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		assertProblem(t, resp, service.CodeTimeout)
+	})
+}
+
+func TestContenderVersions(t *testing.T) {
+	c := contender.Contender{
+		Name:        "versioned-koi",
+		Description: "a koi",
+		SVG:         []byte("pretend this is an svg"),
+	}
+	address := fmt.Sprintf("%s/%s", contenderAddress, c.Name)
+	do := func(method, url string, body interface{}, ifMatch string) *http.Response {
+		var b []byte
+		if body != nil {
+			var err error
+			b, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(b))
+		require.NoError(t, err)
+		req.Header.Set("X-Tatter-Master", service.DefaultMasterKey)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("creating doesn't replace an existing contender", func(t *testing.T) {
+		resp := do("POST", contenderAddress, &c, "")
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, `"1-0-0"`, resp.Header.Get("ETag"))
+
+		resp = do("POST", contenderAddress, &c, "")
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assertProblem(t, resp, service.CodeConflict)
+	})
+	t.Run("updates check If-Match", func(t *testing.T) {
+		resp, err := http.DefaultClient.Get(address)
+		require.NoError(t, err)
+		resp.Body.Close()
+		// the client asks for gzip, and If-Match takes any
+		// representation's ETag
+		etag := resp.Header.Get("ETag")
+		assert.Equal(t, `"1-0-0-gzip"`, etag)
+
+		edit := c
+		edit.Description = "an edited koi"
+		resp = do("PUT", address, &edit, etag)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		// the first update changed the ETag, so the same one fails
+		resp = do("PUT", address, &edit, etag)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		assertProblem(t, resp, service.CodePrecondition)
+
+		// the version and poll in the body are the store's, not the client's
+		resp = do("PUT", address, map[string]interface{}{"description": "an unconditionally edited koi", "version": 99, "poll": "elsewhere"}, "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		resp, err = http.DefaultClient.Get(address)
+		require.NoError(t, err)
+		edited := contender.Contender{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&edited))
+		resp.Body.Close()
+		assert.Equal(t, "an unconditionally edited koi", edited.Description)
+		assert.Equal(t, `"3-0-0-gzip"`, resp.Header.Get("ETag"))
+
+		resp = do("PUT", address, &edit, "not-an-etag")
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		assertProblem(t, resp, service.CodePrecondition)
+
+		resp, err = http.DefaultClient.Get(address)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, `"3-0-0-gzip"`, resp.Header.Get("ETag"))
+	})
+	t.Run("deletes check If-Match", func(t *testing.T) {
+		// "0" only matches contenders saved before they had versions
+		for _, stale := range []string{`"2"`, `"0"`} {
+			resp := do("DELETE", address, nil, stale)
+			assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode, stale)
+			assertProblem(t, resp, service.CodePrecondition)
+		}
+
+		resp := do("DELETE", address, nil, `"3"`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = do("DELETE", address, nil, "*")
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		assertProblem(t, resp, service.CodePrecondition)
+	})
+	t.Run("votes change the ETag, but not the version", func(t *testing.T) {
+		// a poll of two, so the matchup is theirs
+		ctx := context.Background()
+		tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+		require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: "versioned-votes"}))
+		defer tatter.DeletePoll(ctx, "versioned-votes")
+		poll := tatter.Poll("versioned-votes")
+		for _, name := range []string{c.Name, "versioned-carp"} {
+			require.NoError(t, poll.CreateContender(ctx, &contender.Contender{Name: name, SVG: c.SVG}))
+		}
+		address := fmt.Sprintf("%s/polls/versioned-votes/contenders/%s", baseAddress, c.Name)
+		resp := do("GET", address, nil, "")
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		assert.Equal(t, `"1-0-0-gzip"`, etag)
+
+		m, err := poll.RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NoError(t, poll.Vote(ctx, m, c.Name))
+		resp = do("GET", address, nil, "")
+		resp.Body.Close()
+		assert.Equal(t, `"1-1-0-gzip"`, resp.Header.Get("ETag"))
+
+		edit := c
+		edit.Description = "a koi with a vote"
+		resp = do("PUT", address, &edit, etag)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "the vote didn't change the version")
+	})
+}
+
+// assertProblem checks that the response is a problem+json body with the
+// given code, tagged with the request ID we got back in the headers
+func assertProblem(t *testing.T, resp *http.Response, code string) {
+	defer resp.Body.Close()
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	p := service.Problem{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+	assert.Equal(t, code, p.Code)
+	assert.Equal(t, resp.StatusCode, p.Status)
+	assert.NotEmpty(t, p.RequestID)
+	assert.Equal(t, resp.Header.Get(service.RequestIDHeader), p.RequestID)
+}
+
 func TestAddingSeveralContendersCreatesPossibleMatchups(t *testing.T) {
 	things := []string{"banana", "apple", "window", "troll"}
 	contenders := []contender.Contender{}
@@ -153,6 +329,18 @@ func TestAddingSeveralContendersCreatesPossibleMatchups(t *testing.T) {
 		require.True(t, true)
 
 	})
+
+	t.Run("clean up", func(t *testing.T) {
+		for _, contender := range contenders {
+			req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s", contenderAddress, contender.Name), nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Tatter-Master", service.DefaultMasterKey)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusNoContent, resp.StatusCode)
+		}
+	})
 }
 
 func stringInSlice(s string, arr []string) bool {
@@ -163,3 +351,52 @@ func stringInSlice(s string, arr []string) bool {
 	}
 	return false
 }
+
+// TestConcurrentBatchesCreateOnce sends the same batch several times at
+// once, and each contender should be created by only one of them
+func TestConcurrentBatchesCreateOnce(t *testing.T) {
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+	require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: "racing-batches"}))
+	poll := tatter.Poll("racing-batches")
+	racers := []string{"racer-hare", "racer-tortoise", "racer-hound"}
+	defer func() {
+		for _, name := range racers {
+			poll.DeleteContender(ctx, name)
+		}
+		tatter.DeletePoll(ctx, "racing-batches")
+	}()
+
+	batch := []contender.Contender{}
+	for _, name := range racers {
+		batch = append(batch, contender.Contender{Name: name, SVG: []byte("pretend this is an svg")})
+	}
+	const senders = 4
+	created := make(chan string, senders*len(batch))
+	wg := sync.WaitGroup{}
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, err := poll.BatchCreateContenders(ctx, batch)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for _, r := range results {
+				if r.Created() {
+					created <- r.Name
+					continue
+				}
+				assert.Equal(t, http.StatusConflict, r.Status, r.Name)
+			}
+		}()
+	}
+	wg.Wait()
+	close(created)
+
+	names := []string{}
+	for name := range created {
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, racers, names)
+}
@@ -5,95 +5,332 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/go-chi/chi"
 	"github.com/sbogacz/wouldyoutatter/contender"
 	"github.com/sbogacz/wouldyoutatter/dynamostore"
-	log "github.com/sirupsen/logrus"
+	"github.com/sbogacz/wouldyoutatter/logging"
 )
 
+const (
+	// maxBatchSize is the most contenders a batch create can take
+	maxBatchSize = 100
+	// batchConcurrency is how many of a batch's contenders are created at
+	// once
+	batchConcurrency = 10
+)
+
+// BatchContendersPayload is the struct of the expected payload on batch
+// contender POSTs
+type BatchContendersPayload struct {
+	Contenders []contender.Contender `json:"contenders"`
+}
+
+// ContenderUpdatePayload is the struct of the expected payload on
+// contender PUTs. It leaves out the record, version and poll, which
+// belong to the store, so a client can't set them
+type ContenderUpdatePayload struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	SVG         []byte   `json:"svg"`
+	Tags        []string `json:"tags,omitempty"`
+	Artist      string   `json:"artist,omitempty"`
+}
+
+// BatchContendersResp holds the result of a batch create, in the order
+// the contenders were given
+type BatchContendersResp struct {
+	Results []BatchContenderResult `json:"results"`
+}
+
+// BatchContenderResult is the outcome for a single contender of a batch.
+// Failures carry the same status and code as a problem would
+type BatchContenderResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
 func (s *Service) createContender(w http.ResponseWriter, req *http.Request) {
 	d := json.NewDecoder(req.Body)
 	defer req.Body.Close()
 
 	c := &contender.Contender{}
 	if err := d.Decode(c); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("failed to decode payload"))
-		log.Errorf("failed to decode payload: %v", err)
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "failed to decode payload")
+		logging.FromContext(req.Context()).Debugf("failed to decode payload: %v", err)
 		return
 	}
 
-	// save contender
-	if err := s.contenderStore.Set(context.Background(), c); err != nil {
-		http.Error(w, "failed to store contender", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to store contender")
+	// save contender, without replacing an existing one and its record
+	if err := s.contenderStore.Create(req.Context(), c); err != nil {
+		if dynamostore.ConflictError(err) {
+			writeErrorMsg(w, req, http.StatusConflict, CodeConflict, fmt.Sprintf("a contender named %s already exists", c.Name))
+			return
+		}
+		writeError(w, req, err, "failed to store contender")
 		return
 	}
 
 	// get all contenders
-	allContenders, err := s.contenderStore.GetAll(context.TODO())
+	allContenders, err := s.contenderStore.GetAll(req.Context())
 	if err != nil {
-		http.Error(w, "failed to update master matchup set", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to retrieve all contenders to update master matchup set")
+		writeError(w, req, err, "failed to update master matchup set")
 		return
 	}
 
 	// add to master matchup set
-	if err := s.masterMatchupSet.Add(context.TODO(), c.Name, allContenders); err != nil {
-		http.Error(w, "failed to update master matchup set", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to update master matchup set")
+	if err := s.masterMatchupSet.Add(req.Context(), c.Name, allContenders); err != nil {
+		writeError(w, req, err, "failed to update master matchup set")
 		return
 	}
 
+	w.Header().Set("ETag", contenderETag(req.Context(), c))
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (s *Service) getContender(w http.ResponseWriter, req *http.Request) {
-	contenderID := chi.URLParam(req, "contenderID")
+func (s *Service) batchCreateContenders(w http.ResponseWriter, req *http.Request) {
+	d := json.NewDecoder(req.Body)
+	defer req.Body.Close()
 
-	c, err := s.contenderStore.Get(context.Background(), contenderID)
+	payload := &BatchContendersPayload{}
+	if err := d.Decode(payload); err != nil {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "failed to decode payload")
+		logging.FromContext(req.Context()).Debugf("failed to decode payload: %v", err)
+		return
+	}
+	if len(payload.Contenders) == 0 || len(payload.Contenders) > maxBatchSize {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, fmt.Sprintf("a batch must have between 1 and %d contenders", maxBatchSize))
+		return
+	}
+
+	// only the valid contenders are saved, the rest fail on their own
+	results := make([]BatchContenderResult, len(payload.Contenders))
+	seen := map[string]bool{}
+	for i, c := range payload.Contenders {
+		results[i] = BatchContenderResult{Name: c.Name, Status: http.StatusCreated}
+		if err := c.Validate(); err != nil {
+			results[i].Status, results[i].Code, results[i].Detail = http.StatusBadRequest, CodeValidation, err.Error()
+			continue
+		}
+		if seen[c.Name] {
+			results[i].Status, results[i].Code, results[i].Detail = http.StatusBadRequest, CodeValidation, "contender appears more than once in the batch"
+			continue
+		}
+		seen[c.Name] = true
+	}
+
+	// each is created on its own, so one that already exists, even if it
+	// was created since the batch was sent, keeps its record
+	sem := make(chan struct{}, batchConcurrency)
+	wg := sync.WaitGroup{}
+	created := make([]bool, len(results))
+	for i := range payload.Contenders {
+		if results[i].Status != http.StatusCreated {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c := payload.Contenders[i]
+			err := s.contenderStore.Create(req.Context(), &c)
+			switch {
+			case err == nil:
+				created[i] = true
+			case dynamostore.ConflictError(err):
+				results[i].Status, results[i].Code, results[i].Detail = http.StatusConflict, CodeConflict, "a contender with this name already exists"
+			default:
+				statusCode, code := classifyError(err)
+				results[i].Status, results[i].Code, results[i].Detail = statusCode, code, "failed to store contender"
+				logging.FromContext(req.Context()).WithError(err).WithField("contender", results[i].Name).Error("failed to store contender")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	names := []string{}
+	for i := range results {
+		if created[i] {
+			names = append(names, results[i].Name)
+		}
+	}
+	if len(names) > 0 {
+		// update the master matchup set once for the whole batch
+		allContenders, err := s.contenderStore.GetAll(req.Context())
+		if err != nil {
+			writeError(w, req, err, "failed to update master matchup set")
+			return
+		}
+		if err := s.masterMatchupSet.AddAll(req.Context(), names, allContenders); err != nil {
+			writeError(w, req, err, "failed to update master matchup set")
+			return
+		}
+	}
+
+	writeJSON(w, req, http.StatusOK, &BatchContendersResp{Results: results})
+}
+
+func (s *Service) listContenders(w http.ResponseWriter, req *http.Request) {
+	contenders, err := s.contenderStore.GetAll(req.Context())
 	if err != nil {
-		if dynamostore.NotFoundError(err) {
+		writeError(w, req, err, "failed to retrieve contenders")
+		return
+	}
+
+	writeJSON(w, req, http.StatusOK, contendersView(req.Context(), *contenders))
+}
+
+func (s *Service) updateContender(w http.ResponseWriter, req *http.Request) {
+	contenderID := chi.URLParam(req, "contenderID")
+	d := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+
+	p := &ContenderUpdatePayload{}
+	if err := d.Decode(p); err != nil {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "failed to decode payload")
+		logging.FromContext(req.Context()).Debugf("failed to decode payload: %v", err)
+		return
+	}
+	// contenders can't be renamed, since their matchups are keyed by name
+	if p.Name != "" && p.Name != contenderID {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "the contender's name can't be changed")
+		return
+	}
+	c := &contender.Contender{
+		Name:        contenderID,
+		Description: p.Description,
+		SVG:         p.SVG,
+		Tags:        p.Tags,
+		Artist:      p.Artist,
+	}
+	conditions, ok := ifMatch(req)
+	if !ok {
+		writeErrorMsg(w, req, http.StatusPreconditionFailed, CodePrecondition, "If-Match doesn't match the contender's ETag")
+		return
+	}
+	conditional := len(conditions) > 0
 
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("no contender found with id: %s", contenderID)))
+	if err := s.contenderStore.Update(req.Context(), c, conditions...); err != nil {
+		if conditional && (dynamostore.ConflictError(err) || dynamostore.NotFoundError(err)) {
+			writeErrorMsg(w, req, http.StatusPreconditionFailed, CodePrecondition, "the contender has changed since If-Match's ETag")
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("failed to retrieve contender"))
-		log.Errorf("failed to retrieve contender: %v", err)
+		writeError(w, req, err, fmt.Sprintf("failed to update contender with id: %s", contenderID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) getContender(w http.ResponseWriter, req *http.Request) {
+	contenderID := chi.URLParam(req, "contenderID")
+
+	c, err := s.contenderStore.Get(req.Context(), contenderID)
+	if err != nil {
+		writeError(w, req, err, fmt.Sprintf("failed to retrieve contender with id: %s", contenderID))
 		return
 	}
 
 	if c == nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("no contender found with id: %s", contenderID)))
-		log.Infof("no contender found with name: %s", contenderID)
+		writeErrorMsg(w, req, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no contender found with id: %s", contenderID))
+		logging.FromContext(req.Context()).Infof("no contender found with name: %s", contenderID)
 		return
 	}
 
-	b, err := json.Marshal(c)
+	w.Header().Set("ETag", contenderETag(req.Context(), c))
+	writeJSON(w, req, http.StatusOK, contenderView(req.Context(), c))
+}
+
+func (s *Service) getContenderSVG(w http.ResponseWriter, req *http.Request) {
+	contenderID := chi.URLParam(req, "contenderID")
+
+	c, err := s.contenderStore.Get(req.Context(), contenderID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("failed to encode contender"))
-		log.Errorf("failed to retrieve contender: %v", err)
+		writeError(w, req, err, fmt.Sprintf("failed to retrieve contender with id: %s", contenderID))
 		return
 	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
 	w.WriteHeader(http.StatusOK)
-	w.Header().Set("content-type", "application/json")
-	w.Write(b)
+	w.Write(c.SVG)
 }
 
 func (s *Service) deleteContender(w http.ResponseWriter, req *http.Request) {
 	contenderID := chi.URLParam(req, "contenderID")
+	conditions, ok := ifMatch(req)
+	if !ok {
+		writeErrorMsg(w, req, http.StatusPreconditionFailed, CodePrecondition, "If-Match doesn't match the contender's ETag")
+		return
+	}
+	conditional := len(conditions) > 0
+
+	if err := s.contenderStore.Delete(req.Context(), contenderID, conditions...); err != nil {
+		if conditional && dynamostore.ConflictError(err) {
+			writeErrorMsg(w, req, http.StatusPreconditionFailed, CodePrecondition, "the contender has changed since If-Match's ETag")
+			return
+		}
+		writeError(w, req, err, "failed to delete contender")
+		return
+	}
+
+	// get all remaining contenders
+	allContenders, err := s.contenderStore.GetAll(req.Context())
+	if err != nil {
+		writeError(w, req, err, "failed to update master matchup set")
+		return
+	}
 
-	if err := s.contenderStore.Delete(context.Background(), contenderID); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("failed to delete contender"))
-		log.Errorf("failed to delete contender: %v", err)
+	// remove from master matchup set, so it can't be chosen for a matchup
+	if err := s.masterMatchupSet.Remove(req.Context(), contenderID, allContenders); err != nil {
+		writeError(w, req, err, "failed to update master matchup set")
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// contenderETag is the ETag of a contender, which starts with its version
+// and changes with its record too, since votes don't change the version,
+// e.g. "5-12-3". The V2 representation, which links to the SVG, has its own
+func contenderETag(ctx context.Context, c *contender.Contender) string {
+	etag := fmt.Sprintf("%d-%d-%d", c.Version, c.Wins, c.Losses)
+	if versionFromContext(ctx) == V2 {
+		etag += "-v2"
+	}
+	return strconv.Quote(etag)
+}
+
+// ifMatch reads the request's If-Match header as the conditions of the
+// contender's write, which are none without one. It returns false if the
+// header can't match any contender. If-Match: * only needs the contender
+// to exist, and version 0 is that of contenders saved before they had
+// versions, which still need to exist too
+func ifMatch(req *http.Request) (conditions []dynamostore.WriteOption, ok bool) {
+	header := strings.TrimSpace(req.Header.Get("If-Match"))
+	if header == "" {
+		return nil, true
+	}
+	conditions = []dynamostore.WriteOption{dynamostore.IfExists()}
+	if header == "*" {
+		return conditions, true
+	}
+	// weak ETags never match If-Match, and we only issue one ETag per
+	// representation, all of which start with the version, e.g.
+	// "5-12-3-v2-gzip". Only the version is compared, so votes don't
+	// fail edits
+	unquoted, err := strconv.Unquote(header)
+	if err != nil {
+		return nil, false
+	}
+	version, err := strconv.ParseInt(strings.SplitN(unquoted, "-", 2)[0], 10, 64)
+	if err != nil || version < 0 {
+		return nil, false
+	}
+	return append(conditions, dynamostore.IfVersion(version)), true
+}
@@ -4,28 +4,100 @@ import (
 	"encoding/json"
 	"net/http"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
 )
 
-type errorJSON struct {
-	Err string `json:"error"`
+const (
+	problemContentType = "application/problem+json"
+	problemTypeBase    = "https://wouldyoutatter.com/problems/"
+)
+
+// Error codes are the machine readable part of every error response,
+// and are also used to build the problem type URI
+const (
+	CodeNotFound     = "not-found"
+	CodeConflict     = "conflict"
+	CodePollClosed   = "poll-closed"
+	CodePrecondition = "precondition-failed"
+	CodeThrottled    = "throttled"
+	CodeTimeout      = "timeout"
+	CodeUnauthorized = "unauthorized"
+	CodeValidation   = "validation-failed"
+	CodeInternal     = "internal-error"
+)
+
+// Problem is an RFC 7807 problem details body, extended with our error
+// code and the ID of the request that failed
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
 }
 
-func writeError(w http.ResponseWriter, statusCode int, err error) {
-	e := json.NewEncoder(w)
-	if encodingErr := e.Encode(&errorJSON{Err: err.Error()}); encodingErr != nil {
-		log.WithError(err).Error("failed to encode error to JSON")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// classifyError maps the typed errors of the contender and dynamostore
+// packages to an HTTP status and error code
+func classifyError(err error) (int, string) {
+	switch {
+	case contender.IsValidationError(err):
+		return http.StatusBadRequest, CodeValidation
+	case contender.InvalidTokenError(err):
+		return http.StatusUnauthorized, CodeUnauthorized
+	case contender.PollClosedError(err):
+		return http.StatusConflict, CodePollClosed
+	case dynamostore.NotFoundError(err):
+		return http.StatusNotFound, CodeNotFound
+	case dynamostore.ConflictError(err):
+		return http.StatusConflict, CodeConflict
+	case dynamostore.ThrottledError(err):
+		return http.StatusServiceUnavailable, CodeThrottled
+	case dynamostore.CanceledError(err):
+		return http.StatusGatewayTimeout, CodeTimeout
 	}
-	w.WriteHeader(statusCode)
+	return http.StatusInternalServerError, CodeInternal
 }
 
-func writeErrorMsg(w http.ResponseWriter, statusCode int, err string) {
-	e := json.NewEncoder(w)
-	if err := e.Encode(&errorJSON{Err: err}); err != nil {
+// writeError classifies err and writes the matching problem, using detail
+// as the client facing message. Unclassified errors are logged, since
+// their cause isn't exposed to the client
+func writeError(w http.ResponseWriter, req *http.Request, err error, detail string) {
+	statusCode, code := classifyError(err)
+	if statusCode == http.StatusInternalServerError {
+		logging.FromContext(req.Context()).WithError(err).Error(detail)
+	}
+	if code == CodeValidation {
+		// validation errors are meant for the client
+		detail = err.Error()
+	}
+	if statusCode == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeErrorMsg(w, req, statusCode, code, detail)
+}
+
+// writeErrorMsg writes a problem with the given status, code and detail
+func writeErrorMsg(w http.ResponseWriter, req *http.Request, statusCode int, code, detail string) {
+	p := &Problem{
+		Type:      problemTypeBase + code,
+		Title:     http.StatusText(statusCode),
+		Status:    statusCode,
+		Detail:    detail,
+		Instance:  req.URL.Path,
+		Code:      code,
+		RequestID: requestIDFromContext(req.Context()),
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		logging.FromContext(req.Context()).WithError(err).Error("failed to encode error to JSON")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", problemContentType)
 	w.WriteHeader(statusCode)
+	w.Write(b)
 }
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+const (
+	// subscriberBuffer is how many events a subscriber can fall behind
+	// before the InMemoryBroker starts dropping events for it
+	subscriberBuffer = 64
+)
+
+// EventType is the kind of an Event, and names it in the SSE stream
+type EventType string
+
+const (
+	// EventVote is published for every vote recorded
+	EventVote EventType = "vote"
+	// EventLeaderboard is published with the contenders whose rank
+	// changed, and sent to every new subscriber with the whole leaderboard
+	EventLeaderboard EventType = "leaderboard"
+)
+
+// Event is what the service publishes to its Broker, and streams to the
+// clients of its poll
+type Event struct {
+	Type        EventType          `json:"type"`
+	Poll        string             `json:"poll,omitempty"`
+	Vote        *VoteEvent         `json:"vote,omitempty"`
+	Leaderboard []LeaderboardEntry `json:"leaderboard,omitempty"`
+}
+
+// InPoll reports whether the event is one of the poll's. Events from
+// before there were polls are the default poll's
+func (e *Event) InPoll(poll string) bool {
+	return e.Poll == poll || (e.Poll == "" && poll == contender.DefaultPoll)
+}
+
+// VoteEvent describes a single vote
+type VoteEvent struct {
+	Winner string    `json:"winner"`
+	Loser  string    `json:"loser"`
+	Time   time.Time `json:"time"`
+}
+
+// LeaderboardEntry is a contender's position on the leaderboard.
+// PreviousRank is zero if the contender wasn't on it before
+type LeaderboardEntry struct {
+	Rank         int    `json:"rank"`
+	PreviousRank int    `json:"previous_rank,omitempty"`
+	Name         string `json:"name"`
+	Score        int    `json:"score"`
+	Wins         int    `json:"wins"`
+	Losses       int    `json:"losses"`
+}
+
+// Broker fans the service's events out to its subscribers. The
+// InMemoryBroker is enough for a single process, deployments running
+// several instances can plug in a Broker backed by something shared, so
+// clients of every instance see every vote
+type Broker interface {
+	Publish(ctx context.Context, e *Event) error
+	// Subscribe returns a channel of the poll's published events, which
+	// is closed once ctx is done
+	Subscribe(ctx context.Context, poll string) (<-chan *Event, error)
+	// Subscribed reports whether anyone is subscribed to the poll, so the
+	// service can skip working out events nobody would see. A Broker that
+	// can't tell should report true
+	Subscribed(ctx context.Context, poll string) bool
+}
+
+// InMemoryBroker is a Broker for subscribers in the same process
+type InMemoryBroker struct {
+	lock sync.RWMutex
+	// subscribers are the poll of each subscriber
+	subscribers map[chan *Event]string
+}
+
+// NewInMemoryBroker returns an InMemoryBroker with no subscribers
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{
+		subscribers: make(map[chan *Event]string),
+	}
+}
+
+// Publish sends the event to every subscriber of its poll, dropping it for
+// any who aren't keeping up rather than holding up the publisher
+func (b *InMemoryBroker) Publish(ctx context.Context, e *Event) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for ch, poll := range b.subscribers {
+		if !e.InPoll(poll) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			logging.FromContext(ctx).WithField("type", e.Type).Warn("dropping event for slow subscriber")
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a subscriber to the poll until ctx is done
+func (b *InMemoryBroker) Subscribe(ctx context.Context, poll string) (<-chan *Event, error) {
+	ch := make(chan *Event, subscriberBuffer)
+	b.lock.Lock()
+	b.subscribers[ch] = poll
+	b.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.lock.Lock()
+		delete(b.subscribers, ch)
+		close(ch)
+		b.lock.Unlock()
+	}()
+	return ch, nil
+}
+
+// Subscribed reports whether the poll has any subscribers
+func (b *InMemoryBroker) Subscribed(ctx context.Context, poll string) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, subscribed := range b.subscribers {
+		if subscribed == poll {
+			return true
+		}
+	}
+	return false
+}
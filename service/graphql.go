@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/contender"
+)
+
+const (
+	loaderKey contextKey = "contender_loader"
+)
+
+// GraphQLRequest is the body of a POST to the GraphQL endpoint
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLError carries our error code into the extensions of the
+// GraphQL error, so clients can treat it like a problem's code
+type graphQLError struct {
+	error
+	code string
+}
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func newGraphQLError(err error) error {
+	_, code := classifyError(err)
+	if code == CodeInternal {
+		return &graphQLError{error: errors.New("internal error"), code: code}
+	}
+	return &graphQLError{error: err, code: code}
+}
+
+// withExtensions attaches the codes of our errors to the result's errors
+// that don't already carry them. The executor only carries extensions
+// across for errors returned by a resolver, and loses them for errors
+// returned by a thunk, which it wraps again as it locates them
+func withExtensions(result *graphql.Result) {
+	for i := range result.Errors {
+		if result.Errors[i].Extensions != nil {
+			continue
+		}
+		if gqlErr := unwrapGraphQLError(result.Errors[i]); gqlErr != nil {
+			result.Errors[i].Extensions = gqlErr.Extensions()
+		}
+	}
+}
+
+// unwrapGraphQLError finds our error among those the executor wrapped it in
+func unwrapGraphQLError(err error) *graphQLError {
+	for err != nil {
+		switch e := err.(type) {
+		case *graphQLError:
+			return e
+		case gqlerrors.FormattedError:
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			err = e.OriginalError
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *Service) graphQL(w http.ResponseWriter, req *http.Request) {
+	gqlReq := GraphQLRequest{}
+	if req.Method == http.MethodGet {
+		gqlReq.Query = req.URL.Query().Get("query")
+		gqlReq.OperationName = req.URL.Query().Get("operationName")
+	} else {
+		defer req.Body.Close()
+		if err := json.NewDecoder(req.Body).Decode(&gqlReq); err != nil {
+			writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "couldn't decode GraphQL request")
+			return
+		}
+	}
+	if gqlReq.Query == "" {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "must provide a query")
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), loaderKey, newContenderLoader(s.contenderStore))
+	result := graphql.Do(graphql.Params{
+		Schema:         s.graphQLSchema,
+		RequestString:  gqlReq.Query,
+		OperationName:  gqlReq.OperationName,
+		VariableValues: gqlReq.Variables,
+		Context:        ctx,
+	})
+	withExtensions(result)
+	writeJSON(w, req, http.StatusOK, result)
+}
+
+func loaderFromContext(ctx context.Context) *contenderLoader {
+	return ctx.Value(loaderKey).(*contenderLoader)
+}
+
+// newGraphQLSchema builds the schema over contenders, matchups and the
+// leaderboard. Contenders are always resolved through the request's
+// loader, so a query touching the same contender many times fetches it once
+func (s *Service) newGraphQLSchema() (graphql.Schema, error) {
+	contenderType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Contender",
+		Fields: graphql.Fields{
+			"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"description": &graphql.Field{Type: graphql.String},
+			"svgURL": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return svgURL(context.WithValue(p.Context, versionKey, LatestVersion), p.Source.(*contender.Contender).Name), nil
+				},
+			},
+			"tags":   &graphql.Field{Type: graphql.NewList(graphql.String)},
+			"artist": &graphql.Field{Type: graphql.String},
+			"wins":   &graphql.Field{Type: graphql.Int},
+			"losses": &graphql.Field{Type: graphql.Int},
+			"score":  &graphql.Field{Type: graphql.Int},
+			"rank": &graphql.Field{
+				Type:        graphql.Int,
+				Description: "the contender's position on the leaderboard, shared with any contenders on the same score",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rank, err := loaderFromContext(p.Context).Rank(p.Context, p.Source.(*contender.Contender).Name)
+					if err != nil {
+						return nil, newGraphQLError(err)
+					}
+					return rank, nil
+				},
+			},
+		},
+	})
+
+	// resolveContender loads the contender named by the given field of a
+	// matchup, or by the given argument
+	resolveContender := func(name func(graphql.ResolveParams) string) graphql.FieldResolveFn {
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			thunk := loaderFromContext(p.Context).Load(p.Context, name(p))
+			return func() (interface{}, error) {
+				c, err := thunk()
+				if err != nil {
+					return nil, newGraphQLError(err)
+				}
+				return c, nil
+			}, nil
+		}
+	}
+
+	matchupType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Matchup",
+		Description: "the head-to-head record of two contenders",
+		Fields: graphql.Fields{
+			"contender1": &graphql.Field{
+				Type: contenderType,
+				Resolve: resolveContender(func(p graphql.ResolveParams) string {
+					return p.Source.(*contender.Matchup).Contender1
+				}),
+			},
+			"contender2": &graphql.Field{
+				Type: contenderType,
+				Resolve: resolveContender(func(p graphql.ResolveParams) string {
+					return p.Source.(*contender.Matchup).Contender2
+				}),
+			},
+			"contender1Wins": &graphql.Field{Type: graphql.Int},
+			"contender2Wins": &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	leaderboardEntryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "LeaderboardEntry",
+		Fields: graphql.Fields{
+			"rank":      &graphql.Field{Type: graphql.Int},
+			"contender": &graphql.Field{Type: contenderType},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"contender": &graphql.Field{
+				Type: contenderType,
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: resolveContender(func(p graphql.ResolveParams) string {
+					return p.Args["name"].(string)
+				}),
+			},
+			"matchup": &graphql.Field{
+				Type: matchupType,
+				Args: graphql.FieldConfigArgument{
+					"contender1": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"contender2": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					m, err := s.matchupStats(p.Context, p.Args["contender1"].(string), p.Args["contender2"].(string))
+					if err != nil {
+						return nil, newGraphQLError(err)
+					}
+					return m, nil
+				},
+			},
+			"leaderboard": &graphql.Field{
+				Type: graphql.NewList(leaderboardEntryType),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					limit, ok := p.Args["limit"].(int)
+					if !ok {
+						limit = s.leaderboardSize(p.Context)
+					}
+					leaderboard, err := s.leaderboard(p.Context, limit)
+					if err != nil {
+						return nil, newGraphQLError(err)
+					}
+					entries := make([]map[string]interface{}, 0, len(*leaderboard))
+					for i := range *leaderboard {
+						c := &(*leaderboard)[i]
+						rank, err := loaderFromContext(p.Context).Rank(p.Context, c.Name)
+						if err != nil {
+							return nil, newGraphQLError(err)
+						}
+						entries = append(entries, map[string]interface{}{"rank": rank, "contender": c})
+					}
+					return entries, nil
+				},
+			},
+		},
+	})
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"vote": &graphql.Field{
+				Type:        matchupType,
+				Description: "vote for the winner of a matchup, using the token issued with it",
+				Args: graphql.FieldConfigArgument{
+					"contender1": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"contender2": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"token":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"winner":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					contender1, contender2 := p.Args["contender1"].(string), p.Args["contender2"].(string)
+					if err := s.vote(p.Context, p.Args["token"].(string), contender1, contender2, p.Args["winner"].(string)); err != nil {
+						return nil, newGraphQLError(err)
+					}
+					m, err := s.matchupStats(p.Context, contender1, contender2)
+					if err != nil {
+						return nil, newGraphQLError(err)
+					}
+					return m, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: mutationType,
+	})
+}
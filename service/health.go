@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+// Version and GitSHA describe the build, and are meant to be set with
+// -ldflags "-X github.com/sbogacz/wouldyoutatter/service.Version=..."
+var (
+	Version = "dev"
+	GitSHA  = ""
+)
+
+const (
+	// AdminKeyHeader is the header the admin key is read from
+	AdminKeyHeader = "X-Tatter-Admin"
+
+	// readinessTimeout bounds each readiness check, so a slow table
+	// fails the check rather than the probe timing out
+	readinessTimeout = 2 * time.Second
+	// readinessTTL is how long a passing readiness check is reused for,
+	// so frequent probes, from several sources, don't each describe every
+	// table. A failing check is repeated by the next probe
+	readinessTTL = 30 * time.Second
+)
+
+// Readiness is the body of /readyz
+type Readiness struct {
+	// Status is "ready", "unavailable" if a table check failed, or
+	// "draining" once the service has started to stop
+	Status string `json:"status"`
+	// Tables are "ok", or the reason the check failed, by table name
+	Tables map[string]string `json:"tables,omitempty"`
+	// CheckedAt is when the tables were checked
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+}
+
+// readinessCache holds the last passing readiness check. Its lock is held
+// across checks, so concurrent probes share one
+type readinessCache struct {
+	lock      sync.Mutex
+	readiness *Readiness
+}
+
+// DebugInfo is the body of /debug/info
+type DebugInfo struct {
+	Version   string      `json:"version"`
+	GitSHA    string      `json:"git_sha,omitempty"`
+	GoVersion string      `json:"go_version"`
+	StartedAt time.Time   `json:"started_at"`
+	Uptime    string      `json:"uptime"`
+	Store     string      `json:"store"`
+	Region    string      `json:"region,omitempty"`
+	Layout    string      `json:"layout"`
+	Cache     string      `json:"cache"`
+	Tables    []string    `json:"tables"`
+	Startup   TableHealth `json:"startup"`
+}
+
+// healthz only says that the process is serving requests
+func (s *Service) healthz(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, req, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz says whether the service should be sent traffic, which is when
+// every table can be reached, and it isn't draining. Passing table checks
+// are reused for the readinessTTL, but draining is noticed straight away
+func (s *Service) readyz(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		writeJSON(w, req, http.StatusServiceUnavailable, Readiness{Status: "draining"})
+		return
+	}
+
+	readiness := s.checkReadiness(req.Context())
+	statusCode := http.StatusOK
+	if readiness.Status != "ready" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(w, req, statusCode, readiness)
+}
+
+// checkReadiness checks every table can be reached, unless they passed
+// a check within the readinessTTL
+func (s *Service) checkReadiness(ctx context.Context) *Readiness {
+	s.readiness.lock.Lock()
+	defer s.readiness.lock.Unlock()
+	if last := s.readiness.readiness; last != nil && time.Since(last.CheckedAt) < readinessTTL {
+		return last
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	readiness := &Readiness{Status: "ready", Tables: map[string]string{}, CheckedAt: time.Now().UTC()}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, t := range s.tablesToEnsure(s.storers) {
+		wg.Add(1)
+		go func(t ensuredTable) {
+			defer wg.Done()
+			result := "ok"
+			if err := dynamostore.EnsureTable(checkCtx, t.storer, t.item, false); err != nil {
+				logging.FromContext(ctx).WithError(err).WithField("table", t.name).Warn("table isn't ready")
+				result = err.Error()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			readiness.Tables[t.name] = result
+			if result != "ok" {
+				readiness.Status = "unavailable"
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	s.readiness.readiness = nil
+	if readiness.Status == "ready" {
+		s.readiness.readiness = readiness
+	}
+	return readiness
+}
+
+// debugInfo describes the build and how the service is configured
+func (s *Service) debugInfo(w http.ResponseWriter, req *http.Request) {
+	info := DebugInfo{
+		Version:   Version,
+		GitSHA:    gitSHA(),
+		GoVersion: runtime.Version(),
+		StartedAt: s.startedAt,
+		Uptime:    time.Since(s.startedAt).Round(time.Second).String(),
+		Store:     "dynamo",
+		Region:    s.config.AWSRegion,
+		Layout:    s.config.TableLayout,
+		Cache:     s.config.Cache,
+		Startup:   s.tables,
+	}
+	if s.config.AWSRegion == "" {
+		info.Store = "memory"
+	}
+	if info.Layout == "" {
+		info.Layout = LayoutMulti
+	}
+	if info.Cache == "" {
+		info.Cache = CacheOff
+	}
+	for _, t := range s.tablesToEnsure(s.storers) {
+		info.Tables = append(info.Tables, t.name)
+	}
+	writeJSON(w, req, http.StatusOK, info)
+}
+
+// gitSHA is the GitSHA the build was given, or else the revision the go
+// tool stamped it with
+func gitSHA() string {
+	if GitSHA != "" {
+		return GitSHA
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Service) checkAdminKey(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(AdminKeyHeader)
+		if key == "" {
+			writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "missing admin key")
+			return
+		}
+		if key != s.config.AdminKey {
+			writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "wrong admin key")
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
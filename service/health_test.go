@@ -0,0 +1,95 @@
+package service_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/phayes/freeport"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getJSON(t *testing.T, url string, headers map[string]string, v interface{}) int {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode
+}
+
+func TestDebugInfo(t *testing.T) {
+	var info service.DebugInfo
+	status := getJSON(t, baseAddress+"/debug/info", map[string]string{service.AdminKeyHeader: testAdminKey}, &info)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, service.Version, info.Version)
+	assert.Equal(t, service.LayoutMulti, info.Layout)
+	assert.Contains(t, info.Tables, service.DefaultContenderTableName)
+	assert.Len(t, info.Tables, 6)
+	assert.False(t, info.StartedAt.IsZero())
+	assert.True(t, info.Startup.Ready)
+	if !*runAgainstLocalDynamo {
+		assert.Equal(t, "memory", info.Store)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	// no admin key, so no /debug/info
+	draining, err := service.New(service.Config{Port: port, LogLevel: "ERROR", DrainDelay: 300 * time.Millisecond})
+	require.NoError(t, err)
+	started := make(chan error, 1)
+	go func() {
+		started <- draining.Start()
+	}()
+	require.NoError(t, waitForServer(port))
+	address := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	var readiness service.Readiness
+	require.Equal(t, http.StatusOK, getJSON(t, address+"/readyz", nil, &readiness))
+	assert.Equal(t, "ready", readiness.Status)
+	assert.Len(t, readiness.Tables, 6)
+	assert.False(t, readiness.CheckedAt.IsZero())
+	// the next probe reuses the check
+	var again service.Readiness
+	require.Equal(t, http.StatusOK, getJSON(t, address+"/readyz", nil, &again))
+	assert.Equal(t, readiness.CheckedAt, again.CheckedAt)
+	resp, err := http.Get(address + "/debug/info")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	stopped := make(chan struct{})
+	go func() {
+		draining.Stop()
+		close(stopped)
+	}()
+	// readiness fails for the drain delay, while requests are still served
+	status := http.StatusOK
+	for i := 0; i < 50 && status == http.StatusOK; i++ {
+		status = getJSON(t, address+"/readyz", nil, &readiness)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "draining", readiness.Status)
+	var health map[string]string
+	assert.Equal(t, http.StatusOK, getJSON(t, address+"/healthz", nil, &health))
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
+	assert.NoError(t, <-started)
+	_, err = http.Get(address + "/healthz")
+	assert.Error(t, err)
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// CacheControlAsset is the Cache-Control of contender SVGs, which
+	// rarely change
+	CacheControlAsset = "public, max-age=86400"
+	// CacheControlContender is the Cache-Control of contenders, whose
+	// records change with every vote
+	CacheControlContender = "public, max-age=60"
+	// CacheControlLeaderboard is the Cache-Control of the leaderboard
+	CacheControlLeaderboard = "public, max-age=5"
+	// CacheControlMatchupStats is the Cache-Control of matchup stats,
+	// which are private since they carry the user's cookie
+	CacheControlMatchupStats = "private, max-age=5"
+
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// cached buffers successful GET responses, so they can be given an ETag
+// (unless the handler set one), and answered with a 304 if it matches
+// the request's If-None-Match. They're given the Cache-Control policy
+func cached(policy string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodGet {
+				h.ServeHTTP(w, req)
+				return
+			}
+			buf := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(buf, req)
+			if buf.status != http.StatusOK {
+				w.WriteHeader(buf.status)
+				w.Write(buf.body.Bytes())
+				return
+			}
+
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				sum := sha256.Sum256(buf.body.Bytes())
+				etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+				w.Header().Set("ETag", etag)
+			}
+			w.Header().Set("Cache-Control", policy)
+			if noneMatch(req.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(buf.body.Len()))
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf.body.Bytes())
+		})
+	}
+}
+
+// noneMatch reports whether the If-None-Match header lists the ETag.
+// It uses the weak comparison, so W/ prefixes are ignored
+func noneMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter holds on to the status and body of a response
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// compress encodes responses with brotli or gzip, whichever the client
+// prefers in its Accept-Encoding. Responses that are already encoded,
+// streamed as events, or not text, are left alone, as are websocket
+// upgrades. Encoded responses get their own ETag, with the encoding as
+// a suffix, since a cache mustn't hand them to clients that asked for
+// another encoding. The suffix is taken off If-None-Match again for the
+// handlers, which only know the ETag of the content
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+		if encoding == "" || req.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if noneMatch := req.Header.Get("If-None-Match"); noneMatch != "" {
+			req = req.Clone(req.Context())
+			req.Header.Set("If-None-Match", decodedETags(noneMatch, encoding))
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		h.ServeHTTP(cw, req)
+	})
+}
+
+// negotiateEncoding returns the encoding with the highest q-value in the
+// Accept-Encoding header that we support, preferring brotli on a tie, or
+// "" if there's none
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "*" {
+			coding = encodingBrotli
+		}
+		if coding != encodingBrotli && coding != encodingGzip || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && coding == encodingBrotli {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter decides whether to encode the response when its header
+// is written
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	decided  bool
+	encoder  io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided {
+		return
+	}
+	c.decided = true
+	header := c.Header()
+	if compressible(status, header) {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		if c.encoding == encodingBrotli {
+			c.encoder = brotli.NewWriter(c.ResponseWriter)
+		} else {
+			c.encoder = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	// a 304 stands in for the body it would have encoded, since every
+	// response with an ETag is compressible
+	if etag := header.Get("ETag"); etag != "" && (c.encoder != nil || status == http.StatusNotModified) {
+		header.Set("ETag", encodedETag(etag, c.encoding))
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.encoder == nil {
+		return c.ResponseWriter.Write(p)
+	}
+	return c.encoder.Write(p)
+}
+
+// Flush flushes what's been encoded so far, so streams still work
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := c.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Close finishes the encoding, if there is one
+func (c *compressWriter) Close() error {
+	if c.encoder == nil {
+		return nil
+	}
+	return c.encoder.Close()
+}
+
+// encodedETag is the ETag of the content once it's encoded, e.g. "5-gzip"
+// for "5"
+func encodedETag(etag, encoding string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// decodedETags takes the encoding's suffix off each ETag in an
+// If-None-Match header. ETags of other encodings are left as they are,
+// so they don't match
+func decodedETags(header, encoding string) string {
+	etags := strings.Split(header, ",")
+	for i, etag := range etags {
+		etags[i] = strings.Replace(strings.TrimSpace(etag), "-"+encoding+`"`, `"`, 1)
+	}
+	return strings.Join(etags, ", ")
+}
+
+// compressible reports whether a response is worth encoding
+func compressible(status int, header http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/javascript":
+		return true
+	}
+	return false
+}
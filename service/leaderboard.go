@@ -2,39 +2,55 @@ package service
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
 	"strconv"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/logging"
 )
 
 func (s *Service) getLeaderboard(w http.ResponseWriter, req *http.Request) {
-	// let's start with 25 as a default limit
-	limit := 25
+	// start with the poll's leaderboard size as a default limit
+	limit := s.leaderboardSize(req.Context())
 	if val := req.URL.Query().Get("limit"); val != "" {
 		newLimit, err := strconv.Atoi(val)
 		if err != nil {
-			log.WithError(err).Debug("couldn't parse provided new limit, keeping default")
+			logging.FromContext(req.Context()).WithError(err).Debug("couldn't parse provided new limit, keeping default")
 		} else {
 			limit = newLimit
 		}
 	}
-	leaderboard, err := s.contenderStore.GetLeaderboard(context.TODO(), limit)
+	leaderboard, err := s.leaderboard(req.Context(), limit)
 	if err != nil {
-		log.WithError(err).Error("failed to retrieve leaderboard")
-		http.Error(w, "failed to retrieve leaderboard", http.StatusInternalServerError)
+		writeError(w, req, err, "failed to retrieve leaderboard")
 		return
 	}
 
-	b, err := json.Marshal(leaderboard)
+	writeJSON(w, req, http.StatusOK, contendersView(req.Context(), *leaderboard))
+}
+
+// leaderboard returns the top contenders. The leaderboard index is only
+// eventually consistent, so their records are refreshed with a single
+// batch get, which reads from the table itself
+func (s *Service) leaderboard(ctx context.Context, limit int) (*contender.Contenders, error) {
+	leaderboard, err := s.contenderStore.GetLeaderboard(ctx, limit)
 	if err != nil {
-		log.WithError(err).Error("failed to marshal leaderboard")
-		http.Error(w, "failed to retrieve leaderboard", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
-
+	names := make([]string, len(*leaderboard))
+	for i, c := range *leaderboard {
+		names[i] = c.Name
+	}
+	current, err := s.contenderStore.GetMany(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	// keep the index's order, and skip anyone deleted since
+	refreshed := make(contender.Contenders, 0, len(*leaderboard))
+	for _, c := range *leaderboard {
+		if latest, ok := current[c.Name]; ok {
+			refreshed = append(refreshed, *latest)
+		}
+	}
+	return &refreshed, nil
 }
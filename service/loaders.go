@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/contender"
+)
+
+// contenderLoader batches and caches contender lookups for the lifetime of
+// a single GraphQL request. Resolvers queue the names they need and return
+// thunks, so every contender requested at the same depth of the query is
+// fetched in one dispatch, and each name at most once
+type contenderLoader struct {
+	store *contender.Store
+
+	lock    sync.Mutex
+	pending []string
+	results map[string]*contenderResult
+
+	// ranks are computed once, the first time a rank is asked for
+	ranksOnce sync.Once
+	ranks     map[string]int
+	ranksErr  error
+}
+
+type contenderResult struct {
+	done      chan struct{}
+	contender *contender.Contender
+	err       error
+}
+
+func newContenderLoader(store *contender.Store) *contenderLoader {
+	return &contenderLoader{
+		store:   store,
+		results: make(map[string]*contenderResult),
+	}
+}
+
+// Load queues name to be fetched, and returns a thunk that dispatches any
+// queued names when it's first called
+func (l *contenderLoader) Load(ctx context.Context, name string) func() (interface{}, error) {
+	l.lock.Lock()
+	if _, ok := l.results[name]; !ok {
+		l.results[name] = &contenderResult{done: make(chan struct{})}
+		l.pending = append(l.pending, name)
+	}
+	result := l.results[name]
+	l.lock.Unlock()
+
+	return func() (interface{}, error) {
+		l.dispatch(ctx)
+		<-result.done
+		return result.contender, result.err
+	}
+}
+
+// dispatch fetches every queued name with a single batch get
+func (l *contenderLoader) dispatch(ctx context.Context) {
+	l.lock.Lock()
+	batch := l.pending
+	l.pending = nil
+	results := make([]*contenderResult, len(batch))
+	for i, name := range batch {
+		results[i] = l.results[name]
+	}
+	l.lock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	found, err := l.store.GetMany(ctx, batch)
+	for i, name := range batch {
+		switch {
+		case err != nil:
+			results[i].err = err
+		case found[name] == nil:
+			results[i].err = errors.New(dynamodb.ErrCodeResourceNotFoundException)
+		default:
+			results[i].contender = found[name]
+		}
+		close(results[i].done)
+	}
+}
+
+// Rank returns the contender's position on the leaderboard, where
+// contenders with the same score share a rank
+func (l *contenderLoader) Rank(ctx context.Context, name string) (int, error) {
+	l.ranksOnce.Do(func() {
+		l.ranks, l.ranksErr = l.store.GetRanks(ctx)
+	})
+	return l.ranks[name], l.ranksErr
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/logging"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// configureLogging sets up the service's own logger, rather than
+// configuring the standard one, so services in the same process, e.g.
+// tests', can log differently
+func (s *Service) configureLogging() error {
+	out := s.config.LogOutput
+	if out == nil {
+		out = os.Stdout
+	}
+	logger, err := logging.New(s.config.logLevelToLogrus(), s.config.LogFormat, out)
+	if err != nil {
+		return err
+	}
+	s.logger = log.NewEntry(logger)
+	return nil
+}
+
+// logRequests puts a logger for the request in its context, so that
+// everything logged while serving it, down to the stores, can be told
+// apart from other requests', and logs the request once it's served
+func (s *Service) logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		fields := log.Fields{
+			"request_id": requestIDFromContext(req.Context()),
+			"method":     req.Method,
+			"path":       logging.RedactURL(req.URL),
+		}
+		if cookie, err := req.Cookie(CookieKey); err == nil {
+			fields["session_id"] = cookie.Value
+		}
+		if sc := trace.SpanContextFromContext(req.Context()); sc.IsValid() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		logger := s.logger.WithFields(fields)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		req = req.WithContext(logging.WithLogger(req.Context(), logger))
+		h.ServeHTTP(sw, req)
+
+		logger.WithFields(log.Fields{
+			"route":      routePattern(req),
+			"status":     sw.status,
+			"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		}).Info("served request")
+	})
+}
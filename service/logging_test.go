@@ -0,0 +1,58 @@
+package service_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/logging"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var out bytes.Buffer
+	logged, err := service.New(service.Config{
+		LogLevel:  "DEBUG",
+		LogFormat: logging.FormatJSON,
+		LogOutput: &out,
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/v1/contenders?token=sekrit-token", nil)
+	req.Header.Set(service.RequestIDHeader, "logging-request")
+	req.Header.Set("X-Tatter-Master", "sekrit-master-key")
+	req.AddCookie(&http.Cookie{Name: service.CookieKey, Value: "logging-session"})
+	rec := httptest.NewRecorder()
+	logged.Handler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	assert.NotContains(t, out.String(), "sekrit")
+	lines := map[string]map[string]interface{}{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), "every line is JSON")
+		lines[line["msg"].(string)] = line
+	}
+
+	require.Contains(t, lines, "wrong key")
+	assert.Equal(t, "logging-request", lines["wrong key"]["request_id"], "handlers log with the request's logger")
+
+	require.Contains(t, lines, "served request")
+	served := lines["served request"]
+	assert.Equal(t, "logging-request", served["request_id"])
+	assert.Equal(t, "logging-session", served["session_id"])
+	assert.Equal(t, "POST", served["method"])
+	assert.Equal(t, "/v1/contenders?token=%5BREDACTED%5D", served["path"])
+	assert.Equal(t, "/v1/contenders/", served["route"])
+	assert.Equal(t, float64(http.StatusUnauthorized), served["status"])
+	assert.Contains(t, served, "latency_ms")
+
+	_, err = service.New(service.Config{LogFormat: "xml"})
+	assert.Error(t, err)
+}
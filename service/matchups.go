@@ -12,7 +12,8 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/gofrs/uuid"
 	"github.com/sbogacz/wouldyoutatter/contender"
-	log "github.com/sirupsen/logrus"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
 )
 
 const (
@@ -20,20 +21,17 @@ const (
 	CookieKey = "wouldyoutatterID"
 )
 
-// MatchupResp is the response we'll use for our matchups/random endpoint
-type MatchupResp struct {
-	Contender1 contender.Contender `json:"contender_1"`
-	Contender2 contender.Contender `json:"contender_2"`
-	VoteURL    string              `json:"vote_url"` // we don't record this in the DB, but we use it in the API
-	remove     bool
-}
-
 // VotePayload is the struct of the expected payload on vote POSTs
 type VotePayload struct {
 	Winner string `json:"winner"`
 }
 
 func (s *Service) chooseMatchup(w http.ResponseWriter, req *http.Request) {
+	if err := s.checkOpen(req.Context()); err != nil {
+		writeError(w, req, err, "failed to choose matchup")
+		return
+	}
+
 	userIDCookie, err := req.Cookie(CookieKey)
 	var userID string
 	var newUser bool
@@ -41,7 +39,7 @@ func (s *Service) chooseMatchup(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		uid, err := uuid.NewV4()
 		if err != nil {
-			log.WithError(err).Error("couldn't generate a user ID to put in the cookie")
+			logging.FromContext(req.Context()).WithError(err).Error("couldn't generate a user ID to put in the cookie")
 		} else {
 			userID = uid.String()
 		}
@@ -56,100 +54,87 @@ func (s *Service) chooseMatchup(w http.ResponseWriter, req *http.Request) {
 		userID = userIDCookie.Value
 	}
 
-	log.WithField("userID", userID).Debug("getting new matchup")
-	masterSet, err := s.masterMatchupSet.Get(context.TODO())
+	logging.FromContext(req.Context()).WithField("userID", userID).Debug("getting new matchup")
+	masterSet, err := s.masterMatchupSet.Get(req.Context())
 	if err != nil {
-		http.Error(w, "failed to retrieve master matchup set", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to retrieve master matchup set")
+		writeError(w, req, err, "failed to retrieve master matchup set")
 		return
 	}
 
 	userSet := &contender.MatchupSet{}
 	if !newUser {
-		userSet, err = s.userMatchupSet.Get(context.TODO(), userID)
-		if err != nil {
-			http.Error(w, "failed to retrieve user matchup set", http.StatusInternalServerError)
-			log.WithError(err).Error("failed to retrieve user matchup set")
+		// the user may not have seen any matchups of this poll yet, or
+		// the poll may have been deleted and made again since they did
+		userSet, err = s.userMatchupSet.Get(req.Context(), userID)
+		if err != nil && !dynamostore.NotFoundError(err) {
+			writeError(w, req, err, "failed to retrieve user matchup set")
 			return
 		}
+		if err != nil {
+			userSet = &contender.MatchupSet{}
+		}
 	}
 
 	possibleMatchups := masterSet.Set
 	seenMatchups := userSet.Set
 
 	if len(possibleMatchups) < 1 {
+		// there's nothing to vote on until there are at least two contenders
 		w.WriteHeader(http.StatusNoContent)
-		w.Write([]byte("no matchups currently available"))
 		return
 	}
 
 	// if the lists are the same length, then reset the user's set
 	if len(seenMatchups) == len(possibleMatchups) {
-		if deleteErr := s.userMatchupSet.Delete(context.TODO(), userID); deleteErr != nil {
-			http.Error(w, "failed to reset user matchup set", http.StatusInternalServerError)
-			log.WithError(deleteErr).Error("failed to reset user matchup set")
+		if deleteErr := s.userMatchupSet.Delete(req.Context(), userID); deleteErr != nil {
+			writeError(w, req, deleteErr, "failed to reset user matchup set")
 			return
 		}
+		s.metrics.matchupSetResets.Inc()
 		seenMatchups = []contender.MatchupSetEntry{}
 	}
 
-	matchup := chooseNewMatchup(possibleMatchups, seenMatchups)
+	matchup := chooseNewMatchup(req.Context(), possibleMatchups, seenMatchups)
 
 	// create a token for the matchup
-	token, err := s.tokenStore.CreateToken(context.TODO(), matchup.Contender1, matchup.Contender2)
+	token, err := s.tokenStore.CreateToken(req.Context(), matchup.Contender1, matchup.Contender2)
 	if err != nil {
-		http.Error(w, "failed to create token for voting", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to create token for voting")
+		writeError(w, req, err, "failed to create token for voting")
 		return
 	}
+	s.metrics.tokensIssued.Inc()
 
-	// get the rest of the contender's data for the client
-	contender1, err := s.contenderStore.Get(context.TODO(), matchup.Contender1)
+	// get the rest of the contenders' data for the client
+	contenders, err := s.contenderStore.GetMany(req.Context(), []string{matchup.Contender1, matchup.Contender2})
 	if err != nil {
-		log.WithError(err).Error("failed to retrieve contender1 data for matchup")
-		http.Error(w, "failed to retrieve matchup", http.StatusInternalServerError)
+		writeError(w, req, err, "failed to retrieve matchup")
 		return
 	}
-
-	contender2, err := s.contenderStore.Get(context.TODO(), matchup.Contender2)
-	if err != nil {
-		log.WithError(err).Error("failed to retrieve contender2 data for matchup")
-		http.Error(w, "failed to retrieve matchup", http.StatusInternalServerError)
+	contender1, contender2 := contenders[matchup.Contender1], contenders[matchup.Contender2]
+	if contender1 == nil || contender2 == nil {
+		writeErrorMsg(w, req, http.StatusNotFound, CodeNotFound, "failed to retrieve matchup")
 		return
 	}
 
 	// mark this matchup as shown to the user
-	if err := s.userMatchupSet.Add(context.TODO(), userID, matchup.Contender1, matchup.Contender2); err != nil {
-		log.WithError(err).Error("failed to record seen matchup")
+	if err := s.userMatchupSet.Add(req.Context(), userID, matchup.Contender1, matchup.Contender2); err != nil {
+		logging.FromContext(req.Context()).WithError(err).Error("failed to record seen matchup")
 	}
 
 	newURLBase := strings.Split(req.URL.String(), "/random")[0]
 	newURL := fmt.Sprintf("%s/%s/%s/vote?token=%s", newURLBase, matchup.Contender1, matchup.Contender2, token.ID)
 
-	resp := &MatchupResp{
-		Contender1: *contender1,
-		Contender2: *contender2,
-		VoteURL:    newURL,
-	}
-
-	b, err := json.Marshal(&resp)
-	if err != nil {
-		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to marshal matchup response")
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+	writeJSON(w, req, http.StatusOK, matchupView(req.Context(), contender1, contender2, newURL))
 }
 
 func (s *Service) getMatchupStats(w http.ResponseWriter, req *http.Request) {
-	contender1, contender2 := chi.URLParam(req, "contender1"), chi.URLParam(req, "contender2")
+	contender1, contender2 := chi.URLParam(req, "contenderID1"), chi.URLParam(req, "contenderID2")
 	if contender1 == "" {
-		http.Error(w, "contender1 cannot be empty in order to retrieve stats", http.StatusBadRequest)
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "contender1 cannot be empty in order to retrieve stats")
 		return
 	}
 	if contender2 == "" {
-		http.Error(w, "contender2 cannot be empty in order to retrieve stats", http.StatusBadRequest)
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "contender2 cannot be empty in order to retrieve stats")
 		return
 	}
 
@@ -161,47 +146,44 @@ func (s *Service) getMatchupStats(w http.ResponseWriter, req *http.Request) {
 		http.SetCookie(w, userIDCookie)
 	}
 
-	matchup, err := s.matchupStore.Get(context.TODO(), contender1, contender2)
+	matchup, err := s.matchupStats(req.Context(), contender1, contender2)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, req, err, "failed to retrieve matchup")
 		return
 	}
 
-	e := json.NewEncoder(w)
-	if err := e.Encode(matchup); err != nil {
-		log.WithError(err).Error("failed to encode matchup")
-		http.Error(w, "failed to encode matchup", http.StatusInternalServerError)
-		return
+	writeJSON(w, req, http.StatusOK, matchupStatsView(req.Context(), matchup))
+}
+
+// matchupStats returns the head-to-head record of two contenders, which is
+// empty if nobody has voted on the matchup yet
+func (s *Service) matchupStats(ctx context.Context, contender1, contender2 string) (*contender.Matchup, error) {
+	contender1, contender2 = contender.OrderMatchup(contender1, contender2)
+	matchup, err := s.matchupStore.Get(ctx, contender1, contender2)
+	if err != nil {
+		return nil, err
 	}
-	w.WriteHeader(http.StatusOK)
+	if matchup == nil {
+		matchup = &contender.Matchup{Contender1: contender1, Contender2: contender2}
+	}
+	return matchup, nil
 }
 
 func (s *Service) voteOnMatchup(w http.ResponseWriter, req *http.Request) {
 	contender1, contender2 := chi.URLParam(req, "contenderID1"), chi.URLParam(req, "contenderID2")
 	if contender1 == "" {
-		http.Error(w, "contender1 cannot be empty in order to vote", http.StatusBadRequest)
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "contender1 cannot be empty in order to vote")
 		return
 	}
 	if contender2 == "" {
-		http.Error(w, "contender2 cannot be empty in order to vote", http.StatusBadRequest)
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "contender2 cannot be empty in order to vote")
 		return
 	}
 
-	// validate token
+	// make sure there's a token, vote checks it's valid for the matchup
 	token := req.URL.Query().Get("token")
 	if token == "" {
-		http.Error(w, "must provide a valid token in order to vote", http.StatusUnauthorized)
-		return
-	}
-	ok, err := s.tokenStore.ValidateToken(context.TODO(), token, contender1, contender2)
-	if err != nil {
-		http.Error(w, "failed to validate token", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to authenticate token against Dynamo")
-		return
-	}
-
-	if !ok {
-		http.Error(w, "token not valid for the matchup", http.StatusUnauthorized)
+		writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "must provide a valid token in order to vote")
 		return
 	}
 
@@ -210,42 +192,64 @@ func (s *Service) voteOnMatchup(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
 	if err := d.Decode(&v); err != nil {
-		http.Error(w, "couldn't decode vote payload", http.StatusBadRequest)
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "couldn't decode vote payload")
 		return
 	}
-	if v.Winner != contender1 && v.Winner != contender2 {
-		http.Error(w, "can only vote for a winner within the matchup", http.StatusBadRequest)
+
+	if err := s.vote(req.Context(), token, contender1, contender2, v.Winner); err != nil {
+		writeError(w, req, err, "failed to record vote")
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+}
+
+// vote checks the token is valid for the matchup, and records the winner
+// against both the matchup and the contenders
+func (s *Service) vote(ctx context.Context, token, contender1, contender2, winner string) error {
+	if err := s.checkOpen(ctx); err != nil {
+		return err
+	}
+	ok, err := s.tokenStore.ValidateToken(ctx, token, contender1, contender2)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return contender.ErrInvalidToken
+	}
+
+	if winner != contender1 && winner != contender2 {
+		return &contender.ValidationError{Field: "winner", Reason: "can only vote for a winner within the matchup"}
+	}
+
 	loser := contender2
-	if v.Winner == contender2 {
+	if winner == contender2 {
 		loser = contender1
 	}
-	// so the token is valid, now VOTE!
-	if err := s.matchupStore.ScoreMatchup(context.TODO(), v.Winner, loser); err != nil {
-		http.Error(w, "failed to record vote", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to record vote in DB")
-		return
+	// so the token is valid, now VOTE! Once we know the ranks it changes,
+	// if anyone's watching
+	s.seedRanks(ctx)
+	if err := s.matchupStore.ScoreMatchup(ctx, winner, loser); err != nil {
+		return err
 	}
 
 	// update the contender table
-	if err := s.contenderStore.DeclareWinner(context.TODO(), v.Winner); err != nil {
-		http.Error(w, "failed to record vote", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to update contender store with winner")
-		return
+	if err := s.contenderStore.DeclareWinner(ctx, winner); err != nil {
+		return err
 	}
-
-	if err := s.contenderStore.DeclareLoser(context.TODO(), loser); err != nil {
-		http.Error(w, "failed to record vote", http.StatusInternalServerError)
-		log.WithError(err).Error("failed to update contender store with loser")
-		return
+	if err := s.contenderStore.DeclareLoser(ctx, loser); err != nil {
+		return err
 	}
 
-	w.WriteHeader(http.StatusOK)
+	s.metrics.votes.Inc()
+	s.metrics.tokensRedeemed.Inc()
+
+	// let the streams know
+	s.publishVote(ctx, winner, loser)
+	return nil
 }
 
-func chooseNewMatchup(possibleMatchups []contender.MatchupSetEntry, seenMatchups []contender.MatchupSetEntry) contender.MatchupSetEntry {
+func chooseNewMatchup(ctx context.Context, possibleMatchups []contender.MatchupSetEntry, seenMatchups []contender.MatchupSetEntry) contender.MatchupSetEntry {
 	// if we haven't seen any, choose a random one
 	if len(seenMatchups) == 0 {
 		rand.Seed(time.Now().Unix()) // initialize global pseudo random generator
@@ -261,10 +265,10 @@ func chooseNewMatchup(possibleMatchups []contender.MatchupSetEntry, seenMatchups
 
 	for _, possibleMatchup := range shuffledMatchups {
 
-		log.WithField("possible", possibleMatchup).Debug("possible matchup")
+		logging.FromContext(ctx).WithField("possible", possibleMatchup).Debug("possible matchup")
 		var checkedMatchups int
 		for _, seenMatchup := range seenMatchups {
-			log.WithField("seen", seenMatchup).Debug("seen matchup")
+			logging.FromContext(ctx).WithField("seen", seenMatchup).Debug("seen matchup")
 			if seenMatchup.String() == possibleMatchup.String() {
 				break
 			}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+// contendersTimeout bounds the scan that counts the contenders for each
+// scrape
+const contendersTimeout = 5 * time.Second
+
+// metrics are the service's Prometheus metrics. Each Service registers
+// them with a registry of its own, which /metrics serves. They're also
+// the dynamostore package's StoreMetrics, RetryMetrics and CacheMetrics
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	storeDuration    *prometheus.HistogramVec
+	storeErrors      *prometheus.CounterVec
+	retries          *prometheus.CounterVec
+	retriesExhausted *prometheus.CounterVec
+	cacheHits        *prometheus.CounterVec
+	cacheMisses      *prometheus.CounterVec
+
+	votes            prometheus.Counter
+	tokensIssued     prometheus.Counter
+	tokensRedeemed   prometheus.Counter
+	matchupSetResets prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Requests served, by method, route pattern and status",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "How long requests took to serve, by method, route pattern and status",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dynamostore_operation_duration_seconds",
+			Help:    "How long Storer operations took, by table and operation",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"table", "operation"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamostore_operation_errors_total",
+			Help: "Storer operations that failed, by table, operation and error code",
+		}, []string{"table", "operation", "code"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamostore_retries_total",
+			Help: "Dynamo requests that were retried, by table and operation",
+		}, []string{"table", "operation"}),
+		retriesExhausted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamostore_retries_exhausted_total",
+			Help: "Dynamo requests that failed after their last retry, by table and operation",
+		}, []string{"table", "operation"}),
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamostore_cache_hits_total",
+			Help: "Cached reads that were served from the cache, by table and operation",
+		}, []string{"table", "operation"}),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamostore_cache_misses_total",
+			Help: "Cached reads that went to the table, by table and operation",
+		}, []string{"table", "operation"}),
+		votes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wouldyoutatter_votes_total",
+			Help: "Votes cast",
+		}),
+		tokensIssued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wouldyoutatter_tokens_issued_total",
+			Help: "Voting tokens issued with a matchup",
+		}),
+		tokensRedeemed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wouldyoutatter_tokens_redeemed_total",
+			Help: "Voting tokens redeemed for a recorded vote",
+		}),
+		matchupSetResets: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "wouldyoutatter_matchup_set_resets_total",
+			Help: "Users whose seen matchups were reset, having seen every one",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration,
+		m.storeDuration, m.storeErrors,
+		m.retries, m.retriesExhausted,
+		m.cacheHits, m.cacheMisses,
+		m.votes, m.tokensIssued, m.tokensRedeemed, m.matchupSetResets,
+	)
+	return m
+}
+
+// countContenders registers the contenders gauge, which scans the
+// contenders when it's scraped
+func (m *metrics) countContenders(s *Service) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wouldyoutatter_contenders",
+		Help: "Contenders that can be voted on in the default poll",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), s.logger), contendersTimeout)
+		defer cancel()
+		contenders, err := s.contenderStore.GetAll(ctx)
+		if err != nil {
+			s.logger.WithError(err).Warn("failed to count contenders")
+			return 0
+		}
+		return float64(len(*contenders))
+	}))
+}
+
+// Observe implements dynamostore.StoreMetrics
+func (m *metrics) Observe(table, operation string, took time.Duration, err error) {
+	m.storeDuration.WithLabelValues(table, operation).Observe(took.Seconds())
+	if err != nil {
+		_, code := classifyError(err)
+		m.storeErrors.WithLabelValues(table, operation, code).Inc()
+	}
+}
+
+// Retried implements dynamostore.RetryMetrics
+func (m *metrics) Retried(table, operation string, err error) {
+	m.retries.WithLabelValues(table, operation).Inc()
+}
+
+// Exhausted implements dynamostore.RetryMetrics
+func (m *metrics) Exhausted(table, operation string, err error) {
+	m.retriesExhausted.WithLabelValues(table, operation).Inc()
+}
+
+// Hit implements dynamostore.CacheMetrics
+func (m *metrics) Hit(table, operation string) {
+	m.cacheHits.WithLabelValues(table, operation).Inc()
+}
+
+// Miss implements dynamostore.CacheMetrics
+func (m *metrics) Miss(table, operation string) {
+	m.cacheMisses.WithLabelValues(table, operation).Inc()
+}
+
+// handler serves the metrics in the Prometheus exposition format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument counts and times requests by their chi route pattern, rather
+// than their path, so there's a series per route and not per contender
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req)
+
+		route := routePattern(req)
+		status := strconv.Itoa(sw.status)
+		m.requests.WithLabelValues(req.Method, route, status).Inc()
+		m.requestDuration.WithLabelValues(req.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusWriter remembers the status of the response. It can still be
+// flushed, for event streams, and hijacked, for websockets, and unwrapped,
+// so a ResponseController can reach the connection
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response can't be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// measure wraps each of the Storers so their operations are measured,
+// labelled with the name of their table
+func (m *metrics) measure(storers *Storers, c Config) *Storers {
+	table := func(tc *dynamostore.TableConfig, fallback string) string {
+		if c.TableLayout == LayoutSingle {
+			return tableName(c.SingleTableConfig, DefaultSingleTableName)
+		}
+		return tableName(tc, fallback)
+	}
+	return &Storers{
+		Contenders:     dynamostore.WithMetrics(storers.Contenders, table(c.ContenderTableConfig, DefaultContenderTableName), m),
+		Matchups:       dynamostore.WithMetrics(storers.Matchups, table(c.MatchupTableConfig, DefaultMatchupTableName), m),
+		UserMatchups:   dynamostore.WithMetrics(storers.UserMatchups, table(c.UserMatchupsTableConfig, DefaultUserMatchupsTableName), m),
+		MasterMatchups: dynamostore.WithMetrics(storers.MasterMatchups, table(c.MasterMatchupsTableConfig, DefaultMasterMatchupsTableName), m),
+		Tokens:         dynamostore.WithMetrics(storers.Tokens, table(c.TokenTableConfig, DefaultTokenTableName), m),
+		Polls:          dynamostore.WithMetrics(storers.Polls, table(c.PollTableConfig, DefaultPollTableName), m),
+		Migrations:     storers.Migrations,
+	}
+}
+
+// withRetryMetrics returns the config with its tables telling the metrics
+// about their retries
+func (m *metrics) withRetryMetrics(c Config) Config {
+	return withTableConfigs(c, func(tc *dynamostore.TableConfig) {
+		tc.Metrics = m
+	})
+}
+
+// routePattern is the chi route pattern the request was routed by, which
+// is only complete once it has been
+func routePattern(req *http.Request) string {
+	if rctx := chi.RouteContext(req.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return "unmatched"
+}
@@ -0,0 +1,67 @@
+package service_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape returns the value of each of the series, by the series' name and
+// labels, as they're written in the exposition format
+func scrape(t *testing.T) map[string]float64 {
+	resp, err := http.Get(baseAddress + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	series := map[string]float64{}
+	for _, match := range regexp.MustCompile(`(?m)^([a-z_]\S*) (\S+)$`).FindAllStringSubmatch(string(b), -1) {
+		v, err := strconv.ParseFloat(match[2], 64)
+		require.NoError(t, err)
+		series[match[1]] = v
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	names := []string{"metrics-rose", "metrics-anchor"}
+	for _, name := range names {
+		require.NoError(t, tatter.CreateContender(ctx, &contender.Contender{Name: name, SVG: []byte("<svg/>")}))
+		defer tatter.DeleteContender(ctx, name)
+	}
+	before := scrape(t)
+
+	_, err := tatter.GetContender(ctx, "metrics-nobody")
+	require.True(t, client.NotFoundError(err))
+	m, err := tatter.RandomMatchup(ctx)
+	require.NoError(t, err)
+	require.Error(t, tatter.Vote(ctx, m, "metrics-nobody"), "the winner must be in the matchup")
+	require.NoError(t, tatter.Vote(ctx, m, m.Contender1.Name))
+
+	after := scrape(t)
+	increased := func(series string) {
+		assert.True(t, after[series] > before[series], "%s didn't increase", series)
+	}
+	increased(`http_requests_total{method="GET",route="/v1/contenders/{contenderID}/",status="404"}`)
+	increased(`http_requests_total{method="GET",route="/v1/matchups/random",status="200"}`)
+	increased(`http_requests_total{method="POST",route="/v1/matchups/{contenderID1}/{contenderID2}/vote",status="200"}`)
+	increased(`dynamostore_operation_duration_seconds_count{operation="Get",table="Contenders"}`)
+	increased(`dynamostore_operation_errors_total{code="not-found",operation="Get",table="Contenders"}`)
+	increased(`wouldyoutatter_votes_total`)
+	increased(`wouldyoutatter_tokens_issued_total`)
+	assert.Equal(t, 1.0, after[`wouldyoutatter_tokens_redeemed_total`]-before[`wouldyoutatter_tokens_redeemed_total`], "only the recorded vote redeems its token")
+	assert.True(t, after[`wouldyoutatter_contenders`] >= float64(len(names)))
+}
@@ -1,26 +1,79 @@
 package service
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/sbogacz/wouldyoutatter/dynamostore"
-	log "github.com/sirupsen/logrus"
+	"github.com/gofrs/uuid"
+	"github.com/sbogacz/wouldyoutatter/logging"
 )
 
+type contextKey string
+
+const (
+	// RequestIDHeader is the header we read a caller's request ID from,
+	// and echo the request ID back in
+	RequestIDHeader = "X-Request-Id"
+
+	requestIDKey contextKey = "request_id"
+)
+
+// requestID makes sure every request has an ID, reusing the caller's
+// if one was provided, so that it can be surfaced in error bodies
+func requestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if id == "" {
+			uid, err := uuid.NewV4()
+			if err != nil {
+				logging.FromContext(req.Context()).WithError(err).Error("couldn't generate a request ID")
+			} else {
+				id = uid.String()
+			}
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(req.Context(), requestIDKey, id)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// deadline bounds the request's context by the request timeout, so that
+// its storage calls are cancelled once the caller would have given up,
+// as they are when the caller disconnects
+func (s *Service) deadline(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), s.requestTimeout())
+		defer cancel()
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (s *Service) requestTimeout() time.Duration {
+	if s.config.RequestTimeout <= 0 {
+		return DefaultRequestTimeout
+	}
+	return s.config.RequestTimeout
+}
+
 func (s *Service) checkMasterKey(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		log.WithField("headers", req.Header).Debug("checking")
 		key := req.Header.Get("X-Tatter-Master")
 		if key == "" {
-			log.Debug("no key")
-			http.Error(w, "missing key for desired operations", http.StatusUnauthorized)
+			logging.FromContext(req.Context()).Debug("no key")
+			writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "missing key for desired operations")
 			return
 		}
 
 		if key != s.config.MasterKey {
-			log.Debug("wrong key")
-			http.Error(w, "wrong key for desired operation", http.StatusUnauthorized)
+			logging.FromContext(req.Context()).Debug("wrong key")
+			writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "wrong key for desired operation")
 			return
 		}
 		h.ServeHTTP(w, req)
@@ -31,24 +84,19 @@ func (s *Service) validateToken(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		token := req.Header.Get("X-Tatter-Token")
 		if token == "" {
-			log.Debug("no token")
-			http.Error(w, "missing token for voting", http.StatusUnauthorized)
+			logging.FromContext(req.Context()).Debug("no token")
+			writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "missing token for voting")
 			return
 		}
 
-		contender1, contender2 := chi.URLParam(req, "contender1"), chi.URLParam(req, "contender2")
+		contender1, contender2 := chi.URLParam(req, "contenderID1"), chi.URLParam(req, "contenderID2")
 		ok, err := s.tokenStore.ValidateToken(req.Context(), token, contender1, contender2)
 		if err != nil {
-			if dynamostore.NotFoundError(err) {
-				http.Error(w, "invalid token for voting", http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, "failed to authenticate token", http.StatusInternalServerError)
-			log.WithError(err).Error("failed to authenticate token against the database")
+			writeError(w, req, err, "failed to authenticate token")
 			return
 		}
 		if !ok {
-			http.Error(w, "invalid token for voting", http.StatusUnauthorized)
+			writeErrorMsg(w, req, http.StatusUnauthorized, CodeUnauthorized, "invalid token for voting")
 			return
 		}
 		h.ServeHTTP(w, req)
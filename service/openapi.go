@@ -0,0 +1,19 @@
+package service
+
+import (
+	// embed is needed for the OpenAPI document below
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPISpec is the OpenAPI 3 document describing the API, which the
+// handlers are tested against
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+func (s *Service) getOpenAPI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(OpenAPISpec)
+}
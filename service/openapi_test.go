@@ -0,0 +1,423 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPIContract drives every documented operation through the typed
+// client, and checks each response against the spec on the way back
+func TestOpenAPIContract(t *testing.T) {
+	spec := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(service.OpenAPISpec, &spec))
+
+	checker := &contractChecker{t: t, spec: spec, seen: map[string]bool{}}
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	httpClient := &http.Client{Jar: jar, Transport: checker}
+	tatter := client.New(baseAddress, client.WithHTTPClient(httpClient), client.WithMasterKey(service.DefaultMasterKey))
+	anonymous := client.New(baseAddress, client.WithHTTPClient(httpClient))
+	ctx := context.Background()
+
+	names := []string{"spec-rose", "spec-anchor"}
+	batched := []string{"spec-batch-koi", "spec-batch-skull"}
+	t.Run("serves the spec", func(t *testing.T) {
+		resp, err := httpClient.Get(baseAddress + "/openapi.json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, string(service.OpenAPISpec), string(b))
+	})
+	t.Run("contenders", func(t *testing.T) {
+		for _, name := range names {
+			require.NoError(t, tatter.CreateContender(ctx, &contender.Contender{
+				Name:        name,
+				Description: fmt.Sprintf("a %s", name),
+				SVG:         []byte(fmt.Sprintf("pretend this is an svg of %s", name)),
+			}))
+		}
+		assert.Equal(t, http.StatusConflict, client.StatusCode(tatter.CreateContender(ctx, &contender.Contender{Name: names[0]})))
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(anonymous.CreateContender(ctx, &contender.Contender{Name: "nope"})))
+		assert.Equal(t, http.StatusBadRequest, client.StatusCode(tatter.CreateContender(ctx, &contender.Contender{})))
+
+		c, err := tatter.GetContender(ctx, names[0])
+		require.NoError(t, err)
+		assert.Equal(t, names[0], c.Name)
+		_, err = tatter.GetContender(ctx, "spec-nobody")
+		assert.True(t, client.NotFoundError(err))
+
+		updated := *c
+		updated.Description = "an updated " + names[0]
+		updated.Tags = []string{"flower", "traditional"}
+		updated.Artist = "spec artist"
+		require.NoError(t, tatter.UpdateContender(ctx, &updated))
+		assert.True(t, client.NotFoundError(tatter.UpdateContender(ctx, &contender.Contender{Name: "spec-nobody"})))
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(anonymous.UpdateContender(ctx, &updated)))
+
+		all, err := tatter.ListContenders(ctx)
+		require.NoError(t, err)
+		var listed *contender.Contender
+		for i := range all {
+			if all[i].Name == names[0] {
+				listed = &all[i]
+			}
+		}
+		require.NotNil(t, listed)
+		assert.Equal(t, updated.Description, listed.Description)
+		assert.Equal(t, updated.Tags, listed.Tags)
+		assert.Equal(t, updated.Artist, listed.Artist)
+		assert.Equal(t, c.SVG, listed.SVG)
+	})
+	t.Run("batch", func(t *testing.T) {
+		results, err := tatter.BatchCreateContenders(ctx, []contender.Contender{
+			{Name: batched[0], SVG: []byte("pretend this is an svg")},
+			{Name: "spec/batch"},
+			{Name: batched[1], SVG: []byte("pretend this is an svg")},
+			{Name: batched[0]},
+			{Name: names[1]},
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 5)
+		assert.True(t, results[0].Created())
+		assert.Equal(t, http.StatusBadRequest, results[1].Status)
+		assert.Equal(t, service.CodeValidation, results[1].Code)
+		assert.True(t, results[2].Created())
+		assert.Equal(t, http.StatusBadRequest, results[3].Status)
+		// existing contenders aren't replaced
+		assert.Equal(t, http.StatusConflict, results[4].Status)
+		assert.Equal(t, service.CodeConflict, results[4].Code)
+
+		for _, name := range batched {
+			_, err := tatter.GetContender(ctx, name)
+			assert.NoError(t, err)
+		}
+		_, err = tatter.BatchCreateContenders(ctx, nil)
+		assert.Equal(t, http.StatusBadRequest, client.StatusCode(err))
+		_, err = anonymous.BatchCreateContenders(ctx, []contender.Contender{{Name: "nope"}})
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(err))
+	})
+	t.Run("versions", func(t *testing.T) {
+		for _, path := range []string{"/contenders/" + names[0], "/leaderboard", "/matchups/random"} {
+			for _, prefix := range []string{"/v1", "/v2"} {
+				resp, err := httpClient.Get(baseAddress + prefix + path)
+				require.NoError(t, err)
+				resp.Body.Close()
+			}
+			req, err := http.NewRequest("GET", baseAddress+path, nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", service.V2.MediaType())
+			resp, err := httpClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, service.V2.MediaType(), resp.Header.Get("Content-Type"))
+		}
+		resp, err := httpClient.Get(fmt.Sprintf("%s/v2/contenders/%s/svg", baseAddress, names[0]))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("pretend this is an svg of %s", names[0]), string(b))
+	})
+	t.Run("matchups", func(t *testing.T) {
+		m, err := tatter.RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+
+		assert.Equal(t, http.StatusBadRequest, client.StatusCode(tatter.Vote(ctx, m, "spec-nobody")))
+		// other tests' contenders are in the mix, so stick to the matchup we got
+		c1, c2 := m.Contender1.Name, m.Contender2.Name
+		before, err := tatter.MatchupStats(ctx, c2, c1)
+		require.NoError(t, err)
+		require.NoError(t, tatter.Vote(ctx, m, c1))
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(tatter.Vote(ctx, &client.Matchup{
+			VoteURL: fmt.Sprintf("/matchups/%s/%s/vote?token=bogus", c1, c2),
+		}, c1)))
+
+		after, err := tatter.MatchupStats(ctx, c2, c1)
+		require.NoError(t, err)
+		assert.Equal(t, before.Contender1Wins+before.Contender2Wins+1, after.Contender1Wins+after.Contender2Wins)
+	})
+	t.Run("leaderboard", func(t *testing.T) {
+		leaderboard, err := tatter.Leaderboard(ctx, 1)
+		require.NoError(t, err)
+		assert.Len(t, leaderboard, 1)
+	})
+	t.Run("conditional gets", func(t *testing.T) {
+		m, err := tatter.RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		paths := []string{
+			"/contenders/" + names[0],
+			"/contenders/" + names[0] + "/svg",
+			"/leaderboard",
+			fmt.Sprintf("/matchups/%s/%s", m.Contender1.Name, m.Contender2.Name),
+		}
+		for _, path := range paths {
+			resp, err := httpClient.Get(baseAddress + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode, path)
+			etag := resp.Header.Get("ETag")
+			require.NotEmpty(t, etag, path)
+			assert.NotEmpty(t, resp.Header.Get("Cache-Control"), path)
+
+			req, err := http.NewRequest("GET", baseAddress+path, nil)
+			require.NoError(t, err)
+			req.Header.Set("If-None-Match", etag)
+			resp, err = httpClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotModified, resp.StatusCode, path)
+			assert.Equal(t, etag, resp.Header.Get("ETag"), path)
+		}
+	})
+	t.Run("health", func(t *testing.T) {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			resp, err := httpClient.Get(baseAddress + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		}
+		for key, status := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, testAdminKey: http.StatusOK} {
+			req, err := http.NewRequest("GET", baseAddress+"/debug/info", nil)
+			require.NoError(t, err)
+			if key != "" {
+				req.Header.Set(service.AdminKeyHeader, key)
+			}
+			resp, err := httpClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode)
+		}
+	})
+	t.Run("polls", func(t *testing.T) {
+		p := &contender.Poll{ID: "spec-logos", Title: "Logos"}
+		require.NoError(t, tatter.CreatePoll(ctx, p))
+		assert.Equal(t, http.StatusConflict, client.StatusCode(tatter.CreatePoll(ctx, p)))
+		assert.Equal(t, http.StatusBadRequest, client.StatusCode(tatter.CreatePoll(ctx, &contender.Poll{ID: "Spec Logos"})))
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(anonymous.CreatePoll(ctx, &contender.Poll{ID: "nope"})))
+
+		polls, err := tatter.ListPolls(ctx)
+		require.NoError(t, err)
+		ids := []string{}
+		for _, listed := range polls {
+			ids = append(ids, listed.ID)
+		}
+		assert.Contains(t, ids, contender.DefaultPoll)
+		assert.Contains(t, ids, p.ID)
+		got, err := tatter.GetPoll(ctx, p.ID)
+		require.NoError(t, err)
+		assert.Equal(t, p.Title, got.Title)
+		_, err = tatter.GetPoll(ctx, "spec-nobody")
+		assert.True(t, client.NotFoundError(err))
+
+		logos := tatter.Poll(p.ID)
+		for _, name := range names {
+			require.NoError(t, logos.CreateContender(ctx, &contender.Contender{Name: name, SVG: []byte("pretend this is a logo")}))
+		}
+		m, err := logos.RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		require.NoError(t, logos.Vote(ctx, m, m.Contender1.Name))
+		leaderboard, err := logos.Leaderboard(ctx, 1)
+		require.NoError(t, err)
+		require.Len(t, leaderboard, 1)
+		assert.Equal(t, m.Contender1.Name, leaderboard[0].Name)
+
+		m, err = logos.RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		p.Settings.Closed = true
+		require.NoError(t, tatter.UpdatePoll(ctx, p))
+		assert.Equal(t, http.StatusConflict, client.StatusCode(logos.Vote(ctx, m, m.Contender1.Name)))
+		_, err = logos.RandomMatchup(ctx)
+		assert.Equal(t, http.StatusConflict, client.StatusCode(err))
+		assert.True(t, client.NotFoundError(tatter.UpdatePoll(ctx, &contender.Poll{ID: "spec-nobody"})))
+		assert.Equal(t, http.StatusBadRequest, client.StatusCode(tatter.UpdatePoll(ctx, &contender.Poll{ID: p.ID, Settings: contender.PollSettings{LeaderboardSize: -1}})))
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(anonymous.UpdatePoll(ctx, p)))
+
+		assert.Equal(t, http.StatusConflict, client.StatusCode(tatter.DeletePoll(ctx, p.ID)))
+		for _, name := range names {
+			require.NoError(t, logos.DeleteContender(ctx, name))
+		}
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(anonymous.DeletePoll(ctx, p.ID)))
+		require.NoError(t, tatter.DeletePoll(ctx, p.ID))
+		assert.True(t, client.NotFoundError(tatter.DeletePoll(ctx, p.ID)))
+		assert.Equal(t, http.StatusBadRequest, client.StatusCode(tatter.DeletePoll(ctx, contender.DefaultPoll)))
+	})
+	t.Run("clean up", func(t *testing.T) {
+		for _, name := range append(names, batched...) {
+			require.NoError(t, tatter.DeleteContender(ctx, name))
+		}
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(anonymous.DeleteContender(ctx, names[0])))
+	})
+	t.Run("every operation was exercised", func(t *testing.T) {
+		for path, item := range spec["paths"].(map[string]interface{}) {
+			for method := range item.(map[string]interface{}) {
+				if method == "parameters" {
+					continue
+				}
+				assert.True(t, checker.seen[strings.ToUpper(method)+" "+path], "%s %s was never called", method, path)
+			}
+		}
+	})
+}
+
+// contractChecker is a RoundTripper that validates responses against
+// the documented responses of the operation they came from
+type contractChecker struct {
+	t    *testing.T
+	spec map[string]interface{}
+	seen map[string]bool
+}
+
+func (c *contractChecker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	path, op := c.operation(req.Method, req.URL.Path)
+	if !assert.NotNil(c.t, op, "%s %s isn't documented", req.Method, req.URL.Path) {
+		return resp, nil
+	}
+	c.seen[req.Method+" "+path] = true
+
+	responses := op["responses"].(map[string]interface{})
+	documented, ok := responses[strconv.Itoa(resp.StatusCode)]
+	if !assert.True(c.t, ok, "%s %s returned undocumented status %d", req.Method, path, resp.StatusCode) {
+		return resp, nil
+	}
+	content, ok := c.resolve(documented)["content"].(map[string]interface{})
+	if !ok {
+		assert.Empty(c.t, b, "%s %s returned a body for %d", req.Method, path, resp.StatusCode)
+		return resp, nil
+	}
+	contentType := resp.Header.Get("Content-Type")
+	media, ok := content[contentType].(map[string]interface{})
+	if !assert.True(c.t, ok, "%s %s returned undocumented content type %q", req.Method, path, contentType) {
+		return resp, nil
+	}
+	if !strings.HasSuffix(contentType, "json") {
+		return resp, nil
+	}
+	var body interface{}
+	if assert.NoError(c.t, json.Unmarshal(b, &body)) {
+		c.validate(fmt.Sprintf("%s %s %d", req.Method, path, resp.StatusCode), media["schema"], body)
+	}
+	return resp, nil
+}
+
+// operation finds the documented path template and operation for a request
+func (c *contractChecker) operation(method, path string) (string, map[string]interface{}) {
+	// every version serves the same paths
+	for _, prefix := range []string{"/v1/", "/v2/"} {
+		if strings.HasPrefix(path, prefix) {
+			path = strings.TrimPrefix(path, prefix[:3])
+		}
+	}
+	// and every poll serves the same game paths
+	if segments := strings.SplitN(strings.Trim(path, "/"), "/", 3); len(segments) == 3 && segments[0] == "polls" {
+		path = "/" + segments[2]
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for template, item := range c.spec["paths"].(map[string]interface{}) {
+		templateSegments := strings.Split(strings.Trim(template, "/"), "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		matched := true
+		for i := range segments {
+			if !strings.HasPrefix(templateSegments[i], "{") && templateSegments[i] != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if op, ok := item.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{}); ok {
+			return template, op
+		}
+	}
+	return "", nil
+}
+
+// resolve follows local references, e.g. #/components/schemas/Contender
+func (c *contractChecker) resolve(node interface{}) map[string]interface{} {
+	m, _ := node.(map[string]interface{})
+	ref, ok := m["$ref"].(string)
+	if !ok {
+		return m
+	}
+	var target interface{} = c.spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		target = target.(map[string]interface{})[part]
+	}
+	return c.resolve(target)
+}
+
+// validate checks the subset of JSON schema the spec uses
+func (c *contractChecker) validate(where string, schemaNode, value interface{}) {
+	schema := c.resolve(schemaNode)
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !assert.True(c.t, ok, "%s: expected an object, got %v", where, value) {
+			return
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, field := range required {
+				assert.Contains(c.t, obj, field, "%s: missing required field", where)
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			for field, v := range obj {
+				if propSchema, ok := properties[field]; ok {
+					c.validate(where+"."+field, propSchema, v)
+				}
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !assert.True(c.t, ok, "%s: expected an array, got %v", where, value) {
+			return
+		}
+		for i, v := range arr {
+			c.validate(fmt.Sprintf("%s[%d]", where, i), schema["items"], v)
+		}
+	case "string":
+		_, ok := value.(string)
+		assert.True(c.t, ok, "%s: expected a string, got %v", where, value)
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			assert.Contains(c.t, enum, value, "%s: not one of the documented values", where)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		assert.True(c.t, ok && n == float64(int64(n)), "%s: expected an integer, got %v", where, value)
+	case "boolean":
+		_, ok := value.(bool)
+		assert.True(c.t, ok, "%s: expected a boolean, got %v", where, value)
+	}
+}
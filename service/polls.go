@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+const (
+	// defaultLeaderboardSize is how many contenders the leaderboard has,
+	// unless the request or the poll's settings say otherwise
+	defaultLeaderboardSize = 25
+)
+
+type pollContextKey struct{}
+
+// withPoll looks up the poll of the route, so that the stores, and the
+// handlers, use its items and settings
+func (s *Service) withPoll(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pollID := chi.URLParam(req, "pollID")
+		p, err := s.pollStore.Get(req.Context(), pollID)
+		if err != nil {
+			if dynamostore.NotFoundError(err) {
+				writeErrorMsg(w, req, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no poll found with id: %s", pollID))
+				return
+			}
+			writeError(w, req, err, fmt.Sprintf("failed to retrieve poll with id: %s", pollID))
+			return
+		}
+		ctx := context.WithValue(req.Context(), pollContextKey{}, p)
+		ctx = contender.WithPoll(ctx, p.ID)
+		logger := logging.FromContext(ctx).WithField("poll", p.ID)
+		h.ServeHTTP(w, req.WithContext(logging.WithLogger(ctx, logger)))
+	})
+}
+
+// currentPoll returns the poll of the request, which the routes without a
+// poll of their own look up as the default poll
+func (s *Service) currentPoll(ctx context.Context) (*contender.Poll, error) {
+	if p, ok := ctx.Value(pollContextKey{}).(*contender.Poll); ok {
+		return p, nil
+	}
+	return s.pollStore.Get(ctx, contender.PollFromContext(ctx))
+}
+
+// checkOpen returns contender.ErrPollClosed if the request's poll is
+// closed, since closed polls hand out no matchups, and take no votes
+func (s *Service) checkOpen(ctx context.Context) error {
+	p, err := s.currentPoll(ctx)
+	if err != nil {
+		return err
+	}
+	if p.Settings.Closed {
+		return contender.ErrPollClosed
+	}
+	return nil
+}
+
+// leaderboardSize is how many contenders the request's poll has on its
+// leaderboard, unless the request asks for a different number
+func (s *Service) leaderboardSize(ctx context.Context) int {
+	p, err := s.currentPoll(ctx)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Debug("couldn't retrieve poll, using the default leaderboard size")
+		return defaultLeaderboardSize
+	}
+	if p.Settings.LeaderboardSize > 0 {
+		return p.Settings.LeaderboardSize
+	}
+	return defaultLeaderboardSize
+}
+
+// pollPrefix is the path prefix of the request's poll, which is empty for
+// the default poll
+func pollPrefix(ctx context.Context) string {
+	if pollID := contender.PollFromContext(ctx); pollID != contender.DefaultPoll {
+		return "/polls/" + pollID
+	}
+	return ""
+}
+
+func (s *Service) listPolls(w http.ResponseWriter, req *http.Request) {
+	polls, err := s.pollStore.GetAll(req.Context())
+	if err != nil {
+		writeError(w, req, err, "failed to retrieve polls")
+		return
+	}
+	writeJSON(w, req, http.StatusOK, polls)
+}
+
+func (s *Service) createPoll(w http.ResponseWriter, req *http.Request) {
+	d := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+
+	p := &contender.Poll{}
+	if err := d.Decode(p); err != nil {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "failed to decode payload")
+		logging.FromContext(req.Context()).Debugf("failed to decode payload: %v", err)
+		return
+	}
+
+	if err := s.pollStore.Create(req.Context(), p); err != nil {
+		if dynamostore.ConflictError(err) {
+			writeErrorMsg(w, req, http.StatusConflict, CodeConflict, fmt.Sprintf("a poll with id %s already exists", p.ID))
+			return
+		}
+		writeError(w, req, err, "failed to store poll")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Service) getPoll(w http.ResponseWriter, req *http.Request) {
+	p, err := s.currentPoll(req.Context())
+	if err != nil {
+		writeError(w, req, err, "failed to retrieve poll")
+		return
+	}
+	writeJSON(w, req, http.StatusOK, p)
+}
+
+func (s *Service) updatePoll(w http.ResponseWriter, req *http.Request) {
+	pollID := contender.PollFromContext(req.Context())
+	d := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+
+	p := &contender.Poll{}
+	if err := d.Decode(p); err != nil {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "failed to decode payload")
+		logging.FromContext(req.Context()).Debugf("failed to decode payload: %v", err)
+		return
+	}
+	// polls can't be renamed, since the keys of their items start with the ID
+	if p.ID != "" && p.ID != pollID {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "the poll's id can't be changed")
+		return
+	}
+	p.ID = pollID
+
+	if err := s.pollStore.Update(req.Context(), p); err != nil {
+		writeError(w, req, err, fmt.Sprintf("failed to update poll with id: %s", pollID))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) deletePoll(w http.ResponseWriter, req *http.Request) {
+	pollID := contender.PollFromContext(req.Context())
+	if pollID == contender.DefaultPoll {
+		writeErrorMsg(w, req, http.StatusBadRequest, CodeValidation, "the default poll can't be deleted")
+		return
+	}
+
+	// the poll's contenders have to be deleted first, so a poll that's
+	// still being played isn't deleted by mistake. Its matchups, matchup
+	// sets and tokens are deleted along with it
+	contenders, err := s.contenderStore.GetAll(req.Context())
+	if err != nil {
+		writeError(w, req, err, "failed to delete poll")
+		return
+	}
+	if len(*contenders) > 0 {
+		writeErrorMsg(w, req, http.StatusConflict, CodeConflict, fmt.Sprintf("poll %s still has %d contenders", pollID, len(*contenders)))
+		return
+	}
+
+	if err := s.pollStore.Delete(req.Context(), pollID); err != nil {
+		writeError(w, req, err, "failed to delete poll")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,162 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollIsolation(t *testing.T) {
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+
+	pollIDs := []string{"isolated-tattoos", "isolated-logos"}
+	names := []string{"isolated-rose", "isolated-anchor", "isolated-koi"}
+	polls := map[string]*client.Client{}
+	for i, id := range pollIDs {
+		require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: id, Settings: contender.PollSettings{LeaderboardSize: i + 1}}))
+		polls[id] = tatter.Poll(id)
+		// the same names in each poll, with different descriptions
+		for _, name := range names {
+			require.NoError(t, polls[id].CreateContender(ctx, &contender.Contender{
+				Name:        name,
+				Description: fmt.Sprintf("a %s in %s", name, id),
+				SVG:         []byte(fmt.Sprintf("pretend this is an svg of %s in %s", name, id)),
+			}))
+		}
+	}
+	defer func() {
+		for _, id := range pollIDs {
+			for _, name := range names {
+				polls[id].DeleteContender(ctx, name)
+			}
+			tatter.DeletePoll(ctx, id)
+		}
+	}()
+
+	t.Run("each poll has its own contenders", func(t *testing.T) {
+		for _, id := range pollIDs {
+			all, err := polls[id].ListContenders(ctx)
+			require.NoError(t, err)
+			require.Len(t, all, len(names))
+			for _, c := range all {
+				assert.Equal(t, fmt.Sprintf("a %s in %s", c.Name, id), c.Description)
+			}
+		}
+		_, err := tatter.GetContender(ctx, names[0])
+		assert.True(t, client.NotFoundError(err), "the default poll doesn't see them")
+	})
+	t.Run("votes only count in their poll", func(t *testing.T) {
+		m, err := polls[pollIDs[0]].RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		assert.True(t, strings.Contains(m.VoteURL, "/polls/"+pollIDs[0]+"/"), m.VoteURL)
+		require.NoError(t, polls[pollIDs[0]].Vote(ctx, m, m.Contender1.Name))
+
+		winner, err := polls[pollIDs[0]].GetContender(ctx, m.Contender1.Name)
+		require.NoError(t, err)
+		assert.Equal(t, 1, winner.Wins)
+		other, err := polls[pollIDs[1]].GetContender(ctx, m.Contender1.Name)
+		require.NoError(t, err)
+		assert.Equal(t, 0, other.Wins)
+		stats, err := polls[pollIDs[1]].MatchupStats(ctx, m.Contender1.Name, m.Contender2.Name)
+		require.NoError(t, err)
+		assert.Equal(t, 0, stats.Contender1Wins+stats.Contender2Wins)
+	})
+	t.Run("tokens are only valid in their poll", func(t *testing.T) {
+		m, err := polls[pollIDs[0]].RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		elsewhere := &client.Matchup{VoteURL: strings.Replace(m.VoteURL, pollIDs[0], pollIDs[1], 1)}
+		assert.Equal(t, http.StatusUnauthorized, client.StatusCode(polls[pollIDs[1]].Vote(ctx, elsewhere, m.Contender1.Name)))
+		// and it's still good where it was issued
+		assert.NoError(t, polls[pollIDs[0]].Vote(ctx, m, m.Contender1.Name))
+	})
+	t.Run("leaderboards default to the poll's size", func(t *testing.T) {
+		for i, id := range pollIDs {
+			all := contender.Contenders{}
+			status := getJSON(t, fmt.Sprintf("%s/polls/%s/leaderboard", baseAddress, id), nil, &all)
+			require.Equal(t, http.StatusOK, status)
+			assert.Len(t, all, i+1, id)
+		}
+	})
+	t.Run("v2 links to the poll's svgs", func(t *testing.T) {
+		c := service.ContenderRespV2{}
+		status := getJSON(t, fmt.Sprintf("%s/v2/polls/%s/contenders/%s", baseAddress, pollIDs[1], names[0]), nil, &c)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, fmt.Sprintf("/v2/polls/%s/contenders/%s/svg", pollIDs[1], names[0]), c.SVGURL)
+	})
+	t.Run("graphql queries the poll", func(t *testing.T) {
+		resp := doGraphQLAt(t, fmt.Sprintf("%s/polls/%s/graphql", baseAddress, pollIDs[1]), fmt.Sprintf(`{ contender(name: %q) { description svgURL rank } }`, names[0]))
+		require.Empty(t, resp.Errors)
+		c := resp.Data["contender"].(map[string]interface{})
+		assert.Equal(t, fmt.Sprintf("a %s in %s", names[0], pollIDs[1]), c["description"])
+		assert.Equal(t, fmt.Sprintf("/v2/polls/%s/contenders/%s/svg", pollIDs[1], names[0]), c["svgURL"])
+	})
+	t.Run("websockets stream the poll's leaderboard", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s/polls/%s/ws", strings.TrimPrefix(baseAddress, "http"), pollIDs[1]), nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		snapshot := &service.Event{}
+		require.NoError(t, conn.ReadJSON(snapshot))
+		require.Equal(t, service.EventLeaderboard, snapshot.Type)
+		assert.Len(t, snapshot.Leaderboard, len(names))
+		for _, entry := range snapshot.Leaderboard {
+			assert.Contains(t, names, entry.Name)
+		}
+	})
+	t.Run("unknown polls aren't found", func(t *testing.T) {
+		_, err := tatter.Poll("isolated-nobody").ListContenders(ctx)
+		assert.True(t, client.NotFoundError(err))
+	})
+}
+
+func TestDeletePollDeletesItsItems(t *testing.T) {
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+	names := []string{"deleted-rose", "deleted-anchor"}
+	play := func() (*client.Client, *client.Matchup) {
+		require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: "deleted-poll"}))
+		poll := tatter.Poll("deleted-poll")
+		for _, name := range names {
+			require.NoError(t, poll.CreateContender(ctx, &contender.Contender{Name: name, SVG: []byte("pretend this is an svg of " + name)}))
+		}
+		m, err := poll.RandomMatchup(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		return poll, m
+	}
+	deletePoll := func(poll *client.Client) {
+		for _, name := range names {
+			require.NoError(t, poll.DeleteContender(ctx, name))
+		}
+		require.NoError(t, tatter.DeletePoll(ctx, "deleted-poll"))
+	}
+
+	poll, m := play()
+	require.NoError(t, poll.Vote(ctx, m, m.Contender1.Name))
+	unused, err := poll.RandomMatchup(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, unused)
+	deletePoll(poll)
+
+	// a new poll with the same ID starts from nothing
+	poll, _ = play()
+	defer deletePoll(poll)
+	stats, err := poll.MatchupStats(ctx, names[0], names[1])
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Contender1Wins+stats.Contender2Wins)
+	assert.Equal(t, http.StatusUnauthorized, client.StatusCode(poll.Vote(ctx, unused, unused.Contender1.Name)))
+}
@@ -0,0 +1,120 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type graphQLResp struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func TestGraphQL(t *testing.T) {
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+	// a poll of two, so the matchup is theirs
+	require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: "gql"}))
+	defer tatter.DeletePoll(ctx, "gql")
+	poll := tatter.Poll("gql")
+	names := []string{"gql-koi", "gql-skull"}
+	for _, name := range names {
+		require.NoError(t, poll.CreateContender(ctx, &contender.Contender{
+			Name:        name,
+			Description: fmt.Sprintf("a %s", name),
+			SVG:         []byte(fmt.Sprintf("pretend this is an svg of %s", name)),
+		}))
+	}
+	doGraphQL := func(t *testing.T, query string) *graphQLResp {
+		return doGraphQLAt(t, baseAddress+"/polls/gql/graphql", query)
+	}
+
+	// get the matchup, for its token
+	m := onlyMatchup(t, poll, names)
+	voteURL, err := url.Parse(m.VoteURL)
+	require.NoError(t, err)
+	token := voteURL.Query().Get("token")
+
+	t.Run("vote with a bad token", func(t *testing.T) {
+		resp := doGraphQL(t, fmt.Sprintf(`mutation { vote(contender1: %q, contender2: %q, token: "bogus", winner: %q) { contender1Wins } }`,
+			names[0], names[1], names[0]))
+		require.Len(t, resp.Errors, 1)
+		assert.Equal(t, service.CodeUnauthorized, resp.Errors[0].Extensions["code"])
+	})
+	t.Run("vote", func(t *testing.T) {
+		resp := doGraphQL(t, fmt.Sprintf(`mutation { vote(contender1: %q, contender2: %q, token: %q, winner: %q) { contender1Wins contender2Wins } }`,
+			names[0], names[1], token, names[1]))
+		require.Empty(t, resp.Errors)
+		vote := resp.Data["vote"].(map[string]interface{})
+		assert.Equal(t, float64(1), vote["contender1Wins"].(float64)+vote["contender2Wins"].(float64))
+	})
+	t.Run("matchup with ranks in one round-trip", func(t *testing.T) {
+		resp := doGraphQL(t, fmt.Sprintf(`{
+			matchup(contender1: %q, contender2: %q) {
+				contender1 { name rank score svgURL }
+				contender2 { name rank score }
+				contender1Wins
+				contender2Wins
+			}
+			leaderboard(limit: 1) { rank contender { name } }
+		}`, names[0], names[1]))
+		require.Empty(t, resp.Errors)
+
+		matchup := resp.Data["matchup"].(map[string]interface{})
+		c1 := matchup["contender1"].(map[string]interface{})
+		c2 := matchup["contender2"].(map[string]interface{})
+		// the matchup is ordered, so the loser, gql-koi, comes first
+		assert.Equal(t, names[0], c1["name"])
+		assert.Equal(t, float64(-1), c1["score"])
+		assert.Equal(t, float64(1), c2["score"])
+		assert.True(t, c1["rank"].(float64) > c2["rank"].(float64))
+		assert.Equal(t, fmt.Sprintf("/v2/polls/gql/contenders/%s/svg", names[0]), c1["svgURL"])
+		assert.Equal(t, float64(1), matchup["contender2Wins"])
+
+		leaderboard := resp.Data["leaderboard"].([]interface{})
+		require.Len(t, leaderboard, 1)
+		assert.Equal(t, float64(1), leaderboard[0].(map[string]interface{})["rank"])
+	})
+	t.Run("unknown contender", func(t *testing.T) {
+		resp := doGraphQL(t, `{ contender(name: "gql-nobody") { name } }`)
+		require.Len(t, resp.Errors, 1)
+		assert.Equal(t, service.CodeNotFound, resp.Errors[0].Extensions["code"])
+		assert.Equal(t, []interface{}{"contender"}, resp.Errors[0].Path)
+	})
+	t.Run("the default poll's is at the root", func(t *testing.T) {
+		resp := doGraphQLAt(t, baseAddress+"/graphql", fmt.Sprintf(`{ contender(name: %q) { name } }`, names[0]))
+		require.Len(t, resp.Errors, 1)
+		assert.Equal(t, service.CodeNotFound, resp.Errors[0].Extensions["code"])
+	})
+}
+
+// doGraphQLAt queries the GraphQL endpoint at url, e.g. that of a poll
+func doGraphQLAt(t *testing.T, url, query string) *graphQLResp {
+	b, err := json.Marshal(&service.GraphQLRequest{Query: query})
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Post(url, "application/json", bytes.NewReader(b))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"))
+
+	ret := &graphQLResp{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(ret))
+	return ret
+}
@@ -4,15 +4,20 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
+	"github.com/graphql-go/graphql"
 	"github.com/pkg/errors"
 	"github.com/sbogacz/wouldyoutatter/contender"
 	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/tracing"
+	"go.opentelemetry.io/otel/trace"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -26,112 +31,407 @@ type Service struct {
 	userMatchupSet   *contender.MatchupSetStore
 	masterMatchupSet *contender.MasterMatchupSetStore
 	tokenStore       *contender.TokenStore
+	pollStore        *contender.PollStore
+
+	graphQLSchema graphql.Schema
+
+	broker Broker
+	// publishers publish the events of each poll's votes
+	publishersLock sync.Mutex
+	publishers     map[string]*pollPublisher
+
+	// tables is what startup found of the tables
+	tables  TableHealth
+	metrics *metrics
+	tracing *tracing.Tracing
+	tracer  trace.Tracer
+	// logger is for what's logged outside of any request
+	logger *log.Entry
+
+	// storers are kept, uncached, for the readiness checks
+	storers   *Storers
+	readiness readinessCache
+	startedAt time.Time
+	// draining is set once Stop is called, and fails readiness
+	draining int32
 
 	router *chi.Mux
+	mount  sync.Once
 	cancel chan struct{}
+	done   chan struct{}
 }
 
 // New tries to cerate a new instance of Service
 func New(c Config) (*Service, error) {
-	// set log level
-	log.SetLevel(c.logLevelToLogrus())
-	log.SetOutput(os.Stdout)
-
 	ret := &Service{
-		config: c,
-		router: chi.NewRouter(),
-		cancel: make(chan struct{}),
+		config:    c,
+		router:    chi.NewRouter(),
+		cancel:    make(chan struct{}),
+		done:      make(chan struct{}),
+		startedAt: time.Now().UTC(),
+		metrics:   newMetrics(),
+	}
+	if err := ret.configureLogging(); err != nil {
+		return nil, errors.Wrap(err, "failed to configure logging")
+	}
+	if err := ret.configureTracing(); err != nil {
+		return nil, errors.Wrap(err, "failed to configure tracing")
 	}
 	if err := ret.configureStores(); err != nil {
 		return nil, errors.Wrap(err, "failed to configure necessary stores")
 	}
+	ret.broker = c.Broker
+	if ret.broker == nil {
+		ret.broker = NewInMemoryBroker()
+	}
+	schema, err := ret.newGraphQLSchema()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build GraphQL schema")
+	}
+	ret.graphQLSchema = schema
+
 	// Set up very permissive CORS headers. Real use would want to
 	// restrict AllowedOrigins for security.
 	corsMiddleware := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", RequestIDHeader},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by browsers
 	})
 	ret.router.Use(corsMiddleware.Handler)
+	ret.router.Use(requestID)
+	ret.router.Use(ret.trace)
+	ret.router.Use(ret.logRequests)
+	ret.router.Use(ret.metrics.instrument)
+	ret.router.Use(compress)
 
 	return ret, nil
 }
 
-// Start starts the server
-func (s *Service) Start() {
+// Handler returns the service's routes, so they can be served by
+// something other than Start, e.g. a Lambda adapter
+func (s *Service) Handler() http.Handler {
+	s.mount.Do(s.mountRoutes)
+	return s.router
+}
+
+// Start starts the server, and returns once it's stopped, or with the
+// error that stopped it from listening
+func (s *Service) Start() error {
+	h := &http.Server{
+		Addr:         fmt.Sprintf(":%d", s.config.Port),
+		ReadTimeout:  s.config.APIReadTimeout,
+		WriteTimeout: s.config.APIWriteTimeout,
+		Handler:      s.Handler(),
+	}
+
+	go func() {
+		defer close(s.done)
+		<-s.cancel
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+		defer cancel()
+		if err := h.Shutdown(ctx); err != nil {
+			s.logger.WithError(err).Error("requests didn't finish before shutting down")
+		}
+	}()
+
+	if err := h.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "failed to serve")
+	}
+	return nil
+}
+
+func (s *Service) shutdownTimeout() time.Duration {
+	if s.config.ShutdownTimeout <= 0 {
+		return DefaultShutdownTimeout
+	}
+	return s.config.ShutdownTimeout
+}
+
+// mountRoutes registers every route on the router
+func (s *Service) mountRoutes() {
+	// the unversioned routes are aliases, and pick their version from
+	// the Accept header
+	s.router.Group(func(r chi.Router) {
+		r.Use(negotiateVersion)
+		s.routes(r)
+	})
+	s.router.Route("/v1", func(r chi.Router) {
+		r.Use(withVersion(V1))
+		s.routes(r)
+	})
+	s.router.Route("/v2", func(r chi.Router) {
+		r.Use(withVersion(V2))
+		s.routes(r)
+	})
+	s.router.Get("/openapi.json", s.getOpenAPI)
+
+	s.router.Get("/healthz", s.healthz)
+	s.router.Get("/readyz", s.readyz)
+	s.router.Method("GET", "/metrics", s.metrics.handler())
+	if s.config.AdminKey != "" {
+		s.router.With(s.checkAdminKey).Get("/debug/info", s.debugInfo)
+	}
+}
+
+// Stop stops the server gracefully. Readiness fails for the drain delay
+// first, so that load balancers stop sending requests, then in-flight
+// requests get up to the shutdown timeout to finish
+func (s *Service) Stop() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.logger.WithField("delay", s.config.DrainDelay).Info("draining")
+	time.Sleep(s.config.DrainDelay)
+	s.cancel <- struct{}{}
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+	if err := s.tracing.Shutdown(ctx); err != nil {
+		s.logger.WithError(err).Error("failed to export the last spans")
+	}
+}
+
+// routes registers the API's routes, which are the same for every version.
+// The game's routes are served for the default poll, and again under
+// /polls/{pollID} for each poll
+func (s *Service) routes(r chi.Router) {
+	s.gameRoutes(r)
+	r.Route("/polls", func(r chi.Router) {
+		r.With(s.deadline).Get("/", s.listPolls)
+		r.With(s.deadline, s.checkMasterKey).Post("/", s.createPoll)
+		r.Route("/{pollID}", func(r chi.Router) {
+			r.Use(s.withPoll)
+			r.With(s.deadline).Get("/", s.getPoll)
+			r.With(s.deadline, s.checkMasterKey).Put("/", s.updatePoll)
+			r.With(s.deadline, s.checkMasterKey).Delete("/", s.deletePoll)
+			s.gameRoutes(r)
+		})
+	})
+}
+
+// gameRoutes registers the routes of a single poll's game. Every route
+// but the streams' has a deadline
+func (s *Service) gameRoutes(r chi.Router) {
+	r.Get("/leaderboard/stream", s.streamLeaderboard)
+	r.Get("/ws", s.streamWebsocket)
+	r.Group(func(r chi.Router) {
+		r.Use(s.deadline)
+		s.apiRoutes(r)
+	})
+}
+
+// apiRoutes registers the API's request/response routes
+func (s *Service) apiRoutes(r chi.Router) {
 	// route the contenders endpoints
-	s.router.Route("/contenders", func(r chi.Router) {
+	r.With(s.checkMasterKey).Post("/contenders:batch", s.batchCreateContenders)
+	r.Route("/contenders", func(r chi.Router) {
+		r.Get("/", s.listContenders)
 		r.With(s.checkMasterKey).Post("/", s.createContender)
 		r.Route("/{contenderID}", func(r chi.Router) {
-			r.Get("/", s.getContender)
+			r.With(cached(CacheControlContender)).Get("/", s.getContender)
+			r.With(s.checkMasterKey).Put("/", s.updateContender)
+			r.With(cached(CacheControlAsset)).Get("/svg", s.getContenderSVG)
 			r.With(s.checkMasterKey).Delete("/", s.deleteContender)
 		})
 	})
 	// route the matchups endpoints
-	s.router.Route("/matchups", func(r chi.Router) {
+	r.Route("/matchups", func(r chi.Router) {
 		r.Get("/random", s.chooseMatchup)
 		r.Route("/{contenderID1}/{contenderID2}", func(r chi.Router) {
-			r.Get("/", s.getMatchupStats)
+			r.With(cached(CacheControlMatchupStats)).Get("/", s.getMatchupStats)
 			r.Post("/vote", s.voteOnMatchup)
 		})
 	})
 
 	// route the leaderboard
-	s.router.Route("/leaderboard", func(r chi.Router) {
-		r.Get("/", s.getLeaderboard)
+	r.Route("/leaderboard", func(r chi.Router) {
+		r.With(cached(CacheControlLeaderboard)).Get("/", s.getLeaderboard)
 	})
-	h := &http.Server{
-		Addr:         fmt.Sprintf(":%d", s.config.Port),
-		ReadTimeout:  s.config.APIReadTimeout,
-		WriteTimeout: s.config.APIWriteTimeout,
-		Handler:      s.router,
+
+	// and the GraphQL endpoint over all of the above
+	r.Route("/graphql", func(r chi.Router) {
+		r.Get("/", s.graphQL)
+		r.Post("/", s.graphQL)
+	})
+}
+
+func (s *Service) configureStores() error {
+	raw, err := NewStorers(s.metrics.withRetryMetrics(s.config))
+	if err != nil {
+		return err
 	}
+	storers := s.metrics.measure(raw, s.config)
 
-	go func() {
-		<-s.cancel
-		_ = h.Shutdown(context.Background())
-	}()
+	contenders, err := withCache(storers.Contenders, s.config, s.metrics)
+	if err != nil {
+		return err
+	}
+
+	// instantiate the respective stoers we need
+	s.contenderStore = contender.NewStore(contenders)
+	s.matchupStore = contender.NewMatchupStore(storers.Matchups)
+	s.userMatchupSet = contender.NewMatchupSetStore(storers.UserMatchups)
+	s.masterMatchupSet = contender.NewMasterMatchupSetStore(storers.MasterMatchups)
+	s.tokenStore = contender.NewTokenStore(storers.Tokens)
+	s.pollStore = contender.NewPollStore(storers.Polls, s.contenderStore, s.matchupStore, s.userMatchupSet, s.masterMatchupSet, s.tokenStore)
+	s.metrics.countContenders(s)
 
-	if err := h.ListenAndServe(); err != nil {
-		if err != http.ErrServerClosed {
-			log.Fatal(err)
+	s.storers = raw
+	s.tables, err = s.ensureTables(raw)
+	return err
+}
+
+// withCache wraps the contenders Storer with the configured cache, if
+// there is one
+func withCache(db dynamostore.Storer, c Config, metrics dynamostore.CacheMetrics) (dynamostore.Storer, error) {
+	var cache dynamostore.Cache
+	switch c.Cache {
+	case "", CacheOff:
+		return db, nil
+	case CacheLRU:
+		cache = dynamostore.NewLRUCache(c.CacheSize)
+	case CacheRedis:
+		if c.RedisAddr == "" {
+			return nil, errors.New("redis-addr is required for the redis cache")
 		}
+		cache = dynamostore.NewRedisCache(dynamostore.RedisConfig{
+			Addr:     c.RedisAddr,
+			Password: c.RedisPassword,
+		})
+	default:
+		return nil, errors.Errorf("unknown cache %q", c.Cache)
 	}
+	prefix := DefaultContenderTableName
+	if c.ContenderTableConfig != nil {
+		prefix = c.ContenderTableConfig.TableName
+	}
+	return dynamostore.WithCache(db, cache, dynamostore.CacheConfig{
+		Prefix:   prefix,
+		TTL:      c.CacheTTL,
+		QueryTTL: c.CacheQueryTTL,
+		Metrics:  metrics,
+	}), nil
 }
 
-// Stop stops the server gracefully
-func (s *Service) Stop() {
-	s.cancel <- struct{}{}
+// Storers are the Storers for each of the service's tables
+type Storers struct {
+	Contenders     dynamostore.Storer
+	Matchups       dynamostore.Storer
+	UserMatchups   dynamostore.Storer
+	MasterMatchups dynamostore.Storer
+	Tokens         dynamostore.Storer
+	Polls          dynamostore.Storer
+	// Migrations records the schema migrations that have been applied
+	Migrations dynamostore.Storer
 }
 
-func (s *Service) configureStores() error {
-	if s.config.AWSRegion == "" {
-		storer := dynamostore.NewInMemoryStore()
-		s.contenderStore = contender.NewStore(storer)
-		s.matchupStore = contender.NewMatchupStore(storer)
-		s.userMatchupSet = contender.NewMatchupSetStore(storer)
-		s.masterMatchupSet = contender.NewMasterMatchupSetStore(storer)
-		s.tokenStore = contender.NewTokenStore(storer)
-	}
-	cfg, err := external.LoadDefaultAWSConfig()
+// NewStorers returns the Storers for the tables in the config, which
+// are in memory if there's no AWS region configured, and share a table
+// with the single table layout
+func NewStorers(c Config) (*Storers, error) {
+	switch c.TableLayout {
+	case "", LayoutMulti, LayoutSingle:
+	default:
+		return nil, errors.Errorf("unknown table layout %q", c.TableLayout)
+	}
+	if c.AWSRegion == "" {
+		if c.TableLayout == LayoutSingle {
+			return singleTableStorers(dynamostore.NewInMemoryStore(), dynamostore.NewInMemoryStore()), nil
+		}
+		// each store gets its own in-memory "table"
+		return &Storers{
+			Contenders:     dynamostore.NewInMemoryStore(),
+			Matchups:       dynamostore.NewInMemoryStore(),
+			UserMatchups:   dynamostore.NewInMemoryStore(),
+			MasterMatchups: dynamostore.NewInMemoryStore(),
+			Tokens:         dynamostore.NewInMemoryStore(),
+			Polls:          dynamostore.NewInMemoryStore(),
+			Migrations:     dynamostore.NewInMemoryStore(),
+		}, nil
+	}
+	// every table shares the one client, and its connections
+	client, err := NewDynamo(c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	if c.TableLayout == LayoutSingle {
+		db := dynamostore.New(client, c.SingleTableConfig)
+		return singleTableStorers(db, dynamostore.New(client, c.MigrationTableConfig)), nil
+	}
 	// instantiate Storers with their respective table configs
-	contenderStorer := dynamostore.New(dynamodb.New(cfg), s.config.ContenderTableConfig)
-	matchupStorer := dynamostore.New(dynamodb.New(cfg), s.config.MatchupTableConfig)
-	userMatchupSetStorer := dynamostore.New(dynamodb.New(cfg), s.config.UserMatchupsTableConfig)
-	masterMatchupSetStorer := dynamostore.New(dynamodb.New(cfg), s.config.MasterMatchupsTableConfig)
-	tokenStorer := dynamostore.New(dynamodb.New(cfg), s.config.TokenTableConfig)
+	return &Storers{
+		Contenders:     dynamostore.New(client, c.ContenderTableConfig),
+		Matchups:       dynamostore.New(client, c.MatchupTableConfig),
+		UserMatchups:   dynamostore.New(client, c.UserMatchupsTableConfig),
+		MasterMatchups: dynamostore.New(client, c.MasterMatchupsTableConfig),
+		Tokens:         dynamostore.New(client, c.TokenTableConfig),
+		Polls:          dynamostore.New(client, c.PollTableConfig),
+		Migrations:     dynamostore.New(client, c.MigrationTableConfig),
+	}, nil
+}
 
-	// instantiate the respective stoers we need
-	s.contenderStore = contender.NewStore(contenderStorer)
-	s.matchupStore = contender.NewMatchupStore(matchupStorer)
-	s.userMatchupSet = contender.NewMatchupSetStore(userMatchupSetStorer)
-	s.masterMatchupSet = contender.NewMasterMatchupSetStore(masterMatchupSetStorer)
-	s.tokenStore = contender.NewTokenStore(tokenStorer)
-	return nil
+// singleTableStorers keeps each kind of item in db, as its entity. The
+// migrations are kept apart, since they're about the tables themselves
+func singleTableStorers(db, migrations dynamostore.Storer) *Storers {
+	return &Storers{
+		Contenders:     dynamostore.WithEntity(db, contender.ContenderEntity),
+		Matchups:       dynamostore.WithEntity(db, contender.MatchupEntity),
+		UserMatchups:   dynamostore.WithEntity(db, contender.UserMatchupsEntity),
+		MasterMatchups: dynamostore.WithEntity(db, contender.MasterMatchupsEntity),
+		Tokens:         dynamostore.WithEntity(db, contender.TokenEntity),
+		Polls:          dynamostore.WithEntity(db, contender.PollEntity),
+		Migrations:     migrations,
+	}
+}
+
+// the Dynamo client is only made the first time it's needed, and then
+// shared, since loading the AWS config is a noticeable part of a cold
+// start
+var (
+	dynamoOnce   sync.Once
+	dynamoClient *dynamodb.DynamoDB
+	dynamoErr    error
+)
+
+// NewDynamo returns a Dynamo client for the config's region, or nil if
+// there's no AWS region configured, and the tables are in memory. Every
+// call shares the same client
+func NewDynamo(c Config) (*dynamodb.DynamoDB, error) {
+	if c.AWSRegion == "" {
+		return nil, nil
+	}
+	dynamoOnce.Do(func() {
+		cfg, err := external.LoadDefaultAWSConfig()
+		if err != nil {
+			dynamoErr = errors.Wrap(err, "failed to load AWS config")
+			return
+		}
+		dynamoClient = dynamodb.New(cfg)
+	})
+	return dynamoClient, dynamoErr
+}
+
+// withTableConfigs returns the config with each of its table configs
+// copied, and changed by f, so the caller's are untouched
+func withTableConfigs(c Config, f func(*dynamostore.TableConfig)) Config {
+	for _, tc := range []**dynamostore.TableConfig{
+		&c.ContenderTableConfig,
+		&c.MatchupTableConfig,
+		&c.UserMatchupsTableConfig,
+		&c.MasterMatchupsTableConfig,
+		&c.TokenTableConfig,
+		&c.PollTableConfig,
+		&c.MigrationTableConfig,
+		&c.SingleTableConfig,
+	} {
+		if *tc == nil {
+			continue
+		}
+		copied := **tc
+		f(&copied)
+		*tc = &copied
+	}
+	return c
 }
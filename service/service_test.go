@@ -3,8 +3,10 @@ package service_test
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
@@ -23,6 +25,9 @@ var (
 	leaderboardAddress    string
 )
 
+// testAdminKey serves /debug/info for the tests
+const testAdminKey = "test-admin-key"
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -40,6 +45,8 @@ func TestMain(m *testing.M) {
 	// override options for the test
 	config.Port = openPort
 	config.LogLevel = "INFO"
+	config.AdminKey = testAdminKey
+	config.DrainDelay = 0
 	if *runAgainstLocalDynamo {
 		config.AWSRegion = "local"
 	}
@@ -54,6 +61,9 @@ func TestMain(m *testing.M) {
 	leaderboardAddress = fmt.Sprintf("%s/leaderboard", baseAddress)
 
 	go s.Start()
+	if err := waitForServer(openPort); err != nil {
+		log.Fatalf("server didn't come up for tests: %v", err)
+	}
 	status := m.Run()
 	s.Stop()
 
@@ -77,6 +87,21 @@ func setupService(config service.Config) error {
 	return nil
 }
 
+// waitForServer blocks until the service accepts connections, so the
+// first test doesn't race Start
+func waitForServer(port int) error {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			return conn.Close()
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return err
+}
+
 func teardownTables(config service.Config) error {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
@@ -90,6 +115,7 @@ func teardownTables(config service.Config) error {
 		service.DefaultUserMatchupsTableName,
 		service.DefaultTokenTableName,
 		service.DefaultMatchupTableName,
+		service.DefaultPollTableName,
 	}
 
 	for _, table := range tables {
@@ -0,0 +1,364 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+const (
+	// streamLeaderboardSize is how much of the top of the leaderboard
+	// we track rank changes for
+	streamLeaderboardSize = 25
+	// streamKeepAlive is how often we write to idle streams, so proxies
+	// don't time them out and we notice clients that have gone away
+	streamKeepAlive = 15 * time.Second
+	// wsWriteWait is how long we allow a websocket write to take
+	wsWriteWait = 10 * time.Second
+	// maxPendingVotes is how many votes a poll can have waiting to be
+	// published before the oldest are dropped
+	maxPendingVotes = 1000
+)
+
+// the CORS config allows any origin, so the websocket does too
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// pollPublisher publishes the events of a poll's votes. Votes are queued,
+// and a single worker publishes them, working out the changes in rank
+// once for all the votes queued while it was busy
+type pollPublisher struct {
+	lock sync.Mutex
+	// votes are waiting to be published
+	votes []*Event
+	// running is set while a worker is publishing the poll's votes
+	running bool
+	// ranks are those last published, or nil until they're seeded by a
+	// subscriber or a vote
+	ranks map[string]int
+}
+
+// publisher returns the publisher of the poll of ctx
+func (s *Service) publisher(ctx context.Context) *pollPublisher {
+	poll := contender.PollFromContext(ctx)
+	s.publishersLock.Lock()
+	defer s.publishersLock.Unlock()
+	if s.publishers == nil {
+		s.publishers = map[string]*pollPublisher{}
+	}
+	p, ok := s.publishers[poll]
+	if !ok {
+		p = &pollPublisher{}
+		s.publishers[poll] = p
+	}
+	return p
+}
+
+// publishVote queues the vote to be published, followed by any changes in
+// rank it caused, unless nobody is subscribed to its poll. It's called once
+// the vote's been recorded, so it doesn't hold up the voter, and failing to
+// publish is only logged
+func (s *Service) publishVote(ctx context.Context, winner, loser string) {
+	poll := contender.PollFromContext(ctx)
+	p := s.publisher(ctx)
+	if !s.broker.Subscribed(ctx, poll) {
+		// nobody will have seen the ranks since, so they're seeded again
+		// for the next subscriber
+		p.lock.Lock()
+		p.ranks = nil
+		p.lock.Unlock()
+		return
+	}
+
+	vote := &Event{
+		Type: EventVote,
+		Poll: poll,
+		Vote: &VoteEvent{Winner: winner, Loser: loser, Time: time.Now().UTC()},
+	}
+	p.lock.Lock()
+	if len(p.votes) >= maxPendingVotes {
+		logging.FromContext(ctx).Warn("dropping vote event, since the poll's publisher isn't keeping up")
+		p.votes = p.votes[1:]
+	}
+	p.votes = append(p.votes, vote)
+	start := !p.running
+	p.running = true
+	p.lock.Unlock()
+
+	if start {
+		// the worker outlives the request, but logs with its logger
+		background := logging.WithLogger(context.Background(), logging.FromContext(ctx))
+		go s.publishVotes(contender.WithPoll(background, poll), p)
+	}
+}
+
+// publishVotes publishes the queued votes until there are none left, and
+// then the changes in rank they caused
+func (s *Service) publishVotes(ctx context.Context, p *pollPublisher) {
+	for {
+		p.lock.Lock()
+		votes := p.votes
+		p.votes = nil
+		if len(votes) == 0 {
+			p.running = false
+			p.lock.Unlock()
+			return
+		}
+		p.lock.Unlock()
+
+		for _, vote := range votes {
+			if err := s.broker.Publish(ctx, vote); err != nil {
+				logging.FromContext(ctx).WithError(err).Error("failed to publish vote")
+			}
+		}
+		s.publishRankChanges(ctx, p)
+	}
+}
+
+// publishRankChanges publishes the contenders at the top of the leaderboard
+// whose rank has changed since the ranks were last published
+func (s *Service) publishRankChanges(ctx context.Context, p *pollPublisher) {
+	standings, err := s.standings(ctx)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Error("failed to retrieve ranks to publish")
+		return
+	}
+	p.lock.Lock()
+	previous := p.ranks
+	p.ranks = ranksOf(standings)
+	p.lock.Unlock()
+	if previous == nil {
+		// without ranks to compare with, we can't tell what changed
+		return
+	}
+
+	changed := []LeaderboardEntry{}
+	for _, entry := range topOf(standings) {
+		if rank := previous[entry.Name]; rank != entry.Rank {
+			entry.PreviousRank = rank
+			changed = append(changed, entry)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if err := s.broker.Publish(ctx, &Event{Type: EventLeaderboard, Poll: contender.PollFromContext(ctx), Leaderboard: changed}); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("failed to publish leaderboard changes")
+	}
+}
+
+// seedRanks records the ranks of the poll of ctx before a vote, if they
+// haven't been already, so the changes it publishes are against the
+// leaderboard as it was, rather than against nothing. Polls nobody is
+// subscribed to are skipped, and failing to seed is only logged
+func (s *Service) seedRanks(ctx context.Context) {
+	if !s.broker.Subscribed(ctx, contender.PollFromContext(ctx)) {
+		return
+	}
+	p := s.publisher(ctx)
+	p.lock.Lock()
+	seeded := p.ranks != nil
+	p.lock.Unlock()
+	if seeded {
+		return
+	}
+	standings, err := s.standings(ctx)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("failed to retrieve ranks to compare the vote's with")
+		return
+	}
+	p.seed(standings)
+}
+
+// seed sets the ranks, unless they've been set since
+func (p *pollPublisher) seed(standings []LeaderboardEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.ranks == nil {
+		p.ranks = ranksOf(standings)
+	}
+}
+
+// standings ranks every contender of the poll of ctx, highest score first,
+// where contenders with the same score share a rank. Only their scores and
+// records are read
+func (s *Service) standings(ctx context.Context) ([]LeaderboardEntry, error) {
+	scores, err := s.contenderStore.GetScores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LeaderboardEntry, 0, len(*scores))
+	for i, c := range *scores {
+		rank := i + 1
+		if i > 0 && c.Score == entries[i-1].Score {
+			rank = entries[i-1].Rank
+		}
+		entries = append(entries, LeaderboardEntry{
+			Rank:   rank,
+			Name:   c.Name,
+			Score:  c.Score,
+			Wins:   c.Wins,
+			Losses: c.Losses,
+		})
+	}
+	return entries, nil
+}
+
+func ranksOf(standings []LeaderboardEntry) map[string]int {
+	ranks := make(map[string]int, len(standings))
+	for _, entry := range standings {
+		ranks[entry.Name] = entry.Rank
+	}
+	return ranks
+}
+
+// topOf is the part of the standings streams track
+func topOf(standings []LeaderboardEntry) []LeaderboardEntry {
+	if len(standings) > streamLeaderboardSize {
+		return standings[:streamLeaderboardSize]
+	}
+	return standings
+}
+
+// subscribe subscribes to the events of the poll of ctx, and returns the
+// snapshot of the leaderboard to send ahead of them. The snapshot seeds the
+// ranks the poll's votes are compared with, if they aren't already
+func (s *Service) subscribe(ctx context.Context) (<-chan *Event, *Event, error) {
+	poll := contender.PollFromContext(ctx)
+	events, err := s.broker.Subscribe(ctx, poll)
+	if err != nil {
+		return nil, nil, err
+	}
+	standings, err := s.standings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.publisher(ctx).seed(standings)
+	return events, &Event{Type: EventLeaderboard, Poll: poll, Leaderboard: topOf(standings)}, nil
+}
+
+// streamLeaderboard streams the leaderboard and votes as Server-Sent
+// Events, starting with a snapshot of the leaderboard
+func (s *Service) streamLeaderboard(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorMsg(w, req, http.StatusInternalServerError, CodeInternal, "streaming isn't supported")
+		return
+	}
+	events, snapshot, err := s.subscribe(req.Context())
+	if err != nil {
+		writeError(w, req, err, "failed to subscribe to the leaderboard")
+		return
+	}
+
+	// the stream is meant to outlive the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logging.FromContext(req.Context()).WithError(err).Warn("couldn't clear the write deadline for the stream, so it will end at the write timeout")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for e := snapshot; ; {
+		if e != nil {
+			if err := writeSSE(w, e); err != nil {
+				logging.FromContext(req.Context()).WithError(err).Debug("failed to write to the stream")
+				return
+			}
+		}
+		flusher.Flush()
+
+		e = nil
+		select {
+		case next, ok := <-events:
+			if !ok {
+				return
+			}
+			e = next
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+	return err
+}
+
+// streamWebsocket streams the same events as streamLeaderboard, as JSON
+// messages over a websocket
+func (s *Service) streamWebsocket(w http.ResponseWriter, req *http.Request) {
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already replied with the error
+		logging.FromContext(req.Context()).WithError(err).Debug("failed to upgrade to a websocket")
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	events, snapshot, err := s.subscribe(ctx)
+	if err != nil {
+		logging.FromContext(req.Context()).WithError(err).Error("failed to subscribe to the leaderboard")
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to subscribe to the leaderboard"),
+			time.Now().Add(wsWriteWait))
+		return
+	}
+
+	// we don't expect anything from clients, but have to read to handle
+	// control messages and notice when they close the connection
+	_ = conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for e := snapshot; ; {
+		if e != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(e); err != nil {
+				logging.FromContext(req.Context()).WithError(err).Debug("failed to write to the websocket")
+				return
+			}
+		}
+
+		e = nil
+		select {
+		case next, ok := <-events:
+			if !ok {
+				return
+			}
+			e = next
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
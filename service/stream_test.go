@@ -0,0 +1,230 @@
+package service_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/phayes/freeport"
+	"github.com/sbogacz/wouldyoutatter/client"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreams(t *testing.T) {
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+	// a poll of two, so the matchup is theirs
+	require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: "streams"}))
+	defer tatter.DeletePoll(ctx, "streams")
+	poll := tatter.Poll("streams")
+	names := []string{"stream-swallow", "stream-dagger"}
+	for _, name := range names {
+		require.NoError(t, poll.CreateContender(ctx, &contender.Contender{
+			Name:        name,
+			Description: fmt.Sprintf("a %s", name),
+			SVG:         []byte(fmt.Sprintf("pretend this is an svg of %s", name)),
+		}))
+	}
+
+	t.Run("server-sent events", func(t *testing.T) {
+		resp, err := http.Get(baseAddress + "/polls/streams/leaderboard/stream")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		events := readSSE(resp)
+
+		snapshot := nextEvent(t, events)
+		assert.Equal(t, service.EventLeaderboard, snapshot.Type)
+		assert.True(t, hasEntry(snapshot.Leaderboard, names[0]))
+
+		require.NoError(t, poll.Vote(ctx, onlyMatchup(t, poll, names), names[0]))
+		vote := nextEvent(t, events)
+		require.Equal(t, service.EventVote, vote.Type)
+		assert.Equal(t, names[0], vote.Vote.Winner)
+		assert.Equal(t, names[1], vote.Vote.Loser)
+
+		changes := nextEvent(t, events)
+		require.Equal(t, service.EventLeaderboard, changes.Type)
+		// the loser always drops below the winner
+		assert.True(t, hasEntry(changes.Leaderboard, names[1]))
+	})
+	t.Run("websocket", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(baseAddress, "http")+"/polls/streams/ws", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		snapshot := &service.Event{}
+		require.NoError(t, conn.ReadJSON(snapshot))
+		assert.Equal(t, service.EventLeaderboard, snapshot.Type)
+
+		require.NoError(t, poll.Vote(ctx, onlyMatchup(t, poll, names), names[1]))
+		vote := &service.Event{}
+		require.NoError(t, conn.ReadJSON(vote))
+		require.Equal(t, service.EventVote, vote.Type)
+		assert.Equal(t, names[1], vote.Vote.Winner)
+	})
+}
+
+// TestStreamOutlivesWriteTimeout streams through every middleware, on a
+// server whose write timeout passes before the vote is streamed
+func TestStreamOutlivesWriteTimeout(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	writeTimeout := 300 * time.Millisecond
+	streaming, err := service.New(service.Config{Port: port, LogLevel: "ERROR", MasterKey: service.DefaultMasterKey, APIWriteTimeout: writeTimeout})
+	require.NoError(t, err)
+	go streaming.Start()
+	defer streaming.Stop()
+	require.NoError(t, waitForServer(port))
+	address := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	tatter := client.New(address, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+	names := []string{"outlasting-heart", "outlasting-ship"}
+	for _, name := range names {
+		require.NoError(t, tatter.CreateContender(ctx, &contender.Contender{Name: name, SVG: []byte("pretend this is an svg")}))
+	}
+
+	// with and without going through the compression
+	streams := map[string]<-chan *service.Event{}
+	for _, encoding := range []string{"identity", "gzip"} {
+		req, err := http.NewRequest("GET", address+"/leaderboard/stream", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		// the stream has to be closed for the server to stop
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		streams[encoding] = readSSE(resp)
+		assert.Equal(t, service.EventLeaderboard, nextEvent(t, streams[encoding]).Type)
+	}
+
+	time.Sleep(2 * writeTimeout)
+	require.NoError(t, tatter.Vote(ctx, onlyMatchup(t, tatter, names), names[0]))
+	for encoding, events := range streams {
+		vote := nextEvent(t, events)
+		require.Equal(t, service.EventVote, vote.Type, encoding)
+		assert.Equal(t, names[0], vote.Vote.Winner, encoding)
+	}
+}
+
+// TestFirstVoteRankChanges checks the first vote of a poll only reports
+// the ranks it changed, rather than every contender as new
+func TestFirstVoteRankChanges(t *testing.T) {
+	tatter := client.New(baseAddress, client.WithMasterKey(service.DefaultMasterKey))
+	ctx := context.Background()
+	require.NoError(t, tatter.CreatePoll(ctx, &contender.Poll{ID: "first-vote"}))
+	poll := tatter.Poll("first-vote")
+	defer tatter.DeletePoll(ctx, "first-vote")
+	names := []string{"first-vote-heart", "first-vote-moth", "first-vote-wave"}
+	create := func(name string) {
+		require.NoError(t, poll.CreateContender(ctx, &contender.Contender{Name: name, SVG: []byte("pretend this is an svg of " + name)}))
+	}
+	// the matchup is chosen while there are only two, and the third is
+	// added after
+	create(names[0])
+	create(names[1])
+	m := onlyMatchup(t, poll, names[:2])
+	create(names[2])
+
+	resp, err := http.Get(baseAddress + "/polls/first-vote/leaderboard/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events := readSSE(resp)
+	require.Equal(t, service.EventLeaderboard, nextEvent(t, events).Type)
+
+	// everyone starts tied first, so the winner stays there, and the
+	// others drop
+	require.NoError(t, poll.Vote(ctx, m, names[0]))
+	require.Equal(t, service.EventVote, nextEvent(t, events).Type)
+	changes := nextEvent(t, events)
+	require.Equal(t, service.EventLeaderboard, changes.Type)
+	assert.False(t, hasEntry(changes.Leaderboard, names[0]), "the winner's rank didn't change")
+	require.Len(t, changes.Leaderboard, 2)
+	for _, entry := range changes.Leaderboard {
+		assert.Equal(t, 1, entry.PreviousRank, entry.Name)
+	}
+}
+
+// onlyMatchup gets the matchup of a poll of just the two given
+// contenders, which is the only one it can choose
+func onlyMatchup(t *testing.T, tatter *client.Client, names []string) *client.Matchup {
+	m, err := tatter.RandomMatchup(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	require.ElementsMatch(t, names, []string{m.Contender1.Name, m.Contender2.Name})
+	return m
+}
+
+func hasEntry(entries []service.LeaderboardEntry, name string) bool {
+	for _, entry := range entries {
+		if entry.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readSSE decodes the data of each event in the stream
+func readSSE(resp *http.Response) <-chan *service.Event {
+	events := make(chan *service.Event)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "data: ") {
+				continue
+			}
+			e := &service.Event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), e); err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan *service.Event) *service.Event {
+	select {
+	case e, ok := <-events:
+		require.True(t, ok, "the stream ended")
+		return e
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for an event")
+	}
+	return nil
+}
+
+func TestInMemoryBrokerPolls(t *testing.T) {
+	broker := service.NewInMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.False(t, broker.Subscribed(ctx, "birds"))
+
+	events, err := broker.Subscribe(ctx, "birds")
+	require.NoError(t, err)
+	assert.True(t, broker.Subscribed(ctx, "birds"))
+	assert.False(t, broker.Subscribed(ctx, "fish"), "nobody's watching the fish")
+
+	require.NoError(t, broker.Publish(ctx, &service.Event{Type: service.EventVote, Poll: "fish"}))
+	require.NoError(t, broker.Publish(ctx, &service.Event{Type: service.EventVote, Poll: "birds"}))
+	e := <-events
+	assert.Equal(t, "birds", e.Poll, "only the poll's events are sent")
+
+	cancel()
+	for range events {
+	}
+	assert.False(t, broker.Subscribed(context.Background(), "birds"))
+}
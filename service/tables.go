@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sbogacz/wouldyoutatter/contender"
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/logging"
+)
+
+// TableHealth is what the service found of its tables at startup
+type TableHealth struct {
+	// Mode is the --ensure-tables mode they were checked with
+	Mode string `json:"mode"`
+	// Ready is false if any table couldn't be verified, or created
+	Ready bool `json:"ready"`
+	// Errors are the failures, by table name
+	Errors    map[string]string `json:"errors,omitempty"`
+	CheckedAt time.Time         `json:"checked_at,omitempty"`
+}
+
+// TableHealth returns what the service found of its tables at startup.
+// With EnsureTablesOff they aren't checked, and are always ready
+func (s *Service) TableHealth() TableHealth {
+	return s.tables
+}
+
+// ensuredTable is a table to check, and the Storer and item to check it
+// with
+type ensuredTable struct {
+	name   string
+	storer dynamostore.Storer
+	item   dynamostore.Item
+}
+
+// ensureTables verifies, or creates, the service's tables, concurrently,
+// according to the config's EnsureTables mode. Failures are recorded in
+// the health, rather than stopping the service, since a table might
+// still be being created by someone else
+func (s *Service) ensureTables(storers *Storers) (TableHealth, error) {
+	mode := s.config.EnsureTables
+	switch mode {
+	case "", EnsureTablesOff:
+		return TableHealth{Mode: EnsureTablesOff, Ready: true}, nil
+	case EnsureTablesVerify, EnsureTablesCreate:
+	default:
+		return TableHealth{}, errors.Errorf("unknown ensure-tables mode %q", mode)
+	}
+
+	tables := s.tablesToEnsure(storers)
+	timeout := s.config.EnsureTablesTimeout
+	if timeout <= 0 {
+		timeout = DefaultEnsureTablesTimeout
+	}
+	ctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), s.logger), timeout)
+	defer cancel()
+
+	var lock sync.Mutex
+	health := TableHealth{Mode: mode, Ready: true, Errors: map[string]string{}}
+	var wg sync.WaitGroup
+	for _, t := range tables {
+		wg.Add(1)
+		go func(t ensuredTable) {
+			defer wg.Done()
+			err := dynamostore.EnsureTable(ctx, t.storer, t.item, mode == EnsureTablesCreate)
+			if err == nil {
+				return
+			}
+			s.logger.WithError(err).WithField("table", t.name).Error("table isn't ready")
+			lock.Lock()
+			defer lock.Unlock()
+			health.Ready = false
+			health.Errors[t.name] = err.Error()
+		}(t)
+	}
+	wg.Wait()
+	health.CheckedAt = time.Now().UTC()
+	if len(health.Errors) == 0 {
+		health.Errors = nil
+	}
+	return health, nil
+}
+
+// tablesToEnsure lists each of the service's tables once, which, with
+// the single table layout, is just the one
+func (s *Service) tablesToEnsure(storers *Storers) []ensuredTable {
+	c := s.config
+	all := []ensuredTable{
+		{tableName(c.ContenderTableConfig, DefaultContenderTableName), storers.Contenders, &contender.Contender{}},
+		{tableName(c.MatchupTableConfig, DefaultMatchupTableName), storers.Matchups, &contender.Matchup{}},
+		{tableName(c.UserMatchupsTableConfig, DefaultUserMatchupsTableName), storers.UserMatchups, &contender.MatchupSet{}},
+		{tableName(c.MasterMatchupsTableConfig, DefaultMasterMatchupsTableName), storers.MasterMatchups, &contender.MatchupSet{}},
+		{tableName(c.TokenTableConfig, DefaultTokenTableName), storers.Tokens, &contender.Token{}},
+		{tableName(c.PollTableConfig, DefaultPollTableName), storers.Polls, &contender.Poll{}},
+	}
+	if c.TableLayout != LayoutSingle {
+		return all
+	}
+	single := all[0]
+	single.name = tableName(c.SingleTableConfig, DefaultSingleTableName)
+	return []ensuredTable{single}
+}
+
+func tableName(c *dynamostore.TableConfig, fallback string) string {
+	if c == nil || c.TableName == "" {
+		return fallback
+	}
+	return c.TableName
+}
@@ -0,0 +1,28 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureTables(t *testing.T) {
+	for _, layout := range []string{service.LayoutMulti, service.LayoutSingle} {
+		for _, mode := range []string{service.EnsureTablesOff, service.EnsureTablesVerify, service.EnsureTablesCreate} {
+			t.Run(layout+" "+mode, func(t *testing.T) {
+				// the in-memory tables always exist
+				s, err := service.New(service.Config{LogLevel: "ERROR", TableLayout: layout, EnsureTables: mode})
+				require.NoError(t, err)
+				health := s.TableHealth()
+				assert.Equal(t, mode, health.Mode)
+				assert.True(t, health.Ready)
+				assert.Empty(t, health.Errors)
+				assert.Equal(t, mode == service.EnsureTablesOff, health.CheckedAt.IsZero())
+			})
+		}
+	}
+	_, err := service.New(service.Config{LogLevel: "ERROR", EnsureTables: "sometimes"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sbogacz/wouldyoutatter/dynamostore"
+	"github.com/sbogacz/wouldyoutatter/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the instrumentation the service's spans come from
+const tracerName = "github.com/sbogacz/wouldyoutatter/service"
+
+// configureTracing sets up the tracer the requests' spans come from, and
+// has the tables trace their Dynamo calls with the same provider
+func (s *Service) configureTracing() error {
+	t, err := tracing.New(context.Background(), s.config.Tracing)
+	if err != nil {
+		return err
+	}
+	if s.config.TracerProvider != nil {
+		t.Provider = s.config.TracerProvider
+	}
+	s.tracing = t
+	s.tracer = t.Provider.Tracer(tracerName)
+	s.config = withTableConfigs(s.config, func(tc *dynamostore.TableConfig) {
+		tc.TracerProvider = t.Provider
+	})
+	return nil
+}
+
+// FlushTraces exports the spans that haven't been yet. Lambda handlers
+// should call it before returning, since the process may be frozen
+// before the spans are exported in the background
+func (s *Service) FlushTraces(ctx context.Context) error {
+	return s.tracing.Flush(ctx)
+}
+
+// trace starts a span for each request, continuing the caller's trace if
+// it sent one, and names it by the route it was routed by
+func (s *Service) trace(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := s.tracing.Propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := s.tracer.Start(ctx, req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("user_agent.original", req.UserAgent()),
+				attribute.String("request_id", requestIDFromContext(req.Context())),
+			),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		req = req.WithContext(ctx)
+		h.ServeHTTP(sw, req)
+
+		route := routePattern(req)
+		span.SetName(req.Method + " " + route)
+		span.SetAttributes(
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", sw.status),
+		)
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
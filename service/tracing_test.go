@@ -0,0 +1,69 @@
+package service_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sbogacz/wouldyoutatter/service"
+	"github.com/sbogacz/wouldyoutatter/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	traced, err := service.New(service.Config{
+		LogLevel:       "ERROR",
+		Tracing:        tracing.Config{Exporter: tracing.ExporterXRay},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		header  string
+		value   string
+		traceID string
+	}{
+		{
+			name:    "w3c",
+			header:  "traceparent",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:    "x-ray",
+			header:  tracing.XRayHeader,
+			value:   "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+			traceID: "5759e988bd862e3fe1be46a994272793",
+		},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v2/contenders/tracing-nobody", nil)
+			req.Header.Set(c.header, c.value)
+			rec := httptest.NewRecorder()
+			traced.Handler().ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+
+			require.Len(t, recorder.Ended(), i+1)
+			span := recorder.Ended()[i]
+			assert.Equal(t, "GET /v2/contenders/{contenderID}/", span.Name())
+			assert.Equal(t, c.traceID, span.SpanContext().TraceID().String(), "the caller's trace is continued")
+			assert.True(t, span.Parent().IsRemote())
+			assert.Contains(t, span.Attributes(), attribute.String("http.route", "/v2/contenders/{contenderID}/"))
+			assert.Contains(t, span.Attributes(), attribute.Int("http.response.status_code", http.StatusNotFound))
+		})
+	}
+	t.Run("new traces", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		traced.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/nowhere", nil))
+		span := recorder.Ended()[len(recorder.Ended())-1]
+		assert.Equal(t, "GET unmatched", span.Name())
+		assert.False(t, span.Parent().IsValid())
+	})
+}
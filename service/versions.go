@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// APIVersion identifies the shape of request and response bodies
+type APIVersion int
+
+const (
+	// V1 is the original API, where contenders embed their SVG
+	V1 APIVersion = 1
+	// V2 links to contender SVGs instead of embedding them
+	V2 APIVersion = 2
+
+	// LatestVersion is the newest version we serve
+	LatestVersion = V2
+
+	versionKey contextKey = "api_version"
+	// mediaTypeFormat is the vendor media type clients can ask for in
+	// their Accept header, e.g. application/vnd.wouldyoutatter.v2+json
+	mediaTypeFormat = "application/vnd.wouldyoutatter.v%d+json"
+)
+
+// MediaType returns the vendor media type of the version
+func (v APIVersion) MediaType() string {
+	return fmt.Sprintf(mediaTypeFormat, v)
+}
+
+// withVersion pins the version for routes mounted under a version prefix
+func withVersion(v APIVersion) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), versionKey, v)
+			h.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// negotiateVersion picks the version for the unprefixed legacy routes from
+// the Accept header. Without one of our media types they default to V1,
+// and keep answering with plain application/json, so existing clients
+// are unaffected
+func negotiateVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		v, ok := versionFromAccept(req.Header.Get("Accept"))
+		if !ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+		ctx := context.WithValue(req.Context(), versionKey, v)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// versionFromAccept returns the first of our vendor media types listed
+// in the Accept header that we support
+func versionFromAccept(accept string) (APIVersion, bool) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var v APIVersion
+		if _, err := fmt.Sscanf(mediaType, mediaTypeFormat, &v); err != nil {
+			continue
+		}
+		if v >= V1 && v <= LatestVersion && v.MediaType() == mediaType {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func versionFromContext(ctx context.Context) APIVersion {
+	if v, ok := ctx.Value(versionKey).(APIVersion); ok {
+		return v
+	}
+	return V1
+}
+
+// versionPrefix is the path prefix that routes of the request's version
+// are served under
+func versionPrefix(ctx context.Context) string {
+	return fmt.Sprintf("/v%d", versionFromContext(ctx))
+}
+
+// writeJSON encodes v as the response body. Responses from a versioned
+// route, or to clients that asked for one of our vendor media types, are
+// labelled with the version's media type
+func writeJSON(w http.ResponseWriter, req *http.Request, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, req, err, "failed to encode response")
+		return
+	}
+	contentType := "application/json"
+	if version, ok := req.Context().Value(versionKey).(APIVersion); ok {
+		contentType = version.MediaType()
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/sbogacz/wouldyoutatter/contender"
+)
+
+// ContenderResp is the V1 representation of a contender, with its SVG
+// embedded as base64
+type ContenderResp struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	SVG         []byte   `json:"svg"`
+	Wins        int      `json:"wins"`
+	Losses      int      `json:"losses"`
+	Score       int      `json:"score"`
+	Tags        []string `json:"tags,omitempty"`
+	Artist      string   `json:"artist,omitempty"`
+}
+
+// ContenderRespV2 is the V2 representation of a contender, which links
+// to its SVG rather than embedding it
+type ContenderRespV2 struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	SVGURL      string   `json:"svg_url"`
+	Wins        int      `json:"wins"`
+	Losses      int      `json:"losses"`
+	Score       int      `json:"score"`
+	Tags        []string `json:"tags,omitempty"`
+	Artist      string   `json:"artist,omitempty"`
+}
+
+// MatchupResp is the response we'll use for our matchups/random endpoint
+type MatchupResp struct {
+	Contender1 ContenderResp `json:"contender_1"`
+	Contender2 ContenderResp `json:"contender_2"`
+	VoteURL    string        `json:"vote_url"` // we don't record this in the DB, but we use it in the API
+}
+
+// MatchupRespV2 is the V2 response for our matchups/random endpoint
+type MatchupRespV2 struct {
+	Contender1 ContenderRespV2 `json:"contender_1"`
+	Contender2 ContenderRespV2 `json:"contender_2"`
+	VoteURL    string          `json:"vote_url"`
+}
+
+// MatchupStatsResp is the V1 head-to-head record of two contenders, which
+// kept the field names of the storage model
+type MatchupStatsResp struct {
+	Contender1     string
+	Contender2     string
+	Contender1Wins int
+	Contender2Wins int
+}
+
+// MatchupStatsRespV2 is the V2 head-to-head record of two contenders
+type MatchupStatsRespV2 struct {
+	Contender1     string `json:"contender_1"`
+	Contender2     string `json:"contender_2"`
+	Contender1Wins int    `json:"contender_1_wins"`
+	Contender2Wins int    `json:"contender_2_wins"`
+}
+
+func contenderView(ctx context.Context, c *contender.Contender) interface{} {
+	if versionFromContext(ctx) >= V2 {
+		return &ContenderRespV2{
+			Name:        c.Name,
+			Description: c.Description,
+			SVGURL:      svgURL(ctx, c.Name),
+			Wins:        c.Wins,
+			Losses:      c.Losses,
+			Score:       c.Score,
+			Tags:        c.Tags,
+			Artist:      c.Artist,
+		}
+	}
+	return &ContenderResp{
+		Name:        c.Name,
+		Description: c.Description,
+		SVG:         c.SVG,
+		Wins:        c.Wins,
+		Losses:      c.Losses,
+		Score:       c.Score,
+		Tags:        c.Tags,
+		Artist:      c.Artist,
+	}
+}
+
+func contendersView(ctx context.Context, cs contender.Contenders) []interface{} {
+	ret := make([]interface{}, 0, len(cs))
+	for i := range cs {
+		ret = append(ret, contenderView(ctx, &cs[i]))
+	}
+	return ret
+}
+
+func matchupView(ctx context.Context, c1, c2 *contender.Contender, voteURL string) interface{} {
+	if versionFromContext(ctx) >= V2 {
+		return &MatchupRespV2{
+			Contender1: *contenderView(ctx, c1).(*ContenderRespV2),
+			Contender2: *contenderView(ctx, c2).(*ContenderRespV2),
+			VoteURL:    voteURL,
+		}
+	}
+	return &MatchupResp{
+		Contender1: *contenderView(ctx, c1).(*ContenderResp),
+		Contender2: *contenderView(ctx, c2).(*ContenderResp),
+		VoteURL:    voteURL,
+	}
+}
+
+func matchupStatsView(ctx context.Context, m *contender.Matchup) interface{} {
+	if versionFromContext(ctx) >= V2 {
+		return &MatchupStatsRespV2{
+			Contender1:     m.Contender1,
+			Contender2:     m.Contender2,
+			Contender1Wins: m.Contender1Wins,
+			Contender2Wins: m.Contender2Wins,
+		}
+	}
+	return &MatchupStatsResp{
+		Contender1:     m.Contender1,
+		Contender2:     m.Contender2,
+		Contender1Wins: m.Contender1Wins,
+		Contender2Wins: m.Contender2Wins,
+	}
+}
+
+func svgURL(ctx context.Context, name string) string {
+	return fmt.Sprintf("%s%s/contenders/%s/svg", versionPrefix(ctx), pollPrefix(ctx), url.PathEscape(name))
+}
@@ -0,0 +1,156 @@
+// Package tracing sets up OpenTelemetry tracing for the service, with
+// spans exported over OTLP, either as they are or in the form AWS X-Ray
+// expects, for an ADOT collector or the X-Ray Lambda extension to send on
+package tracing
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	// ExporterOff doesn't trace
+	ExporterOff = "off"
+	// ExporterOTLP exports spans over OTLP/HTTP, with W3C trace context
+	// propagation
+	ExporterOTLP = "otlp"
+	// ExporterXRay exports spans over OTLP/HTTP too, but with trace IDs
+	// X-Ray accepts, and propagates the X-Amzn-Trace-Id header as well as
+	// W3C trace context
+	ExporterXRay = "xray"
+
+	// DefaultServiceName is the service.name of the spans
+	DefaultServiceName = "wouldyoutatter"
+	// DefaultSampleRatio traces every request that isn't already traced
+	DefaultSampleRatio = 1.0
+)
+
+// Config controls how the service is traced
+type Config struct {
+	// Exporter is ExporterOff, ExporterOTLP or ExporterXRay
+	Exporter string
+	// Endpoint is the host:port of the OTLP/HTTP receiver. If it's empty,
+	// the exporter's own default, and OTEL_EXPORTER_OTLP_* environment
+	// variables, are used
+	Endpoint string
+	// Insecure sends spans over HTTP rather than HTTPS
+	Insecure bool
+	// SampleRatio is the fraction of new traces that are sampled. Traces
+	// that come with a parent follow its sampling decision
+	SampleRatio float64
+	ServiceName string
+}
+
+// Flags returns the tracing configuration options
+func (c *Config) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:        "tracing",
+			EnvVar:      "TRACING",
+			Usage:       "off, otlp to export spans over OTLP/HTTP, or xray to export X-Ray compatible spans over OTLP/HTTP",
+			Destination: &c.Exporter,
+			Value:       ExporterOff,
+		},
+		cli.StringFlag{
+			Name:        "otlp-endpoint",
+			EnvVar:      "OTLP_ENDPOINT",
+			Usage:       "the host:port spans are exported to, which otherwise comes from OTEL_EXPORTER_OTLP_ENDPOINT or is localhost:4318",
+			Destination: &c.Endpoint,
+		},
+		cli.BoolFlag{
+			Name:        "otlp-insecure",
+			EnvVar:      "OTLP_INSECURE",
+			Usage:       "export spans over HTTP rather than HTTPS",
+			Destination: &c.Insecure,
+		},
+		cli.Float64Flag{
+			Name:        "trace-sample-ratio",
+			EnvVar:      "TRACE_SAMPLE_RATIO",
+			Usage:       "the fraction of new traces to sample",
+			Destination: &c.SampleRatio,
+			Value:       DefaultSampleRatio,
+		},
+		cli.StringFlag{
+			Name:        "trace-service-name",
+			EnvVar:      "OTEL_SERVICE_NAME",
+			Usage:       "the service.name of the spans",
+			Destination: &c.ServiceName,
+			Value:       DefaultServiceName,
+		},
+	}
+}
+
+// Tracing is a configured TracerProvider and Propagator
+type Tracing struct {
+	Provider   trace.TracerProvider
+	Propagator propagation.TextMapPropagator
+	// sdk is the provider that exports spans, if there is one
+	sdk *sdktrace.TracerProvider
+}
+
+// New sets up tracing as configured. With ExporterOff, the provider
+// doesn't record spans, but trace context is still propagated
+func New(ctx context.Context, c Config) (*Tracing, error) {
+	w3c := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	switch c.Exporter {
+	case "", ExporterOff:
+		return &Tracing{Provider: noop.NewTracerProvider(), Propagator: w3c}, nil
+	case ExporterOTLP, ExporterXRay:
+	default:
+		return nil, errors.Errorf("unknown tracing exporter %q", c.Exporter)
+	}
+
+	var opts []otlptracehttp.Option
+	if c.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+	}
+	if c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create OTLP exporter")
+	}
+	serviceName := c.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	providerOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	}
+	propagator := w3c
+	if c.Exporter == ExporterXRay {
+		providerOpts = append(providerOpts, sdktrace.WithIDGenerator(NewXRayIDGenerator()))
+		propagator = propagation.NewCompositeTextMapPropagator(w3c, XRayPropagator{})
+	}
+	provider := sdktrace.NewTracerProvider(providerOpts...)
+	return &Tracing{Provider: provider, Propagator: propagator, sdk: provider}, nil
+}
+
+// Flush exports the spans that haven't been yet, e.g. before a Lambda
+// invocation returns, and the process is frozen
+func (t *Tracing) Flush(ctx context.Context) error {
+	if t.sdk == nil {
+		return nil
+	}
+	return t.sdk.ForceFlush(ctx)
+}
+
+// Shutdown exports the spans that haven't been yet, and stops exporting
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.sdk == nil {
+		return nil
+	}
+	return t.sdk.Shutdown(ctx)
+}
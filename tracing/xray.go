@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// XRayHeader carries X-Ray's trace context, e.g.
+// Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1
+const XRayHeader = "X-Amzn-Trace-Id"
+
+// xrayIDGenerator makes trace IDs that start with the time, in seconds,
+// as X-Ray requires
+type xrayIDGenerator struct {
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+// NewXRayIDGenerator returns an IDGenerator whose trace IDs X-Ray accepts
+func NewXRayIDGenerator() sdktrace.IDGenerator {
+	var seed int64
+	_ = binary.Read(crand.Reader, binary.LittleEndian, &seed)
+	return &xrayIDGenerator{random: rand.New(rand.NewSource(seed))}
+}
+
+func (g *xrayIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var traceID trace.TraceID
+	binary.BigEndian.PutUint32(traceID[:4], uint32(time.Now().Unix()))
+	g.random.Read(traceID[4:])
+	return traceID, g.newSpanID()
+}
+
+func (g *xrayIDGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.newSpanID()
+}
+
+func (g *xrayIDGenerator) newSpanID() trace.SpanID {
+	var spanID trace.SpanID
+	for !spanID.IsValid() {
+		g.random.Read(spanID[:])
+	}
+	return spanID
+}
+
+// XRayPropagator propagates trace context in the X-Amzn-Trace-Id header,
+// which is what API Gateway, ALBs and Lambda pass on
+type XRayPropagator struct{}
+
+var _ propagation.TextMapPropagator = XRayPropagator{}
+
+// Inject sets the header from the span context in ctx, if there's one
+func (XRayPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	id := sc.TraceID().String()
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	carrier.Set(XRayHeader, "Root=1-"+id[:8]+"-"+id[8:]+";Parent="+sc.SpanID().String()+";Sampled="+sampled)
+}
+
+// Extract returns ctx with the remote span context from the header, if
+// it's valid. A header without a Parent, as a load balancer sends, only
+// names the trace, so there's no span context to continue
+func (XRayPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	header := carrier.Get(XRayHeader)
+	if header == "" {
+		return ctx
+	}
+	var cfg trace.SpanContextConfig
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			fields := strings.Split(kv[1], "-")
+			if len(fields) != 3 || fields[0] != "1" {
+				return ctx
+			}
+			b, err := hex.DecodeString(fields[1] + fields[2])
+			if err != nil || len(b) != len(cfg.TraceID) {
+				return ctx
+			}
+			copy(cfg.TraceID[:], b)
+		case "Parent":
+			b, err := hex.DecodeString(kv[1])
+			if err != nil || len(b) != len(cfg.SpanID) {
+				return ctx
+			}
+			copy(cfg.SpanID[:], b)
+		case "Sampled":
+			if kv[1] == "1" {
+				cfg.TraceFlags = trace.FlagsSampled
+			}
+		}
+	}
+	cfg.Remote = true
+	sc := trace.NewSpanContext(cfg)
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Fields are the headers the propagator uses
+func (XRayPropagator) Fields() []string {
+	return []string{XRayHeader}
+}
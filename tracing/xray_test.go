@@ -0,0 +1,77 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sbogacz/wouldyoutatter/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestXRayIDGenerator(t *testing.T) {
+	traceID, spanID := tracing.NewXRayIDGenerator().NewIDs(context.Background())
+	assert.True(t, traceID.IsValid())
+	assert.True(t, spanID.IsValid())
+	started := time.Unix(int64(binary.BigEndian.Uint32(traceID[:4])), 0)
+	assert.WithinDuration(t, time.Now(), started, 2*time.Second, "trace IDs start with the time")
+}
+
+func TestXRayPropagator(t *testing.T) {
+	p := tracing.XRayPropagator{}
+	cases := []struct {
+		name    string
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{name: "sampled", header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1", valid: true, sampled: true},
+		{name: "not sampled", header: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0", valid: true},
+		{name: "from a load balancer", header: "Root=1-5759e988-bd862e3fe1be46a994272793"},
+		{name: "garbage", header: "Root=2-nope;Parent=zz"},
+		{name: "missing"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := http.Header{}
+			if c.header != "" {
+				header.Set(tracing.XRayHeader, c.header)
+			}
+			sc := trace.SpanContextFromContext(p.Extract(context.Background(), propagation.HeaderCarrier(header)))
+			require.Equal(t, c.valid, sc.IsValid())
+			if !c.valid {
+				return
+			}
+			assert.True(t, sc.IsRemote())
+			assert.Equal(t, "5759e988bd862e3fe1be46a994272793", sc.TraceID().String())
+			assert.Equal(t, "53995c3f42cd8ad8", sc.SpanID().String())
+			assert.Equal(t, c.sampled, sc.IsSampled())
+
+			// and back again
+			injected := http.Header{}
+			p.Inject(trace.ContextWithSpanContext(context.Background(), sc), propagation.HeaderCarrier(injected))
+			assert.Equal(t, c.header, injected.Get(tracing.XRayHeader))
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	off, err := tracing.New(context.Background(), tracing.Config{})
+	require.NoError(t, err)
+	assert.NoError(t, off.Flush(context.Background()))
+
+	xray, err := tracing.New(context.Background(), tracing.Config{Exporter: tracing.ExporterXRay, Endpoint: "localhost:4318", Insecure: true})
+	require.NoError(t, err)
+	assert.Contains(t, xray.Propagator.Fields(), tracing.XRayHeader)
+	assert.Contains(t, xray.Propagator.Fields(), "traceparent")
+	// nothing was traced, so there's nothing to export
+	assert.NoError(t, xray.Shutdown(context.Background()))
+
+	_, err = tracing.New(context.Background(), tracing.Config{Exporter: "jaeger"})
+	assert.Error(t, err)
+}